@@ -17,13 +17,19 @@ package commonms
 
 import (
 	"collie-api-server/config"
+	"collie-api-server/service/tracing"
+	"collie-api-server/util"
 	"context"
 	"errors"
 	"github.com/sirupsen/logrus"
 	"runtime/debug"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
+	"time"
 )
 
+// tracingShutdownTimeout bounds the export of the spans left on exit
+const tracingShutdownTimeout = 5 * time.Second
+
 func RunApp(fnRun func(config.Config, *logrus.Entry, context.Context, chan error) error) {
 
 	cfg := config.Get()
@@ -34,7 +40,10 @@ func RunApp(fnRun func(config.Config, *logrus.Entry, context.Context, chan error
 
 	logBuildInfo(log)
 
-	log.Printf("%v", cfg)
+	redacted := cfg
+	redacted.EsKey = util.RedactToken(cfg.EsKey)
+	redacted.Notify.SmtpPassword = util.RedactToken(cfg.Notify.SmtpPassword)
+	log.Printf("%v", redacted)
 
 	ctx := signals.SetupSignalHandler()
 	ctx, ctxCancel := context.WithCancel(ctx)
@@ -45,6 +54,19 @@ func RunApp(fnRun func(config.Config, *logrus.Entry, context.Context, chan error
 	closeHealthz := StartHealthz(cfg, log, exitCh)
 	defer closeHealthz()
 
+	shutdownTracing, err := tracing.Start(ctx, cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Error starting tracing: %v", err)
+	}
+	defer func() {
+		// the signal context is done by now, the spans left get a while of their own to be exported
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Warnf("Error flushing traces: %v", err)
+		}
+	}()
+
 	if err := fnRun(cfg, log, ctx, exitCh); err != nil {
 		log.Fatalf("agent failed: %v", err)
 	}
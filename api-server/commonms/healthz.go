@@ -24,6 +24,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 
 	"collie-api-server/config"
+	"collie-api-server/service/metrics"
 )
 
 func newHealthzProvider(cfg config.Config, log logrus.FieldLogger) *HealthzProvider {
@@ -94,10 +95,13 @@ func nowPtr() *time.Time {
 
 func runHealthzEndpoints(cfg config.Config, log *logrus.Entry, controllerCheck healthz.Checker, exitCh chan error) func() {
 	log.Infof("starting healthz on port: %d", cfg.HealthzPort)
-	healthzSrv := &http.Server{Addr: portToServerAddr(cfg.HealthzPort), Handler: &healthz.Handler{Checks: map[string]healthz.Checker{
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/", &healthz.Handler{Checks: map[string]healthz.Checker{
 		"server":     healthz.Ping,
 		"controller": controllerCheck,
-	}}}
+	}})
+	healthzSrv := &http.Server{Addr: portToServerAddr(cfg.HealthzPort), Handler: mux}
 	closeFunc := func() {
 		if err := healthzSrv.Close(); err != nil {
 			log.Errorf("closing healthz server: %v", err)
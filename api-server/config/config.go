@@ -40,6 +40,51 @@ type Config struct {
 	EsURL      string `mapstructure:"es_url"`
 	EsKey      string `mapstructure:"es_key"`
 	GrafanaURL string `mapstructure:"grafana_url"`
+	// CursorSecret signs the pagination cursors, a random key by default, which does not survive a restart
+	CursorSecret string `mapstructure:"cursor_secret"`
+
+	AgentStaleAfter      time.Duration `mapstructure:"agent_stale_after"`
+	WaiverExpiringWithin time.Duration `mapstructure:"waiver_expiring_within"`
+	// ScanRetention is the time scans are kept as evidence of the assessments
+	ScanRetention time.Duration `mapstructure:"scan_retention"`
+	// ReportRetention is the time generated reports are kept for download
+	ReportRetention time.Duration `mapstructure:"report_retention"`
+	// ReportMaxSize is the largest report in bytes that is generated
+	ReportMaxSize int `mapstructure:"report_max_size"`
+
+	Notify  Notify  `mapstructure:"notify"`
+	Tracing Tracing `mapstructure:"tracing"`
+}
+
+// Notify configures the delivery of notifications. Email channels need an SMTP relay.
+type Notify struct {
+	DedupWindow   time.Duration `mapstructure:"dedup_window"`
+	DigestCheck   time.Duration `mapstructure:"digest_check"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+	SmtpHost      string        `mapstructure:"smtp_host"`
+	SmtpPort      int           `mapstructure:"smtp_port"`
+	SmtpFrom      string        `mapstructure:"smtp_from"`
+	SmtpUsername  string        `mapstructure:"smtp_username"`
+	SmtpPassword  string        `mapstructure:"smtp_password"`
+	StaleInterval time.Duration `mapstructure:"stale_interval"`
+	// AllowPrivateUrls lets channels deliver to private addresses, for receivers inside the cluster
+	AllowPrivateUrls bool `mapstructure:"allow_private_urls"`
+}
+
+// Tracing exports OpenTelemetry traces of the requests served. It is off unless an exporter is set.
+type Tracing struct {
+	// Exporter is otlp, to send the traces to a collector over OTLP/HTTP, or file
+	Exporter string `mapstructure:"exporter"`
+	// Endpoint is the host:port of the collector, such as otel-collector:4318. The OTEL_EXPORTER_OTLP_ENDPOINT
+	// variable applies when it is empty.
+	Endpoint string `mapstructure:"endpoint"`
+	// Insecure sends the traces over plain HTTP
+	Insecure bool `mapstructure:"insecure"`
+	// File is the path of the file the traces are appended to as JSON, "-" for stdout
+	File string `mapstructure:"file"`
+	// SampleRatio is the ratio of the traces kept, from 0 to 1. Requests of a traced agent cycle are
+	// kept when the agent kept the cycle.
+	SampleRatio float64 `mapstructure:"sample_ratio"`
 }
 
 type Log struct {
@@ -76,6 +121,20 @@ func Get() Config {
 	viper.SetDefault("controller.initialization_timeout_extension", 5*time.Minute)
 
 	viper.SetDefault("healthz_port", 9876)
+	viper.SetDefault("agent_stale_after", 25*time.Hour)
+	viper.SetDefault("waiver_expiring_within", 14*24*time.Hour)
+	viper.SetDefault("scan_retention", 400*24*time.Hour)
+	viper.SetDefault("report_retention", 90*24*time.Hour)
+	viper.SetDefault("report_max_size", 20<<20)
+	viper.SetDefault("notify.dedup_window", 24*time.Hour)
+	viper.SetDefault("notify.digest_check", time.Minute)
+	viper.SetDefault("notify.timeout", 10*time.Second)
+	viper.SetDefault("notify.smtp_port", 25)
+	viper.SetDefault("notify.smtp_from", "collie@localhost")
+	viper.SetDefault("notify.stale_interval", time.Minute)
+	viper.SetDefault("notify.allow_private_urls", false)
+	viper.SetDefault("tracing.file", "-")
+	viper.SetDefault("tracing.sample_ratio", 1.0)
 
 	default_config := "config/app-default.yaml"
 	viper.SetConfigFile(default_config)
@@ -124,6 +183,18 @@ func Get() Config {
 	required(cfg.AgentImage, "AGENT_IMAGE")
 	required(cfg.GrafanaURL, "GRAFANA_URL")
 	required_secret(cfg.EsKey, "ES_KEY")
+	if cfg.ScanRetention <= 0 {
+		panic(fmt.Errorf("env variable SCAN_RETENTION must be positive"))
+	}
+	if cfg.ReportRetention <= 0 {
+		panic(fmt.Errorf("env variable REPORT_RETENTION must be positive"))
+	}
+	if cfg.ReportMaxSize <= 0 {
+		panic(fmt.Errorf("env variable REPORT_MAX_SIZE must be positive"))
+	}
+	if cfg.Tracing.Exporter != "" && cfg.Tracing.Exporter != "otlp" && cfg.Tracing.Exporter != "file" {
+		panic(fmt.Errorf("env variable TRACING_EXPORTER must be otlp or file: %s", cfg.Tracing.Exporter))
+	}
 
 	return *cfg
 }
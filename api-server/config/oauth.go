@@ -73,8 +73,23 @@ func getOAuthConfig() map[string]string {
 // 	return d
 // }
 
+// sensitive tells whether a variable holds a credential, whose value is not logged.
+func sensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"secret", "password", "token", "key"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
 func dumpEnv() {
 	for _, e := range os.Environ() {
+		if k, v, ok := strings.Cut(e, "="); ok && sensitive(k) {
+			log.Printf("ENV %s=<masked> %d", k, len(v))
+			continue
+		}
 		log.Println("ENV", e)
 	}
 }
@@ -146,7 +161,7 @@ func loadOAuthConfig() map[string]string {
 	//cfg.Gitlab.validate("gitlab")
 
 	for k, v := range cfg {
-		if strings.Contains(k, "secret") {
+		if sensitive(k) {
 			log.Printf("%s=<masked> %d", k, len(v))
 			continue
 		}
@@ -0,0 +1,108 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/agentconfig"
+)
+
+// GetAgentConfig godoc
+//
+//	@Summary		Get the configuration of the agent
+//	@Description	Polled by the agent. Returns the settings of the org with its enabled rule packs and custom rules.
+//	@Description	The ETag is the version of the configuration, and 304 is returned when it matches If-None-Match.
+//	@Tags			agent
+//	@Produce		json
+//	@Param			If-None-Match	header		string	false	"ETag of the configuration the agent runs"
+//	@Success		200				{object}	agentconfig.AgentConfig
+//	@Success		304
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/agent/config [get]
+func (c *Controller) GetAgentConfig(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	cfg, err := agentconfig.Get(authInfo.OrgId())
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	etag := `"` + cfg.Version + `"`
+	ctx.Header("ETag", etag)
+	if ctx.GetHeader("If-None-Match") == etag {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+	ctx.JSON(http.StatusOK, cfg)
+}
+
+// GetAgentSettings godoc
+//
+//	@Summary		Get the agent settings
+//	@Description	Get the settings of the agents of the current org, with the version of the configuration delivered to them
+//	@Tags			agents
+//	@Produce		json
+//	@Success		200	{object}	agentconfig.OrgSettings
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/agent-config [get]
+func (c *Controller) GetAgentSettings(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	s, err := agentconfig.GetSettings(authInfo.OrgId())
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, s)
+}
+
+// UpdateAgentSettings godoc
+//
+//	@Summary		Update the agent settings
+//	@Description	Replace the scan interval, enabled scanners, namespace filter, redaction policy and log level of the agents
+//	@Description	of the current org. The agents apply them without restart, on their next configuration poll.
+//	@Tags			agents
+//	@Accept			json
+//	@Produce		json
+//	@Param			settings	body		agentconfig.Settings	true	"Agent settings"
+//	@Success		200			{object}	agentconfig.OrgSettings
+//	@Failure		400			{object}	httputil.HTTPError
+//	@Failure		401			{object}	httputil.HTTPError
+//	@Failure		500			{object}	httputil.HTTPError
+//	@Router			/agent-config [put]
+func (c *Controller) UpdateAgentSettings(ctx *gin.Context) {
+	var s agentconfig.Settings
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	ret, err := agentconfig.UpdateSettings(authInfo.OrgId(), authInfo.Username(), &s)
+	if errors.Is(err, agentconfig.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, ret)
+}
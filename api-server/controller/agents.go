@@ -0,0 +1,130 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/agent"
+	"collie-api-server/service/metrics"
+)
+
+// AgentHeartbeat godoc
+//
+//	@Summary		Register an agent or refresh its heartbeat
+//	@Description	Called by the agent on start-up and after each cycle. The agent is registered on first contact.
+//	@Tags			agent
+//	@Accept			json
+//	@Produce		json
+//	@Param			heartbeat	body		agent.Heartbeat	true	"Agent details"
+//	@Success		200			{object}	agent.AgentInfo
+//	@Failure		400			{object}	httputil.HTTPError
+//	@Failure		401			{object}	httputil.HTTPError
+//	@Failure		500			{object}	httputil.HTTPError
+//	@Router			/agent/heartbeat [post]
+func (c *Controller) AgentHeartbeat(ctx *gin.Context) {
+	var hb agent.Heartbeat
+	if err := ctx.ShouldBindJSON(&hb); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	info, err := agent.RecordHeartbeat(authInfo.OrgId(), hb)
+	if errors.Is(err, agent.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	if info.RegisteredAt.Equal(info.LastHeartbeat) {
+		metrics.Onboarding("agent-registered")
+	}
+	if len(hb.PreviousClusterIds) > 0 {
+		mergePreviousIds(authInfo.OrgId(), info, hb.PreviousClusterIds)
+	}
+	ctx.JSON(http.StatusOK, info)
+}
+
+// ListAgents godoc
+//
+//	@Summary		List agents
+//	@Description	List the registered agents of the current org, with their derived status
+//	@Tags			agents
+//	@Produce		json
+//	@Success		200	{array}		agent.AgentInfo
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/agents [get]
+func (c *Controller) ListAgents(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	agents, err := agent.List(authInfo.OrgId())
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, agents)
+}
+
+// GetAgent godoc
+//
+//	@Summary		Get an agent
+//	@Description	Get a registered agent of the current org
+//	@Tags			agents
+//	@Produce		json
+//	@Param			id	path		string	true	"Agent id"
+//	@Success		200	{object}	agent.AgentInfo
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/agents/{id} [get]
+func (c *Controller) GetAgent(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	info, err := agent.Get(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, info)
+}
+
+// DeleteAgent godoc
+//
+//	@Summary		Delete an agent
+//	@Description	Remove an agent from the registry. Data already reported by the agent is kept.
+//	@Tags			agents
+//	@Param			id	path	string	true	"Agent id"
+//	@Success		204
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/agents/{id} [delete]
+func (c *Controller) DeleteAgent(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := agent.Get(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	if err := agent.Delete(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
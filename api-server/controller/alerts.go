@@ -0,0 +1,200 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/alert"
+)
+
+// CreateAlertRule godoc
+//
+//	@Summary		Create an alert rule
+//	@Description	Create a rule evaluated on each cluster after each completed scan. The condition is checked against the findings
+//	@Description	matching the query: count fires on more matches than the threshold, new on more newly failing matches than the threshold,
+//	@Description	score_delta on a score drop of more points than the threshold. Fired alerts are recorded and sent to the channels of the rule.
+//	@Tags			alerts
+//	@Accept			json
+//	@Produce		json
+//	@Param			rule	body		alert.RuleRequest	true	"Rule"
+//	@Success		201		{object}	alert.Rule
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/alerts/rules [post]
+func (c *Controller) CreateAlertRule(ctx *gin.Context) {
+	var req alert.RuleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	r, err := alert.CreateRule(authInfo.OrgId(), authInfo.Username(), &req)
+	if errors.Is(err, alert.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, r)
+}
+
+// ListAlertRules godoc
+//
+//	@Summary		List alert rules
+//	@Tags			alerts
+//	@Produce		json
+//	@Success		200	{array}		alert.Rule
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/alerts/rules [get]
+func (c *Controller) ListAlertRules(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	rules, err := alert.ListRules(authInfo.OrgId())
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, rules)
+}
+
+// GetAlertRule godoc
+//
+//	@Summary		Get an alert rule
+//	@Tags			alerts
+//	@Produce		json
+//	@Param			id	path		string	true	"Rule id"
+//	@Success		200	{object}	alert.Rule
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/alerts/rules/{id} [get]
+func (c *Controller) GetAlertRule(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	r, err := alert.GetRule(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, r)
+}
+
+// UpdateAlertRule godoc
+//
+//	@Summary		Update an alert rule
+//	@Tags			alerts
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string				true	"Rule id"
+//	@Param			rule	body		alert.RuleRequest	true	"Rule"
+//	@Success		200		{object}	alert.Rule
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		404		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/alerts/rules/{id} [put]
+func (c *Controller) UpdateAlertRule(ctx *gin.Context) {
+	var req alert.RuleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := alert.GetRule(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	r, err := alert.UpdateRule(authInfo.OrgId(), ctx.Param("id"), &req)
+	if errors.Is(err, alert.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, r)
+}
+
+// DeleteAlertRule godoc
+//
+//	@Summary		Delete an alert rule
+//	@Description	Delete an alert rule. The alerts it fired stay in the history.
+//	@Tags			alerts
+//	@Param			id	path	string	true	"Rule id"
+//	@Success		204
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/alerts/rules/{id} [delete]
+func (c *Controller) DeleteAlertRule(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := alert.GetRule(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	if err := alert.DeleteRule(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// ListAlerts godoc
+//
+//	@Summary		List fired alerts
+//	@Description	List the alerts fired in the current org, most recent first, with the findings which triggered them
+//	@Tags			alerts
+//	@Produce		json
+//	@Param			rule	query		string	false	"Only the alerts of this rule"
+//	@Success		200		{array}		alert.Alert
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/alerts [get]
+func (c *Controller) ListAlerts(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	alerts, err := alert.History(authInfo.OrgId(), ctx.Query("rule"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, alerts)
+}
+
+// GetAlert godoc
+//
+//	@Summary		Get a fired alert
+//	@Tags			alerts
+//	@Produce		json
+//	@Param			id	path		string	true	"Alert id"
+//	@Success		200	{object}	alert.Alert
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/alerts/{id} [get]
+func (c *Controller) GetAlert(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	a, err := alert.GetAlert(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, a)
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/agent"
+	"collie-api-server/service/cluster"
+	"collie-api-server/service/es"
+)
+
+// GetSnapshots godoc
+//
+//	@Summary		List the snapshots of a cluster
+//	@Description	Get the current snapshot of a cluster and the snapshots retained for diffing, newest first
+//	@Tags			clusters
+//	@Produce		json
+//	@Param			id	path		string	true	"Cluster id"
+//	@Success		200	{object}	es.SnapshotPointer
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/clusters/{id}/snapshots [get]
+func (c *Controller) GetSnapshots(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	clusterId := clusterParam(ctx)
+	pointer, err := es.GetSnapshotPointer(authInfo.OrgId(), clusterId)
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	if pointer == nil {
+		httputil.Abort(ctx, http.StatusNotFound, errors.New("No completed snapshot for cluster: "+clusterId))
+		return
+	}
+	ctx.JSON(http.StatusOK, pointer)
+}
+
+// GetDiff godoc
+//
+//	@Summary		Cluster drift between two snapshots
+//	@Description	List the resources added, removed or modified, with field level changes, and the findings newly failing or newly fixed between two retained snapshots.
+//	@Description	Snapshots are given by id, or by RFC3339 time for the latest snapshot completed at or before that time.
+//	@Tags			clusters
+//	@Produce		json
+//	@Param			id		path		string	true	"Cluster id"
+//	@Param			from	query		string	false	"Earlier snapshot, the one preceding the current snapshot by default"
+//	@Param			to		query		string	false	"Later snapshot, the current snapshot by default"
+//	@Success		200		{object}	es.Diff
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		404		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/clusters/{id}/diff [get]
+func (c *Controller) GetDiff(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	clusterId := clusterParam(ctx)
+	pointer, err := es.GetSnapshotPointer(authInfo.OrgId(), clusterId)
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	if pointer == nil || len(pointer.Snapshots) == 0 {
+		httputil.Abort(ctx, http.StatusNotFound, errors.New("No completed snapshot for cluster: "+clusterId))
+		return
+	}
+
+	to := &pointer.Snapshots[0]
+	if ref := ctx.Query("to"); ref != "" {
+		if to, err = pointer.ResolveSnapshot(ref); err != nil {
+			httputil.Abort(ctx, http.StatusBadRequest, err)
+			return
+		}
+	}
+	var from *es.SnapshotRef
+	if ref := ctx.Query("from"); ref != "" {
+		if from, err = pointer.ResolveSnapshot(ref); err != nil {
+			httputil.Abort(ctx, http.StatusBadRequest, err)
+			return
+		}
+	} else if len(pointer.Snapshots) > 1 {
+		from = &pointer.Snapshots[1]
+	} else {
+		httputil.Abort(ctx, http.StatusBadRequest, errors.New("Only one snapshot is retained, nothing to compare with"))
+		return
+	}
+
+	diff, err := es.DiffSnapshots(authInfo.OrgId(), clusterId, from, to)
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, diff)
+}
+
+// ListClusterAliases godoc
+//
+//	@Summary		List the aliases of a cluster
+//	@Description	List the ids a cluster was known by before, whose history is merged into the cluster
+//	@Tags			clusters
+//	@Produce		json
+//	@Param			id	path		string	true	"Cluster id"
+//	@Success		200	{array}		cluster.Alias
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/clusters/{id}/aliases [get]
+func (c *Controller) ListClusterAliases(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	aliases, err := cluster.Aliases(authInfo.OrgId(), clusterParam(ctx))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, aliases)
+}
+
+// AddClusterAlias godoc
+//
+//	@Summary		Merge an old id into a cluster
+//	@Description	Record an id the cluster was known by before as its alias, and merge the findings, resources, snapshots, postures, scans and waivers of the old id into the cluster.
+//	@Description	Agents report the ids of their cluster which changed, this is for the ids they could not know of.
+//	@Tags			clusters
+//	@Produce		json
+//	@Param			id		path		string	true	"Cluster id"
+//	@Param			alias	path		string	true	"Old cluster id"
+//	@Success		200		{object}	cluster.Alias
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		409		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/clusters/{id}/aliases/{alias} [put]
+func (c *Controller) AddClusterAlias(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	if _, _, err := cluster.Add(authInfo.OrgId(), ctx.Param("alias"), ctx.Param("id")); errors.Is(err, cluster.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	alias, err := cluster.Merge(authInfo.OrgId(), ctx.Param("alias"))
+	if errors.Is(err, cluster.ErrMerging) {
+		httputil.Abort(ctx, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, alias)
+}
+
+// DeleteClusterAlias godoc
+//
+//	@Summary		Forget an alias of a cluster
+//	@Description	The history already merged stays with the cluster
+//	@Tags			clusters
+//	@Param			id		path	string	true	"Cluster id"
+//	@Param			alias	path	string	true	"Old cluster id"
+//	@Success		204
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/clusters/{id}/aliases/{alias} [delete]
+func (c *Controller) DeleteClusterAlias(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	if cluster.Canonical(authInfo.OrgId(), ctx.Param("alias")) != clusterParam(ctx) {
+		httputil.Abort(ctx, http.StatusNotFound, errors.New("No such alias of cluster: "+ctx.Param("alias")))
+		return
+	}
+	if err := cluster.Remove(authInfo.OrgId(), ctx.Param("alias")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// mergePreviousIds records the previous ids an agent reports for its cluster as aliases, and merges
+// their history in the background. Only the ids the agent reported before are merged, so that an
+// agent cannot take over the history of another cluster. A merge which failed is tried again on a
+// later heartbeat, once its backoff is over.
+func mergePreviousIds(orgId string, info *agent.AgentInfo, previous []string) {
+	clusterId := info.ClusterId
+	for _, id := range previous {
+		if id == "" || id == clusterId {
+			continue
+		}
+		if !info.Reported(id) {
+			log.Printf("Refusing to alias cluster: alias=%s, cluster=%s, agent %s never reported it", id, clusterId, info.AgentId)
+			continue
+		}
+		alias, _, err := cluster.Add(orgId, id, clusterId)
+		if err != nil {
+			log.Printf("Error aliasing cluster: alias=%s, cluster=%s, %s", id, clusterId, err)
+			continue
+		}
+		if cluster.Pending(alias, time.Now()) {
+			go func(id string) {
+				_, _ = cluster.Merge(orgId, id)
+			}(id)
+		}
+	}
+}
+
+// clusterParam returns the cluster of the path, resolving an old id to the id the cluster is known by now.
+func clusterParam(ctx *gin.Context) string {
+	return cluster.Canonical(middleware.GetAuth(ctx).OrgId(), ctx.Param("id"))
+}
+
+// clusterQuery returns the cluster of the query, resolving an old id as clusterParam does.
+func clusterQuery(ctx *gin.Context) string {
+	if id := ctx.Query("cluster"); id != "" {
+		return cluster.Canonical(middleware.GetAuth(ctx).OrgId(), id)
+	}
+	return ""
+}
+
+// clusterList returns the clusters of the query, resolving old ids as clusterParam does.
+func clusterList(ctx *gin.Context) []string {
+	orgId := middleware.GetAuth(ctx).OrgId()
+	ret := queryList(ctx, "cluster")
+	for i, id := range ret {
+		ret[i] = cluster.Canonical(orgId, id)
+	}
+	return ret
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/catalog"
+	"collie-api-server/service/es"
+)
+
+// GetControlCatalog godoc
+//
+//	@Summary		Get the control catalog
+//	@Description	Get the frameworks, their controls, and the mappings of the plugin rules to the controls
+//	@Tags			controls
+//	@Produce		json
+//	@Success		200	{object}	catalog.Catalog
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Router			/controls [get]
+func (c *Controller) GetControlCatalog(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, catalog.Get())
+}
+
+// GetFramework godoc
+//
+//	@Summary		Get a framework
+//	@Description	Get a framework of the control catalog with its controls
+//	@Tags			controls
+//	@Produce		json
+//	@Param			framework	path		string	true	"Framework id"	example(nist-800-53)
+//	@Success		200			{object}	catalog.Framework
+//	@Failure		401			{object}	httputil.HTTPError
+//	@Failure		404			{object}	httputil.HTTPError
+//	@Router			/controls/{framework} [get]
+func (c *Controller) GetFramework(ctx *gin.Context) {
+	f, err := catalog.GetFramework(ctx.Param("framework"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, f)
+}
+
+// GetControlPosture godoc
+//
+//	@Summary		Get the posture of a control
+//	@Description	Get the posture of the rules mapping to a control, over the current snapshots of the clusters of the org
+//	@Tags			controls
+//	@Produce		json
+//	@Param			framework	path		string		true	"Framework id"	example(nist-800-53)
+//	@Param			control		path		string		true	"Control id"	example(AC-6)
+//	@Param			cluster		query		[]string	false	"Cluster ids, all clusters by default"	collectionFormat(csv)
+//	@Success		200			{object}	es.ControlPosture
+//	@Failure		401			{object}	httputil.HTTPError
+//	@Failure		404			{object}	httputil.HTTPError
+//	@Failure		500			{object}	httputil.HTTPError
+//	@Router			/controls/{framework}/{control}/posture [get]
+func (c *Controller) GetControlPosture(ctx *gin.Context) {
+	framework, control := ctx.Param("framework"), ctx.Param("control")
+	if _, _, _, err := catalog.Resolve(framework, control); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	posture, err := es.GetControlPosture(authInfo.OrgId(), framework, control, clusterList(ctx))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, posture)
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/celrule"
+)
+
+// CreateCustomRule godoc
+//
+//	@Summary		Create a custom rule
+//	@Description	Add a one-line CEL check evaluated by the agents of the org on the resources of the given kinds, such as
+//	@Description	object.spec.template.spec.containers.all(c, has(c.resources.limits)). Resources for which it is false fail the rule.
+//	@Tags			custom-rules
+//	@Accept			json
+//	@Produce		json
+//	@Param			rule	body		celrule.Request	true	"Rule id, kinds and CEL expression"
+//	@Success		201		{object}	celrule.Rule
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/custom-rules [post]
+func (c *Controller) CreateCustomRule(ctx *gin.Context) {
+	var req celrule.Request
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	rule, err := celrule.Create(authInfo.OrgId(), authInfo.Username(), &req)
+	if errors.Is(err, celrule.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, rule)
+}
+
+// ListCustomRules godoc
+//
+//	@Summary		List custom rules
+//	@Description	List the custom rules of the current org, by rule id
+//	@Tags			custom-rules
+//	@Produce		json
+//	@Success		200	{array}		celrule.Rule
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/custom-rules [get]
+func (c *Controller) ListCustomRules(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	rules, err := celrule.List(authInfo.OrgId())
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, rules)
+}
+
+// GetCustomRule godoc
+//
+//	@Summary		Get a custom rule
+//	@Tags			custom-rules
+//	@Produce		json
+//	@Param			id	path		string	true	"Rule id"
+//	@Success		200	{object}	celrule.Rule
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/custom-rules/{id} [get]
+func (c *Controller) GetCustomRule(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	rule, err := celrule.Get(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, rule)
+}
+
+// UpdateCustomRule godoc
+//
+//	@Summary		Update a custom rule
+//	@Description	Replace a custom rule. The agents pick it up with their configuration.
+//	@Tags			custom-rules
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string			true	"Rule id"
+//	@Param			rule	body		celrule.Request	true	"Rule id, kinds and CEL expression"
+//	@Success		200		{object}	celrule.Rule
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		404		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/custom-rules/{id} [put]
+func (c *Controller) UpdateCustomRule(ctx *gin.Context) {
+	var req celrule.Request
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := celrule.Get(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	rule, err := celrule.Update(authInfo.OrgId(), ctx.Param("id"), &req)
+	if errors.Is(err, celrule.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, rule)
+}
+
+// DeleteCustomRule godoc
+//
+//	@Summary		Delete a custom rule
+//	@Tags			custom-rules
+//	@Param			id	path	string	true	"Rule id"
+//	@Success		204
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/custom-rules/{id} [delete]
+func (c *Controller) DeleteCustomRule(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := celrule.Get(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	if err := celrule.Delete(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
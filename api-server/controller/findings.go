@@ -0,0 +1,151 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/catalog"
+	"collie-api-server/service/es"
+)
+
+const maxPageSize = 500
+
+// ListFindings godoc
+//
+//	@Summary		Query compliance findings
+//	@Description	Query the compliance findings of the current org. List filters accept comma separated or repeated values.
+//	@Description	Pages are chained with the returned nextCursor, which is only valid for a few minutes.
+//	@Tags			findings
+//	@Produce		json
+//	@Param			cluster		query		[]string	false	"Cluster ids"	collectionFormat(csv)
+//	@Param			namespace	query		[]string	false	"Namespaces"	collectionFormat(csv)
+//	@Param			plugin		query		[]string	false	"Plugins"		collectionFormat(csv)
+//	@Param			rule		query		[]string	false	"Rule ids"		collectionFormat(csv)
+//	@Param			severity	query		[]string	false	"Severities"	collectionFormat(csv)
+//	@Param			status		query		[]string	false	"Statuses, WAIVED for the failures covered by a waiver"	collectionFormat(csv)
+//	@Param			framework	query		string		false	"Framework of the control catalog, with control"	example(nist-800-53)
+//	@Param			control		query		string		false	"Control of the framework, restricts to the rules mapping to it"	example(AC-6)
+//	@Param			from		query		string		false	"Start of time range (RFC3339, inclusive)"
+//	@Param			to			query		string		false	"End of time range (RFC3339, exclusive)"
+//	@Param			sort		query		string		false	"Sort key"	Enums(timestamp, cluster, plugin, rule, status, severity, namespace)	default(timestamp)
+//	@Param			order		query		string		false	"Sort order"	Enums(asc, desc)	default(desc)
+//	@Param			size		query		int			false	"Page size"	default(50)
+//	@Param			cursor		query		string		false	"Cursor of the next page"
+//	@Success		200			{object}	es.FindingPage
+//	@Failure		400			{object}	httputil.HTTPError
+//	@Failure		401			{object}	httputil.HTTPError
+//	@Failure		500			{object}	httputil.HTTPError
+//	@Router			/findings [get]
+func (c *Controller) ListFindings(ctx *gin.Context) {
+	q, err := parseFindingQuery(ctx)
+	if err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	page, err := es.SearchFindings(authInfo.OrgId(), q)
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, page)
+}
+
+func parseFindingQuery(ctx *gin.Context) (*es.FindingQuery, error) {
+	q := &es.FindingQuery{
+		ClusterIds: clusterList(ctx),
+		Namespaces: queryList(ctx, "namespace"),
+		Plugins:    queryList(ctx, "plugin"),
+		RuleIds:    queryList(ctx, "rule"),
+		Severities: queryList(ctx, "severity"),
+		Statuses:   queryList(ctx, "status"),
+		Sort:       ctx.DefaultQuery("sort", "timestamp"),
+		Cursor:     ctx.Query("cursor"),
+	}
+
+	var err error
+	if q.RuleSelectors, err = controlSelectors(ctx); err != nil {
+		return nil, err
+	}
+	if q.From, err = queryTime(ctx, "from"); err != nil {
+		return nil, err
+	}
+	if q.To, err = queryTime(ctx, "to"); err != nil {
+		return nil, err
+	}
+
+	switch order := ctx.DefaultQuery("order", "desc"); order {
+	case "asc":
+		q.Desc = false
+	case "desc":
+		q.Desc = true
+	default:
+		return nil, fmt.Errorf("Invalid order: %s", order)
+	}
+
+	q.Size, err = strconv.Atoi(ctx.DefaultQuery("size", "50"))
+	if err != nil || q.Size <= 0 || q.Size > maxPageSize {
+		return nil, fmt.Errorf("Invalid size, expecting 1 to %d: %s", maxPageSize, ctx.Query("size"))
+	}
+	return q, nil
+}
+
+// controlSelectors resolves the framework and control parameters to the rules mapping to the control.
+func controlSelectors(ctx *gin.Context) ([]catalog.RuleSelector, error) {
+	framework, control := ctx.Query("framework"), ctx.Query("control")
+	if framework == "" && control == "" {
+		return nil, nil
+	}
+	if framework == "" || control == "" {
+		return nil, fmt.Errorf("framework and control go together")
+	}
+	_, _, selectors, err := catalog.Resolve(framework, control)
+	return selectors, err
+}
+
+// queryList collects a multi-valued query parameter, given either repeated or comma separated.
+func queryList(ctx *gin.Context, name string) []string {
+	ret := []string{}
+	for _, v := range ctx.QueryArray(name) {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				ret = append(ret, item)
+			}
+		}
+	}
+	return ret
+}
+
+func queryTime(ctx *gin.Context, name string) (*time.Time, error) {
+	v := ctx.Query(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s, expecting RFC3339 time: %s", name, v)
+	}
+	return &t, nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/notify"
+)
+
+// CreateChannel godoc
+//
+//	@Summary		Create a notification channel
+//	@Description	Create a channel delivering the notifications of the current org: a generic webhook, whose payload is signed
+//	@Description	with HMAC-SHA256 in the X-Collie-Signature header when a secret is set, a Slack incoming webhook, or email.
+//	@Description	Events of a channel with a digest are delivered together once the digest period is over.
+//	@Tags			notifications
+//	@Accept			json
+//	@Produce		json
+//	@Param			channel	body		notify.ChannelRequest	true	"Channel"
+//	@Success		201		{object}	notify.Channel
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/notifications/channels [post]
+func (c *Controller) CreateChannel(ctx *gin.Context) {
+	var req notify.ChannelRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	ch, err := notify.CreateChannel(authInfo.OrgId(), &req)
+	if errors.Is(err, notify.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, ch)
+}
+
+// ListChannels godoc
+//
+//	@Summary		List notification channels
+//	@Description	List the notification channels of the current org, with the outcome of their last delivery
+//	@Tags			notifications
+//	@Produce		json
+//	@Success		200	{array}		notify.Channel
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/notifications/channels [get]
+func (c *Controller) ListChannels(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	channels, err := notify.ListChannels(authInfo.OrgId())
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, channels)
+}
+
+// GetChannel godoc
+//
+//	@Summary		Get a notification channel
+//	@Tags			notifications
+//	@Produce		json
+//	@Param			id	path		string	true	"Channel id"
+//	@Success		200	{object}	notify.Channel
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/notifications/channels/{id} [get]
+func (c *Controller) GetChannel(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	ch, err := notify.GetChannel(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, ch)
+}
+
+// UpdateChannel godoc
+//
+//	@Summary		Update a notification channel
+//	@Tags			notifications
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string					true	"Channel id"
+//	@Param			channel	body		notify.ChannelRequest	true	"Channel"
+//	@Success		200		{object}	notify.Channel
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		404		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/notifications/channels/{id} [put]
+func (c *Controller) UpdateChannel(ctx *gin.Context) {
+	var req notify.ChannelRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := notify.GetChannel(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ch, err := notify.UpdateChannel(authInfo.OrgId(), ctx.Param("id"), &req)
+	if errors.Is(err, notify.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, ch)
+}
+
+// DeleteChannel godoc
+//
+//	@Summary		Delete a notification channel
+//	@Description	Delete a notification channel, dropping the events pending for its digest
+//	@Tags			notifications
+//	@Param			id	path	string	true	"Channel id"
+//	@Success		204
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/notifications/channels/{id} [delete]
+func (c *Controller) DeleteChannel(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := notify.GetChannel(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	if err := notify.DeleteChannel(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// TestChannel godoc
+//
+//	@Summary		Test a notification channel
+//	@Description	Deliver a test notification to a channel right away, ignoring its digest
+//	@Tags			notifications
+//	@Param			id	path	string	true	"Channel id"
+//	@Success		204
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Failure		502	{object}	httputil.HTTPError
+//	@Router			/notifications/channels/{id}/test [post]
+func (c *Controller) TestChannel(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := notify.GetChannel(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	if err := notify.Test(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusBadGateway, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
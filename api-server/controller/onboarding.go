@@ -24,10 +24,13 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"collie-api-server/config"
+	"collie-api-server/httputil"
 	"collie-api-server/middleware"
 	"collie-api-server/service"
+	"collie-api-server/service/agent"
 	"collie-api-server/service/auth"
 	"collie-api-server/service/es"
+	"collie-api-server/service/metrics"
 	"collie-api-server/util"
 )
 
@@ -38,18 +41,25 @@ import (
 //	@Tags			onboarding
 //	@Accept			json
 //	@Produce		json
-//	@Success		200	{object}	string
-//	@Failure		400	{object}	httputil.HTTPError
-//	@Failure		404	{object}	httputil.HTTPError
-//	@Failure		500	{object}	httputil.HTTPError
+//	@Param			provider	query		string	false	"string enums"	Enums(AKS, EKS, GKE, Other)
+//	@Success		200			{object}	string
+//	@Failure		400			{object}	httputil.HTTPError
+//	@Failure		404			{object}	httputil.HTTPError
+//	@Failure		500			{object}	httputil.HTTPError
 //	@Router			/onboarding/bootstrap [get]
 func (c *Controller) GetBootstrap(ctx *gin.Context) {
 	cfg := config.Get()
+	provider, err := service.ParseProvider(ctx.Query("provider"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
 	authInfo := middleware.GetAuth(ctx)
 	token := auth.GenerateApiKey(authInfo)
 	agentId := util.RandomString(8)
-	collieUrl := fmt.Sprintf("%s/api/v1/onboarding/agent.yaml?provider=AKS&aid=%s", cfg.ApiURL, agentId)
+	collieUrl := fmt.Sprintf("%s/api/v1/onboarding/agent.yaml?provider=%s&aid=%s", cfg.ApiURL, provider, agentId)
 	cmd := fmt.Sprintf("curl -skH \"Authorization: Bearer %s\" \"%s\" | kubectl apply -f -", token, collieUrl)
+	metrics.Onboarding("bootstrap")
 	data := map[string]string{
 		"aid": agentId,
 		"cmd": cmd,
@@ -79,6 +89,8 @@ func (c *Controller) GetOnboardingStatus(ctx *gin.Context) {
 	var err error
 	if isTestAgentStatusSimulationEnabled() {
 		hasActivity = true
+	} else if _, e := agent.Get(orgId, agentId); e == nil {
+		hasActivity = true
 	} else {
 		hasActivity, err = es.HasActivities(orgId, agentId)
 	}
@@ -116,7 +128,7 @@ func isTestAgentStatusSimulationEnabled() bool {
 //	@Tags			onboarding
 //	@Accept			json
 //	@Produce		text/plain
-//	@Param			provider	query		string	false	"string enums"	Enums(AKS, EKS, Other)
+//	@Param			provider	query		string	false	"string enums"	Enums(AKS, EKS, GKE, Other)
 //	@Param			aid			query		string	true	"Agent id"
 //	@Success		200			{object}	string
 //	@Failure		400			{object}	httputil.HTTPError
@@ -124,7 +136,11 @@ func isTestAgentStatusSimulationEnabled() bool {
 //	@Failure		500			{object}	httputil.HTTPError
 //	@Router			/onboarding/agent.yaml [get]
 func (c *Controller) GetAgentYaml(ctx *gin.Context) {
-	provider := ctx.DefaultQuery("provider", "Other")
+	provider, err := service.ParseProvider(ctx.Query("provider"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
 	agentId := ctx.Query("aid")
 	authInfo := middleware.GetAuth(ctx)
 	apiKey := auth.GenerateApiKey(authInfo)
@@ -137,5 +153,6 @@ func (c *Controller) GetAgentYaml(ctx *gin.Context) {
 		}
 		return
 	}
+	metrics.Onboarding("agent-yaml")
 	ctx.String(http.StatusOK, text)
 }
@@ -52,6 +52,18 @@ func (c *Controller) PortalIndex(ctx *gin.Context) {
 	ctx.HTML(http.StatusOK, "index.html", data)
 }
 
+func (c *Controller) PortalAgents(ctx *gin.Context) {
+	cfg := config.Get()
+	data := gin.H{
+		"staleAfter": cfg.AgentStaleAfter.String(),
+	}
+	ctx.HTML(http.StatusOK, "agents.html", data)
+}
+
+func (c *Controller) PortalRules(ctx *gin.Context) {
+	ctx.HTML(http.StatusOK, "rules.html", gin.H{})
+}
+
 func (c *Controller) PortalLogin(ctx *gin.Context) {
 	data := map[string]interface{}{
 		"cspAuthUrl":    csp.GetAuthUrl(),
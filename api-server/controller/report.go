@@ -16,41 +16,143 @@ limitations under the License.
 package controller
 
 import (
-	"github.com/gin-gonic/gin"
+	"errors"
 	"log"
 	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/alert"
+	"collie-api-server/service/es"
+	"collie-api-server/service/notify/events"
+	"collie-api-server/service/scan"
+	"collie-api-server/service/scanrequest"
 )
 
 // SyncStart godoc
 //
 //	@Summary		Indicating a sync has been started
-//	@Description	Indicating a sync has been started
+//	@Description	Indicating a sync has been started. Records a running scan.
 //	@Tags			agent
 //	@Accept			json
 //	@Produce		json
-//	@Success		200	{object}	string
-//	@Failure		400	{object}	httputil.HTTPError
-//	@Failure		404	{object}	httputil.HTTPError
-//	@Failure		500	{object}	httputil.HTTPError
+//	@Param			scan	body		scan.Scan	true	"Scan"
+//	@Success		200		{object}	scan.Scan
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		404		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
 //	@Router			/agent/sync-start [post]
 func (c *Controller) SyncStart(ctx *gin.Context) {
-	log.Printf("SyncStart")
-	ctx.String(http.StatusOK, "")
+	var s scan.Scan
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	ret, err := scan.Start(authInfo.OrgId(), &s)
+	if errors.Is(err, scan.ErrNoId) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("SyncStart: scan=%s, agent=%s, cluster=%s", ret.Id, ret.AgentId, ret.ClusterId)
+	if ret.RequestId != "" {
+		if err := scanrequest.Started(authInfo.OrgId(), ret.RequestId, scanRun(ret)); err != nil {
+			log.Printf("Error updating scan request %s: %s", ret.RequestId, err)
+		}
+	}
+	ctx.JSON(http.StatusOK, ret)
 }
 
 // PostDiscoveryComplete godoc
 //
 //	@Summary		Indicating a sync has complete
-//	@Description	Indicating a sync has complete
+//	@Description	Indicating a sync has complete. Records the final state of the scan.
 //	@Tags			agent
 //	@Accept			json
 //	@Produce		json
-//	@Success		200	{object}	string
-//	@Failure		400	{object}	httputil.HTTPError
-//	@Failure		404	{object}	httputil.HTTPError
-//	@Failure		500	{object}	httputil.HTTPError
+//	@Param			scan	body		scan.Scan	true	"Scan"
+//	@Success		200		{object}	scan.Scan
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		404		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
 //	@Router			/agent/sync-complete [post]
 func (c *Controller) SyncComplete(ctx *gin.Context) {
-	log.Printf("SyncComplete")
-	ctx.String(http.StatusOK, "")
+	var s scan.Scan
+	if err := ctx.ShouldBindJSON(&s); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	ret, err := scan.Complete(authInfo.OrgId(), &s)
+	if errors.Is(err, scan.ErrNoId) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("SyncComplete: scan=%s, agent=%s, cluster=%s, status=%s", ret.Id, ret.AgentId, ret.ClusterId, ret.Status)
+	if ret.RequestId != "" {
+		if err := scanrequest.Completed(authInfo.OrgId(), ret.RequestId, scanRun(ret)); err != nil {
+			log.Printf("Error updating scan request %s: %s", ret.RequestId, err)
+		}
+	}
+	// only a cycle without errors becomes the current snapshot of the cluster,
+	// its posture is recorded and the alert rules are evaluated on it
+	if ret.Status == scan.StatusCompleted {
+		go recordPosture(authInfo.OrgId(), ret)
+	} else if ret.Status == scan.StatusFailed {
+		go events.ScanFailed(authInfo.OrgId(), ret)
+	}
+	ctx.JSON(http.StatusOK, ret)
+}
+
+func recordPosture(orgId string, s *scan.Scan) {
+	p, err := es.RecordPosture(orgId, s.AgentId, s.ClusterId, s.Id)
+	if err != nil {
+		log.Printf("Error recording posture: scan=%s, cluster=%s, %s", s.Id, s.ClusterId, err)
+		return
+	}
+	previous, err := previousSnapshot(orgId, s)
+	if err != nil {
+		log.Printf("Error getting snapshots: cluster=%s, %s", s.ClusterId, err)
+	}
+
+	events.ScoreBelow(orgId, p)
+	if previous != "" {
+		notifyNewFindings(orgId, s, previous)
+	}
+	alert.Evaluate(orgId, &alert.Scan{ClusterId: s.ClusterId, ScanId: s.Id, PreviousScanId: previous, Posture: p})
+}
+
+// previousSnapshot returns the snapshot of the cluster preceding the scan, empty for the first snapshot of a cluster.
+func previousSnapshot(orgId string, s *scan.Scan) (string, error) {
+	pointer, err := es.GetSnapshotPointer(orgId, s.ClusterId)
+	if err != nil {
+		return "", err
+	}
+	if len(pointer.Snapshots) < 2 || pointer.Snapshots[0].Id != s.Id {
+		return "", nil
+	}
+	return pointer.Snapshots[1].Id, nil
+}
+
+// notifyNewFindings notifies the findings failing since the previous snapshot of the cluster.
+func notifyNewFindings(orgId string, s *scan.Scan, previous string) {
+	findings, err := es.NewlyFailing(orgId, s.ClusterId, previous, s.Id)
+	if err != nil {
+		log.Printf("Error comparing snapshots: cluster=%s, %s", s.ClusterId, err)
+		return
+	}
+	events.NewFindings(orgId, s.ClusterId, findings)
+}
+
+// scanRun returns the scan run for a scan request.
+func scanRun(s *scan.Scan) *scanrequest.Run {
+	return &scanrequest.Run{ScanId: s.Id, Status: s.Status, StartedAt: s.StartedAt, EndedAt: s.EndedAt, Errors: s.Errors}
 }
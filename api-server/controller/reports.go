@@ -0,0 +1,157 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/catalog"
+	"collie-api-server/service/report"
+)
+
+// CreateReport godoc
+//
+//	@Summary		Generate a compliance report
+//	@Description	Generate a point-in-time report of a cluster, or of the org when no cluster is given, from the current snapshots.
+//	@Description	The report has an executive summary, the score, and the failing controls with their remediation and affected resources.
+//	@Description	The sarif and oscal formats export the findings as SARIF 2.1.0 and OSCAL assessment results.
+//	@Description	Given a framework and control of the control catalog, the report only covers the rules mapping to the control.
+//	@Tags			reports
+//	@Accept			json
+//	@Produce		json
+//	@Param			request	body		report.Request	true	"Scope and format"
+//	@Success		201		{object}	report.Report
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		413		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/reports [post]
+func (c *Controller) CreateReport(ctx *gin.Context) {
+	var req report.Request
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	if !report.IsSupported(req.Format) {
+		httputil.Abort(ctx, http.StatusBadRequest, fmt.Errorf("Unsupported format: %s", req.Format))
+		return
+	}
+	if req.Framework != "" || req.Control != "" {
+		if _, _, _, err := catalog.Resolve(req.Framework, req.Control); err != nil {
+			httputil.Abort(ctx, http.StatusBadRequest, err)
+			return
+		}
+	}
+	authInfo := middleware.GetAuth(ctx)
+	r, err := report.Generate(authInfo.OrgId(), req)
+	if errors.Is(err, report.ErrTooLarge) {
+		httputil.Abort(ctx, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, r)
+}
+
+// ListReports godoc
+//
+//	@Summary		List reports
+//	@Description	List the reports generated for the current org, most recent first
+//	@Tags			reports
+//	@Produce		json
+//	@Success		200	{array}		report.Report
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/reports [get]
+func (c *Controller) ListReports(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	reports, err := report.List(authInfo.OrgId())
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, reports)
+}
+
+// GetReport godoc
+//
+//	@Summary		Get a report
+//	@Description	Get the metadata of a report
+//	@Tags			reports
+//	@Produce		json
+//	@Param			id	path		string	true	"Report id"
+//	@Success		200	{object}	report.Report
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/reports/{id} [get]
+func (c *Controller) GetReport(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	r, err := report.Get(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, r)
+}
+
+// DownloadReport godoc
+//
+//	@Summary		Download a report
+//	@Description	Download the file of a report, as CSV, HTML, PDF, SARIF or OSCAL
+//	@Tags			reports
+//	@Produce		text/csv,text/html,application/pdf,application/sarif+json,application/json
+//	@Param			id	path		string	true	"Report id"
+//	@Success		200	{file}		file
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/reports/{id}/download [get]
+func (c *Controller) DownloadReport(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	r, content, err := report.Content(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", r.FileName))
+	ctx.Data(http.StatusOK, r.ContentType, content)
+}
+
+// DeleteReport godoc
+//
+//	@Summary		Delete a report
+//	@Description	Delete a report and its file
+//	@Tags			reports
+//	@Param			id	path	string	true	"Report id"
+//	@Success		204
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/reports/{id} [delete]
+func (c *Controller) DeleteReport(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	if err := report.Delete(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
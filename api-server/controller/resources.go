@@ -0,0 +1,113 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/es"
+)
+
+// ListResources godoc
+//
+//	@Summary		Browse the resource inventory of a cluster
+//	@Description	List the resources reported by the agent of a cluster, ordered by resource key.
+//	@Description	Label keys are matched as reported, with dots replaced by underscores.
+//	@Tags			clusters
+//	@Produce		json
+//	@Param			id			path		string		true	"Cluster id"
+//	@Param			kind		query		[]string	false	"Kinds, in plural lower case"	collectionFormat(csv)
+//	@Param			namespace	query		[]string	false	"Namespaces"					collectionFormat(csv)
+//	@Param			name		query		string		false	"Prefix of the resource name"
+//	@Param			label		query		[]string	false	"Label selectors as key=value"	collectionFormat(csv)
+//	@Param			size		query		int			false	"Page size"	default(50)
+//	@Param			cursor		query		string		false	"Cursor of the next page"
+//	@Success		200			{object}	es.ResourcePage
+//	@Failure		400			{object}	httputil.HTTPError
+//	@Failure		401			{object}	httputil.HTTPError
+//	@Failure		500			{object}	httputil.HTTPError
+//	@Router			/clusters/{id}/resources [get]
+func (c *Controller) ListResources(ctx *gin.Context) {
+	q := &es.ResourceQuery{
+		ClusterId:  clusterParam(ctx),
+		Kinds:      queryList(ctx, "kind"),
+		Namespaces: queryList(ctx, "namespace"),
+		Name:       ctx.Query("name"),
+		Labels:     map[string]string{},
+		Cursor:     ctx.Query("cursor"),
+	}
+	for _, selector := range queryList(ctx, "label") {
+		k, v, ok := strings.Cut(selector, "=")
+		if !ok || k == "" {
+			httputil.Abort(ctx, http.StatusBadRequest, fmt.Errorf("Invalid label selector, expecting key=value: %s", selector))
+			return
+		}
+		q.Labels[k] = v
+	}
+	size, err := strconv.Atoi(ctx.DefaultQuery("size", "50"))
+	if err != nil || size <= 0 || size > maxPageSize {
+		httputil.Abort(ctx, http.StatusBadRequest, fmt.Errorf("Invalid size, expecting 1 to %d: %s", maxPageSize, ctx.Query("size")))
+		return
+	}
+	q.Size = size
+
+	authInfo := middleware.GetAuth(ctx)
+	page, err := es.SearchResources(authInfo.OrgId(), q)
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, page)
+}
+
+// GetResource godoc
+//
+//	@Summary		Get a resource
+//	@Description	Get the full object of a resource as last reported, with the compliance findings attached to it.
+//	@Description	The path is "/<name>" for cluster scoped resources and "/<namespace>/<name>" for namespaced ones.
+//	@Tags			clusters
+//	@Produce		json
+//	@Param			id		path		string	true	"Cluster id"
+//	@Param			kind	path		string	true	"Kind, in plural lower case"	example(pods)
+//	@Param			path	path		string	true	"Namespace and name"			example(default/nginx)
+//	@Success		200		{object}	es.ResourceDetail
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		404		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/clusters/{id}/resources/{kind}/{path} [get]
+func (c *Controller) GetResource(ctx *gin.Context) {
+	key := ctx.Param("kind") + "#" + strings.Trim(ctx.Param("path"), "/")
+
+	authInfo := middleware.GetAuth(ctx)
+	detail, err := es.GetResource(authInfo.OrgId(), clusterParam(ctx), key)
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	if detail == nil {
+		httputil.Abort(ctx, http.StatusNotFound, errors.New("Resource not found: "+key))
+		return
+	}
+	ctx.JSON(http.StatusOK, detail)
+}
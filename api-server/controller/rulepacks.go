@@ -0,0 +1,159 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/rulepack"
+)
+
+// CreateRulePack godoc
+//
+//	@Summary		Create a rule pack
+//	@Description	Add Rego policies evaluated by the agents of the org against every discovered resource. Each module is a package under collie
+//	@Description	with a deny set of messages and a __rego_metadata__ object holding id, title, severity, category and remediation.
+//	@Tags			rule-packs
+//	@Accept			json
+//	@Produce		json
+//	@Param			pack	body		rulepack.Request	true	"Name and Rego modules"
+//	@Success		201		{object}	rulepack.RulePack
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/rule-packs [post]
+func (c *Controller) CreateRulePack(ctx *gin.Context) {
+	var req rulepack.Request
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	p, err := rulepack.Create(authInfo.OrgId(), authInfo.Username(), &req)
+	if errors.Is(err, rulepack.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, p)
+}
+
+// ListRulePacks godoc
+//
+//	@Summary		List rule packs
+//	@Description	List the rule packs of the current org, by name
+//	@Tags			rule-packs
+//	@Produce		json
+//	@Success		200	{array}		rulepack.RulePack
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/rule-packs [get]
+func (c *Controller) ListRulePacks(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	packs, err := rulepack.List(authInfo.OrgId())
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, packs)
+}
+
+// GetRulePack godoc
+//
+//	@Summary		Get a rule pack
+//	@Tags			rule-packs
+//	@Produce		json
+//	@Param			id	path		string	true	"Rule pack id"
+//	@Success		200	{object}	rulepack.RulePack
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/rule-packs/{id} [get]
+func (c *Controller) GetRulePack(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	p, err := rulepack.Get(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, p)
+}
+
+// UpdateRulePack godoc
+//
+//	@Summary		Update a rule pack
+//	@Description	Replace the policies of a rule pack. The agents pick them up with their configuration.
+//	@Tags			rule-packs
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string				true	"Rule pack id"
+//	@Param			pack	body		rulepack.Request	true	"Name and Rego modules"
+//	@Success		200		{object}	rulepack.RulePack
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		404		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/rule-packs/{id} [put]
+func (c *Controller) UpdateRulePack(ctx *gin.Context) {
+	var req rulepack.Request
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := rulepack.Get(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	p, err := rulepack.Update(authInfo.OrgId(), ctx.Param("id"), &req)
+	if errors.Is(err, rulepack.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, p)
+}
+
+// DeleteRulePack godoc
+//
+//	@Summary		Delete a rule pack
+//	@Tags			rule-packs
+//	@Param			id	path	string	true	"Rule pack id"
+//	@Success		204
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/rule-packs/{id} [delete]
+func (c *Controller) DeleteRulePack(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := rulepack.Get(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	if err := rulepack.Delete(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
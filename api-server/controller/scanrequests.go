@@ -0,0 +1,179 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/agent"
+	"collie-api-server/service/scanrequest"
+)
+
+const maxScanRequestWait = time.Minute
+
+// CreateScanRequest godoc
+//
+//	@Summary		Request a scan now
+//	@Description	Queue a scan request for an agent, which runs a cycle as soon as it picks it up, optionally limited to some phases.
+//	@Description	A request still queued for the agent is returned instead, extended with the phases asked for.
+//	@Tags			scans
+//	@Accept			json
+//	@Produce		json
+//	@Param			request	body		scanrequest.Request	true	"Agent and phases, all phases when empty"
+//	@Success		201		{object}	scanrequest.ScanRequest
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		404		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/scan-requests [post]
+func (c *Controller) CreateScanRequest(ctx *gin.Context) {
+	var req scanrequest.Request
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := agent.Get(authInfo.OrgId(), req.AgentId); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	sr, err := scanrequest.Create(authInfo.OrgId(), authInfo.Username(), &req)
+	if errors.Is(err, scanrequest.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, sr)
+}
+
+// ListScanRequests godoc
+//
+//	@Summary		List scan requests
+//	@Description	List the scan requests of the current org, most recent first
+//	@Tags			scans
+//	@Produce		json
+//	@Param			agentId	query		string	false	"Only the requests of this agent"
+//	@Success		200		{array}		scanrequest.ScanRequest
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/scan-requests [get]
+func (c *Controller) ListScanRequests(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	requests, err := scanrequest.List(authInfo.OrgId(), ctx.Query("agentId"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, requests)
+}
+
+// GetScanRequest godoc
+//
+//	@Summary		Get a scan request
+//	@Description	Get a scan request, with its status from queued to the outcome of its scan
+//	@Tags			scans
+//	@Produce		json
+//	@Param			id	path		string	true	"Scan request id"
+//	@Success		200	{object}	scanrequest.ScanRequest
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/scan-requests/{id} [get]
+func (c *Controller) GetScanRequest(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	sr, err := scanrequest.Get(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, sr)
+}
+
+// CancelScanRequest godoc
+//
+//	@Summary		Cancel a scan request
+//	@Description	Cancel a scan request which has not been picked up by its agent yet
+//	@Tags			scans
+//	@Produce		json
+//	@Param			id	path		string	true	"Scan request id"
+//	@Success		200	{object}	scanrequest.ScanRequest
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Failure		409	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/scan-requests/{id}/cancel [post]
+func (c *Controller) CancelScanRequest(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := scanrequest.Get(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	sr, err := scanrequest.Cancel(authInfo.OrgId(), ctx.Param("id"))
+	if errors.Is(err, scanrequest.ErrNotQueued) {
+		httputil.Abort(ctx, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, sr)
+}
+
+// NextScanRequest godoc
+//
+//	@Summary		Wait for the next scan request of the agent
+//	@Description	Long-polled by the agent. Returns the oldest queued request of the agent, waiting for one up to the given duration.
+//	@Tags			agent
+//	@Produce		json
+//	@Param			agentId	query		string	true	"Agent id"
+//	@Param			wait	query		string	false	"Maximum wait, 30s by default and 1m at most"
+//	@Success		200		{object}	scanrequest.ScanRequest
+//	@Success		204
+//	@Failure		400	{object}	httputil.HTTPError
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/agent/scan-requests/next [get]
+func (c *Controller) NextScanRequest(ctx *gin.Context) {
+	agentId := ctx.Query("agentId")
+	if agentId == "" {
+		httputil.Abort(ctx, http.StatusBadRequest, fmt.Errorf("agentId is required"))
+		return
+	}
+	wait, err := time.ParseDuration(ctx.DefaultQuery("wait", "30s"))
+	if err != nil || wait < 0 || wait > maxScanRequestWait {
+		httputil.Abort(ctx, http.StatusBadRequest, fmt.Errorf("Invalid wait, expecting up to %s: %s", maxScanRequestWait, ctx.Query("wait")))
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	sr, err := scanrequest.Next(ctx.Request.Context(), authInfo.OrgId(), agentId, wait)
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	if sr == nil {
+		ctx.Status(http.StatusNoContent)
+		return
+	}
+	ctx.JSON(http.StatusOK, sr)
+}
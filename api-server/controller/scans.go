@@ -0,0 +1,83 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/scan"
+)
+
+// ListScans godoc
+//
+//	@Summary		List scans
+//	@Description	List the scan cycles reported by the agents of the current org, most recent first
+//	@Tags			scans
+//	@Produce		json
+//	@Param			agent	query		string	false	"Agent id"
+//	@Param			cluster	query		string	false	"Cluster id"
+//	@Param			limit	query		int		false	"Maximum number of scans"	default(100)
+//	@Success		200		{array}		scan.Scan
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/scans [get]
+func (c *Controller) ListScans(ctx *gin.Context) {
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "100"))
+	if err != nil || limit < 0 {
+		httputil.Abort(ctx, http.StatusBadRequest, fmt.Errorf("Invalid limit: %s", ctx.Query("limit")))
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	filter := scan.Filter{
+		AgentId:   ctx.Query("agent"),
+		ClusterId: clusterQuery(ctx),
+		Limit:     limit,
+	}
+	scans, err := scan.List(authInfo.OrgId(), filter)
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, scans)
+}
+
+// GetScan godoc
+//
+//	@Summary		Get a scan
+//	@Description	Get a scan cycle with its per-phase timings, document counts, errors and plugin statuses
+//	@Tags			scans
+//	@Produce		json
+//	@Param			id	path		string	true	"Scan id"
+//	@Success		200	{object}	scan.Scan
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/scans/{id} [get]
+func (c *Controller) GetScan(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	s, err := scan.Get(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, s)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/es"
+)
+
+const (
+	maxTrendWindow = 366 * 24 * time.Hour
+	minTrendStep   = time.Hour
+	maxTrendPoints = 1000
+)
+
+// GetTrends godoc
+//
+//	@Summary		Compliance posture trend
+//	@Description	Time series of the posture score and finding counts of the org and of each cluster, recorded at the end of each scan cycle.
+//	@Description	A cluster point summarizes the latest cycle of the cluster in an interval. An org point counts the latest cycle of each cluster
+//	@Description	up to the interval, assessed within the last 31 days, so that clusters scanned less often still count. Durations accept a "d" suffix for days.
+//	@Tags			posture
+//	@Produce		json
+//	@Param			cluster		query		[]string	false	"Cluster ids"	collectionFormat(csv)
+//	@Param			window		query		string		false	"Length of the series, ending now"	default(30d)
+//	@Param			interval	query		string		false	"Length of each point"				default(1d)
+//	@Success		200			{object}	es.Trend
+//	@Failure		400			{object}	httputil.HTTPError
+//	@Failure		401			{object}	httputil.HTTPError
+//	@Failure		500			{object}	httputil.HTTPError
+//	@Router			/trends [get]
+func (c *Controller) GetTrends(ctx *gin.Context) {
+	window, err := parseDuration(ctx.DefaultQuery("window", "30d"))
+	if err != nil || window <= 0 || window > maxTrendWindow {
+		httputil.Abort(ctx, http.StatusBadRequest, fmt.Errorf("Invalid window, expecting up to %s: %s", maxTrendWindow, ctx.Query("window")))
+		return
+	}
+	interval, err := parseDuration(ctx.DefaultQuery("interval", "1d"))
+	if err != nil || interval < minTrendStep || window/interval > maxTrendPoints {
+		httputil.Abort(ctx, http.StatusBadRequest, fmt.Errorf("Invalid interval, expecting at least %s and at most %d points: %s", minTrendStep, maxTrendPoints, ctx.Query("interval")))
+		return
+	}
+
+	to := time.Now().UTC()
+	q := &es.TrendQuery{
+		ClusterIds: clusterList(ctx),
+		From:       to.Add(-window).Truncate(interval),
+		To:         to,
+		Interval:   interval,
+	}
+	authInfo := middleware.GetAuth(ctx)
+	trend, err := es.GetTrend(authInfo.OrgId(), q)
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, trend)
+}
+
+// parseDuration parses a Go duration, or a number of days such as "30d".
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"collie-api-server/config"
+	"collie-api-server/httputil"
+	"collie-api-server/middleware"
+	"collie-api-server/service/waiver"
+)
+
+// CreateWaiver godoc
+//
+//	@Summary		Create a waiver
+//	@Description	Accept the failures of a rule as a risk until the waiver expires. The scope narrows down with cluster, namespace and resource,
+//	@Description	a resource ending with * matches all resources starting with it. Covered findings are reported as WAIVED and not assessed in scores.
+//	@Tags			waivers
+//	@Accept			json
+//	@Produce		json
+//	@Param			waiver	body		waiver.Request	true	"Scope, justification, owner and expiry"
+//	@Success		201		{object}	waiver.Waiver
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/waivers [post]
+func (c *Controller) CreateWaiver(ctx *gin.Context) {
+	var req waiver.Request
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	w, err := waiver.Create(authInfo.OrgId(), authInfo.Username(), &req)
+	if errors.Is(err, waiver.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, w)
+}
+
+// ListWaivers godoc
+//
+//	@Summary		List waivers
+//	@Description	List the waivers of the current org, soonest expiry first, including expired ones
+//	@Tags			waivers
+//	@Produce		json
+//	@Success		200	{array}		waiver.Waiver
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/waivers [get]
+func (c *Controller) ListWaivers(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	waivers, err := waiver.List(authInfo.OrgId())
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, waivers)
+}
+
+// ListExpiringWaivers godoc
+//
+//	@Summary		List expiring waivers
+//	@Description	List the active waivers of the current org expiring soon, WAIVER_EXPIRING_WITHIN by default
+//	@Tags			waivers
+//	@Produce		json
+//	@Param			within	query		string	false	"Duration, such as 72h or 30d"
+//	@Success		200		{array}		waiver.Waiver
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/waivers/expiring [get]
+func (c *Controller) ListExpiringWaivers(ctx *gin.Context) {
+	within := config.Get().WaiverExpiringWithin
+	if v := ctx.Query("within"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil {
+			httputil.Abort(ctx, http.StatusBadRequest, err)
+			return
+		}
+		within = d
+	}
+	authInfo := middleware.GetAuth(ctx)
+	waivers, err := waiver.Expiring(authInfo.OrgId(), within)
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, waivers)
+}
+
+// GetWaiver godoc
+//
+//	@Summary		Get a waiver
+//	@Tags			waivers
+//	@Produce		json
+//	@Param			id	path		string	true	"Waiver id"
+//	@Success		200	{object}	waiver.Waiver
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/waivers/{id} [get]
+func (c *Controller) GetWaiver(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	w, err := waiver.Get(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, w)
+}
+
+// UpdateWaiver godoc
+//
+//	@Summary		Update a waiver
+//	@Description	Replace the scope, justification, owner and expiry of a waiver, for instance to renew it
+//	@Tags			waivers
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string			true	"Waiver id"
+//	@Param			waiver	body		waiver.Request	true	"Scope, justification, owner and expiry"
+//	@Success		200		{object}	waiver.Waiver
+//	@Failure		400		{object}	httputil.HTTPError
+//	@Failure		401		{object}	httputil.HTTPError
+//	@Failure		404		{object}	httputil.HTTPError
+//	@Failure		500		{object}	httputil.HTTPError
+//	@Router			/waivers/{id} [put]
+func (c *Controller) UpdateWaiver(ctx *gin.Context) {
+	var req waiver.Request
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := waiver.Get(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	w, err := waiver.Update(authInfo.OrgId(), authInfo.Username(), ctx.Param("id"), &req)
+	if errors.Is(err, waiver.ErrInvalid) {
+		httputil.Abort(ctx, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, w)
+}
+
+// DeleteWaiver godoc
+//
+//	@Summary		Delete a waiver
+//	@Description	Delete a waiver, the findings it covered fail again
+//	@Tags			waivers
+//	@Param			id	path	string	true	"Waiver id"
+//	@Success		204
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Failure		500	{object}	httputil.HTTPError
+//	@Router			/waivers/{id} [delete]
+func (c *Controller) DeleteWaiver(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	if _, err := waiver.Get(authInfo.OrgId(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	if err := waiver.Delete(authInfo.OrgId(), authInfo.Username(), ctx.Param("id")); err != nil {
+		httputil.Abort(ctx, http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// GetWaiverHistory godoc
+//
+//	@Summary		Get the history of a waiver
+//	@Description	List who created, updated, reassigned and deleted a waiver, oldest change first, with the waiver as it was after each change.
+//	@Description	The history of a deleted waiver is kept.
+//	@Tags			waivers
+//	@Produce		json
+//	@Param			id	path		string	true	"Waiver id"
+//	@Success		200	{array}		waiver.Event
+//	@Failure		401	{object}	httputil.HTTPError
+//	@Failure		404	{object}	httputil.HTTPError
+//	@Router			/waivers/{id}/history [get]
+func (c *Controller) GetWaiverHistory(ctx *gin.Context) {
+	authInfo := middleware.GetAuth(ctx)
+	events, err := waiver.History(authInfo.OrgId(), ctx.Param("id"))
+	if err != nil {
+		httputil.Abort(ctx, http.StatusNotFound, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, events)
+}
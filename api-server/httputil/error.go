@@ -19,8 +19,9 @@ import "github.com/gin-gonic/gin"
 
 func Abort(ctx *gin.Context, code int, err error) {
 	er := HTTPError{
-		Code:    code,
-		Message: err.Error(),
+		Code:      code,
+		Message:   err.Error(),
+		RequestId: ctx.GetString("requestId"),
 	}
 	ctx.AbortWithStatusJSON(code, er)
 }
@@ -28,4 +29,6 @@ func Abort(ctx *gin.Context, code int, err error) {
 type HTTPError struct {
 	Code    int    `json:"code" example:"400"`
 	Message string `json:"message" example:"status bad request"`
+	// RequestId is the id of the request in the access logs
+	RequestId string `json:"requestId,omitempty" example:"9f86d081884c7d65"`
 }
@@ -24,6 +24,12 @@ import (
 	"collie-api-server/controller"
 	_ "collie-api-server/docs"
 	auth "collie-api-server/middleware"
+	"collie-api-server/service/agent"
+	"collie-api-server/service/notify"
+	"collie-api-server/service/notify/events"
+	"collie-api-server/service/report"
+	"collie-api-server/service/scan"
+	"collie-api-server/service/tracing"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -36,6 +42,12 @@ var (
 	GitRef    = "no-ref"
 )
 
+// scanExpiryInterval is the time between two deletions of the scans past their retention
+const scanExpiryInterval = time.Hour
+
+// reportExpiryInterval is the time between two deletions of the reports past their retention
+const reportExpiryInterval = time.Hour
+
 //	@title			Collie API Server
 //	@version		1.0
 //	@description	This is the API server for Collie K8S compliance tool.
@@ -84,11 +96,28 @@ func main() {
 }
 
 func run(cfg config.Config, log *logrus.Entry, ctx context.Context, exitCh chan error) error {
+	notify.Configure(notify.Settings{
+		DedupWindow:      cfg.Notify.DedupWindow,
+		DigestCheck:      cfg.Notify.DigestCheck,
+		Timeout:          cfg.Notify.Timeout,
+		SmtpHost:         cfg.Notify.SmtpHost,
+		SmtpPort:         cfg.Notify.SmtpPort,
+		SmtpFrom:         cfg.Notify.SmtpFrom,
+		SmtpUsername:     cfg.Notify.SmtpUsername,
+		SmtpPassword:     cfg.Notify.SmtpPassword,
+		AllowPrivateUrls: cfg.Notify.AllowPrivateUrls,
+	})
+	go notify.Run(ctx)
+	go agent.WatchStale(ctx, cfg.Notify.StaleInterval, events.AgentStale)
+	go scan.Expire(ctx, scanExpiryInterval, cfg.ScanRetention)
+	go report.Expire(ctx, reportExpiryInterval, cfg.ReportRetention)
 	return startRestController()
 }
 
 func startRestController() error {
-	r := gin.Default()
+	// gin.Default without its text logger, the access logs are JSON lines with the request id
+	r := gin.New()
+	r.Use(gin.Recovery(), tracing.Middleware(), auth.RequestId, auth.AccessLog, auth.Metrics)
 
 	// allow all origins
 	//r.Use(cors.Default())
@@ -100,9 +129,9 @@ func startRestController() error {
 	// - Preflight requests cached for 12 hours
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"https://collie.eng.vmware.com", "http://localhost:8081", "*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH"},
-		AllowHeaders:     []string{"Origin", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowHeaders:     []string{"Origin", "Authorization", auth.RequestIdHeader},
+		ExposeHeaders:    []string{"Content-Length", auth.RequestIdHeader},
 		AllowCredentials: true,
 		// AllowOriginFunc: func(origin string) bool {
 		//     return origin == "https://collie.eng.vmware.com.com"
@@ -128,8 +157,126 @@ func startRestController() error {
 			}
 			agent := apiV1.Group("/agent")
 			{
+				agent.Use(auth.Authenticate)
+				agent.POST("/heartbeat", c.AgentHeartbeat)
 				agent.POST("/sync-start", c.SyncStart)
 				agent.POST("/sync-complete", c.SyncComplete)
+				agent.GET("/config", c.GetAgentConfig)
+				agent.GET("/scan-requests/next", c.NextScanRequest)
+			}
+			agents := apiV1.Group("/agents")
+			{
+				agents.Use(auth.Authenticate)
+				agents.GET("", c.ListAgents)
+				agents.GET("/:id", c.GetAgent)
+				agents.DELETE("/:id", c.DeleteAgent)
+			}
+			scans := apiV1.Group("/scans")
+			{
+				scans.Use(auth.Authenticate)
+				scans.GET("", c.ListScans)
+				scans.GET("/:id", c.GetScan)
+			}
+			scanRequests := apiV1.Group("/scan-requests")
+			{
+				scanRequests.Use(auth.Authenticate)
+				scanRequests.POST("", c.CreateScanRequest)
+				scanRequests.GET("", c.ListScanRequests)
+				scanRequests.GET("/:id", c.GetScanRequest)
+				scanRequests.POST("/:id/cancel", c.CancelScanRequest)
+			}
+			findings := apiV1.Group("/findings")
+			{
+				findings.Use(auth.Authenticate)
+				findings.GET("", c.ListFindings)
+			}
+			trends := apiV1.Group("/trends")
+			{
+				trends.Use(auth.Authenticate)
+				trends.GET("", c.GetTrends)
+			}
+			reports := apiV1.Group("/reports")
+			{
+				reports.Use(auth.Authenticate)
+				reports.POST("", c.CreateReport)
+				reports.GET("", c.ListReports)
+				reports.GET("/:id", c.GetReport)
+				reports.GET("/:id/download", c.DownloadReport)
+				reports.DELETE("/:id", c.DeleteReport)
+			}
+			controls := apiV1.Group("/controls")
+			{
+				controls.Use(auth.Authenticate)
+				controls.GET("", c.GetControlCatalog)
+				controls.GET("/:framework", c.GetFramework)
+				controls.GET("/:framework/:control/posture", c.GetControlPosture)
+			}
+			waivers := apiV1.Group("/waivers")
+			{
+				waivers.Use(auth.Authenticate)
+				waivers.POST("", c.CreateWaiver)
+				waivers.GET("", c.ListWaivers)
+				waivers.GET("/expiring", c.ListExpiringWaivers)
+				waivers.GET("/:id", c.GetWaiver)
+				waivers.PUT("/:id", c.UpdateWaiver)
+				waivers.DELETE("/:id", c.DeleteWaiver)
+				waivers.GET("/:id/history", c.GetWaiverHistory)
+			}
+			agentConfig := apiV1.Group("/agent-config")
+			{
+				agentConfig.Use(auth.Authenticate)
+				agentConfig.GET("", c.GetAgentSettings)
+				agentConfig.PUT("", c.UpdateAgentSettings)
+			}
+			rulePacks := apiV1.Group("/rule-packs")
+			{
+				rulePacks.Use(auth.Authenticate)
+				rulePacks.POST("", c.CreateRulePack)
+				rulePacks.GET("", c.ListRulePacks)
+				rulePacks.GET("/:id", c.GetRulePack)
+				rulePacks.PUT("/:id", c.UpdateRulePack)
+				rulePacks.DELETE("/:id", c.DeleteRulePack)
+			}
+			customRules := apiV1.Group("/custom-rules")
+			{
+				customRules.Use(auth.Authenticate)
+				customRules.POST("", c.CreateCustomRule)
+				customRules.GET("", c.ListCustomRules)
+				customRules.GET("/:id", c.GetCustomRule)
+				customRules.PUT("/:id", c.UpdateCustomRule)
+				customRules.DELETE("/:id", c.DeleteCustomRule)
+			}
+			notifications := apiV1.Group("/notifications")
+			{
+				notifications.Use(auth.Authenticate)
+				notifications.POST("/channels", c.CreateChannel)
+				notifications.GET("/channels", c.ListChannels)
+				notifications.GET("/channels/:id", c.GetChannel)
+				notifications.PUT("/channels/:id", c.UpdateChannel)
+				notifications.DELETE("/channels/:id", c.DeleteChannel)
+				notifications.POST("/channels/:id/test", c.TestChannel)
+			}
+			alerts := apiV1.Group("/alerts")
+			{
+				alerts.Use(auth.Authenticate)
+				alerts.GET("", c.ListAlerts)
+				alerts.POST("/rules", c.CreateAlertRule)
+				alerts.GET("/rules", c.ListAlertRules)
+				alerts.GET("/rules/:id", c.GetAlertRule)
+				alerts.PUT("/rules/:id", c.UpdateAlertRule)
+				alerts.DELETE("/rules/:id", c.DeleteAlertRule)
+				alerts.GET("/:id", c.GetAlert)
+			}
+			clusters := apiV1.Group("/clusters")
+			{
+				clusters.Use(auth.Authenticate)
+				clusters.GET("/:id/resources", c.ListResources)
+				clusters.GET("/:id/resources/:kind/*path", c.GetResource)
+				clusters.GET("/:id/snapshots", c.GetSnapshots)
+				clusters.GET("/:id/diff", c.GetDiff)
+				clusters.GET("/:id/aliases", c.ListClusterAliases)
+				clusters.PUT("/:id/aliases/:alias", c.AddClusterAlias)
+				clusters.DELETE("/:id/aliases/:alias", c.DeleteClusterAlias)
 			}
 		}
 
@@ -141,6 +288,8 @@ func startRestController() error {
 		portal := root.Group("/portal")
 		{
 			portal.GET("", auth.RedirectToLoginOnAuthFailure, c.PortalIndex)
+			portal.GET("/agents", auth.RedirectToLoginOnAuthFailure, c.PortalAgents)
+			portal.GET("/rules", auth.RedirectToLoginOnAuthFailure, c.PortalRules)
 			portal.GET("/login", c.PortalLogin)
 		}
 	}
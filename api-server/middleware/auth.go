@@ -26,6 +26,8 @@ import (
 	"collie-api-server/config"
 	"collie-api-server/httputil"
 	authSvc "collie-api-server/service/auth"
+	"collie-api-server/service/metrics"
+	"collie-api-server/util"
 )
 
 var loginUrl string = config.Require("oauth.hostUrl") + "/collie/portal/login"
@@ -35,12 +37,13 @@ func handleAuth(c *gin.Context) bool {
 	if token == "" {
 		t, err := c.Request.Cookie("auth")
 		if err != nil {
-			//log.Printf("auth failed. token=%s, err=%s", token, err.Error())
+			metrics.AuthFailed("")
 			return false
 		}
 		t2, err := url.QueryUnescape(t.Value)
 		if err != nil {
-			log.Printf("auth failed. token=%s, err=%s", t, err.Error())
+			log.Printf("auth failed. requestId=%s, token=%s, err=%s", GetRequestId(c), util.RedactToken(t.Value), err.Error())
+			metrics.AuthFailed("")
 			return false
 		}
 		token = t2
@@ -48,7 +51,8 @@ func handleAuth(c *gin.Context) bool {
 	authInfo, err := authSvc.Authenticate(token)
 
 	if err != nil {
-		log.Printf("auth failed. token=%s, err=%s", token, err.Error())
+		log.Printf("auth failed. requestId=%s, token=%s, err=%s", GetRequestId(c), util.RedactToken(token), err.Error())
+		metrics.AuthFailed(authSvc.Provider(token))
 		return false
 	}
 	c.Set("auth", authInfo)
@@ -0,0 +1,112 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	authSvc "collie-api-server/service/auth"
+	"collie-api-server/service/metrics"
+	"collie-api-server/service/tracing"
+	"collie-api-server/util"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+// requestIdPattern bounds the request ids accepted from the callers, such as an ingress
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var accessLog = &logrus.Logger{
+	Out:       os.Stdout,
+	Formatter: &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano},
+	Hooks:     make(logrus.LevelHooks),
+	Level:     logrus.InfoLevel,
+}
+
+// RequestId tags the request with the id given by the caller, or a new one, and returns it in the response.
+func RequestId(c *gin.Context) {
+	id := c.GetHeader(RequestIdHeader)
+	if !requestIdPattern.MatchString(id) {
+		id = util.RandomString(8)
+	}
+	c.Set("requestId", id)
+	c.Header(RequestIdHeader, id)
+	c.Next()
+}
+
+// GetRequestId returns the id of the request, empty outside of the RequestId middleware.
+func GetRequestId(c *gin.Context) string {
+	return c.GetString("requestId")
+}
+
+// AccessLog writes a JSON line per request, leaving out the credentials of the query.
+func AccessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	fields := logrus.Fields{
+		"requestId": GetRequestId(c),
+		"method":    c.Request.Method,
+		"path":      c.Request.URL.Path,
+		"route":     c.FullPath(),
+		"status":    c.Writer.Status(),
+		"latencyMs": time.Since(start).Milliseconds(),
+		"bytes":     c.Writer.Size(),
+		"clientIp":  c.ClientIP(),
+		"userAgent": c.Request.UserAgent(),
+	}
+	if traceId := tracing.TraceId(c); traceId != "" {
+		fields["traceId"] = traceId
+	}
+	if q := util.RedactQuery(c.Request.URL.RawQuery); q != "" {
+		fields["query"] = q
+	}
+	if v, ok := c.Get("auth"); ok {
+		if a, ok := v.(authSvc.AuthInfo); ok {
+			fields["orgId"] = a.OrgId()
+		}
+	}
+	if len(c.Errors) > 0 {
+		fields["error"] = c.Errors.String()
+	}
+
+	entry := accessLog.WithFields(fields)
+	switch {
+	case c.Writer.Status() >= 500:
+		entry.Error("request")
+	case c.Writer.Status() >= 400:
+		entry.Warn("request")
+	default:
+		entry.Info("request")
+	}
+}
+
+// Metrics records the count and the latency of the requests by route and status.
+func Metrics(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	metrics.RequestServed(c.Request.Method, route, c.Writer.Status(), time.Since(start))
+}
@@ -20,6 +20,8 @@ import (
 	"collie-api-server/config"
 	_ "embed"
 	b64 "encoding/base64"
+	"fmt"
+	"strings"
 	"text/template"
 )
 
@@ -31,6 +33,36 @@ type AgentYamlParams struct {
 	Provider string
 	Image    string
 	AgentId  string
+	// Benchmark is the kube-bench benchmark of the provider, empty when kube-bench picks it by version
+	Benchmark string
+}
+
+// Providers of agent.yaml
+const (
+	ProviderEKS   = "EKS"
+	ProviderGKE   = "GKE"
+	ProviderAKS   = "AKS"
+	ProviderOther = "Other"
+)
+
+// benchmarks are the kube-bench benchmarks of the managed providers, whose control plane is not scanned
+var benchmarks = map[string]string{
+	ProviderEKS: "eks-1.2.0",
+	ProviderGKE: "gke-1.2.0",
+	ProviderAKS: "aks-1.0",
+}
+
+// ParseProvider returns the provider of agent.yaml named case-insensitively, Other when it is empty.
+func ParseProvider(provider string) (string, error) {
+	if provider == "" {
+		return ProviderOther, nil
+	}
+	for _, p := range []string{ProviderEKS, ProviderGKE, ProviderAKS, ProviderOther} {
+		if strings.EqualFold(provider, p) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown provider %s, expected one of EKS, GKE, AKS or Other", provider)
 }
 
 var (
@@ -47,21 +79,38 @@ var (
 func GenerageAgentYaml(provider string, apiKey string, esKey string, agentId string) (string, error) {
 
 	cfg := config.Get()
-	t, err := template.New("agent.yaml").
-		Option("missingkey=error").
-		Parse(templateAgentYaml)
+	data := AgentYamlParams{
+		ApiUrl:    cfg.ApiURL,
+		ApiKey:    b64encode(apiKey), // secret, need encoding
+		EsUrl:     cfg.EsURL,
+		EsKey:     b64encode(esKey), // secret, need encoding
+		Provider:  provider,
+		Image:     cfg.AgentImage,
+		AgentId:   agentId,
+		Benchmark: benchmarks[provider],
+	}
+
+	text, err := renderYaml("agent.yaml", templateAgentYaml, data)
+	if err != nil {
+		return "", err
+	}
+	job, err := renderYaml("kube-bench-job.yaml", templateKubeBenchJob, data)
 	if err != nil {
 		return "", err
 	}
 
-	data := AgentYamlParams{
-		ApiUrl:   cfg.ApiURL,
-		ApiKey:   b64encode(apiKey), // secret, need encoding
-		EsUrl:    cfg.EsURL,
-		EsKey:    b64encode(esKey), // secret, need encoding
-		Provider: provider,
-		Image:    cfg.AgentImage,
-		AgentId:  agentId,
+	text = combineK8sYaml(text, job)
+	text = combineK8sYaml(text, templateKubeHunterJob)
+
+	return text, nil
+}
+
+func renderYaml(name string, text string, data AgentYamlParams) (string, error) {
+	t, err := template.New(name).
+		Option("missingkey=error").
+		Parse(text)
+	if err != nil {
+		return "", err
 	}
 
 	var buffer bytes.Buffer
@@ -69,12 +118,7 @@ func GenerageAgentYaml(provider string, apiKey string, esKey string, agentId str
 	if err != nil {
 		return "", err
 	}
-	text := buffer.String()
-
-	text = combineK8sYaml(text, templateKubeBenchJob)
-	text = combineK8sYaml(text, templateKubeHunterJob)
-
-	return text, nil
+	return buffer.String(), nil
 }
 
 func combineK8sYaml(src1 string, src2 string) string {
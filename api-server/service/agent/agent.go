@@ -0,0 +1,263 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"collie-api-server/config"
+	"collie-api-server/service/persist"
+)
+
+const (
+	StatusHealthy = "healthy"
+	StatusStale   = "stale"
+	StatusErrored = "errored"
+)
+
+// maxClusterIds caps the cluster ids remembered per agent.
+const maxClusterIds = 10
+
+// AgentInfo is the registry record of an agent, created on its first contact.
+type AgentInfo struct {
+	AgentId      string `json:"agentId" example:"4f9a1c2b3d4e5f60"`
+	OrgId        string `json:"orgId"`
+	ClusterId    string `json:"clusterId"`
+	Provider     string `json:"provider" example:"AKS"`
+	AgentVersion string `json:"agentVersion"`
+	K8sVersion   string `json:"k8sVersion" example:"1.25"`
+	// Distribution is k3s, openshift or tkg, empty for an upstream or managed Kubernetes
+	Distribution string `json:"distribution,omitempty" example:"k3s"`
+	Region       string `json:"region,omitempty" example:"eastus"`
+	// ConfigVersion is the version of the remote configuration the agent runs
+	ConfigVersion string    `json:"configVersion,omitempty"`
+	RegisteredAt  time.Time `json:"registeredAt"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+	LastError     string    `json:"lastError,omitempty"`
+	Status        string    `json:"status" example:"healthy"`
+	// StaleNotifiedAt is the time the agent was notified as stale, until it is heard from again
+	StaleNotifiedAt *time.Time `json:"staleNotifiedAt,omitempty"`
+	// ClusterIds are the cluster ids the agent reported, most recent last. Only they can be merged
+	// into its cluster as previous ids.
+	ClusterIds []string `json:"clusterIds,omitempty"`
+}
+
+// Reported tells whether the agent reported the cluster id in a heartbeat.
+func (info *AgentInfo) Reported(clusterId string) bool {
+	for _, id := range info.ClusterIds {
+		if id == clusterId {
+			return true
+		}
+	}
+	return false
+}
+
+// remember adds a cluster id to the ids reported by the agent, as the most recent one.
+func (info *AgentInfo) remember(clusterId string) {
+	if clusterId == "" {
+		return
+	}
+	ids := make([]string, 0, len(info.ClusterIds)+1)
+	for _, id := range info.ClusterIds {
+		if id != clusterId {
+			ids = append(ids, id)
+		}
+	}
+	ids = append(ids, clusterId)
+	if len(ids) > maxClusterIds {
+		ids = ids[len(ids)-maxClusterIds:]
+	}
+	info.ClusterIds = ids
+}
+
+// ErrInvalid is returned when a heartbeat is not valid
+var ErrInvalid = errors.New("Invalid heartbeat")
+
+// Heartbeat is posted by the agent on start-up and after each cycle.
+type Heartbeat struct {
+	AgentId      string `json:"agentId"`
+	ClusterId    string `json:"clusterId"`
+	Provider     string `json:"provider"`
+	AgentVersion string `json:"agentVersion"`
+	K8sVersion   string `json:"k8sVersion"`
+	// Distribution and Region are detected by the agent along with the provider
+	Distribution string `json:"distribution,omitempty"`
+	Region       string `json:"region,omitempty"`
+	// ConfigVersion is the version of the remote configuration the agent runs, empty before the first poll
+	ConfigVersion string `json:"configVersion"`
+	Error         string `json:"error"`
+	// PreviousClusterIds are the ids the cluster was known by before, merged into ClusterId when
+	// the agent reported them before
+	PreviousClusterIds []string `json:"previousClusterIds,omitempty"`
+}
+
+var (
+	agentColl persist.DurableStore
+	mu        sync.Mutex
+)
+
+func init() {
+	agentColl = persist.Durable("agent", func() interface{} { return &AgentInfo{} })
+}
+
+// RecordHeartbeat registers the agent on first contact and refreshes its details afterwards.
+func RecordHeartbeat(orgId string, hb Heartbeat) (*AgentInfo, error) {
+	if hb.AgentId == "" {
+		return nil, fmt.Errorf("%w: agentId is required", ErrInvalid)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now().UTC()
+	info := &AgentInfo{}
+	if v, err := agentColl.Get(orgId, hb.AgentId); err == nil {
+		*info = *v.(*AgentInfo)
+	} else if !errors.Is(err, persist.ErrNotFound) {
+		return nil, err
+	} else {
+		info.AgentId = hb.AgentId
+		info.OrgId = orgId
+		info.RegisteredAt = now
+	}
+
+	// agents registered before the ids were remembered reported their last cluster id
+	info.remember(info.ClusterId)
+	info.remember(hb.ClusterId)
+	info.ClusterId = hb.ClusterId
+	info.Provider = hb.Provider
+	info.AgentVersion = hb.AgentVersion
+	info.K8sVersion = hb.K8sVersion
+	info.Distribution = hb.Distribution
+	info.Region = hb.Region
+	info.ConfigVersion = hb.ConfigVersion
+	info.LastHeartbeat = now
+	info.LastError = hb.Error
+	info.StaleNotifiedAt = nil
+	if err := agentColl.Put(orgId, hb.AgentId, info); err != nil {
+		return nil, err
+	}
+
+	return withStatus(info), nil
+}
+
+func Get(orgId string, agentId string) (*AgentInfo, error) {
+	v, err := agentColl.Get(orgId, agentId)
+	if err != nil {
+		return nil, err
+	}
+	return withStatus(v.(*AgentInfo)), nil
+}
+
+// List returns the agents of the org, oldest registration first.
+func List(orgId string) ([]*AgentInfo, error) {
+	items, err := agentColl.List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*AgentInfo, 0, len(items))
+	for _, v := range items {
+		ret = append(ret, withStatus(v.(*AgentInfo)))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].RegisteredAt.Before(ret[j].RegisteredAt)
+	})
+	return ret, nil
+}
+
+func Delete(orgId string, agentId string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return agentColl.Delete(orgId, agentId)
+}
+
+// withStatus returns a copy of the record with the derived status filled in.
+// An agent which has not been heard of for longer than AGENT_STALE_AFTER is stale,
+// regardless of the outcome of its last cycle.
+func withStatus(info *AgentInfo) *AgentInfo {
+	ret := *info
+	if time.Since(ret.LastHeartbeat) > config.Get().AgentStaleAfter {
+		ret.Status = StatusStale
+	} else if ret.LastError != "" {
+		ret.Status = StatusErrored
+	} else {
+		ret.Status = StatusHealthy
+	}
+	return &ret
+}
+
+// WatchStale checks the agents of all orgs at every interval until the context is done,
+// and calls onStale once for each agent turning stale, including the agents which turned
+// stale while the server was down.
+func WatchStale(ctx context.Context, interval time.Duration, onStale func(*AgentInfo)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, info := range markStale() {
+			onStale(info)
+		}
+	}
+}
+
+// markStale records the agents turning stale as notified, and returns them.
+func markStale() []*AgentInfo {
+	mu.Lock()
+	defer mu.Unlock()
+	items, err := agentColl.List("")
+	if err != nil {
+		log.Printf("Error checking stale agents: %s", err)
+		return nil
+	}
+	ret := []*AgentInfo{}
+	now := time.Now().UTC()
+	for _, v := range items {
+		info := withStatus(v.(*AgentInfo))
+		if info.Status != StatusStale || info.StaleNotifiedAt != nil {
+			continue
+		}
+		info.StaleNotifiedAt = &now
+		if err := agentColl.Put(info.OrgId, info.AgentId, info); err != nil {
+			log.Printf("Error recording stale agent %s of org %s: %s", info.AgentId, info.OrgId, err)
+			continue
+		}
+		ret = append(ret, info)
+	}
+	return ret
+}
+
+// CountByStatus counts the agents of all orgs by derived status.
+func CountByStatus() (map[string]int, error) {
+	items, err := agentColl.List("")
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]int{}
+	for _, v := range items {
+		ret[withStatus(v.(*AgentInfo)).Status]++
+	}
+	return ret, nil
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agentconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"collie-api-server/service/celrule"
+	"collie-api-server/service/persist"
+	"collie-api-server/service/rulepack"
+)
+
+// Scanners are the phases of the agent cycle which can be turned off. The cluster phase always runs.
+var Scanners = []string{"resources", "kube-bench", "kube-hunter", "rules"}
+
+var logLevels = map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
+
+// NamespaceFilter selects the namespaces scanned by the agents. A pattern is a namespace name,
+// or a prefix of names ending with "*". An empty include list selects all namespaces.
+type NamespaceFilter struct {
+	Include []string `json:"include" example:"team-*"`
+	Exclude []string `json:"exclude" example:"kube-system"`
+}
+
+// Redaction tells what the agents strip from the resources before reporting them.
+// The rules are still evaluated on the complete resources.
+type Redaction struct {
+	// EnvValues redacts the values of the environment variables of containers
+	EnvValues bool `json:"envValues"`
+	// Annotations are the annotation keys whose values are redacted, or prefixes of keys ending with "*"
+	Annotations []string `json:"annotations" example:"kubectl.kubernetes.io/last-applied-configuration"`
+}
+
+// Settings are the agent settings of an org, edited from the portal.
+type Settings struct {
+	ScanInterval string          `json:"scanInterval" example:"12h"`
+	Scanners     []string        `json:"scanners" example:"resources,kube-bench,kube-hunter,rules"`
+	Namespaces   NamespaceFilter `json:"namespaces"`
+	Redaction    Redaction       `json:"redaction"`
+	LogLevel     string          `json:"logLevel" example:"info"`
+}
+
+// OrgSettings are the settings of an org, with the version of the agent configuration they result in.
+type OrgSettings struct {
+	Settings
+	// Version is the version of the configuration currently delivered to the agents
+	Version   string     `json:"version"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	UpdatedBy string     `json:"updatedBy,omitempty"`
+}
+
+// AgentConfig is the configuration polled by the agents: the settings of the org, with its
+// enabled rule packs and custom rules. Version is a digest of the content, and changes with it.
+type AgentConfig struct {
+	Version string `json:"version" example:"3f9a1c2b3d4e5f60"`
+	Settings
+	RulePacks   []*rulepack.RulePack `json:"rulePacks"`
+	CustomRules []*celrule.Rule      `json:"customRules"`
+	// RulesRevision increases on every change of the rule packs or custom rules of the org. The agents
+	// keep the rules they run when it is lower than theirs, as the server lost the rules.
+	RulesRevision int64 `json:"rulesRevision" example:"12"`
+}
+
+// ErrInvalid is returned when the settings are not valid
+var ErrInvalid = errors.New("Invalid agent settings")
+
+var (
+	settingsColl persist.DurableStore
+	mu           sync.Mutex
+)
+
+// settingsId is the id of the settings in the collection, which holds one item per org
+const settingsId = "settings"
+
+func init() {
+	settingsColl = persist.Durable("agentconfig", func() interface{} { return &OrgSettings{} })
+}
+
+// Defaults are the settings of an org which has not changed them, matching the behavior of the agent without remote config.
+func Defaults() Settings {
+	return Settings{
+		ScanInterval: "12h",
+		Scanners:     append([]string{}, Scanners...),
+		Namespaces:   NamespaceFilter{Include: []string{}, Exclude: []string{}},
+		Redaction:    Redaction{Annotations: []string{}},
+		LogLevel:     "info",
+	}
+}
+
+func validPattern(p string) error {
+	if p == "" {
+		return errors.New("empty pattern")
+	}
+	if i := strings.Index(p, "*"); i >= 0 && i != len(p)-1 {
+		return fmt.Errorf("%s: only a trailing * is accepted", p)
+	}
+	return nil
+}
+
+func (s *Settings) validate() error {
+	d, err := time.ParseDuration(s.ScanInterval)
+	if err != nil {
+		return fmt.Errorf("invalid scanInterval: %w", err)
+	}
+	if d < 5*time.Minute {
+		return errors.New("scanInterval must be at least 5m")
+	}
+	known := map[string]bool{}
+	for _, name := range Scanners {
+		known[name] = true
+	}
+	for _, name := range s.Scanners {
+		if !known[name] {
+			return fmt.Errorf("unknown scanner %s, expected one of %s", name, strings.Join(Scanners, ", "))
+		}
+	}
+	for _, p := range append(append([]string{}, s.Namespaces.Include...), s.Namespaces.Exclude...) {
+		if err := validPattern(p); err != nil {
+			return fmt.Errorf("invalid namespace pattern %w", err)
+		}
+	}
+	for _, p := range s.Redaction.Annotations {
+		if err := validPattern(p); err != nil {
+			return fmt.Errorf("invalid annotation pattern %w", err)
+		}
+	}
+	s.LogLevel = strings.ToLower(s.LogLevel)
+	if !logLevels[s.LogLevel] {
+		return fmt.Errorf("unknown logLevel %s", s.LogLevel)
+	}
+	return nil
+}
+
+func getSettings(orgId string) (*OrgSettings, error) {
+	items, err := settingsColl.List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return &OrgSettings{Settings: Defaults()}, nil
+	}
+	ret := *items[0].(*OrgSettings)
+	return &ret, nil
+}
+
+// GetSettings returns the settings of the org, the defaults when they have not been changed.
+func GetSettings(orgId string) (*OrgSettings, error) {
+	c, err := Get(orgId)
+	if err != nil {
+		return nil, err
+	}
+	s, err := getSettings(orgId)
+	if err != nil {
+		return nil, err
+	}
+	s.Version = c.Version
+	return s, nil
+}
+
+func UpdateSettings(orgId string, user string, s *Settings) (*OrgSettings, error) {
+	if s.Scanners == nil {
+		s.Scanners = []string{}
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	mu.Lock()
+	now := time.Now().UTC()
+	err := settingsColl.Put(orgId, settingsId, &OrgSettings{Settings: *s, UpdatedAt: &now, UpdatedBy: user})
+	mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return GetSettings(orgId)
+}
+
+// Get returns the configuration of the agents of the org.
+func Get(orgId string) (*AgentConfig, error) {
+	packs, err := rulepack.Enabled(orgId)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := celrule.Enabled(orgId)
+	if err != nil {
+		return nil, err
+	}
+	packRevision, err := rulepack.Revision(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ruleRevision, err := celrule.Revision(orgId)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := getSettings(orgId)
+	if err != nil {
+		return nil, err
+	}
+	c := &AgentConfig{
+		Settings:      settings.Settings,
+		RulePacks:     packs,
+		CustomRules:   rules,
+		RulesRevision: packRevision + ruleRevision,
+	}
+	b, _ := json.Marshal(c)
+	sum := sha256.Sum256(b)
+	c.Version = hex.EncodeToString(sum[:8])
+	return c, nil
+}
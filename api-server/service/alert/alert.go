@@ -0,0 +1,414 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"collie-api-server/service/es"
+	"collie-api-server/service/notify"
+	"collie-api-server/service/persist"
+	"collie-api-server/util"
+)
+
+const (
+	// ConditionCount fires when more findings than the threshold match the query
+	ConditionCount = "count"
+	// ConditionNew fires when more findings than the threshold match the query and were not failing in the previous scan
+	ConditionNew = "new"
+	// ConditionScoreDelta fires when the score of the cluster dropped by more than the threshold since the previous scan
+	ConditionScoreDelta = "score_delta"
+)
+
+// maxAlertFindings caps the findings kept with a fired alert.
+const maxAlertFindings = 20
+
+// maxHistory caps the fired alerts kept per org.
+const maxHistory = 1000
+
+// Query selects the findings a rule looks at. Empty filters match anything. Statuses default to FAIL and WARN.
+type Query struct {
+	ClusterIds []string `json:"clusterIds,omitempty"`
+	Plugins    []string `json:"plugins,omitempty" example:"kube-bench"`
+	RuleIds    []string `json:"ruleIds,omitempty"`
+	Severities []string `json:"severities,omitempty" example:"critical,high"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Statuses   []string `json:"statuses,omitempty"`
+}
+
+type Condition struct {
+	Type      string  `json:"type" binding:"required" enums:"count,new,score_delta" example:"count"`
+	Threshold float64 `json:"threshold" example:"0"`
+}
+
+// Rule is evaluated for each cluster after each completed scan, and notifies its channels when the condition holds.
+type Rule struct {
+	Id          string     `json:"id" example:"5a7c9e1b"`
+	OrgId       string     `json:"orgId"`
+	Name        string     `json:"name" example:"Critical findings in production"`
+	Query       Query      `json:"query"`
+	Condition   Condition  `json:"condition"`
+	ChannelIds  []string   `json:"channelIds"`
+	Enabled     bool       `json:"enabled"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CreatedBy   string     `json:"createdBy"`
+	LastFiredAt *time.Time `json:"lastFiredAt,omitempty"`
+}
+
+type RuleRequest struct {
+	Name       string    `json:"name" binding:"required"`
+	Query      Query     `json:"query"`
+	Condition  Condition `json:"condition" binding:"required"`
+	ChannelIds []string  `json:"channelIds"`
+	Enabled    *bool     `json:"enabled"`
+}
+
+// Alert is the record of a rule firing.
+type Alert struct {
+	Id        string        `json:"id" example:"b2d4f6a8"`
+	OrgId     string        `json:"orgId"`
+	RuleId    string        `json:"ruleId"`
+	RuleName  string        `json:"ruleName"`
+	ClusterId string        `json:"clusterId"`
+	ScanId    string        `json:"scanId"`
+	FiredAt   time.Time     `json:"firedAt"`
+	Condition Condition     `json:"condition"`
+	Value     float64       `json:"value"`
+	Message   string        `json:"message"`
+	Findings  []*es.Finding `json:"findings"`
+	Channels  []string      `json:"channels"`
+}
+
+// Scan is what a rule is evaluated on: the scan which just completed and its posture.
+type Scan struct {
+	ClusterId string
+	ScanId    string
+	// PreviousScanId is the snapshot preceding the scan, empty for the first scan of a cluster
+	PreviousScanId string
+	Posture        *es.Posture
+}
+
+// ErrInvalid is returned when a request does not make a valid rule
+var ErrInvalid = errors.New("Invalid alert rule")
+
+var (
+	ruleColl  persist.DurableStore
+	alertColl persist.DurableStore
+	mu        sync.Mutex
+)
+
+func init() {
+	ruleColl = persist.Durable("alert-rule", func() interface{} { return &Rule{} })
+	alertColl = persist.Durable("alert", func() interface{} { return &Alert{} })
+}
+
+func (r *RuleRequest) toRule(orgId string, rule *Rule) error {
+	switch r.Condition.Type {
+	case ConditionCount, ConditionNew, ConditionScoreDelta:
+	default:
+		return fmt.Errorf("%w: unknown condition %s", ErrInvalid, r.Condition.Type)
+	}
+	if r.Condition.Threshold < 0 {
+		return fmt.Errorf("%w: threshold must not be negative", ErrInvalid)
+	}
+	for _, id := range r.ChannelIds {
+		if _, err := notify.GetChannel(orgId, id); err != nil {
+			return fmt.Errorf("%w: unknown channel %s", ErrInvalid, id)
+		}
+	}
+	rule.Name = r.Name
+	rule.Query = r.Query
+	rule.Condition = r.Condition
+	rule.ChannelIds = r.ChannelIds
+	if rule.ChannelIds == nil {
+		rule.ChannelIds = []string{}
+	}
+	rule.Enabled = r.Enabled == nil || *r.Enabled
+	return nil
+}
+
+func CreateRule(orgId string, user string, r *RuleRequest) (*Rule, error) {
+	rule := &Rule{
+		Id:        util.RandomString(8),
+		OrgId:     orgId,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: user,
+	}
+	if err := r.toRule(orgId, rule); err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if err := ruleColl.Put(orgId, rule.Id, rule); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func UpdateRule(orgId string, ruleId string, r *RuleRequest) (*Rule, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	v, err := ruleColl.Get(orgId, ruleId)
+	if err != nil {
+		return nil, err
+	}
+	rule := *v.(*Rule)
+	if err := r.toRule(orgId, &rule); err != nil {
+		return nil, err
+	}
+	if err := ruleColl.Put(orgId, ruleId, &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func GetRule(orgId string, ruleId string) (*Rule, error) {
+	v, err := ruleColl.Get(orgId, ruleId)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Rule), nil
+}
+
+// ListRules returns the rules of the org, oldest first.
+func ListRules(orgId string) ([]*Rule, error) {
+	items, err := ruleColl.List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Rule, 0, len(items))
+	for _, v := range items {
+		ret = append(ret, v.(*Rule))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].CreatedAt.Before(ret[j].CreatedAt)
+	})
+	return ret, nil
+}
+
+func DeleteRule(orgId string, ruleId string) error {
+	return ruleColl.Delete(orgId, ruleId)
+}
+
+// History returns the alerts fired in the org, most recent first, optionally only those of a rule.
+func History(orgId string, ruleId string) ([]*Alert, error) {
+	items, err := alertColl.List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*Alert{}
+	for _, v := range items {
+		if a := v.(*Alert); ruleId == "" || a.RuleId == ruleId {
+			ret = append(ret, a)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].FiredAt.After(ret[j].FiredAt)
+	})
+	return ret, nil
+}
+
+func GetAlert(orgId string, alertId string) (*Alert, error) {
+	v, err := alertColl.Get(orgId, alertId)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Alert), nil
+}
+
+func (q *Query) appliesTo(clusterId string) bool {
+	return len(q.ClusterIds) == 0 || containsFold(q.ClusterIds, clusterId)
+}
+
+func (q *Query) statuses() []string {
+	if len(q.Statuses) == 0 {
+		return []string{"FAIL", "WARN"}
+	}
+	return q.Statuses
+}
+
+func (q *Query) findingQuery(clusterId string, scanId string) *es.FindingQuery {
+	return &es.FindingQuery{
+		ClusterIds: []string{clusterId},
+		Plugins:    q.Plugins,
+		RuleIds:    q.RuleIds,
+		Severities: q.Severities,
+		Namespaces: q.Namespaces,
+		Statuses:   q.statuses(),
+		Snapshots:  []string{scanId},
+	}
+}
+
+func (q *Query) matches(f *es.Finding) bool {
+	match := func(values []string, v string) bool {
+		return len(values) == 0 || containsFold(values, v)
+	}
+	return match(q.Plugins, f.Plugin) && match(q.RuleIds, f.RuleId) && match(q.Severities, f.Severity) &&
+		match(q.Namespaces, f.Namespace) && match(q.statuses(), f.Status)
+}
+
+// evaluate returns the value the condition is checked against, and the findings behind it.
+func (r *Rule) evaluate(orgId string, s *Scan) (float64, []*es.Finding, error) {
+	switch r.Condition.Type {
+	case ConditionCount:
+		q := r.Query.findingQuery(s.ClusterId, s.ScanId)
+		q.Size = maxAlertFindings
+		count, findings, err := es.CountFindings(orgId, q)
+		if err != nil {
+			return 0, nil, err
+		}
+		return float64(count), findings, nil
+	case ConditionNew:
+		if s.PreviousScanId == "" {
+			return 0, nil, nil
+		}
+		newlyFailing, err := es.NewlyFailing(orgId, s.ClusterId, s.PreviousScanId, s.ScanId)
+		if err != nil {
+			return 0, nil, err
+		}
+		findings := []*es.Finding{}
+		for _, f := range newlyFailing {
+			if r.Query.matches(f) {
+				findings = append(findings, f)
+			}
+		}
+		return float64(len(findings)), findings, nil
+	case ConditionScoreDelta:
+		prev, err := es.PreviousPosture(orgId, s.ClusterId, s.ScanId)
+		if err != nil || prev == nil || s.Posture == nil {
+			return 0, nil, err
+		}
+		return prev.Score - s.Posture.Score, nil, nil
+	}
+	return 0, nil, fmt.Errorf("Unknown condition: %s", r.Condition.Type)
+}
+
+func (r *Rule) describe(value float64) string {
+	switch r.Condition.Type {
+	case ConditionCount:
+		return fmt.Sprintf("%d finding(s) match, more than %g", int(value), r.Condition.Threshold)
+	case ConditionNew:
+		return fmt.Sprintf("%d new finding(s) since the previous scan, more than %g", int(value), r.Condition.Threshold)
+	}
+	return fmt.Sprintf("Score dropped by %.2f points since the previous scan, more than %g", value, r.Condition.Threshold)
+}
+
+// Evaluate checks the enabled rules of the org against a completed scan, records the alerts
+// of the rules whose condition holds, and notifies their channels.
+func Evaluate(orgId string, s *Scan) []*Alert {
+	fired := []*Alert{}
+	rules, err := ListRules(orgId)
+	if err != nil {
+		log.Printf("Error listing the alert rules of org %s: %s", orgId, err)
+		return fired
+	}
+	for _, r := range rules {
+		if !r.Enabled || !r.Query.appliesTo(s.ClusterId) {
+			continue
+		}
+		value, findings, err := r.evaluate(orgId, s)
+		if err != nil {
+			log.Printf("Error evaluating alert rule %s of org %s: %s", r.Id, orgId, err)
+			continue
+		}
+		if value <= r.Condition.Threshold {
+			continue
+		}
+
+		now := time.Now().UTC()
+		if len(findings) > maxAlertFindings {
+			findings = findings[:maxAlertFindings]
+		}
+		if findings == nil {
+			findings = []*es.Finding{}
+		}
+		a := &Alert{
+			Id:        util.RandomString(8),
+			OrgId:     orgId,
+			RuleId:    r.Id,
+			RuleName:  r.Name,
+			ClusterId: s.ClusterId,
+			ScanId:    s.ScanId,
+			FiredAt:   now,
+			Condition: r.Condition,
+			Value:     value,
+			Message:   r.describe(value),
+			Findings:  findings,
+			Channels:  r.ChannelIds,
+		}
+		if err := record(a, r); err != nil {
+			log.Printf("Error recording alert of rule %s of org %s: %s", r.Id, orgId, err)
+		}
+		fired = append(fired, a)
+		log.Printf("Alert fired: rule=%s, cluster=%s, scan=%s, %s", r.Id, s.ClusterId, s.ScanId, a.Message)
+
+		notify.PublishTo(orgId, r.ChannelIds, &notify.Event{
+			Type:      notify.EventAlert,
+			OrgId:     orgId,
+			ClusterId: s.ClusterId,
+			Title:     "Alert: " + r.Name,
+			Message:   a.Message,
+			Time:      now,
+			Key:       strings.Join([]string{notify.EventAlert, r.Id, s.ClusterId, s.ScanId}, "|"),
+			Score:     value,
+			Data:      map[string]string{"alertId": a.Id, "ruleId": r.Id, "scanId": s.ScanId},
+		})
+	}
+	return fired
+}
+
+// record keeps a fired alert, dropping the oldest alerts of the org past maxHistory.
+func record(a *Alert, r *Rule) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := alertColl.Put(a.OrgId, a.Id, a); err != nil {
+		return err
+	}
+	if v, err := ruleColl.Get(r.OrgId, r.Id); err == nil {
+		rule := *v.(*Rule)
+		rule.LastFiredAt = &a.FiredAt
+		if err := ruleColl.Put(r.OrgId, r.Id, &rule); err != nil {
+			return err
+		}
+	}
+	history, err := History(a.OrgId, "")
+	if err != nil {
+		return err
+	}
+	if len(history) > maxHistory {
+		for _, old := range history[maxHistory:] {
+			if err := alertColl.Delete(old.OrgId, old.Id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func containsFold(list []string, v string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, v) {
+			return true
+		}
+	}
+	return false
+}
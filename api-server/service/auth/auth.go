@@ -46,20 +46,27 @@ func generateRandToken(length int) string {
 	return hex.EncodeToString(b)
 }
 
-func Authenticate(token string) (AuthInfo, error) {
+// parseToken splits a token into its auth provider and the credential checked by the provider.
+// Tokens without provider are API keys.
+func parseToken(token string) (provider string, code string) {
 	token = strings.TrimPrefix(token, "Bearer ")
 	token = strings.TrimPrefix(token, "Token ")
 
 	parts := strings.Split(token, "/")
-	var provider string
-	var code string
 	if len(parts) == 1 {
-		provider = "api"
-		code = parts[0]
-	} else {
-		provider = parts[0]
-		code = parts[1]
+		return "api", parts[0]
 	}
+	return parts[0], parts[1]
+}
+
+// Provider returns the auth provider of a token, such as api, csp, gitlab or google.
+func Provider(token string) string {
+	provider, _ := parseToken(token)
+	return provider
+}
+
+func Authenticate(token string) (AuthInfo, error) {
+	provider, code := parseToken(token)
 
 	if provider == "api" {
 		return validateApiToken(code)
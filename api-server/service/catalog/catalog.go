@@ -0,0 +1,207 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package catalog
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The catalog is versioned with the code. Its version is reported along with anything derived from it,
+// so that a posture or a report can be traced back to the mappings it was computed with.
+
+//go:embed catalog.yaml
+var catalogYaml []byte
+
+// ruleControl stands for the rule id itself in a mapping, for plugins which implement a framework.
+const ruleControl = "{rule}"
+
+type Control struct {
+	Id    string `json:"id" yaml:"id" example:"AC-6"`
+	Title string `json:"title" yaml:"title" example:"Least Privilege"`
+}
+
+type Framework struct {
+	Id       string     `json:"id" yaml:"id" example:"nist-800-53"`
+	Name     string     `json:"name" yaml:"name" example:"NIST SP 800-53"`
+	Version  string     `json:"version" yaml:"version" example:"Rev. 5"`
+	Controls []*Control `json:"controls" yaml:"controls"`
+}
+
+// Mapping maps the rules of a plugin matching Rule, a rule id or a prefix ending with "*",
+// to controls, keyed by framework id.
+type Mapping struct {
+	Plugin   string              `json:"plugin" yaml:"plugin" example:"kube-bench"`
+	Rule     string              `json:"rule" yaml:"rule" example:"5.1.*"`
+	Controls map[string][]string `json:"controls" yaml:"controls"`
+}
+
+type Catalog struct {
+	Version    string       `json:"version" yaml:"version" example:"2023.10.1"`
+	Frameworks []*Framework `json:"frameworks" yaml:"frameworks"`
+	Mappings   []*Mapping   `json:"mappings" yaml:"mappings"`
+}
+
+// RuleSelector selects the findings of a plugin whose rule id equals RuleId, or starts with it when Prefix is set.
+// An empty prefix selects all the rules of the plugin.
+type RuleSelector struct {
+	Plugin string
+	RuleId string
+	Prefix bool
+}
+
+var catalog *Catalog
+
+func init() {
+	c, err := parse(catalogYaml)
+	if err != nil {
+		log.Fatalf("Invalid control catalog: %s", err)
+	}
+	catalog = c
+}
+
+func parse(b []byte) (*Catalog, error) {
+	var c Catalog
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	frameworks := map[string]*Framework{}
+	for _, f := range c.Frameworks {
+		frameworks[f.Id] = f
+	}
+	for _, m := range c.Mappings {
+		if m.Plugin == "" || m.Rule == "" {
+			return nil, fmt.Errorf("mapping without plugin or rule: %+v", m)
+		}
+		for fw, ids := range m.Controls {
+			f, ok := frameworks[fw]
+			if !ok {
+				return nil, fmt.Errorf("mapping of %s %s: unknown framework %s", m.Plugin, m.Rule, fw)
+			}
+			for _, id := range ids {
+				if id != ruleControl && f.control(id) == nil {
+					return nil, fmt.Errorf("mapping of %s %s: unknown control %s %s", m.Plugin, m.Rule, fw, id)
+				}
+			}
+		}
+	}
+	return &c, nil
+}
+
+func (f *Framework) control(id string) *Control {
+	for _, c := range f.Controls {
+		if strings.EqualFold(c.Id, id) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (m *Mapping) matches(plugin string, ruleId string) bool {
+	if !strings.EqualFold(m.Plugin, plugin) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(m.Rule, "*"); ok {
+		return strings.HasPrefix(ruleId, prefix)
+	}
+	return m.Rule == ruleId
+}
+
+func (m *Mapping) selector() RuleSelector {
+	prefix, ok := strings.CutSuffix(m.Rule, "*")
+	return RuleSelector{Plugin: m.Plugin, RuleId: prefix, Prefix: ok}
+}
+
+// Get returns the catalog.
+func Get() *Catalog {
+	return catalog
+}
+
+func Version() string {
+	return catalog.Version
+}
+
+func GetFramework(id string) (*Framework, error) {
+	for _, f := range catalog.Frameworks {
+		if strings.EqualFold(f.Id, id) {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown framework: %s", id)
+}
+
+// ControlsOf returns the controls a rule maps to, keyed by framework id. All the matching mappings apply.
+func ControlsOf(plugin string, ruleId string) map[string][]string {
+	ret := map[string][]string{}
+	for _, m := range catalog.Mappings {
+		if !m.matches(plugin, ruleId) {
+			continue
+		}
+		for fw, ids := range m.Controls {
+			for _, id := range ids {
+				if id == ruleControl {
+					id = ruleId
+				}
+				ret[fw] = appendUnique(ret[fw], id)
+			}
+		}
+	}
+	for _, ids := range ret {
+		sort.Strings(ids)
+	}
+	return ret
+}
+
+// Resolve returns the control of a framework and the rules mapping to it. A control stands for itself
+// in the frameworks implemented by a plugin, so that "cis-k8s 5.1.3" resolves to the kube-bench rule 5.1.3.
+func Resolve(framework string, controlId string) (*Framework, *Control, []RuleSelector, error) {
+	f, err := GetFramework(framework)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	control := f.control(controlId)
+	selectors := []RuleSelector{}
+	for _, m := range catalog.Mappings {
+		for _, id := range m.Controls[f.Id] {
+			if id == ruleControl && m.matches(m.Plugin, controlId) {
+				if control == nil {
+					control = &Control{Id: controlId}
+				}
+				selectors = append(selectors, RuleSelector{Plugin: m.Plugin, RuleId: controlId})
+			} else if control != nil && strings.EqualFold(id, control.Id) {
+				selectors = append(selectors, m.selector())
+			}
+		}
+	}
+	if control == nil {
+		return nil, nil, nil, fmt.Errorf("Unknown control of %s: %s", f.Id, controlId)
+	}
+	return f, control, selectors, nil
+}
+
+func appendUnique(list []string, v string) []string {
+	for _, item := range list {
+		if item == v {
+			return list
+		}
+	}
+	return append(list, v)
+}
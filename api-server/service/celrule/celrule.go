@@ -0,0 +1,291 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package celrule
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+
+	"collie-api-server/service/persist"
+	"collie-api-server/util"
+)
+
+// Kinds are the resource kinds discovered by the agent, which rules can match.
+var Kinds = []string{
+	"cronjobs", "csidrivers", "csinodes", "csistoragecapacities", "daemonsets", "deployments", "events",
+	"horizontalpodautoscalers", "jobs", "leases", "nodes", "persistentvolumeclaims", "persistentvolumes",
+	"pods", "replicasets", "replicationcontrollers", "services", "statefulsets", "storageclasses",
+}
+
+var (
+	ruleIdPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	severities    = map[string]bool{"INFO": true, "LOW": true, "MEDIUM": true, "HIGH": true, "CRITICAL": true}
+)
+
+// Rule is a one-line CEL check evaluated by the agents on the resources of the matching kinds.
+// The expression sees the resource as object, and must hold: a resource for which it evaluates
+// to false is reported as a failing finding of the collie plugin.
+type Rule struct {
+	Id          string    `json:"id" example:"7d3f9a1c"`
+	OrgId       string    `json:"orgId"`
+	RuleId      string    `json:"ruleId" example:"require-limits"`
+	Title       string    `json:"title" example:"Containers must have resource limits"`
+	Kinds       []string  `json:"kinds" example:"deployments"`
+	Expression  string    `json:"expression" example:"object.spec.template.spec.containers.all(c, has(c.resources.limits))"`
+	Severity    string    `json:"severity" example:"MEDIUM"`
+	Category    string    `json:"category"`
+	Remediation string    `json:"remediation"`
+	Enabled     bool      `json:"enabled"`
+	Version     int       `json:"version"`
+	CreatedAt   time.Time `json:"createdAt"`
+	CreatedBy   string    `json:"createdBy"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Request creates or replaces a rule.
+type Request struct {
+	RuleId      string   `json:"ruleId" binding:"required"`
+	Title       string   `json:"title" binding:"required"`
+	Kinds       []string `json:"kinds" binding:"required"`
+	Expression  string   `json:"expression" binding:"required"`
+	Severity    string   `json:"severity"`
+	Category    string   `json:"category"`
+	Remediation string   `json:"remediation"`
+	Enabled     *bool    `json:"enabled"`
+}
+
+// MaxCost bounds the estimated cost of an expression, with the lists, maps and strings of the
+// object counted at maxObjectSize. It lets rules nest two comprehensions but not three, and
+// matches the cost limit of the agents.
+const MaxCost = 10000000
+
+const maxObjectSize = 1000
+
+// costEstimator sizes the values of the object, which the checker knows nothing about.
+type costEstimator struct{}
+
+func (costEstimator) EstimateSize(element checker.AstNode) *checker.SizeEstimate {
+	return &checker.SizeEstimate{Min: 0, Max: maxObjectSize}
+}
+
+func (costEstimator) EstimateCallCost(function, overloadId string, target *checker.AstNode, args []checker.AstNode) *checker.CallEstimate {
+	return nil
+}
+
+// ErrInvalid is returned when a request does not make a valid rule
+var ErrInvalid = errors.New("Invalid custom rule")
+
+var (
+	ruleColl persist.DurableStore
+	// revision counts the changes of the rules of each org, so that agents tell a server which lost them
+	revision *persist.Counter
+	mu       sync.Mutex
+	env      *cel.Env
+)
+
+func init() {
+	ruleColl = persist.Durable("celrule", func() interface{} { return &Rule{} })
+	revision = persist.NewCounter("celrule-revision")
+	var err error
+	env, err = cel.NewEnv(cel.Variable("object", cel.DynType))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Compile checks that the expression compiles, evaluates to a bool and is not estimated to cost
+// more than MaxCost.
+func Compile(expression string) error {
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return issues.Err()
+	}
+	if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+		return fmt.Errorf("expression must evaluate to a bool, not %s", t)
+	}
+	cost, err := env.EstimateCost(ast, costEstimator{})
+	if err != nil {
+		return err
+	}
+	if cost.Max > MaxCost {
+		return fmt.Errorf("expression is too expensive, its estimated cost %d exceeds %d", cost.Max, MaxCost)
+	}
+	return nil
+}
+
+func (r *Request) validate() error {
+	if !ruleIdPattern.MatchString(r.RuleId) {
+		return errors.New("ruleId must be lowercase alphanumerics and dashes")
+	}
+	if len(r.Kinds) == 0 {
+		return errors.New("at least one kind is required")
+	}
+	for _, k := range r.Kinds {
+		if i := sort.SearchStrings(Kinds, k); i == len(Kinds) || Kinds[i] != k {
+			return fmt.Errorf("unknown kind %s, expected one of %s", k, strings.Join(Kinds, ", "))
+		}
+	}
+	r.Severity = strings.ToUpper(r.Severity)
+	if r.Severity == "" {
+		r.Severity = "MEDIUM"
+	} else if !severities[r.Severity] {
+		return fmt.Errorf("unknown severity %s", r.Severity)
+	}
+	return Compile(r.Expression)
+}
+
+func (rule *Rule) apply(r *Request) {
+	rule.RuleId = r.RuleId
+	rule.Title = r.Title
+	rule.Kinds = r.Kinds
+	rule.Expression = r.Expression
+	rule.Severity = r.Severity
+	rule.Category = r.Category
+	rule.Remediation = r.Remediation
+	rule.Enabled = r.Enabled == nil || *r.Enabled
+}
+
+// checkUnique fails when another rule of the org has the same rule id.
+func checkUnique(orgId string, id string, ruleId string) error {
+	rules, err := List(orgId)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Id != id && rule.RuleId == ruleId {
+			return fmt.Errorf("%w: rule %s already exists", ErrInvalid, ruleId)
+		}
+	}
+	return nil
+}
+
+func Create(orgId string, user string, r *Request) (*Rule, error) {
+	if err := r.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+	now := time.Now().UTC()
+	rule := &Rule{
+		Id:        util.RandomString(8),
+		OrgId:     orgId,
+		Version:   1,
+		CreatedAt: now,
+		CreatedBy: user,
+		UpdatedAt: now,
+	}
+	rule.apply(r)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err := checkUnique(orgId, rule.Id, rule.RuleId); err != nil {
+		return nil, err
+	}
+	if err := ruleColl.Put(orgId, rule.Id, rule); err != nil {
+		return nil, err
+	}
+	if _, err := revision.Incr(orgId); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func Update(orgId string, id string, r *Request) (*Rule, error) {
+	if err := r.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	v, err := ruleColl.Get(orgId, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUnique(orgId, id, r.RuleId); err != nil {
+		return nil, err
+	}
+	rule := *v.(*Rule)
+	rule.apply(r)
+	rule.Version++
+	rule.UpdatedAt = time.Now().UTC()
+	if err := ruleColl.Put(orgId, id, &rule); err != nil {
+		return nil, err
+	}
+	if _, err := revision.Incr(orgId); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func Get(orgId string, id string) (*Rule, error) {
+	v, err := ruleColl.Get(orgId, id)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Rule), nil
+}
+
+// List returns the rules of the org, by rule id.
+func List(orgId string) ([]*Rule, error) {
+	items, err := ruleColl.List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Rule, 0, len(items))
+	for _, v := range items {
+		ret = append(ret, v.(*Rule))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].RuleId < ret[j].RuleId
+	})
+	return ret, nil
+}
+
+// Enabled returns the rules of the org to be evaluated by its agents.
+func Enabled(orgId string) ([]*Rule, error) {
+	rules, err := List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*Rule{}
+	for _, rule := range rules {
+		if rule.Enabled {
+			ret = append(ret, rule)
+		}
+	}
+	return ret, nil
+}
+
+// Revision returns the number of changes of the rules of the org.
+func Revision(orgId string) (int64, error) {
+	return revision.Get(orgId)
+}
+
+func Delete(orgId string, id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := ruleColl.Delete(orgId, id); err != nil {
+		return err
+	}
+	_, err := revision.Incr(orgId)
+	return err
+}
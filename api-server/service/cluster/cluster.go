@@ -0,0 +1,220 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"collie-api-server/service/es"
+	"collie-api-server/service/persist"
+	"collie-api-server/service/scan"
+	"collie-api-server/service/waiver"
+)
+
+// Alias is an id a cluster was known by before, such as the id reported by agents before the cluster
+// identity was the kube-system namespace. The history of the alias is merged into the cluster, and
+// lookups by the alias resolve to the cluster.
+type Alias struct {
+	Alias     string    `json:"alias" example:"4c4c4544-0047-3910-8052-b4c04f4b4d32"`
+	OrgId     string    `json:"orgId"`
+	ClusterId string    `json:"clusterId" example:"6f0d2b8a-3a57-4c1e-9a3e-6d1f2c0e9b71"`
+	CreatedAt time.Time `json:"createdAt"`
+	// MergedAt is the time the history of the alias was last merged into the cluster
+	MergedAt *time.Time `json:"mergedAt,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	// Failures counts the merges which failed in a row, the last one at FailedAt
+	Failures int        `json:"failures,omitempty"`
+	FailedAt *time.Time `json:"failedAt,omitempty"`
+}
+
+// a failed merge is tried again in the background after mergeBackoff, doubled on each failure up to maxMergeBackoff
+const (
+	mergeBackoff    = time.Minute
+	maxMergeBackoff = time.Hour
+)
+
+var (
+	// ErrInvalid is returned when an id cannot be an alias of the cluster
+	ErrInvalid = errors.New("Invalid alias")
+	// ErrMerging is returned when the alias is being merged already
+	ErrMerging = errors.New("Alias being merged")
+)
+
+var (
+	aliasColl persist.DurableStore
+	// merging holds the aliases being merged, by org and alias
+	merging = map[string]bool{}
+	mu      sync.Mutex
+)
+
+func init() {
+	aliasColl = persist.Durable("clusteralias", func() interface{} { return &Alias{} })
+}
+
+// Canonical returns the id a cluster is known by now, the id itself unless it is an alias.
+func Canonical(orgId string, clusterId string) string {
+	if v, err := aliasColl.Get(orgId, clusterId); err == nil {
+		return v.(*Alias).ClusterId
+	}
+	return clusterId
+}
+
+// Aliases returns the aliases of a cluster, oldest first.
+func Aliases(orgId string, clusterId string) ([]*Alias, error) {
+	items, err := aliasColl.List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*Alias{}
+	for _, v := range items {
+		if a := v.(*Alias); a.ClusterId == clusterId {
+			copied := *a
+			ret = append(ret, &copied)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].CreatedAt.Before(ret[j].CreatedAt)
+	})
+	return ret, nil
+}
+
+// Add records alias as an id of the cluster, and tells whether it is new. An alias of an alias is an
+// alias of the cluster, and the aliases of a cluster becoming an alias follow it, so that aliases never
+// chain.
+func Add(orgId string, alias string, clusterId string) (*Alias, bool, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	clusterId = Canonical(orgId, clusterId)
+	if alias == "" || alias == clusterId {
+		return nil, false, fmt.Errorf("%w: alias must be another id than the cluster id", ErrInvalid)
+	}
+	if v, err := aliasColl.Get(orgId, alias); err == nil {
+		a := *v.(*Alias)
+		if a.ClusterId == clusterId {
+			return &a, false, nil
+		}
+		return nil, false, fmt.Errorf("%w: alias is an alias of another cluster: %s", ErrInvalid, a.ClusterId)
+	}
+
+	chained, err := Aliases(orgId, alias)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, a := range chained {
+		a.ClusterId = clusterId
+		if err := aliasColl.Put(orgId, a.Alias, a); err != nil {
+			return nil, false, err
+		}
+	}
+	a := &Alias{Alias: alias, OrgId: orgId, ClusterId: clusterId, CreatedAt: time.Now().UTC()}
+	if err := aliasColl.Put(orgId, alias, a); err != nil {
+		return nil, false, err
+	}
+	copied := *a
+	return &copied, true, nil
+}
+
+// Remove forgets an alias. The history already merged stays with the cluster.
+func Remove(orgId string, alias string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return aliasColl.Delete(orgId, alias)
+}
+
+// Pending tells whether the history of an alias is to be merged in the background: it was not merged,
+// it is not being merged, and the backoff after the last failed merge is over.
+func Pending(a *Alias, now time.Time) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if a.MergedAt != nil || merging[a.OrgId+"/"+a.Alias] {
+		return false
+	}
+	if a.Failures == 0 || a.FailedAt == nil {
+		return true
+	}
+	backoff := mergeBackoff
+	for i := 1; i < a.Failures && backoff < maxMergeBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxMergeBackoff {
+		backoff = maxMergeBackoff
+	}
+	return !now.Before(a.FailedAt.Add(backoff))
+}
+
+// Merge moves the history of an alias to its cluster: the documents, postures and snapshots in ES, the
+// scans and the waivers. It may run again, for instance when an agent still reported under the alias,
+// but not while the alias is being merged, when ErrMerging is returned.
+func Merge(orgId string, alias string) (*Alias, error) {
+	mu.Lock()
+	v, err := aliasColl.Get(orgId, alias)
+	if err != nil {
+		mu.Unlock()
+		return nil, err
+	}
+	k := orgId + "/" + alias
+	if merging[k] {
+		mu.Unlock()
+		return nil, ErrMerging
+	}
+	merging[k] = true
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		delete(merging, k)
+		mu.Unlock()
+	}()
+	a := *v.(*Alias)
+
+	err = es.MergeCluster(orgId, a.Alias, a.ClusterId)
+	scans, waivers := 0, 0
+	if err == nil {
+		scans, err = scan.Reassign(orgId, a.Alias, a.ClusterId)
+	}
+	if err == nil {
+		waivers, err = waiver.Reassign(orgId, a.Alias, a.ClusterId)
+	}
+	if err == nil {
+		log.Printf("Cluster merged: alias=%s, cluster=%s, scans=%d, waivers=%d", a.Alias, a.ClusterId, scans, waivers)
+		now := time.Now().UTC()
+		a.MergedAt = &now
+		a.Error = ""
+		a.Failures = 0
+		a.FailedAt = nil
+	} else {
+		log.Printf("Error merging cluster: alias=%s, cluster=%s, %s", a.Alias, a.ClusterId, err)
+		now := time.Now().UTC()
+		a.Error = err.Error()
+		a.Failures++
+		a.FailedAt = &now
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// the alias may have been removed or re-pointed meanwhile
+	if v, getErr := aliasColl.Get(orgId, alias); getErr == nil && v.(*Alias).ClusterId == a.ClusterId {
+		if putErr := aliasColl.Put(orgId, alias, &a); putErr != nil && err == nil {
+			err = putErr
+		}
+	}
+	return &a, err
+}
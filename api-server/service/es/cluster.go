@@ -0,0 +1,204 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package es
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// maxMergeAttempts bounds the retries of the merge of the snapshot pointers, which the agent of the
+// cluster may update at the same time
+const maxMergeAttempts = 5
+
+// MergeCluster moves the documents, the postures and the snapshots of a cluster to the id it is now
+// known by, as when its id changed. The retained snapshots of the old id are kept after those of the
+// new id, so that the drift stays comparable across the change, until the agent rotates them out.
+func MergeCluster(orgId string, from string, to string) error {
+	ctx := context.Background()
+	for _, index := range []string{IndexName(orgId), PostureIndexName(orgId)} {
+		if err := es.renameCluster(ctx, index, from, to); err != nil {
+			return err
+		}
+	}
+	return es.mergeSnapshotPointers(ctx, orgId, from, to)
+}
+
+// renameCluster sets the cluster id of the documents of an index from one id to the other.
+func (es *EsFacade) renameCluster(ctx context.Context, index string, from string, to string) error {
+	_, err := es.updateField(ctx, index, "c", from, to)
+	return err
+}
+
+// updateField sets a keyword field of the documents of an index from one value to the other, and
+// returns how many documents it updated.
+func (es *EsFacade) updateField(ctx context.Context, index string, field string, from string, to string) (int64, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"query": termQuery(field+".keyword", from),
+		"script": map[string]interface{}{
+			"source": "ctx._source[params.field] = params.to",
+			"lang":   "painless",
+			"params": map[string]string{"field": field, "to": to},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	res, err := es.client.UpdateByQuery([]string{index},
+		es.client.UpdateByQuery.WithContext(ctx),
+		es.client.UpdateByQuery.WithBody(bytes.NewReader(body)),
+		es.client.UpdateByQuery.WithConflicts("proceed"),
+		es.client.UpdateByQuery.WithRefresh(true),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if res.IsError() {
+		return 0, errors.New("Error updating documents: " + res.String())
+	}
+	var ret struct {
+		Updated int64 `json:"updated"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&ret); err != nil {
+		return 0, err
+	}
+	log.Printf("Documents updated: index=%s, %s=%s, to=%s, updated=%d", index, field, from, to, ret.Updated)
+	return ret.Updated, nil
+}
+
+type pointerDoc struct {
+	pointer     *SnapshotPointer
+	seqNo       int
+	primaryTerm int
+}
+
+func (es *EsFacade) getSnapshotPointer(ctx context.Context, orgId string, clusterId string) (*pointerDoc, error) {
+	res, err := es.client.Get(SnapshotIndexName(orgId), clusterId, es.client.Get.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, errors.New("Error getting snapshot pointer: " + res.String())
+	}
+	var doc struct {
+		SeqNo       int             `json:"_seq_no"`
+		PrimaryTerm int             `json:"_primary_term"`
+		Source      SnapshotPointer `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &pointerDoc{&doc.Source, doc.SeqNo, doc.PrimaryTerm}, nil
+}
+
+// mergeSnapshotPointers adds the snapshots retained for the old id to the pointer of the new id, or
+// moves the pointer of the old id when the new id has none yet, then deletes the pointer of the old id,
+// so that the current snapshot of the cluster is counted once.
+func (es *EsFacade) mergeSnapshotPointers(ctx context.Context, orgId string, from string, to string) error {
+	index := SnapshotIndexName(orgId)
+	old, err := es.getSnapshotPointer(ctx, orgId, from)
+	if err != nil || old == nil {
+		return err
+	}
+
+	merged := false
+	for attempt := 1; attempt <= maxMergeAttempts && !merged; attempt++ {
+		cur, err := es.getSnapshotPointer(ctx, orgId, to)
+		if err != nil {
+			return err
+		}
+
+		ptr := *old.pointer
+		ptr.ClusterId = to
+		opts := []func(*esapi.IndexRequest){
+			es.client.Index.WithContext(ctx),
+			es.client.Index.WithDocumentID(to),
+			es.client.Index.WithRefresh("true"),
+		}
+		if cur == nil {
+			opts = append(opts, es.client.Index.WithOpType("create"))
+		} else {
+			ptr = *cur.pointer
+			ptr.Snapshots = mergeSnapshots(cur.pointer.Snapshots, old.pointer.Snapshots)
+			opts = append(opts, es.client.Index.WithIfSeqNo(cur.seqNo), es.client.Index.WithIfPrimaryTerm(cur.primaryTerm))
+		}
+
+		body, err := json.Marshal(ptr)
+		if err != nil {
+			return err
+		}
+		res, err := es.client.Index(index, bytes.NewReader(body), opts...)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusConflict {
+			log.Printf("Snapshot pointer changed concurrently, retrying %d/%d", attempt, maxMergeAttempts)
+			continue
+		}
+		if res.IsError() {
+			return errors.New("Error merging snapshot pointers: " + res.String())
+		}
+		merged = true
+	}
+	if !merged {
+		return fmt.Errorf("Error merging snapshot pointers: too many concurrent updates")
+	}
+
+	res, err := es.client.Delete(index, from, es.client.Delete.WithContext(ctx),
+		es.client.Delete.WithIfSeqNo(old.seqNo), es.client.Delete.WithIfPrimaryTerm(old.primaryTerm),
+		es.client.Delete.WithRefresh("true"))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return errors.New("Error deleting snapshot pointer: " + res.String())
+	}
+	return nil
+}
+
+// mergeSnapshots returns the snapshots of both lists once, newest first.
+func mergeSnapshots(a []SnapshotRef, b []SnapshotRef) []SnapshotRef {
+	seen := map[string]bool{}
+	ret := []SnapshotRef{}
+	for _, s := range append(append([]SnapshotRef{}, a...), b...) {
+		if !seen[s.Id] {
+			seen[s.Id] = true
+			ret = append(ret, s)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].CompletedAt.After(ret[j].CompletedAt)
+	})
+	return ret
+}
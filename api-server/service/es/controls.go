@@ -0,0 +1,74 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package es
+
+import (
+	"sort"
+
+	"collie-api-server/service/catalog"
+)
+
+// ControlPosture is the posture of the rules mapping to a control of the catalog, over the current snapshots.
+type ControlPosture struct {
+	CatalogVersion string           `json:"catalogVersion" example:"2023.10.1"`
+	Framework      string           `json:"framework" example:"nist-800-53"`
+	Control        *catalog.Control `json:"control"`
+	Posture        *Posture         `json:"posture"`
+	// Clusters is the posture of each cluster, keyed by cluster id
+	Clusters map[string]*Posture `json:"clusters"`
+	// Failing lists the failing rules, as plugin/rule
+	Failing []string `json:"failing"`
+}
+
+// GetControlPosture computes the posture of a control across the given clusters, or all clusters of the org.
+func GetControlPosture(orgId string, framework string, controlId string, clusterIds []string) (*ControlPosture, error) {
+	f, control, selectors, err := catalog.Resolve(framework, controlId)
+	if err != nil {
+		return nil, err
+	}
+	findings, err := ListFindings(orgId, &FindingQuery{ClusterIds: clusterIds, RuleSelectors: selectors})
+	if err != nil {
+		return nil, err
+	}
+
+	byCluster := map[string][]*Finding{}
+	failing := map[string]bool{}
+	for _, finding := range findings {
+		byCluster[finding.ClusterId] = append(byCluster[finding.ClusterId], finding)
+		if IsFailing(finding.Status) {
+			failing[finding.Plugin+"/"+finding.RuleId] = true
+		}
+	}
+
+	ret := &ControlPosture{
+		CatalogVersion: catalog.Version(),
+		Framework:      f.Id,
+		Control:        control,
+		Posture:        SummarizeFindings(findings),
+		Clusters:       map[string]*Posture{},
+		Failing:        make([]string, 0, len(failing)),
+	}
+	for clusterId, list := range byCluster {
+		p := SummarizeFindings(list)
+		p.ClusterId = clusterId
+		ret.Clusters[clusterId] = p
+	}
+	for rule := range failing {
+		ret.Failing = append(ret.Failing, rule)
+	}
+	sort.Strings(ret.Failing)
+	return ret, nil
+}
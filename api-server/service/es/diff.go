@@ -0,0 +1,343 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package es
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+
+	"collie-api-server/service/waiver"
+)
+
+// Volatile parts of resource objects, which change without any change of the resource itself.
+var (
+	ignoredDiffPaths = []string{
+		"metadata.resourceVersion",
+		"metadata.managedFields",
+		"metadata.annotations.kubectl_kubernetes_io/last-applied-configuration",
+	}
+	ignoredDiffFields = map[string]bool{
+		"lastHeartbeatTime": true,
+		"lastProbeTime":     true,
+		// the holders of Leases renew them every few seconds
+		"renewTime": true,
+	}
+	// events are a log rather than state, they are not compared
+	ignoredDiffKinds = []string{"events"}
+)
+
+type FieldChange struct {
+	Path string      `json:"path" example:"spec.template.spec.containers[0].image"`
+	Op   string      `json:"op" example:"changed" enums:"added,removed,changed"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+type ResourceChange struct {
+	*Resource
+	Changes []FieldChange `json:"changes"`
+}
+
+type ResourceDiff struct {
+	Added    []*Resource       `json:"added"`
+	Removed  []*Resource       `json:"removed"`
+	Modified []*ResourceChange `json:"modified"`
+}
+
+type FindingDiff struct {
+	// NewlyFailing are the findings failing in the later snapshot which were not failing in the earlier one
+	NewlyFailing []*Finding `json:"newlyFailing"`
+	// NewlyFixed are the findings failing in the earlier snapshot which are not failing in the later one
+	NewlyFixed []*Finding `json:"newlyFixed"`
+}
+
+type Diff struct {
+	ClusterId string       `json:"clusterId"`
+	From      SnapshotRef  `json:"from"`
+	To        SnapshotRef  `json:"to"`
+	Resources ResourceDiff `json:"resources"`
+	Findings  FindingDiff  `json:"findings"`
+}
+
+// ResolveSnapshot finds a retained snapshot of the pointer, given either its id, or a time
+// in RFC3339, in which case it is the latest snapshot completed at or before that time.
+func (p *SnapshotPointer) ResolveSnapshot(ref string) (*SnapshotRef, error) {
+	for i := range p.Snapshots {
+		if p.Snapshots[i].Id == ref {
+			return &p.Snapshots[i], nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339, ref)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown snapshot, expecting a retained snapshot id or an RFC3339 time: %s", ref)
+	}
+	// snapshots are newest first
+	for i := range p.Snapshots {
+		if !p.Snapshots[i].CompletedAt.After(t) {
+			return &p.Snapshots[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No retained snapshot completed at or before %s", ref)
+}
+
+// IsFailing tells whether a finding status calls for action.
+func IsFailing(status string) bool {
+	s := strings.ToUpper(status)
+	return s == "FAIL" || s == "WARN"
+}
+
+func findingKey(f *Finding) string {
+	return f.Plugin + "|" + f.RuleId + "|" + f.Resource
+}
+
+func ignoredPath(path string) bool {
+	for _, p := range ignoredDiffPaths {
+		if path == p || strings.HasPrefix(path, p+".") || strings.HasPrefix(path, p+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten collects the leaf values of a JSON value by path.
+func flatten(path string, v interface{}, out map[string]interface{}) {
+	if ignoredPath(path) {
+		return
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			out[path] = v
+		}
+		for k, val := range v {
+			if ignoredDiffFields[k] {
+				continue
+			}
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			flatten(p, val, out)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			out[path] = v
+		}
+		for i, val := range v {
+			flatten(fmt.Sprintf("%s[%d]", path, i), val, out)
+		}
+	default:
+		out[path] = v
+	}
+}
+
+// diffObjects returns the field level changes from a to b, ordered by path.
+func diffObjects(a map[string]interface{}, b map[string]interface{}) []FieldChange {
+	fa, fb := map[string]interface{}{}, map[string]interface{}{}
+	flatten("", a, fa)
+	flatten("", b, fb)
+
+	changes := []FieldChange{}
+	for path, va := range fa {
+		vb, ok := fb[path]
+		if !ok {
+			changes = append(changes, FieldChange{Path: path, Op: "removed", From: va})
+		} else if !reflect.DeepEqual(va, vb) {
+			changes = append(changes, FieldChange{Path: path, Op: "changed", From: va, To: vb})
+		}
+	}
+	for path, vb := range fb {
+		if _, ok := fa[path]; !ok {
+			changes = append(changes, FieldChange{Path: path, Op: "added", To: vb})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func (es *EsFacade) iterateSnapshot(ctx context.Context, orgId string, clusterId string, snapshotId string, docType string) (*docIterator, error) {
+	filters := []types.Query{
+		existsQuery(docType),
+		termQuery(fieldCluster, clusterId),
+		termQuery(fieldSnapshot, snapshotId),
+	}
+	if docType == fieldResourceDoc {
+		mustNot := []types.Query{}
+		for _, kind := range ignoredDiffKinds {
+			mustNot = append(mustNot, termQuery(fieldKind, kind))
+		}
+		filters = append(filters, types.Query{Bool: &types.BoolQuery{MustNot: mustNot}})
+	}
+	return es.iterate(ctx, IndexName(orgId), filters, fieldSort(fieldResourceKey, false))
+}
+
+func (es *EsFacade) nextResource(it *docIterator) (*Resource, map[string]interface{}, error) {
+	hit, err := it.next()
+	if err != nil || hit == nil {
+		return nil, nil, err
+	}
+	doc, err := parseResourceDoc(*hit)
+	if err != nil {
+		return nil, nil, err
+	}
+	return toResource(hit.Id, doc), doc.Object, nil
+}
+
+// diffResources walks through the resources of both snapshots in key order, as a merge join.
+func (es *EsFacade) diffResources(ctx context.Context, orgId string, clusterId string, from string, to string) (*ResourceDiff, error) {
+	itFrom, err := es.iterateSnapshot(ctx, orgId, clusterId, from, fieldResourceDoc)
+	if err != nil {
+		return nil, err
+	}
+	defer itFrom.close()
+	itTo, err := es.iterateSnapshot(ctx, orgId, clusterId, to, fieldResourceDoc)
+	if err != nil {
+		return nil, err
+	}
+	defer itTo.close()
+
+	diff := &ResourceDiff{Added: []*Resource{}, Removed: []*Resource{}, Modified: []*ResourceChange{}}
+	ra, oa, err := es.nextResource(itFrom)
+	if err != nil {
+		return nil, err
+	}
+	rb, ob, err := es.nextResource(itTo)
+	if err != nil {
+		return nil, err
+	}
+	for ra != nil || rb != nil {
+		switch {
+		case rb == nil || (ra != nil && ra.Key < rb.Key):
+			diff.Removed = append(diff.Removed, ra)
+			ra, oa, err = es.nextResource(itFrom)
+		case ra == nil || rb.Key < ra.Key:
+			diff.Added = append(diff.Added, rb)
+			rb, ob, err = es.nextResource(itTo)
+		default:
+			if changes := diffObjects(oa, ob); len(changes) > 0 {
+				diff.Modified = append(diff.Modified, &ResourceChange{Resource: rb, Changes: changes})
+			}
+			if ra, oa, err = es.nextResource(itFrom); err == nil {
+				rb, ob, err = es.nextResource(itTo)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return diff, nil
+}
+
+func (es *EsFacade) snapshotFindings(ctx context.Context, orgId string, clusterId string, snapshotId string) (map[string]*Finding, error) {
+	it, err := es.iterateSnapshot(ctx, orgId, clusterId, snapshotId, fieldCompliance)
+	if err != nil {
+		return nil, err
+	}
+	defer it.close()
+
+	ret := map[string]*Finding{}
+	for {
+		hit, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if hit == nil {
+			return ret, nil
+		}
+		f, err := toFinding(*hit)
+		if err != nil {
+			return nil, err
+		}
+		ret[findingKey(f)] = f
+	}
+}
+
+func (es *EsFacade) diffFindings(ctx context.Context, orgId string, clusterId string, from string, to string) (*FindingDiff, error) {
+	fa, err := es.snapshotFindings(ctx, orgId, clusterId, from)
+	if err != nil {
+		return nil, err
+	}
+	fb, err := es.snapshotFindings(ctx, orgId, clusterId, to)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &FindingDiff{NewlyFailing: []*Finding{}, NewlyFixed: []*Finding{}}
+	for k, b := range fb {
+		if a, ok := fa[k]; IsFailing(b.Status) && (!ok || !IsFailing(a.Status)) {
+			diff.NewlyFailing = append(diff.NewlyFailing, b)
+		}
+	}
+	for k, a := range fa {
+		if b, ok := fb[k]; IsFailing(a.Status) && (!ok || !IsFailing(b.Status)) {
+			diff.NewlyFixed = append(diff.NewlyFixed, a)
+		}
+	}
+	byKey := func(list []*Finding) func(i, j int) bool {
+		return func(i, j int) bool { return findingKey(list[i]) < findingKey(list[j]) }
+	}
+	sort.Slice(diff.NewlyFailing, byKey(diff.NewlyFailing))
+	sort.Slice(diff.NewlyFixed, byKey(diff.NewlyFixed))
+	return diff, nil
+}
+
+// NewlyFailing returns the findings of a cluster failing in a snapshot which were not failing in the
+// previous one, leaving out the failures covered by a waiver.
+func NewlyFailing(orgId string, clusterId string, from string, to string) ([]*Finding, error) {
+	diff, err := es.diffFindings(context.Background(), orgId, clusterId, from, to)
+	if err != nil {
+		return nil, err
+	}
+	waivers, err := waiver.Active(orgId)
+	if err != nil {
+		return nil, err
+	}
+	applyWaivers(waivers, diff.NewlyFailing)
+	ret := []*Finding{}
+	for _, f := range diff.NewlyFailing {
+		if IsFailing(f.Status) {
+			ret = append(ret, f)
+		}
+	}
+	return ret, nil
+}
+
+// DiffSnapshots compares two snapshots of a cluster: the resources added, removed or modified,
+// and the findings newly failing or newly fixed, going from one to the other.
+func DiffSnapshots(orgId string, clusterId string, from *SnapshotRef, to *SnapshotRef) (*Diff, error) {
+	ctx := context.Background()
+	resources, err := es.diffResources(ctx, orgId, clusterId, from.Id, to.Id)
+	if err != nil {
+		return nil, err
+	}
+	findings, err := es.diffFindings(ctx, orgId, clusterId, from.Id, to.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &Diff{
+		ClusterId: clusterId,
+		From:      *from,
+		To:        *to,
+		Resources: *resources,
+		Findings:  *findings,
+	}, nil
+}
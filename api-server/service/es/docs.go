@@ -0,0 +1,196 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package es
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+)
+
+// Services keeping their own records in ES, such as scans, store them through these helpers. The records
+// of an org go to an index of their own, named by the service.
+
+// PutDoc stores doc under id, replacing the document stored under the id before. The document is
+// searchable once PutDoc returns.
+func PutDoc(index string, id string, doc interface{}) error {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	res, err := es.client.Index(index, bytes.NewReader(body),
+		es.client.Index.WithDocumentID(url.PathEscape(id)),
+		es.client.Index.WithRefresh("wait_for"))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return errors.New("Error indexing document: " + res.String())
+	}
+	return nil
+}
+
+// GetDocSource decodes the document stored under id into doc, and tells whether it exists.
+func GetDocSource(index string, id string, doc interface{}) (bool, error) {
+	res, err := es.client.Get(index, url.PathEscape(id))
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.IsError() {
+		return false, errors.New("Error getting document: " + res.String())
+	}
+	var ret struct {
+		Source json.RawMessage `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&ret); err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(ret.Source, doc)
+}
+
+// DeleteDoc deletes the document stored under id, if any.
+func DeleteDoc(index string, id string) error {
+	res, err := es.client.Delete(index, url.PathEscape(id), es.client.Delete.WithRefresh("wait_for"))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return errors.New("Error deleting document: " + res.String())
+	}
+	return nil
+}
+
+// SearchSources returns the documents matching every term of the filter, sorted on a field, at most size
+// of them. The filter fields are keyword fields. There are no documents while the index does not exist.
+func SearchSources(index string, filter map[string]string, sortField string, desc bool, size int) ([]json.RawMessage, error) {
+	filters := []types.Query{}
+	for k, v := range filter {
+		filters = append(filters, termQuery(k, v))
+	}
+	req := &search.Request{
+		Query: &types.Query{Bool: &types.BoolQuery{Filter: filters}},
+		Size:  &size,
+		Sort:  []types.SortCombinations{fieldSort(sortField, desc)},
+	}
+	res, err := es.search(context.Background(), []string{index}, req)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return []json.RawMessage{}, nil
+		}
+		return nil, err
+	}
+	ret := make([]json.RawMessage, 0, len(res.Hits.Hits))
+	for _, hit := range res.Hits.Hits {
+		ret = append(ret, hit.Source)
+	}
+	return ret, nil
+}
+
+// ReassignDocs sets a keyword field of the documents of an index from one value to the other, and returns
+// how many documents it updated.
+func ReassignDocs(index string, field string, from string, to string) (int64, error) {
+	return es.updateField(context.Background(), index, field, from, to)
+}
+
+// DeleteBefore deletes the documents of the indices whose date field is before t, and returns how many it
+// deleted. Indices may be patterns, such as collie-scan-*, to apply a retention to every org.
+func DeleteBefore(indices []string, field string, t time.Time) (int64, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"query": timeRangeQuery(field, nil, &t),
+	})
+	if err != nil {
+		return 0, err
+	}
+	res, err := es.client.DeleteByQuery(indices, bytes.NewReader(body),
+		es.client.DeleteByQuery.WithConflicts("proceed"),
+		es.client.DeleteByQuery.WithAllowNoIndices(true))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if res.IsError() {
+		return 0, errors.New("Error deleting documents: " + res.String())
+	}
+	var ret struct {
+		Deleted int64 `json:"deleted"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&ret); err != nil {
+		return 0, err
+	}
+	log.Printf("Documents deleted: indices=%v, before=%s, deleted=%d", indices, t.Format(time.RFC3339), ret.Deleted)
+	return ret.Deleted, nil
+}
+
+// contentMapping keeps the files out of the search: they are stored as binary, and only their date is indexed.
+const contentMapping = `{"mappings":{"dynamic":false,"properties":{"createdAt":{"type":"date"},"content":{"type":"binary"}}}}`
+
+// createdIndices are the indices known to exist with their mapping
+var createdIndices sync.Map
+
+// ensureIndex creates the index with its mapping unless it exists.
+func (es *EsFacade) ensureIndex(ctx context.Context, index string, mapping string) error {
+	if _, ok := createdIndices.Load(index); ok {
+		return nil
+	}
+	res, err := es.client.Indices.Create(index,
+		es.client.Indices.Create.WithContext(ctx),
+		es.client.Indices.Create.WithBody(strings.NewReader(mapping)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() && !strings.Contains(res.String(), "resource_already_exists_exception") {
+		return errors.New("Error creating index: " + res.String())
+	}
+	createdIndices.Store(index, true)
+	return nil
+}
+
+// PutContent stores a file under id, in an index of files.
+func PutContent(index string, id string, content []byte, createdAt time.Time) error {
+	if err := es.ensureIndex(context.Background(), index, contentMapping); err != nil {
+		return err
+	}
+	return PutDoc(index, id, map[string]interface{}{"createdAt": createdAt, "content": content})
+}
+
+// GetContent returns the file stored under id, and tells whether it exists.
+func GetContent(index string, id string) ([]byte, bool, error) {
+	var doc struct {
+		Content []byte `json:"content"`
+	}
+	found, err := GetDocSource(index, id, &doc)
+	return doc.Content, found, err
+}
@@ -21,7 +21,6 @@ import (
 	b64 "encoding/base64"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -30,7 +29,11 @@ import (
 	"github.com/cenkalti/backoff/v4"
 
 	"collie-api-server/config"
+	"collie-api-server/service/metrics"
+	"collie-api-server/util"
 	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
 )
 
 type EsFacade struct {
@@ -83,7 +86,7 @@ func createEsClient(esUrl string, esToken string) (*EsFacade, error) {
 
 	esUsername, esPassword, err := parseEsToken(esToken)
 	if err != nil {
-		log.Printf("Error parsing ES token: %s", esToken)
+		log.Printf("Error parsing ES token: %s", util.RedactToken(esToken))
 		return nil, err
 	}
 
@@ -94,7 +97,7 @@ func createEsClient(esUrl string, esToken string) (*EsFacade, error) {
 		},
 		Username:  esUsername,
 		Password:  esPassword,
-		Transport: transport,
+		Transport: metrics.InstrumentES(transport),
 
 		// Retry on 429 TooManyRequests statuses
 		RetryOnStatus: []int{502, 503, 504, 429},
@@ -132,73 +135,32 @@ func createEsClient(esUrl string, esToken string) (*EsFacade, error) {
 type SearchTotal struct {
 	Value int `json:"value"`
 }
-type SearchHits struct {
-	Hits  []map[string]interface{} `json:"hits"`
-	Total SearchTotal              `json:"total"`
-}
-
-type SearchResult struct {
-	Hits SearchHits `json:"hits"`
-}
 
 func (es *EsFacade) getDoc(indexName string, filter map[string]string, size int) ([]map[string]interface{}, error) {
-	// Define the search query
-	list := []string{}
+	filters := []types.Query{}
 	for k, v := range filter {
-		list = append(list, fmt.Sprintf(`{"term":{"%s":"%s"}}`, k, v))
-	}
-	query := fmt.Sprintf(`{
-		"query": {
-			"bool": { 
-				"filter": [%s]
-			}
-		},
-		"size": %d
-	}`, strings.Join(list, ","), size)
-
-	/*
-		// Create a search request
-		req := esapi.SearchRequest{
-			Index: []string{indexName},
-			Body:  esutil.NewJSONReader(query),
-		}
-
-		// Perform the search request using the Elasticsearch v8 typed client
-		res, err := req.Do(context.Background(), es.client)
-		if err != nil {
-			log.Fatalf("Error performing search request: %s", err)
-		}
-		defer res.Body.Close()
-
-		// Check for errors in the search response
-		if res.IsError() {
-			log.Fatalf("Error response from Elasticsearch: %s", res.Status())
-		}
-	*/
-	res, err := es.client.Search(
-		es.client.Search.WithContext(context.Background()),
-		es.client.Search.WithIndex(indexName),
-		es.client.Search.WithBody(strings.NewReader(query)),
-	)
-	if err != nil {
-		log.Printf("Error parsing search response: %s", err)
-		return nil, err
+		filters = append(filters, termQuery(k, v))
 	}
-	defer res.Body.Close()
-	if res.IsError() {
-		log.Printf("Error response from Elasticsearch: %s", res.Status())
-		return nil, errors.New(res.Status())
+	req := &search.Request{
+		Query: &types.Query{Bool: &types.BoolQuery{Filter: filters}},
+		Size:  &size,
 	}
 
-	// Parse the search response using the SearchResult struct
-	var searchResult SearchResult
-	err = json.NewDecoder(res.Body).Decode(&searchResult)
+	res, err := es.search(context.Background(), []string{indexName}, req)
 	if err != nil {
-		log.Printf("Error parsing search response: %s", err)
 		return nil, err
 	}
 
-	return searchResult.Hits.Hits, nil
+	docs := make([]map[string]interface{}, 0, len(res.Hits.Hits))
+	for _, hit := range res.Hits.Hits {
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal(hit.Source, &doc); err != nil {
+			log.Printf("Error parsing search response: %s", err)
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
 }
 
 func GetDoc(indexName string, filter map[string]string, size int) ([]map[string]interface{}, error) {
@@ -217,7 +179,7 @@ func GetDoc1(indexName string, filter map[string]string) (map[string]interface{}
 }
 
 func HasActivities(orgId string, agentId string) (bool, error) {
-	indexName := "collie-k8s-" + orgId
+	indexName := IndexName(orgId)
 	filter := map[string]string{
 		"a": agentId,
 	}
@@ -0,0 +1,378 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+
+	"collie-api-server/service/catalog"
+	"collie-api-server/service/waiver"
+)
+
+const (
+	fieldTimestamp   = "@timestamp"
+	fieldCluster     = "c.keyword"
+	fieldCompliance  = "compliance"
+	fieldPlugin      = "compliance.plugin.keyword"
+	fieldRuleId      = "compliance.ruleId.keyword"
+	fieldStatus      = "compliance.status.keyword"
+	fieldSeverity    = "compliance.severity.keyword"
+	fieldNamespace   = "compliance.namespace.keyword"
+	fieldResource    = "compliance.resource.keyword"
+	facetBucketLimit = 50
+)
+
+// findingSortFields are the sort keys accepted from clients, mapped to document fields.
+var findingSortFields = map[string]string{
+	"timestamp": fieldTimestamp,
+	"cluster":   fieldCluster,
+	"plugin":    fieldPlugin,
+	"rule":      fieldRuleId,
+	"status":    fieldStatus,
+	"severity":  fieldSeverity,
+	"namespace": fieldNamespace,
+}
+
+// findingFacetFields are the fields counted in the facets of a findings page.
+var findingFacetFields = map[string]string{
+	"cluster":   fieldCluster,
+	"plugin":    fieldPlugin,
+	"rule":      fieldRuleId,
+	"status":    fieldStatus,
+	"severity":  fieldSeverity,
+	"namespace": fieldNamespace,
+}
+
+type FindingQuery struct {
+	ClusterIds []string
+	Namespaces []string
+	Plugins    []string
+	RuleIds    []string
+	Severities []string
+	Statuses   []string
+	Resources  []string
+	// RuleSelectors restricts the findings to the rules of a control, none when not nil but empty
+	RuleSelectors []catalog.RuleSelector
+	// Snapshots defaults to the current snapshot of each cluster
+	Snapshots []string
+	From      *time.Time
+	To        *time.Time
+	Sort      string
+	Desc      bool
+	Size      int
+	Cursor    string
+}
+
+type Finding struct {
+	Id          string    `json:"id"`
+	Timestamp   time.Time `json:"timestamp"`
+	AgentId     string    `json:"agentId"`
+	ClusterId   string    `json:"clusterId"`
+	Plugin      string    `json:"plugin" example:"kube-bench"`
+	RuleId      string    `json:"ruleId" example:"1.1.1"`
+	Category    string    `json:"category"`
+	Subcategory string    `json:"subcategory"`
+	Description string    `json:"description"`
+	Status      string    `json:"status" example:"FAIL"`
+	// WaiverId is the waiver covering the finding, when its status is WAIVED
+	WaiverId    string `json:"waiverId,omitempty"`
+	Severity    string `json:"severity"`
+	Namespace   string `json:"namespace"`
+	Resource    string `json:"resource"`
+	Remediation string `json:"remediation"`
+	// Controls are the controls of the catalog the rule maps to, keyed by framework id
+	Controls map[string][]string `json:"controls,omitempty"`
+}
+
+type FindingPage struct {
+	Findings   []*Finding                  `json:"findings"`
+	Total      int                         `json:"total"`
+	NextCursor string                      `json:"nextCursor,omitempty"`
+	Facets     map[string]map[string]int64 `json:"facets"`
+}
+
+// complianceDoc is the layout of the compliance documents written by the agent reporter.
+type complianceDoc struct {
+	Timestamp  time.Time `json:"@timestamp"`
+	AgentId    string    `json:"a"`
+	ClusterId  string    `json:"c"`
+	Compliance struct {
+		Plugin      string `json:"plugin"`
+		RuleId      string `json:"ruleId"`
+		Category    string `json:"category"`
+		Subcategory string `json:"subcategory"`
+		Description string `json:"description"`
+		Status      string `json:"status"`
+		Severity    string `json:"severity"`
+		Namespace   string `json:"namespace"`
+		Resource    string `json:"resource"`
+		Remediation string `json:"remediation"`
+	} `json:"compliance"`
+}
+
+// filters builds the filters of the query, with the waived findings given by waived.
+func (q *FindingQuery) filters(waived types.Query) []types.Query {
+	filters := []types.Query{existsQuery(fieldCompliance)}
+	add := func(field string, values []string) {
+		if len(values) > 0 {
+			filters = append(filters, anyOf(field, values))
+		}
+	}
+	add(fieldCluster, q.ClusterIds)
+	add(fieldNamespace, q.Namespaces)
+	add(fieldPlugin, q.Plugins)
+	add(fieldRuleId, q.RuleIds)
+	add(fieldSeverity, q.Severities)
+	if len(q.Statuses) > 0 {
+		filters = append(filters, statusQuery(q.Statuses, waived))
+	}
+	if len(q.Resources) > 0 {
+		filters = append(filters, types.Query{Terms: &types.TermsQuery{
+			TermsQuery: map[string]types.TermsQueryField{fieldResource: q.Resources},
+		}})
+	}
+	if q.RuleSelectors != nil {
+		filters = append(filters, ruleSelectorQuery(q.RuleSelectors))
+	}
+	if q.From != nil || q.To != nil {
+		filters = append(filters, timeRangeQuery(fieldTimestamp, q.From, q.To))
+	}
+	return filters
+}
+
+// ruleSelectorQuery matches the findings of any of the selected rules.
+func ruleSelectorQuery(selectors []catalog.RuleSelector) types.Query {
+	should := make([]types.Query, 0, len(selectors))
+	for _, sel := range selectors {
+		must := []types.Query{anyOf(fieldPlugin, []string{sel.Plugin})}
+		if sel.Prefix && sel.RuleId != "" {
+			must = append(must, prefixOf(fieldRuleId, sel.RuleId))
+		} else if !sel.Prefix {
+			must = append(must, termQuery(fieldRuleId, sel.RuleId))
+		}
+		should = append(should, types.Query{Bool: &types.BoolQuery{Must: must}})
+	}
+	if len(should) == 0 {
+		return types.Query{MatchNone: &types.MatchNoneQuery{}}
+	}
+	return types.Query{Bool: &types.BoolQuery{Should: should, MinimumShouldMatch: 1}}
+}
+
+func (es *EsFacade) searchFindings(ctx context.Context, orgId string, q *FindingQuery) (*FindingPage, error) {
+	sortField, ok := findingSortFields[q.Sort]
+	if !ok {
+		return nil, fmt.Errorf("Invalid sort: %s", q.Sort)
+	}
+
+	waivers, err := waiver.Active(orgId)
+	if err != nil {
+		return nil, err
+	}
+	waived := waivedQuery(waivers)
+	filters := q.filters(waived)
+	snapshot, err := es.snapshotFilter(ctx, orgId, q.Snapshots)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != nil {
+		filters = append(filters, *snapshot)
+	}
+
+	index := IndexName(orgId)
+	pit, after, found, err := es.startPage(ctx, index, q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return &FindingPage{Findings: []*Finding{}, Facets: map[string]map[string]int64{}}, nil
+	}
+
+	aggs := map[string]types.Aggregations{}
+	for name, field := range findingFacetFields {
+		aggs[name] = termsAgg(field, facetBucketLimit)
+	}
+	aggs["waived"] = waivedStatusAgg(waived)
+	size := q.Size
+	req := &search.Request{
+		Query: &types.Query{Bool: &types.BoolQuery{Filter: filters}},
+		Pit:   &types.PointInTimeReference{Id: pit, KeepAlive: pitKeepAlive},
+		Size:  &size,
+		// the point in time adds an implicit _shard_doc tiebreaker, which makes search_after stable
+		Sort:           []types.SortCombinations{fieldSort(sortField, q.Desc), fieldSort(fieldTimestamp, true)},
+		SearchAfter:    after,
+		TrackTotalHits: true,
+		Aggregations:   aggs,
+	}
+
+	res, err := es.search(ctx, nil, req)
+	if err != nil {
+		es.endPage(ctx, index, nil, pit, size)
+		return nil, err
+	}
+
+	page := &FindingPage{
+		Findings: make([]*Finding, 0, len(res.Hits.Hits)),
+		Total:    res.Hits.Total.Value,
+		Facets:   map[string]map[string]int64{},
+	}
+	for _, hit := range res.Hits.Hits {
+		f, err := toFinding(hit)
+		if err != nil {
+			es.endPage(ctx, index, nil, pit, size)
+			return nil, err
+		}
+		page.Findings = append(page.Findings, f)
+	}
+	applyWaivers(waivers, page.Findings)
+	for name := range findingFacetFields {
+		if raw, ok := res.Aggregations[name]; ok {
+			counts, err := termsFacets(raw)
+			if err != nil {
+				es.endPage(ctx, index, nil, pit, size)
+				return nil, err
+			}
+			page.Facets[name] = counts
+		}
+	}
+	if counts, ok := page.Facets["status"]; ok {
+		waivedCounts, err := decodeWaivedStatus(res.Aggregations["waived"])
+		if err != nil {
+			es.endPage(ctx, index, nil, pit, size)
+			return nil, err
+		}
+		waive(counts, waivedCounts)
+	}
+	page.NextCursor = es.endPage(ctx, index, res, pit, size)
+	return page, nil
+}
+
+func toFinding(hit searchHit) (*Finding, error) {
+	var doc complianceDoc
+	if err := json.Unmarshal(hit.Source, &doc); err != nil {
+		return nil, err
+	}
+	c := doc.Compliance
+	return &Finding{
+		Id:          hit.Id,
+		Timestamp:   doc.Timestamp,
+		AgentId:     doc.AgentId,
+		ClusterId:   doc.ClusterId,
+		Plugin:      c.Plugin,
+		RuleId:      c.RuleId,
+		Category:    c.Category,
+		Subcategory: c.Subcategory,
+		Description: c.Description,
+		Status:      c.Status,
+		Severity:    c.Severity,
+		Namespace:   c.Namespace,
+		Resource:    c.Resource,
+		Remediation: c.Remediation,
+		Controls:    catalog.ControlsOf(c.Plugin, c.RuleId),
+	}, nil
+}
+
+// SearchFindings returns one page of the compliance findings of the org matching the query,
+// with facet counts over all matching findings.
+func SearchFindings(orgId string, q *FindingQuery) (*FindingPage, error) {
+	return es.searchFindings(context.Background(), orgId, q)
+}
+
+// ListFindings returns all the findings matching the filters of the query, of the current snapshots by default.
+// Sort and pagination of the query are ignored.
+func ListFindings(orgId string, q *FindingQuery) ([]*Finding, error) {
+	ctx := context.Background()
+	waivers, err := waiver.Active(orgId)
+	if err != nil {
+		return nil, err
+	}
+	filters := q.filters(waivedQuery(waivers))
+	snapshot, err := es.snapshotFilter(ctx, orgId, q.Snapshots)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != nil {
+		filters = append(filters, *snapshot)
+	}
+
+	it, err := es.iterate(ctx, IndexName(orgId), filters, fieldSort(fieldCluster, false), fieldSort(fieldPlugin, false), fieldSort(fieldRuleId, false))
+	if err != nil {
+		return nil, err
+	}
+	defer it.close()
+
+	ret := []*Finding{}
+	for {
+		hit, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if hit == nil {
+			applyWaivers(waivers, ret)
+			return ret, nil
+		}
+		f, err := toFinding(*hit)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, f)
+	}
+}
+
+// CountFindings returns the number of findings matching the filters of the query, of the current
+// snapshots by default, along with the first q.Size of them. Sort and cursor of the query are ignored.
+func CountFindings(orgId string, q *FindingQuery) (int, []*Finding, error) {
+	ctx := context.Background()
+	waivers, err := waiver.Active(orgId)
+	if err != nil {
+		return 0, nil, err
+	}
+	filters := q.filters(waivedQuery(waivers))
+	snapshot, err := es.snapshotFilter(ctx, orgId, q.Snapshots)
+	if err != nil {
+		return 0, nil, err
+	}
+	if snapshot != nil {
+		filters = append(filters, *snapshot)
+	}
+
+	size := q.Size
+	req := &search.Request{
+		Query:          &types.Query{Bool: &types.BoolQuery{Filter: filters}},
+		Size:           &size,
+		Sort:           []types.SortCombinations{fieldSort(fieldCluster, false), fieldSort(fieldPlugin, false), fieldSort(fieldRuleId, false)},
+		TrackTotalHits: true,
+	}
+	res, err := es.search(ctx, []string{IndexName(orgId)}, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	findings := make([]*Finding, 0, len(res.Hits.Hits))
+	for _, hit := range res.Hits.Hits {
+		f, err := toFinding(hit)
+		if err != nil {
+			return 0, nil, err
+		}
+		findings = append(findings, f)
+	}
+	applyWaivers(waivers, findings)
+	return res.Hits.Total.Value, findings, nil
+}
@@ -0,0 +1,494 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package es
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+
+	"collie-api-server/service/waiver"
+)
+
+const (
+	fieldCategory       = "compliance.category.keyword"
+	unknownSeverity     = "unknown"
+	maxPostureBreakdown = 500
+	// maxPostureAge is the time the latest posture of a cluster counts in the org trend
+	maxPostureAge = 31 * 24 * time.Hour
+)
+
+// severityWeights weigh findings in the posture score. Findings of any other severity,
+// including findings without severity, have weight 1.
+var severityWeights = map[string]float64{
+	"critical": 10,
+	"high":     5,
+	"medium":   3,
+	"low":      1,
+}
+
+// PostureIndexName is the index holding the posture summaries of an org. Unlike the documents
+// reported by the agents, summaries are never replaced, so they make the compliance history.
+func PostureIndexName(orgId string) string {
+	return "collie-posture-" + orgId
+}
+
+// StatusCounts are the number of findings per status.
+type StatusCounts struct {
+	Pass int64 `json:"pass"`
+	Fail int64 `json:"fail"`
+	Warn int64 `json:"warn"`
+	// Waived are failures accepted by a waiver, they are not assessed in the score
+	Waived int64 `json:"waived"`
+	Other  int64 `json:"other"`
+}
+
+func (c *StatusCounts) add(status string, n int64) {
+	switch strings.ToUpper(status) {
+	case "PASS":
+		c.Pass += n
+	case "FAIL":
+		c.Fail += n
+	case "WARN":
+		c.Warn += n
+	case StatusWaived:
+		c.Waived += n
+	default:
+		c.Other += n
+	}
+}
+
+func (c *StatusCounts) merge(o StatusCounts) {
+	c.Pass += o.Pass
+	c.Fail += o.Fail
+	c.Warn += o.Warn
+	c.Waived += o.Waived
+	c.Other += o.Other
+}
+
+type Breakdown struct {
+	Key string `json:"key"`
+	StatusCounts
+}
+
+// Posture is the compliance summary of one cluster at the end of a scan cycle.
+type Posture struct {
+	Timestamp time.Time `json:"@timestamp"`
+	ClusterId string    `json:"c"`
+	AgentId   string    `json:"a"`
+	ScanId    string    `json:"scanId"`
+	// Score is the weighted percentage of passing findings, 100 when there is nothing to assess.
+	Score float64 `json:"score"`
+	StatusCounts
+	ByPlugin   []Breakdown `json:"byPlugin"`
+	ByCategory []Breakdown `json:"byCategory"`
+	BySeverity []Breakdown `json:"bySeverity"`
+	// weighted pass and assessed counts, kept to combine the scores of several clusters
+	WeightedPass  float64 `json:"weightedPass"`
+	WeightedTotal float64 `json:"weightedTotal"`
+}
+
+type TrendQuery struct {
+	ClusterIds []string
+	From       time.Time
+	To         time.Time
+	Interval   time.Duration
+}
+
+// TrendPoint summarizes an interval with the latest posture of each cluster counted in it.
+type TrendPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Clusters  int       `json:"clusters"`
+	Score     float64   `json:"score"`
+	StatusCounts
+}
+
+type Trend struct {
+	From     time.Time     `json:"from"`
+	To       time.Time     `json:"to"`
+	Interval string        `json:"interval" example:"24h0m0s"`
+	Org      []*TrendPoint `json:"org"`
+	// Clusters holds the series of each cluster, by cluster id
+	Clusters map[string][]*TrendPoint `json:"clusters"`
+}
+
+func score(weightedPass float64, weightedTotal float64) float64 {
+	if weightedTotal == 0 {
+		return 100
+	}
+	return float64(int64(weightedPass/weightedTotal*10000+0.5)) / 100
+}
+
+// SeverityWeight is the weight of a finding of the given severity in the posture score.
+func SeverityWeight(severity string) float64 {
+	if w, ok := severityWeights[strings.ToLower(severity)]; ok {
+		return w
+	}
+	return 1
+}
+
+// totalize computes the totals and the score from the breakdown by severity.
+func (p *Posture) totalize() {
+	for _, b := range p.BySeverity {
+		p.StatusCounts.merge(b.StatusCounts)
+		w := SeverityWeight(b.Key)
+		p.WeightedPass += w * float64(b.Pass)
+		p.WeightedTotal += w * float64(b.Pass+b.Fail+b.Warn)
+	}
+	p.Score = score(p.WeightedPass, p.WeightedTotal)
+}
+
+func statusAgg(waived types.Query) map[string]types.Aggregations {
+	return map[string]types.Aggregations{
+		"status": termsAgg(fieldStatus, 10),
+		"waived": waivedStatusAgg(waived),
+	}
+}
+
+// decodeStatusBreakdown decodes a terms aggregation with the sub-aggregations of statusAgg.
+func decodeStatusBreakdown(raw json.RawMessage) ([]Breakdown, error) {
+	var agg struct {
+		Buckets []struct {
+			Key    interface{} `json:"key"`
+			Status struct {
+				Buckets []termsBucket `json:"buckets"`
+			} `json:"status"`
+			Waived json.RawMessage `json:"waived"`
+		} `json:"buckets"`
+	}
+	if err := json.Unmarshal(raw, &agg); err != nil {
+		return nil, err
+	}
+	ret := make([]Breakdown, 0, len(agg.Buckets))
+	for _, b := range agg.Buckets {
+		bd := Breakdown{Key: fmt.Sprintf("%v", b.Key)}
+		counts := map[string]int64{}
+		for _, s := range b.Status.Buckets {
+			counts[fmt.Sprintf("%v", s.Key)] = s.DocCount
+		}
+		waived, err := decodeWaivedStatus(b.Waived)
+		if err != nil {
+			return nil, err
+		}
+		waive(counts, waived)
+		for status, n := range counts {
+			bd.add(status, n)
+		}
+		ret = append(ret, bd)
+	}
+	return ret, nil
+}
+
+// computePosture aggregates the compliance documents of the snapshot reported for the cluster.
+func (es *EsFacade) computePosture(ctx context.Context, orgId string, agentId string, clusterId string, snapshotId string) (*Posture, error) {
+	index := IndexName(orgId)
+	// make the documents of the cycle that just completed visible to the aggregations
+	res, err := es.client.Indices.Refresh(es.client.Indices.Refresh.WithIndex(index),
+		es.client.Indices.Refresh.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	missing := unknownSeverity
+	size := 0
+	waivers, err := waiver.Active(orgId)
+	if err != nil {
+		return nil, err
+	}
+	waived := waivedQuery(waivers)
+	plugin := termsAgg(fieldPlugin, maxPostureBreakdown)
+	plugin.Aggregations = statusAgg(waived)
+	category := termsAgg(fieldCategory, maxPostureBreakdown)
+	category.Aggregations = statusAgg(waived)
+	severity := termsAgg(fieldSeverity, maxPostureBreakdown)
+	severity.Terms.Missing = missing
+	severity.Aggregations = statusAgg(waived)
+	req := &search.Request{
+		Query: &types.Query{Bool: &types.BoolQuery{Filter: []types.Query{
+			existsQuery(fieldCompliance),
+			termQuery(fieldCluster, clusterId),
+			termQuery(fieldSnapshot, snapshotId),
+		}}},
+		Size: &size,
+		Aggregations: map[string]types.Aggregations{
+			"plugin":   plugin,
+			"category": category,
+			"severity": severity,
+		},
+	}
+	sr, err := es.search(ctx, []string{index}, req)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Posture{
+		Timestamp: time.Now().UTC(),
+		ClusterId: clusterId,
+		AgentId:   agentId,
+		ScanId:    snapshotId,
+	}
+	if p.ByPlugin, err = decodeStatusBreakdown(sr.Aggregations["plugin"]); err != nil {
+		return nil, err
+	}
+	if p.ByCategory, err = decodeStatusBreakdown(sr.Aggregations["category"]); err != nil {
+		return nil, err
+	}
+	if p.BySeverity, err = decodeStatusBreakdown(sr.Aggregations["severity"]); err != nil {
+		return nil, err
+	}
+	p.totalize()
+	return p, nil
+}
+
+// SummarizeFindings computes the posture of a set of findings, as computePosture does with aggregations.
+func SummarizeFindings(findings []*Finding) *Posture {
+	p := &Posture{Timestamp: time.Now().UTC()}
+	byPlugin, byCategory, bySeverity := map[string]*Breakdown{}, map[string]*Breakdown{}, map[string]*Breakdown{}
+	count := func(m map[string]*Breakdown, key string, status string) {
+		if m[key] == nil {
+			m[key] = &Breakdown{Key: key}
+		}
+		m[key].add(status, 1)
+	}
+	for _, f := range findings {
+		severity := f.Severity
+		if severity == "" {
+			severity = unknownSeverity
+		}
+		count(byPlugin, f.Plugin, f.Status)
+		count(byCategory, f.Category, f.Status)
+		count(bySeverity, severity, f.Status)
+	}
+	list := func(m map[string]*Breakdown) []Breakdown {
+		ret := make([]Breakdown, 0, len(m))
+		for _, b := range m {
+			ret = append(ret, *b)
+		}
+		sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+		return ret
+	}
+	p.ByPlugin, p.ByCategory, p.BySeverity = list(byPlugin), list(byCategory), list(bySeverity)
+	p.totalize()
+	return p
+}
+
+func (es *EsFacade) indexPosture(ctx context.Context, orgId string, p *Posture) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	res, err := es.client.Index(PostureIndexName(orgId), bytes.NewReader(body),
+		es.client.Index.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return errors.New("Error indexing posture: " + res.String())
+	}
+	return nil
+}
+
+// postureExcludes are the breakdowns of the postures, which trends do not need
+var postureExcludes = []string{"byPlugin", "byCategory", "bySeverity"}
+
+// listPostures returns the postures of the trend window, oldest first, page by page so that none is left out.
+func (es *EsFacade) listPostures(ctx context.Context, orgId string, q *TrendQuery) ([]*Posture, error) {
+	filters := []types.Query{timeRangeQuery(fieldTimestamp, &q.From, &q.To)}
+	if len(q.ClusterIds) > 0 {
+		filters = append(filters, anyOf(fieldCluster, q.ClusterIds))
+	}
+	it, err := es.iterate(ctx, PostureIndexName(orgId), filters, fieldSort(fieldTimestamp, false))
+	if err != nil {
+		return nil, err
+	}
+	defer it.close()
+	it.excludes = postureExcludes
+
+	ret := []*Posture{}
+	for {
+		hit, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if hit == nil {
+			return ret, nil
+		}
+		var p Posture
+		if err := json.Unmarshal(hit.Source, &p); err != nil {
+			return nil, err
+		}
+		ret = append(ret, &p)
+	}
+}
+
+// priorPostures returns the latest posture of each cluster recorded in the maxPostureAge before the trend
+// window, which the window starts from.
+func (es *EsFacade) priorPostures(ctx context.Context, orgId string, q *TrendQuery) ([]*Posture, error) {
+	since := q.From.Add(-maxPostureAge)
+	filters := []types.Query{timeRangeQuery(fieldTimestamp, &since, &q.From)}
+	if len(q.ClusterIds) > 0 {
+		filters = append(filters, anyOf(fieldCluster, q.ClusterIds))
+	}
+	size := maxClusterCount
+	req := &search.Request{
+		Query:    &types.Query{Bool: &types.BoolQuery{Filter: filters}},
+		Size:     &size,
+		Sort:     []types.SortCombinations{fieldSort(fieldTimestamp, true)},
+		Collapse: &types.FieldCollapse{Field: fieldCluster},
+		Source_:  types.SourceFilter{Excludes: postureExcludes},
+	}
+	res, err := es.search(ctx, []string{PostureIndexName(orgId)}, req)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return []*Posture{}, nil
+		}
+		return nil, err
+	}
+	ret := make([]*Posture, 0, len(res.Hits.Hits))
+	for _, hit := range res.Hits.Hits {
+		var p Posture
+		if err := json.Unmarshal(hit.Source, &p); err != nil {
+			return nil, err
+		}
+		ret = append(ret, &p)
+	}
+	return ret, nil
+}
+
+// trendPoint combines the postures of the clusters assessed in an interval.
+func trendPoint(t time.Time, latest map[string]*Posture) *TrendPoint {
+	pt := &TrendPoint{Timestamp: t, Clusters: len(latest)}
+	var weightedPass, weightedTotal float64
+	for _, p := range latest {
+		pt.StatusCounts.merge(p.StatusCounts)
+		weightedPass += p.WeightedPass
+		weightedTotal += p.WeightedTotal
+	}
+	pt.Score = score(weightedPass, weightedTotal)
+	return pt
+}
+
+// buildTrend buckets the postures, sorted by time, by interval. The series of a cluster has a point
+// for each interval with a cycle of the cluster. The org point of an interval counts the latest posture
+// of every cluster up to the interval, prior postures included, so that clusters scanned less often than
+// the interval still count; a cluster without posture for maxPostureAge is no longer counted, as when it
+// was removed. Intervals without any cluster counted are omitted.
+func buildTrend(q *TrendQuery, prior []*Posture, postures []*Posture) *Trend {
+	trend := &Trend{
+		From:     q.From,
+		To:       q.To,
+		Interval: q.Interval.String(),
+		Org:      []*TrendPoint{},
+		Clusters: map[string][]*TrendPoint{},
+	}
+	buckets := map[time.Time]map[string]*Posture{}
+	for _, p := range postures {
+		t := q.From.Add(p.Timestamp.Sub(q.From).Truncate(q.Interval))
+		if buckets[t] == nil {
+			buckets[t] = map[string]*Posture{}
+		}
+		// later cycles of a cluster override earlier ones in the same interval
+		buckets[t][p.ClusterId] = p
+	}
+	latest := map[string]*Posture{}
+	for _, p := range prior {
+		latest[p.ClusterId] = p
+	}
+	for t := q.From; t.Before(q.To); t = t.Add(q.Interval) {
+		for clusterId, p := range buckets[t] {
+			latest[clusterId] = p
+			trend.Clusters[clusterId] = append(trend.Clusters[clusterId], trendPoint(t, map[string]*Posture{clusterId: p}))
+		}
+		end := t.Add(q.Interval)
+		for clusterId, p := range latest {
+			if end.Sub(p.Timestamp) > maxPostureAge {
+				delete(latest, clusterId)
+			}
+		}
+		if len(latest) > 0 {
+			trend.Org = append(trend.Org, trendPoint(t, latest))
+		}
+	}
+	return trend
+}
+
+// RecordPosture computes the posture of a cluster from the findings of the cycle that just completed,
+// and appends it to the compliance history of the org.
+func RecordPosture(orgId string, agentId string, clusterId string, scanId string) (*Posture, error) {
+	ctx := context.Background()
+	p, err := es.computePosture(ctx, orgId, agentId, clusterId, scanId)
+	if err != nil {
+		return nil, err
+	}
+	if err := es.indexPosture(ctx, orgId, p); err != nil {
+		return nil, err
+	}
+	log.Printf("Posture recorded: cluster=%s, scan=%s, score=%.2f", clusterId, scanId, p.Score)
+	return p, nil
+}
+
+// PreviousPosture returns the latest posture of a cluster recorded before the given scan, nil if there is none.
+func PreviousPosture(orgId string, clusterId string, scanId string) (*Posture, error) {
+	size := 1
+	req := &search.Request{
+		Query: &types.Query{Bool: &types.BoolQuery{
+			Filter:  []types.Query{termQuery(fieldCluster, clusterId)},
+			MustNot: []types.Query{termQuery("scanId.keyword", scanId)},
+		}},
+		Size: &size,
+		Sort: []types.SortCombinations{fieldSort(fieldTimestamp, true)},
+	}
+	res, err := es.search(context.Background(), []string{PostureIndexName(orgId)}, req)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(res.Hits.Hits) == 0 {
+		return nil, nil
+	}
+	var p Posture
+	if err := json.Unmarshal(res.Hits.Hits[0].Source, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GetTrend returns the time series of the posture of the org and of each of its clusters.
+func GetTrend(orgId string, q *TrendQuery) (*Trend, error) {
+	ctx := context.Background()
+	prior, err := es.priorPostures(ctx, orgId, q)
+	if err != nil {
+		return nil, err
+	}
+	postures, err := es.listPostures(ctx, orgId, q)
+	if err != nil {
+		return nil, err
+	}
+	return buildTrend(q, prior, postures), nil
+}
@@ -0,0 +1,381 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package es
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types/enums/fieldtype"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types/enums/sortorder"
+
+	"collie-api-server/config"
+)
+
+// Queries are always built with the typed query builders of the ES client, never by string
+// concatenation, so that user input ends up as values and cannot inject query syntax.
+
+const pitKeepAlive = "5m"
+
+// IndexName is the index holding the documents reported by the agents of an org.
+func IndexName(orgId string) string {
+	return "collie-k8s-" + orgId
+}
+
+type searchHit struct {
+	Id     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+	Sort   []interface{}   `json:"sort"`
+}
+
+type termsBucket struct {
+	Key      interface{} `json:"key"`
+	DocCount int64       `json:"doc_count"`
+}
+
+type searchResponse struct {
+	PitId string `json:"pit_id"`
+	Hits  struct {
+		Total SearchTotal `json:"total"`
+		Hits  []searchHit `json:"hits"`
+	} `json:"hits"`
+	Aggregations map[string]json.RawMessage `json:"aggregations"`
+}
+
+// search runs a typed search request. When the request carries a point in time, indices must be empty.
+func (es *EsFacade) search(ctx context.Context, indices []string, req *search.Request) (*searchResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	opts := []func(*esapi.SearchRequest){
+		es.client.Search.WithContext(ctx),
+		es.client.Search.WithBody(bytes.NewReader(body)),
+	}
+	if len(indices) > 0 {
+		opts = append(opts, es.client.Search.WithIndex(indices...))
+	}
+	res, err := es.client.Search(opts...)
+	if err != nil {
+		log.Printf("Error performing search request: %s", err)
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		log.Printf("Error response from Elasticsearch: %s", res.String())
+		return nil, errors.New(res.Status())
+	}
+
+	var ret searchResponse
+	decoder := json.NewDecoder(res.Body)
+	// keep sort values such as epoch millis exact, they are sent back as search_after
+	decoder.UseNumber()
+	if err := decoder.Decode(&ret); err != nil {
+		log.Printf("Error parsing search response: %s", err)
+		return nil, err
+	}
+	log.Printf("ES search: indices=%v, hits=%d, took=%s", indices, len(ret.Hits.Hits), time.Since(start).Truncate(time.Millisecond))
+	return &ret, nil
+}
+
+func (es *EsFacade) openPit(ctx context.Context, index string) (string, error) {
+	res, err := es.client.OpenPointInTime([]string{index}, pitKeepAlive,
+		es.client.OpenPointInTime.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", fmt.Errorf("Error opening point in time: %s", res.String())
+	}
+	var pit struct {
+		Id string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&pit); err != nil {
+		return "", err
+	}
+	return pit.Id, nil
+}
+
+func (es *EsFacade) closePit(ctx context.Context, pit string) {
+	body, _ := json.Marshal(map[string]string{"id": pit})
+	res, err := es.client.ClosePointInTime(es.client.ClosePointInTime.WithBody(bytes.NewReader(body)),
+		es.client.ClosePointInTime.WithContext(ctx))
+	if err != nil {
+		log.Printf("Error closing point in time: %s", err)
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		log.Printf("Error closing point in time: %s", res.String())
+	}
+}
+
+// docIterator walks through all the documents matching a query, in sort order, page by page.
+type docIterator struct {
+	es      *EsFacade
+	ctx     context.Context
+	filters []types.Query
+	sort    []types.SortCombinations
+	pit     string
+	after   []types.FieldValue
+	buf     []searchHit
+	done    bool
+	// excludes are the fields left out of the documents returned
+	excludes []string
+}
+
+const iteratorPageSize = 1000
+
+func (es *EsFacade) iterate(ctx context.Context, index string, filters []types.Query, sort ...types.SortCombinations) (*docIterator, error) {
+	it := &docIterator{es: es, ctx: ctx, filters: filters, sort: sort}
+	pit, _, found, err := es.startPage(ctx, index, "")
+	if err != nil {
+		return nil, err
+	}
+	it.pit = pit
+	it.done = !found
+	return it, nil
+}
+
+// next returns the next document, or nil when all documents have been returned.
+func (it *docIterator) next() (*searchHit, error) {
+	if len(it.buf) == 0 && !it.done {
+		size := iteratorPageSize
+		req := &search.Request{
+			Query:       &types.Query{Bool: &types.BoolQuery{Filter: it.filters}},
+			Pit:         &types.PointInTimeReference{Id: it.pit, KeepAlive: pitKeepAlive},
+			Size:        &size,
+			Sort:        it.sort,
+			SearchAfter: it.after,
+		}
+		if len(it.excludes) > 0 {
+			req.Source_ = types.SourceFilter{Excludes: it.excludes}
+		}
+		res, err := it.es.search(it.ctx, nil, req)
+		if err != nil {
+			return nil, err
+		}
+		if res.PitId != "" {
+			it.pit = res.PitId
+		}
+		it.buf = res.Hits.Hits
+		it.done = len(it.buf) < size
+		if n := len(it.buf); n > 0 {
+			it.after = nil
+			for _, v := range it.buf[n-1].Sort {
+				it.after = append(it.after, v)
+			}
+		}
+	}
+	if len(it.buf) == 0 {
+		return nil, nil
+	}
+	hit := it.buf[0]
+	it.buf = it.buf[1:]
+	return &hit, nil
+}
+
+func (it *docIterator) close() {
+	if it.pit != "" {
+		it.es.closePit(it.ctx, it.pit)
+	}
+}
+
+// termsFacets decodes the buckets of a terms aggregation into value counts.
+func termsFacets(raw json.RawMessage) (map[string]int64, error) {
+	var agg struct {
+		Buckets []termsBucket `json:"buckets"`
+	}
+	if err := json.Unmarshal(raw, &agg); err != nil {
+		return nil, err
+	}
+	ret := map[string]int64{}
+	for _, b := range agg.Buckets {
+		ret[fmt.Sprintf("%v", b.Key)] = b.DocCount
+	}
+	return ret, nil
+}
+
+// cursor is the opaque pagination token handed to clients. It carries the point in time
+// and the sort values of the last hit, so that the next page continues with search_after.
+type cursor struct {
+	Pit   string        `json:"p"`
+	After []interface{} `json:"a"`
+	// Index is the index the point in time was opened on, the index of the org of the client
+	Index string `json:"i"`
+}
+
+// cursorKey signs the cursors, so that a cursor only continues a search on the index it was issued for.
+// Without a configured secret, the cursors issued before a restart are rejected, as their points in time
+// have likely expired anyway.
+var cursorKey = newCursorKey(config.Get().CursorSecret)
+
+func newCursorKey(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Errorf("generating cursor key: %v", err))
+	}
+	return key
+}
+
+func signCursor(payload []byte) []byte {
+	mac := hmac.New(sha256.New, cursorKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b) + "." + base64.RawURLEncoding.EncodeToString(signCursor(b))
+}
+
+// decodeCursor verifies that the cursor was issued by this server for a search on the index.
+func decodeCursor(s string, index string) (*cursor, error) {
+	payload, signature, ok := strings.Cut(s, ".")
+	if !ok {
+		return nil, errors.New("Invalid cursor")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, signCursor(b)) {
+		return nil, errors.New("Invalid cursor")
+	}
+	var c cursor
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&c); err != nil || c.Pit == "" || c.Index != index {
+		return nil, errors.New("Invalid cursor")
+	}
+	return &c, nil
+}
+
+// startPage resolves where a page starts: a new point in time on the index for the first page,
+// or the point in time and the search_after values carried by the cursor of the previous page.
+// found is false when the index does not exist yet, in which case the page is empty.
+func (es *EsFacade) startPage(ctx context.Context, index string, cursorStr string) (pit string, after []types.FieldValue, found bool, err error) {
+	if cursorStr != "" {
+		c, err := decodeCursor(cursorStr, index)
+		if err != nil {
+			return "", nil, false, err
+		}
+		for _, v := range c.After {
+			after = append(after, v)
+		}
+		return c.Pit, after, true, nil
+	}
+	pit, err = es.openPit(ctx, index)
+	if err != nil {
+		if strings.Contains(err.Error(), "index_not_found_exception") {
+			return "", nil, false, nil
+		}
+		return "", nil, false, err
+	}
+	return pit, nil, true, nil
+}
+
+// endPage returns the cursor of the page following res, or "" when res is the last page, in which case
+// the point in time is closed rather than left open until it expires. res is nil when the search failed.
+func (es *EsFacade) endPage(ctx context.Context, index string, res *searchResponse, pit string, size int) string {
+	if res != nil && res.PitId != "" {
+		pit = res.PitId
+	}
+	if res == nil || len(res.Hits.Hits) == 0 || len(res.Hits.Hits) < size {
+		es.closePit(ctx, pit)
+		return ""
+	}
+	return encodeCursor(cursor{Pit: pit, After: res.Hits.Hits[len(res.Hits.Hits)-1].Sort, Index: index})
+}
+
+func termQuery(field string, value string) types.Query {
+	return types.Query{Term: map[string]types.TermQuery{
+		field: {Value: value},
+	}}
+}
+
+// anyOf matches documents whose field equals any of the values, ignoring case.
+func anyOf(field string, values []string) types.Query {
+	caseInsensitive := true
+	should := make([]types.Query, 0, len(values))
+	for _, v := range values {
+		should = append(should, types.Query{Term: map[string]types.TermQuery{
+			field: {Value: v, CaseInsensitive: &caseInsensitive},
+		}})
+	}
+	return types.Query{Bool: &types.BoolQuery{Should: should, MinimumShouldMatch: 1}}
+}
+
+// prefixOf matches documents whose field starts with the value, ignoring case.
+func prefixOf(field string, value string) types.Query {
+	caseInsensitive := true
+	return types.Query{Prefix: map[string]types.PrefixQuery{
+		field: {Value: value, CaseInsensitive: &caseInsensitive},
+	}}
+}
+
+func existsQuery(field string) types.Query {
+	return types.Query{Exists: &types.ExistsQuery{Field: field}}
+}
+
+func timeRangeQuery(field string, from *time.Time, to *time.Time) types.Query {
+	r := types.DateRangeQuery{}
+	if from != nil {
+		v := from.UTC().Format(time.RFC3339)
+		r.Gte = &v
+	}
+	if to != nil {
+		v := to.UTC().Format(time.RFC3339)
+		r.Lt = &v
+	}
+	return types.Query{Range: map[string]types.RangeQuery{field: r}}
+}
+
+func fieldSort(field string, desc bool) types.SortCombinations {
+	order := sortorder.Asc
+	if desc {
+		order = sortorder.Desc
+	}
+	unmapped := fieldtype.Keyword
+	return types.SortOptions{SortOptions: map[string]types.FieldSort{
+		field: {Order: &order, UnmappedType: &unmapped},
+	}}
+}
+
+func termsAgg(field string, size int) types.Aggregations {
+	return types.Aggregations{Terms: &types.TermsAggregation{Field: &field, Size: &size}}
+}
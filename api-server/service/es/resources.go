@@ -0,0 +1,264 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+)
+
+const (
+	fieldKind              = "k.keyword"
+	fieldResourceKey       = "r.keyword"
+	fieldResourceDoc       = "resource"
+	fieldResourceNamespace = "resource.metadata.namespace.keyword"
+	fieldResourceName      = "resource.metadata.name.keyword"
+	fieldResourceLabels    = "resource.metadata.labels."
+	maxResourceFindings    = 500
+)
+
+// patternLabelKey is the syntax of kubernetes label keys, an optional DNS prefix and a name.
+var patternLabelKey = regexp.MustCompile(`^([a-z0-9]([-a-z0-9.]*[a-z0-9])?/)?[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+
+type ResourceQuery struct {
+	ClusterId  string
+	Kinds      []string
+	Namespaces []string
+	// Name matches the beginning of the resource name
+	Name   string
+	Labels map[string]string
+	// Snapshots defaults to the current snapshot of each cluster
+	Snapshots []string
+	Size      int
+	Cursor    string
+}
+
+type Resource struct {
+	Id        string            `json:"id"`
+	Timestamp time.Time         `json:"timestamp"`
+	ClusterId string            `json:"clusterId"`
+	Kind      string            `json:"kind" example:"pods"`
+	Key       string            `json:"key" example:"pods#default/nginx"`
+	Namespace string            `json:"namespace,omitempty"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+type ResourcePage struct {
+	Resources  []*Resource `json:"resources"`
+	Total      int         `json:"total"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// ResourceDetail is a resource with its full object, as reported by the agent, and its findings.
+type ResourceDetail struct {
+	Resource
+	Object   map[string]interface{} `json:"object"`
+	Findings []*Finding             `json:"findings"`
+}
+
+// resourceDoc is the layout of the resource documents written by the agent reporter.
+// Dots in the keys of the object, such as in label keys, are replaced with underscores.
+type resourceDoc struct {
+	Timestamp time.Time              `json:"@timestamp"`
+	ClusterId string                 `json:"c"`
+	Kind      string                 `json:"k"`
+	Key       string                 `json:"r"`
+	Object    map[string]interface{} `json:"resource"`
+}
+
+// labelField is the document field of a label. Label keys are validated before use as field names.
+func labelField(key string) (string, error) {
+	if !patternLabelKey.MatchString(key) {
+		return "", fmt.Errorf("Invalid label key: %s", key)
+	}
+	return fieldResourceLabels + strings.ReplaceAll(key, ".", "_") + ".keyword", nil
+}
+
+func (q *ResourceQuery) filters() ([]types.Query, error) {
+	filters := []types.Query{
+		existsQuery(fieldResourceDoc),
+		termQuery(fieldCluster, q.ClusterId),
+	}
+	if len(q.Kinds) > 0 {
+		filters = append(filters, anyOf(fieldKind, q.Kinds))
+	}
+	if len(q.Namespaces) > 0 {
+		filters = append(filters, anyOf(fieldResourceNamespace, q.Namespaces))
+	}
+	if q.Name != "" {
+		filters = append(filters, prefixOf(fieldResourceName, q.Name))
+	}
+	for k, v := range q.Labels {
+		field, err := labelField(k)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, termQuery(field, v))
+	}
+	return filters, nil
+}
+
+func (es *EsFacade) searchResources(ctx context.Context, orgId string, q *ResourceQuery) (*ResourcePage, error) {
+	filters, err := q.filters()
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := es.snapshotFilter(ctx, orgId, q.Snapshots)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != nil {
+		filters = append(filters, *snapshot)
+	}
+
+	index := IndexName(orgId)
+	pit, after, found, err := es.startPage(ctx, index, q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return &ResourcePage{Resources: []*Resource{}}, nil
+	}
+
+	size := q.Size
+	req := &search.Request{
+		Query:          &types.Query{Bool: &types.BoolQuery{Filter: filters}},
+		Pit:            &types.PointInTimeReference{Id: pit, KeepAlive: pitKeepAlive},
+		Size:           &size,
+		Sort:           []types.SortCombinations{fieldSort(fieldResourceKey, false)},
+		SearchAfter:    after,
+		TrackTotalHits: true,
+	}
+
+	res, err := es.search(ctx, nil, req)
+	if err != nil {
+		es.endPage(ctx, index, nil, pit, size)
+		return nil, err
+	}
+
+	page := &ResourcePage{
+		Resources: make([]*Resource, 0, len(res.Hits.Hits)),
+		Total:     res.Hits.Total.Value,
+	}
+	for _, hit := range res.Hits.Hits {
+		doc, err := parseResourceDoc(hit)
+		if err != nil {
+			es.endPage(ctx, index, nil, pit, size)
+			return nil, err
+		}
+		page.Resources = append(page.Resources, toResource(hit.Id, doc))
+	}
+	page.NextCursor = es.endPage(ctx, index, res, pit, size)
+	return page, nil
+}
+
+func (es *EsFacade) getResource(ctx context.Context, orgId string, clusterId string, key string) (*ResourceDetail, error) {
+	filters := []types.Query{
+		existsQuery(fieldResourceDoc),
+		termQuery(fieldCluster, clusterId),
+		termQuery(fieldResourceKey, key),
+	}
+	snapshot, err := es.snapshotFilter(ctx, orgId, nil)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != nil {
+		filters = append(filters, *snapshot)
+	}
+
+	size := 1
+	req := &search.Request{
+		Query: &types.Query{Bool: &types.BoolQuery{Filter: filters}},
+		Size:  &size,
+		Sort:  []types.SortCombinations{fieldSort(fieldTimestamp, true)},
+	}
+	res, err := es.search(ctx, []string{IndexName(orgId)}, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Hits.Hits) == 0 {
+		return nil, nil
+	}
+	hit := res.Hits.Hits[0]
+	doc, err := parseResourceDoc(hit)
+	if err != nil {
+		return nil, err
+	}
+
+	findings, err := es.searchFindings(ctx, orgId, &FindingQuery{
+		ClusterIds: []string{clusterId},
+		Resources:  []string{key},
+		Sort:       "timestamp",
+		Desc:       true,
+		Size:       maxResourceFindings,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ResourceDetail{
+		Resource: *toResource(hit.Id, doc),
+		Object:   doc.Object,
+		Findings: findings.Findings,
+	}, nil
+}
+
+func parseResourceDoc(hit searchHit) (*resourceDoc, error) {
+	var doc resourceDoc
+	if err := json.Unmarshal(hit.Source, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func toResource(id string, doc *resourceDoc) *Resource {
+	r := &Resource{
+		Id:        id,
+		Timestamp: doc.Timestamp,
+		ClusterId: doc.ClusterId,
+		Kind:      doc.Kind,
+		Key:       doc.Key,
+	}
+	if metadata, ok := doc.Object["metadata"].(map[string]interface{}); ok {
+		r.Namespace, _ = metadata["namespace"].(string)
+		r.Name, _ = metadata["name"].(string)
+		if labels, ok := metadata["labels"].(map[string]interface{}); ok {
+			r.Labels = map[string]string{}
+			for k, v := range labels {
+				r.Labels[k] = fmt.Sprintf("%v", v)
+			}
+		}
+	}
+	return r
+}
+
+// SearchResources returns one page of the resources of a cluster matching the query, ordered by key.
+func SearchResources(orgId string, q *ResourceQuery) (*ResourcePage, error) {
+	return es.searchResources(context.Background(), orgId, q)
+}
+
+// GetResource returns the latest report of a resource with its findings, or nil if it is unknown.
+func GetResource(orgId string, clusterId string, key string) (*ResourceDetail, error) {
+	return es.getResource(context.Background(), orgId, clusterId, key)
+}
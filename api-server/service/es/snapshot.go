@@ -0,0 +1,111 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+)
+
+const (
+	fieldSnapshot   = "s.keyword"
+	maxClusterCount = 1000
+)
+
+// SnapshotIndexName is the index holding the pointer to the current snapshot of each cluster of an org.
+// The pointers are maintained by the agents, which tag every document with its snapshot id "s".
+func SnapshotIndexName(orgId string) string {
+	return "collie-snapshot-" + orgId
+}
+
+type SnapshotRef struct {
+	Id          string    `json:"id"`
+	StartedAt   time.Time `json:"startedAt"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+// SnapshotPointer designates the current snapshot of a cluster, and the snapshots retained for diffing.
+type SnapshotPointer struct {
+	ClusterId string    `json:"c"`
+	AgentId   string    `json:"a"`
+	Current   string    `json:"current"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// retained snapshots, newest first, starting with the current one
+	Snapshots []SnapshotRef `json:"snapshots"`
+}
+
+func (es *EsFacade) listSnapshotPointers(ctx context.Context, orgId string) ([]*SnapshotPointer, error) {
+	size := maxClusterCount
+	req := &search.Request{
+		Query: &types.Query{MatchAll: &types.MatchAllQuery{}},
+		Size:  &size,
+	}
+	res, err := es.search(ctx, []string{SnapshotIndexName(orgId)}, req)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return []*SnapshotPointer{}, nil
+		}
+		return nil, err
+	}
+	ret := make([]*SnapshotPointer, 0, len(res.Hits.Hits))
+	for _, hit := range res.Hits.Hits {
+		var p SnapshotPointer
+		if err := json.Unmarshal(hit.Source, &p); err != nil {
+			return nil, err
+		}
+		ret = append(ret, &p)
+	}
+	return ret, nil
+}
+
+// snapshotFilter restricts a query to the given snapshots, or to the current snapshot of each cluster
+// when none is given. Before any cycle of the org has completed there is no pointer, and no restriction.
+func (es *EsFacade) snapshotFilter(ctx context.Context, orgId string, snapshots []string) (*types.Query, error) {
+	if len(snapshots) == 0 {
+		pointers, err := es.listSnapshotPointers(ctx, orgId)
+		if err != nil {
+			return nil, err
+		}
+		if len(pointers) == 0 {
+			return nil, nil
+		}
+		for _, p := range pointers {
+			snapshots = append(snapshots, p.Current)
+		}
+	}
+	return &types.Query{Terms: &types.TermsQuery{
+		TermsQuery: map[string]types.TermsQueryField{fieldSnapshot: snapshots},
+	}}, nil
+}
+
+// GetSnapshotPointer returns the snapshot pointer of a cluster, or nil if no cycle of the cluster has completed.
+func GetSnapshotPointer(orgId string, clusterId string) (*SnapshotPointer, error) {
+	pointers, err := es.listSnapshotPointers(context.Background(), orgId)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pointers {
+		if p.ClusterId == clusterId {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
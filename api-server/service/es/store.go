@@ -0,0 +1,92 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package es
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+
+	"collie-api-server/service/persist"
+)
+
+// The durable collections of the services, such as waivers, are kept in an index per collection and org.
+// Only the envelope of the items is indexed, the services search their items in memory.
+
+// storeMapping indexes the envelope of the items, and keeps the items as they are
+const storeMapping = `{"mappings":{"dynamic":false,"properties":{"collection":{"type":"keyword"},"orgId":{"type":"keyword"},"id":{"type":"keyword"}}}}`
+
+// StoreIndexName is the index of the items of a durable collection of an org.
+func StoreIndexName(collection string, orgId string) string {
+	return "collie-store-" + collection + "-" + orgId
+}
+
+type storeDoc struct {
+	Collection string          `json:"collection"`
+	OrgId      string          `json:"orgId"`
+	Id         string          `json:"id"`
+	Item       json.RawMessage `json:"item"`
+}
+
+type storeBackend struct{}
+
+func init() {
+	persist.SetBackend(storeBackend{})
+}
+
+func (storeBackend) Put(collection string, orgId string, id string, item interface{}) error {
+	index := StoreIndexName(collection, orgId)
+	if err := es.ensureIndex(context.Background(), index, storeMapping); err != nil {
+		return err
+	}
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return PutDoc(index, id, &storeDoc{Collection: collection, OrgId: orgId, Id: id, Item: b})
+}
+
+func (storeBackend) Delete(collection string, orgId string, id string) error {
+	return DeleteDoc(StoreIndexName(collection, orgId), id)
+}
+
+// Load reads the items of a collection from the indices of every org. The pattern of the indices may
+// match the indices of other collections, whose names start alike, so the items are filtered by collection.
+func (storeBackend) Load(collection string) ([]persist.Record, error) {
+	ctx := context.Background()
+	it, err := es.iterate(ctx, StoreIndexName(collection, "*"),
+		[]types.Query{termQuery("collection", collection)}, fieldSort("id", false))
+	if err != nil {
+		return nil, err
+	}
+	defer it.close()
+	ret := []persist.Record{}
+	for {
+		hit, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if hit == nil {
+			return ret, nil
+		}
+		var doc storeDoc
+		if err := json.Unmarshal(hit.Source, &doc); err != nil {
+			return nil, err
+		}
+		ret = append(ret, persist.Record{OrgId: doc.OrgId, Id: doc.Id, Item: doc.Item})
+	}
+}
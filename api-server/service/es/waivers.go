@@ -0,0 +1,124 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package es
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+
+	"collie-api-server/service/waiver"
+)
+
+// StatusWaived is the status of the failing findings covered by a waiver. Waivers are applied when
+// findings are read, so that creating, renewing or deleting a waiver takes effect without a new scan.
+const StatusWaived = "WAIVED"
+
+var failingStatuses = []string{"FAIL", "WARN"}
+
+// waivedQuery matches the failing findings covered by any of the waivers.
+func waivedQuery(waivers []*waiver.Waiver) types.Query {
+	if len(waivers) == 0 {
+		return types.Query{MatchNone: &types.MatchNoneQuery{}}
+	}
+	should := make([]types.Query, 0, len(waivers))
+	for _, w := range waivers {
+		must := []types.Query{
+			anyOf(fieldPlugin, []string{w.Plugin}),
+			termQuery(fieldRuleId, w.RuleId),
+			anyOf(fieldStatus, failingStatuses),
+		}
+		if w.ClusterId != "" {
+			must = append(must, termQuery(fieldCluster, w.ClusterId))
+		}
+		if w.Namespace != "" {
+			must = append(must, termQuery(fieldNamespace, w.Namespace))
+		}
+		if prefix, ok := strings.CutSuffix(w.Resource, "*"); ok {
+			must = append(must, types.Query{Prefix: map[string]types.PrefixQuery{fieldResource: {Value: prefix}}})
+		} else if w.Resource != "" {
+			must = append(must, termQuery(fieldResource, w.Resource))
+		}
+		should = append(should, types.Query{Bool: &types.BoolQuery{Filter: must}})
+	}
+	return types.Query{Bool: &types.BoolQuery{Should: should, MinimumShouldMatch: 1}}
+}
+
+// statusQuery matches the findings with any of the statuses, as they read once waivers are applied.
+func statusQuery(statuses []string, waived types.Query) types.Query {
+	should := make([]types.Query, 0, len(statuses))
+	for _, s := range statuses {
+		if strings.EqualFold(s, StatusWaived) {
+			// findings reported as waived by the agent, or waived here
+			should = append(should, anyOf(fieldStatus, []string{s}), waived)
+		} else {
+			should = append(should, types.Query{Bool: &types.BoolQuery{
+				Filter:  []types.Query{anyOf(fieldStatus, []string{s})},
+				MustNot: []types.Query{waived},
+			}})
+		}
+	}
+	return types.Query{Bool: &types.BoolQuery{Should: should, MinimumShouldMatch: 1}}
+}
+
+// waivedStatusAgg counts the waived findings per original status.
+func waivedStatusAgg(waived types.Query) types.Aggregations {
+	return types.Aggregations{
+		Filter:       &waived,
+		Aggregations: map[string]types.Aggregations{"status": termsAgg(fieldStatus, 10)},
+	}
+}
+
+// decodeWaivedStatus decodes the counts of waivedStatusAgg.
+func decodeWaivedStatus(raw json.RawMessage) (map[string]int64, error) {
+	if raw == nil {
+		return map[string]int64{}, nil
+	}
+	var agg struct {
+		Status json.RawMessage `json:"status"`
+	}
+	if err := json.Unmarshal(raw, &agg); err != nil {
+		return nil, err
+	}
+	return termsFacets(agg.Status)
+}
+
+// waive moves the waived findings out of their original status in status facets.
+func waive(counts map[string]int64, waived map[string]int64) {
+	for status, n := range waived {
+		if counts[status] -= n; counts[status] <= 0 {
+			delete(counts, status)
+		}
+		counts[StatusWaived] += n
+	}
+}
+
+// applyWaivers marks the failing findings covered by a waiver as waived.
+func applyWaivers(waivers []*waiver.Waiver, findings []*Finding) {
+	for _, f := range findings {
+		if !IsFailing(f.Status) {
+			continue
+		}
+		for _, w := range waivers {
+			if w.Matches(f.Plugin, f.RuleId, f.ClusterId, f.Namespace, f.Resource) {
+				f.Status = StatusWaived
+				f.WaiverId = w.Id
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package export
+
+import "time"
+
+// statusWaived is the status of the failures accepted by a waiver, as es.StatusWaived
+const statusWaived = "WAIVED"
+
+// Finding is a result of a check to export. The exports do not depend on where the findings are stored, the
+// agent exports its results of a cluster alike.
+type Finding struct {
+	Timestamp   time.Time
+	ClusterId   string
+	Plugin      string
+	RuleId      string
+	Category    string
+	Subcategory string
+	Description string
+	Status      string
+	// WaiverId is the waiver accepting the failure, empty when waived by an annotation of the resource
+	WaiverId    string
+	Severity    string
+	Namespace   string
+	Resource    string
+	Remediation string
+}
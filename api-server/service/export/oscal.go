@@ -0,0 +1,220 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package export
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+)
+
+// OSCAL 1.1 assessment results, https://pages.nist.gov/OSCAL/reference/1.1.1/assessment-results/json-outline/
+// Each finding is an observation of the check, with its location as properties, and an OSCAL finding on
+// the rule, satisfied when the check passed.
+
+const (
+	oscalVersion = "1.1.1"
+	oscalPropNs  = "https://github.com/vmware-labs/compliance-dashboard-for-kubernetes/ns/oscal"
+)
+
+type oscalDocument struct {
+	AssessmentResults oscalAssessmentResults `json:"assessment-results"`
+}
+
+type oscalAssessmentResults struct {
+	Uuid     string        `json:"uuid"`
+	Metadata oscalMetadata `json:"metadata"`
+	ImportAp oscalImportAp `json:"import-ap"`
+	Results  []oscalResult `json:"results"`
+}
+
+type oscalMetadata struct {
+	Title        string `json:"title"`
+	LastModified string `json:"last-modified"`
+	Version      string `json:"version"`
+	OscalVersion string `json:"oscal-version"`
+}
+
+type oscalImportAp struct {
+	Href string `json:"href"`
+}
+
+type oscalResult struct {
+	Uuid             string                `json:"uuid"`
+	Title            string                `json:"title"`
+	Description      string                `json:"description"`
+	Start            string                `json:"start"`
+	ReviewedControls oscalReviewedControls `json:"reviewed-controls"`
+	Observations     []oscalObservation    `json:"observations,omitempty"`
+	Findings         []oscalFinding        `json:"findings,omitempty"`
+}
+
+type oscalReviewedControls struct {
+	ControlSelections []oscalControlSelection `json:"control-selections"`
+}
+
+type oscalControlSelection struct {
+	IncludeAll struct{} `json:"include-all"`
+}
+
+type oscalProp struct {
+	Name  string `json:"name"`
+	Ns    string `json:"ns,omitempty"`
+	Value string `json:"value"`
+}
+
+type oscalObservation struct {
+	Uuid        string      `json:"uuid"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	Props       []oscalProp `json:"props"`
+	Methods     []string    `json:"methods"`
+	Types       []string    `json:"types"`
+	Collected   string      `json:"collected"`
+	Remarks     string      `json:"remarks,omitempty"`
+}
+
+type oscalFinding struct {
+	Uuid                string                    `json:"uuid"`
+	Title               string                    `json:"title"`
+	Description         string                    `json:"description"`
+	Target              oscalTarget               `json:"target"`
+	RelatedObservations []oscalRelatedObservation `json:"related-observations"`
+	Remarks             string                    `json:"remarks,omitempty"`
+}
+
+type oscalTarget struct {
+	Type     string            `json:"type"`
+	TargetId string            `json:"target-id"`
+	Status   oscalTargetStatus `json:"status"`
+}
+
+type oscalTargetStatus struct {
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type oscalRelatedObservation struct {
+	ObservationUuid string `json:"observation-uuid"`
+}
+
+func newUuid() string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+// oscalProps lists the non-empty properties, as OSCAL does not allow empty values, nor surrounding spaces.
+func oscalProps(kv ...string) []oscalProp {
+	props := []oscalProp{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if v := strings.TrimSpace(kv[i+1]); v != "" {
+			props = append(props, oscalProp{Name: kv[i], Ns: oscalPropNs, Value: v})
+		}
+	}
+	return props
+}
+
+// oscalTargetId turns a rule into a token, the syntax of OSCAL identifiers.
+func oscalTargetId(f *Finding) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '_' {
+			return r
+		}
+		return '_'
+	}, f.Plugin+"_"+f.RuleId)
+}
+
+// OSCAL exports findings as OSCAL assessment results.
+func OSCAL(title string, findings []*Finding, start time.Time) ([]byte, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	result := oscalResult{
+		Uuid:        newUuid(),
+		Title:       title,
+		Description: "Automated assessment of kubernetes clusters by kube-bench, kube-hunter and Collie rules.",
+		Start:       start.UTC().Format(time.RFC3339),
+		ReviewedControls: oscalReviewedControls{
+			ControlSelections: []oscalControlSelection{{}},
+		},
+	}
+
+	for _, f := range findings {
+		description := nonEmpty(f.Description, f.RuleId)
+		collected := f.Timestamp
+		if collected.IsZero() {
+			collected = start
+		}
+		obs := oscalObservation{
+			Uuid:        newUuid(),
+			Title:       f.Plugin + " " + f.RuleId,
+			Description: description,
+			Props: oscalProps(
+				"plugin", f.Plugin,
+				"rule-id", f.RuleId,
+				"status", f.Status,
+				"severity", f.Severity,
+				"category", f.Category,
+				"cluster", f.ClusterId,
+				"namespace", f.Namespace,
+				"resource", f.Resource,
+			),
+			Methods:   []string{"TEST"},
+			Types:     []string{"finding"},
+			Collected: collected.UTC().Format(time.RFC3339),
+		}
+		if strings.EqualFold(f.Status, statusWaived) {
+			obs.Props = append(obs.Props, oscalProps("waived-by", waivedBy(f.WaiverId))...)
+		}
+		result.Observations = append(result.Observations, obs)
+
+		state := "satisfied"
+		if notSatisfied(f.Status) {
+			state = "not-satisfied"
+		}
+		result.Findings = append(result.Findings, oscalFinding{
+			Uuid:        newUuid(),
+			Title:       f.Plugin + " " + f.RuleId,
+			Description: description,
+			Target: oscalTarget{
+				Type:     "objective-id",
+				TargetId: oscalTargetId(f),
+				Status:   oscalTargetStatus{State: state},
+			},
+			RelatedObservations: []oscalRelatedObservation{{ObservationUuid: obs.Uuid}},
+			Remarks:             f.Remediation,
+		})
+	}
+
+	doc := oscalDocument{AssessmentResults: oscalAssessmentResults{
+		Uuid: newUuid(),
+		Metadata: oscalMetadata{
+			Title:        title,
+			LastModified: now,
+			Version:      now,
+			OscalVersion: oscalVersion,
+		},
+		// there is no assessment plan document, the plan is implied by the plugins
+		ImportAp: oscalImportAp{Href: "#"},
+		Results:  []oscalResult{result},
+	}}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func notSatisfied(status string) bool {
+	s := strings.ToUpper(status)
+	// a waived failure is still not satisfied, the waiver only accepts the risk
+	return s == "FAIL" || s == "WARN" || s == statusWaived
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"collie-api-server/service/agent"
+)
+
+const namespace = "collie_api"
+
+// providers are the auth providers counted by name, the others are counted as invalid
+var providers = map[string]bool{"api": true, "csp": true, "gitlab": true, "google": true, "none": true}
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "HTTP requests by route and status.",
+	}, []string{"method", "route", "status"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the HTTP requests by route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Failed authentications by auth provider.",
+	}, []string{"provider"})
+	esDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "es_request_duration_seconds",
+		Help:      "Latency of the requests to ES by operation and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "code"})
+	onboarding = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "onboarding_total",
+		Help:      "Onboarding steps: bootstrap commands and agent manifests served, agents registered.",
+	}, []string{"step"})
+)
+
+func init() {
+	prometheus.MustRegister(agentCollector{
+		desc: prometheus.NewDesc(namespace+"_agents", "Registered agents by status.", []string{"status"}, nil),
+	})
+}
+
+// agentCollector counts the agents of the registry at each scrape, since their status is derived from the time.
+type agentCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c agentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c agentCollector) Collect(ch chan<- prometheus.Metric) {
+	byStatus, err := agent.CountByStatus()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	counts := map[string]int{agent.StatusHealthy: 0, agent.StatusStale: 0, agent.StatusErrored: 0}
+	for status, n := range byStatus {
+		counts[status] = n
+	}
+	for status, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), status)
+	}
+}
+
+// Handler serves the metrics in the Prometheus format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RequestServed records an HTTP request. route is the path template of the request, such as /collie/api/v1/agents/:id.
+func RequestServed(method string, route string, status int, d time.Duration) {
+	code := strconv.Itoa(status)
+	requests.WithLabelValues(method, route, code).Inc()
+	requestDuration.WithLabelValues(method, route, code).Observe(d.Seconds())
+}
+
+// AuthFailed records a failed authentication, provider is empty when no token was given.
+func AuthFailed(provider string) {
+	if provider == "" {
+		provider = "none"
+	} else if !providers[provider] {
+		provider = "invalid"
+	}
+	authFailures.WithLabelValues(provider).Inc()
+}
+
+// Onboarding records an onboarding step.
+func Onboarding(step string) {
+	onboarding.WithLabelValues(step).Inc()
+}
+
+// InstrumentES records the latency of the requests to ES going through next.
+func InstrumentES(next http.RoundTripper) http.RoundTripper {
+	return esRoundTripper{next: next}
+}
+
+type esRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (rt esRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := rt.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	esDuration.WithLabelValues(esOperation(req.URL.Path), code).Observe(time.Since(start).Seconds())
+	return res, err
+}
+
+// esOperation returns the ES API of a path, its last segment starting with "_" such as _search or _pit,
+// leaving out the index names.
+func esOperation(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if strings.HasPrefix(segments[i], "_") {
+			return segments[i]
+		}
+	}
+	if len(segments) == 1 && segments[0] == "" {
+		return "info"
+	}
+	return "other"
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headerValue keeps reported values from injecting mail headers.
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+func sendEmail(ctx context.Context, ch *Channel, events []*Event) error {
+	cfg := getSettings()
+	if cfg.SmtpHost == "" {
+		return errors.New("NOTIFY_SMTP_HOST is not configured")
+	}
+
+	subject := "[Collie] " + events[0].Title
+	if len(events) > 1 {
+		subject = fmt.Sprintf("[Collie] %d notifications", len(events))
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", headerValue(cfg.SmtpFrom))
+	fmt.Fprintf(&msg, "To: %s\r\n", headerValue(strings.Join(ch.Recipients, ", ")))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", headerValue(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(summary(events, false), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	var auth smtp.Auth
+	if cfg.SmtpUsername != "" {
+		auth = smtp.PlainAuth("", cfg.SmtpUsername, cfg.SmtpPassword, cfg.SmtpHost)
+	}
+	addr := net.JoinHostPort(cfg.SmtpHost, strconv.Itoa(cfg.SmtpPort))
+
+	// smtp.SendMail has no context, give up waiting for it when the context is done
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(addr, auth, cfg.SmtpFrom, ch.Recipients, []byte(msg.String()))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
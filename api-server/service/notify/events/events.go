@@ -0,0 +1,106 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"collie-api-server/service/agent"
+	"collie-api-server/service/es"
+	"collie-api-server/service/notify"
+	"collie-api-server/service/scan"
+)
+
+// notifiedSeverities are the severities of the new findings worth a notification.
+var notifiedSeverities = map[string]bool{"critical": true, "high": true}
+
+// NewFindings publishes the newly failing findings of a cluster with a critical or high severity.
+func NewFindings(orgId string, clusterId string, findings []*es.Finding) {
+	events := []*notify.Event{}
+	now := time.Now().UTC()
+	for _, f := range findings {
+		if !notifiedSeverities[strings.ToLower(f.Severity)] || !es.IsFailing(f.Status) {
+			continue
+		}
+		location := f.Resource
+		if location == "" {
+			location = f.Namespace
+		}
+		msg := f.Description
+		if location != "" {
+			msg += " on " + location
+		}
+		events = append(events, &notify.Event{
+			Type:      notify.EventNewFinding,
+			OrgId:     orgId,
+			ClusterId: clusterId,
+			Severity:  strings.ToUpper(f.Severity),
+			Title:     fmt.Sprintf("New %s finding: %s %s", strings.ToUpper(f.Severity), f.Plugin, f.RuleId),
+			Message:   msg,
+			Time:      now,
+			Key:       strings.Join([]string{notify.EventNewFinding, clusterId, f.Plugin, f.RuleId, f.Resource}, "|"),
+			Data:      map[string]string{"plugin": f.Plugin, "ruleId": f.RuleId, "resource": f.Resource, "status": f.Status},
+		})
+	}
+	if len(events) > 0 {
+		notify.Publish(orgId, events...)
+	}
+}
+
+// AgentStale publishes that an agent has not been heard from for too long.
+func AgentStale(info *agent.AgentInfo) {
+	notify.Publish(info.OrgId, &notify.Event{
+		Type:      notify.EventAgentStale,
+		OrgId:     info.OrgId,
+		ClusterId: info.ClusterId,
+		Title:     "Agent " + info.AgentId + " is stale",
+		Message:   "Last heartbeat at " + info.LastHeartbeat.Format(time.RFC3339) + ", the cluster is no longer assessed.",
+		Time:      time.Now().UTC(),
+		Key:       notify.EventAgentStale + "|" + info.AgentId + "|" + info.LastHeartbeat.Format(time.RFC3339),
+		Data:      map[string]string{"agentId": info.AgentId},
+	})
+}
+
+// ScanFailed publishes that every phase of a scan failed.
+func ScanFailed(orgId string, s *scan.Scan) {
+	notify.Publish(orgId, &notify.Event{
+		Type:      notify.EventScanFailed,
+		OrgId:     orgId,
+		ClusterId: s.ClusterId,
+		Title:     "Scan " + s.Id + " failed",
+		Message:   strings.Join(s.Errors, "\n"),
+		Time:      time.Now().UTC(),
+		Key:       notify.EventScanFailed + "|" + s.Id,
+		Data:      map[string]string{"scanId": s.Id, "agentId": s.AgentId},
+	})
+}
+
+// ScoreBelow publishes the score of a cluster, delivered to the channels whose threshold is above it.
+func ScoreBelow(orgId string, p *es.Posture) {
+	notify.Publish(orgId, &notify.Event{
+		Type:      notify.EventScoreBelow,
+		OrgId:     orgId,
+		ClusterId: p.ClusterId,
+		Title:     fmt.Sprintf("Compliance score dropped to %.1f%%", p.Score),
+		Message:   fmt.Sprintf("%d failed and %d warning checks in scan %s.", p.Fail, p.Warn, p.ScanId),
+		Time:      time.Now().UTC(),
+		Key:       notify.EventScoreBelow + "|" + p.ClusterId,
+		Score:     p.Score,
+		Data:      map[string]string{"scanId": p.ScanId},
+	})
+}
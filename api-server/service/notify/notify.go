@@ -0,0 +1,480 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"collie-api-server/service/persist"
+	"collie-api-server/util"
+)
+
+const (
+	TypeWebhook = "webhook"
+	TypeSlack   = "slack"
+	TypeEmail   = "email"
+)
+
+const (
+	EventNewFinding = "finding.new"
+	EventAgentStale = "agent.stale"
+	EventScanFailed = "scan.failed"
+	EventScoreBelow = "score.below"
+	// EventAlert is sent to the channels targeted by an alert rule, whatever their events
+	EventAlert = "alert"
+)
+
+var eventTypes = []string{EventNewFinding, EventAgentStale, EventScanFailed, EventScoreBelow}
+
+// Channel is where the notifications of an org are delivered. A channel with a digest collects
+// its events and delivers them together once the digest period is over.
+type Channel struct {
+	Id         string   `json:"id" example:"3b9e0c7d"`
+	OrgId      string   `json:"orgId"`
+	Name       string   `json:"name" example:"security-team"`
+	Type       string   `json:"type" example:"webhook" enums:"webhook,slack,email"`
+	Url        string   `json:"url,omitempty" example:"https://hooks.example.com/collie"`
+	Recipients []string `json:"recipients,omitempty"`
+	// the secret signing webhook payloads is never returned
+	Secret    string   `json:"-"`
+	HasSecret bool     `json:"hasSecret"`
+	Events    []string `json:"events" example:"finding.new,scan.failed"`
+	// ScoreThreshold is the score below which score.below events are delivered, 0 to never deliver them
+	ScoreThreshold float64   `json:"scoreThreshold" example:"80"`
+	Digest         string    `json:"digest,omitempty" example:"1h"`
+	Enabled        bool      `json:"enabled"`
+	CreatedAt      time.Time `json:"createdAt"`
+	LastDelivery   time.Time `json:"lastDelivery,omitempty"`
+	LastError      string    `json:"lastError,omitempty"`
+}
+
+// ErrInvalid is returned when a request does not make a valid channel
+var ErrInvalid = errors.New("Invalid channel")
+
+// storedChannel is a channel as kept in the collection, along with its secret
+type storedChannel struct {
+	Channel
+	Secret string `json:"secret,omitempty"`
+}
+
+// ChannelRequest creates or replaces a channel. Events defaults to all event types.
+type ChannelRequest struct {
+	Name       string   `json:"name" binding:"required"`
+	Type       string   `json:"type" binding:"required" enums:"webhook,slack,email"`
+	Url        string   `json:"url"`
+	Recipients []string `json:"recipients"`
+	Secret     string   `json:"secret"`
+	// ClearSecret removes the secret of the channel, which is kept when Secret is empty
+	ClearSecret    bool     `json:"clearSecret"`
+	Events         []string `json:"events"`
+	ScoreThreshold float64  `json:"scoreThreshold"`
+	Digest         string   `json:"digest" example:"1h"`
+	Enabled        *bool    `json:"enabled"`
+}
+
+// Event is something worth telling an org about. Events with the same key are delivered once
+// per channel within the dedup window.
+type Event struct {
+	Type      string            `json:"type" example:"finding.new"`
+	OrgId     string            `json:"orgId"`
+	ClusterId string            `json:"clusterId,omitempty"`
+	Severity  string            `json:"severity,omitempty"`
+	Title     string            `json:"title"`
+	Message   string            `json:"message"`
+	Time      time.Time         `json:"time"`
+	Key       string            `json:"key"`
+	Score     float64           `json:"score,omitempty"`
+	Data      map[string]string `json:"data,omitempty"`
+}
+
+// Settings configure the delivery of the notifications, from the notify configuration.
+type Settings struct {
+	// DedupWindow is the time within which events of the same key are delivered once per channel
+	DedupWindow time.Duration
+	// DigestCheck is the time between two checks of the digests due
+	DigestCheck time.Duration
+	// Timeout bounds a delivery
+	Timeout      time.Duration
+	SmtpHost     string
+	SmtpPort     int
+	SmtpFrom     string
+	SmtpUsername string
+	SmtpPassword string
+	// AllowPrivateUrls lets webhook and slack channels deliver to loopback, link-local and
+	// private addresses, which are refused otherwise
+	AllowPrivateUrls bool
+}
+
+type sender func(ctx context.Context, ch *Channel, events []*Event) error
+
+var senders = map[string]sender{
+	TypeWebhook: sendWebhook,
+	TypeSlack:   sendSlack,
+	TypeEmail:   sendEmail,
+}
+
+var (
+	settings    Settings
+	channelColl persist.DurableStore
+	mu          sync.Mutex
+	// sent holds when an event key was last delivered to a channel, by channel id and key
+	sent = map[string]map[string]time.Time{}
+	// pending holds the events waiting for the digest of a channel, by channel id
+	pending = map[string]*digest{}
+)
+
+type digest struct {
+	orgId  string
+	since  time.Time
+	events []*Event
+}
+
+func init() {
+	channelColl = persist.Durable("notification-channel", func() interface{} { return &storedChannel{} })
+}
+
+// Configure sets the delivery settings, before the first notification is published.
+func Configure(s Settings) {
+	mu.Lock()
+	defer mu.Unlock()
+	settings = s
+}
+
+func getSettings() Settings {
+	mu.Lock()
+	defer mu.Unlock()
+	return settings
+}
+
+func putChannel(ch *Channel) error {
+	return channelColl.Put(ch.OrgId, ch.Id, &storedChannel{Channel: *ch, Secret: ch.Secret})
+}
+
+func getChannel(orgId string, channelId string) (*Channel, error) {
+	v, err := channelColl.Get(orgId, channelId)
+	if err != nil {
+		return nil, err
+	}
+	stored := v.(*storedChannel)
+	ch := stored.Channel
+	ch.Secret = stored.Secret
+	return &ch, nil
+}
+
+// digestPeriod is the period of the digest of the channel, 0 to deliver the events right away.
+func (ch *Channel) digestPeriod() time.Duration {
+	d, _ := time.ParseDuration(ch.Digest)
+	return d
+}
+
+// toChannel validates the request and sets it to the channel. Urls on a private address are
+// refused unless allowPrivate, urls on a host name are checked when delivering.
+func (r *ChannelRequest) toChannel(ch *Channel, allowPrivate bool) error {
+	if _, ok := senders[r.Type]; !ok {
+		return fmt.Errorf("Unsupported channel type: %s", r.Type)
+	}
+	switch r.Type {
+	case TypeWebhook, TypeSlack:
+		u, err := url.Parse(r.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid url: %s", r.Url)
+		}
+		if ip := net.ParseIP(u.Hostname()); ip != nil && isPrivate(ip) && !allowPrivate {
+			return fmt.Errorf("Private address not allowed: %s", r.Url)
+		}
+	case TypeEmail:
+		if len(r.Recipients) == 0 {
+			return errors.New("recipients are required")
+		}
+		for _, rcpt := range r.Recipients {
+			if !strings.Contains(rcpt, "@") || strings.ContainsAny(rcpt, "\r\n") {
+				return fmt.Errorf("Invalid recipient: %s", rcpt)
+			}
+		}
+	}
+	for _, e := range r.Events {
+		if !contains(eventTypes, e) {
+			return fmt.Errorf("Unknown event type: %s", e)
+		}
+	}
+	if r.Digest != "" {
+		d, err := time.ParseDuration(r.Digest)
+		if err != nil || d < 0 {
+			return fmt.Errorf("Invalid digest: %s", r.Digest)
+		}
+	}
+
+	ch.Name = r.Name
+	ch.Type = r.Type
+	ch.Url = r.Url
+	ch.Recipients = r.Recipients
+	if r.Secret != "" || r.ClearSecret {
+		ch.Secret = r.Secret
+	}
+	ch.HasSecret = ch.Secret != ""
+	ch.Events = r.Events
+	if len(ch.Events) == 0 {
+		ch.Events = eventTypes
+	}
+	ch.ScoreThreshold = r.ScoreThreshold
+	ch.Digest = r.Digest
+	ch.Enabled = r.Enabled == nil || *r.Enabled
+	return nil
+}
+
+func CreateChannel(orgId string, r *ChannelRequest) (*Channel, error) {
+	ch := &Channel{
+		Id:        util.RandomString(8),
+		OrgId:     orgId,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := r.toChannel(ch, getSettings().AllowPrivateUrls); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+	if err := putChannel(ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func UpdateChannel(orgId string, channelId string, r *ChannelRequest) (*Channel, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	ch, err := getChannel(orgId, channelId)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.toChannel(ch, settings.AllowPrivateUrls); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+	if err := putChannel(ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func GetChannel(orgId string, channelId string) (*Channel, error) {
+	return getChannel(orgId, channelId)
+}
+
+// ListChannels returns the channels of the org, oldest first.
+func ListChannels(orgId string) ([]*Channel, error) {
+	items, err := channelColl.List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Channel, 0, len(items))
+	for _, v := range items {
+		stored := v.(*storedChannel)
+		ch := stored.Channel
+		ch.Secret = stored.Secret
+		ret = append(ret, &ch)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].CreatedAt.Before(ret[j].CreatedAt)
+	})
+	return ret, nil
+}
+
+func DeleteChannel(orgId string, channelId string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := channelColl.Delete(orgId, channelId); err != nil {
+		return err
+	}
+	delete(sent, channelId)
+	delete(pending, channelId)
+	return nil
+}
+
+func (ch *Channel) accepts(e *Event) bool {
+	if !ch.Enabled || !contains(ch.Events, e.Type) {
+		return false
+	}
+	if e.Type == EventScoreBelow {
+		return e.Score < ch.ScoreThreshold
+	}
+	return true
+}
+
+// Publish delivers events to the channels of the org subscribed to them, dropping the events
+// already delivered within the dedup window. Delivery is asynchronous.
+func Publish(orgId string, events ...*Event) {
+	channels, err := ListChannels(orgId)
+	if err != nil {
+		log.Printf("Error publishing %d notification(s) of org %s: %s", len(events), orgId, err)
+		return
+	}
+	publish(channels, (*Channel).accepts, events)
+}
+
+// PublishTo delivers events to the given channels of the org, as Publish does, regardless of the
+// events the channels are subscribed to.
+func PublishTo(orgId string, channelIds []string, events ...*Event) {
+	all, err := ListChannels(orgId)
+	if err != nil {
+		log.Printf("Error publishing %d notification(s) of org %s: %s", len(events), orgId, err)
+		return
+	}
+	channels := []*Channel{}
+	for _, ch := range all {
+		if contains(channelIds, ch.Id) {
+			channels = append(channels, ch)
+		}
+	}
+	publish(channels, func(ch *Channel, e *Event) bool { return ch.Enabled }, events)
+}
+
+func publish(channels []*Channel, accepts func(*Channel, *Event) bool, events []*Event) {
+	now := time.Now()
+
+	mu.Lock()
+	defer mu.Unlock()
+	window := settings.DedupWindow
+	for _, ch := range channels {
+		batch := []*Event{}
+		for _, e := range events {
+			if !accepts(ch, e) {
+				continue
+			}
+			if last, ok := sent[ch.Id][e.Key]; ok && now.Sub(last) < window {
+				continue
+			}
+			if sent[ch.Id] == nil {
+				sent[ch.Id] = map[string]time.Time{}
+			}
+			// the key is reserved until the delivery, which forgets it if it fails
+			sent[ch.Id][e.Key] = now
+			batch = append(batch, e)
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if ch.digestPeriod() > 0 {
+			if pending[ch.Id] == nil {
+				pending[ch.Id] = &digest{orgId: ch.OrgId, since: now}
+			}
+			pending[ch.Id].events = append(pending[ch.Id].events, batch...)
+			continue
+		}
+		go deliver(ch, batch)
+	}
+}
+
+// Test delivers a test event to a channel, synchronously.
+func Test(orgId string, channelId string) error {
+	ch, err := GetChannel(orgId, channelId)
+	if err != nil {
+		return err
+	}
+	return deliver(ch, []*Event{{
+		Type:    "test",
+		OrgId:   orgId,
+		Title:   "Test notification",
+		Message: fmt.Sprintf("Channel %s is set up to receive Collie notifications.", ch.Name),
+		Time:    time.Now().UTC(),
+		Key:     "test",
+	}})
+}
+
+func deliver(ch *Channel, events []*Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), getSettings().Timeout)
+	defer cancel()
+	err := senders[ch.Type](ctx, ch, events)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if stored, e := getChannel(ch.OrgId, ch.Id); e == nil {
+		stored.LastDelivery = time.Now().UTC()
+		stored.LastError = ""
+		if err != nil {
+			stored.LastError = err.Error()
+		}
+		if e := putChannel(stored); e != nil {
+			log.Printf("Error recording the delivery to channel %s of org %s: %s", ch.Id, ch.OrgId, e)
+		}
+	}
+	if err != nil {
+		log.Printf("Error delivering %d notification(s) to channel %s of org %s: %s", len(events), ch.Id, ch.OrgId, err)
+		// the events are delivered again when they are published next
+		for _, e := range events {
+			delete(sent[ch.Id], e.Key)
+		}
+	}
+	return err
+}
+
+// flushDigests delivers the pending events of the channels whose digest period is over,
+// counted from the first pending event. It also forgets the keys past the dedup window.
+func flushDigests(now time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	window := settings.DedupWindow
+	for channelId, d := range pending {
+		ch, err := getChannel(d.orgId, channelId)
+		if err != nil {
+			delete(pending, channelId)
+			continue
+		}
+		if now.Sub(d.since) < ch.digestPeriod() {
+			continue
+		}
+		delete(pending, channelId)
+		go deliver(ch, d.events)
+	}
+	for channelId, keys := range sent {
+		for k, t := range keys {
+			if now.Sub(t) >= window {
+				delete(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			delete(sent, channelId)
+		}
+	}
+}
+
+// Run flushes the digests until the context is done.
+func Run(ctx context.Context) {
+	ticker := time.NewTicker(getSettings().DigestCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			flushDigests(now)
+		}
+	}
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,355 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+func configure(t *testing.T, s Settings) {
+	t.Helper()
+	if s.Timeout == 0 {
+		s.Timeout = 5 * time.Second
+	}
+	old := getSettings()
+	Configure(s)
+	t.Cleanup(func() { Configure(old) })
+}
+
+// webhookServer records the requests it receives.
+func webhookServer(t *testing.T) (*httptest.Server, chan received) {
+	t.Helper()
+	requests := make(chan received, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{header: r.Header, body: body}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func receive(t *testing.T, requests chan received) received {
+	t.Helper()
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+	}
+	return received{}
+}
+
+func noDelivery(t *testing.T, requests chan received) {
+	t.Helper()
+	select {
+	case r := <-requests:
+		t.Fatalf("unexpected delivery: %s", r.body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func payload(t *testing.T, r received) *webhookPayload {
+	t.Helper()
+	var p webhookPayload
+	if err := json.Unmarshal(r.body, &p); err != nil {
+		t.Fatal(err)
+	}
+	return &p
+}
+
+func createChannel(t *testing.T, orgId string, r *ChannelRequest) *Channel {
+	t.Helper()
+	ch, err := CreateChannel(orgId, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = DeleteChannel(orgId, ch.Id) })
+	return ch
+}
+
+func event(orgId string, key string) *Event {
+	return &Event{Type: EventScanFailed, OrgId: orgId, Title: "Scan " + key + " failed", Time: time.Now().UTC(), Key: key}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	configure(t, Settings{DedupWindow: time.Hour, AllowPrivateUrls: true})
+	srv, requests := webhookServer(t)
+	createChannel(t, "org-sign", &ChannelRequest{Name: "signed", Type: TypeWebhook, Url: srv.URL, Secret: "s3cret"})
+
+	Publish("org-sign", event("org-sign", "a"))
+	r := receive(t, requests)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(r.body)
+	if got, want := r.header.Get(SignatureHeader), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("%s = %q, want %q", SignatureHeader, got, want)
+	}
+	if got := r.header.Get("X-Collie-Event"); got != EventScanFailed {
+		t.Errorf("X-Collie-Event = %q", got)
+	}
+	if p := payload(t, r); p.OrgId != "org-sign" || len(p.Events) != 1 || p.Events[0].Key != "a" {
+		t.Errorf("payload = %s", r.body)
+	}
+}
+
+func TestWebhookUnsigned(t *testing.T) {
+	configure(t, Settings{DedupWindow: time.Hour, AllowPrivateUrls: true})
+	srv, requests := webhookServer(t)
+	createChannel(t, "org-unsigned", &ChannelRequest{Name: "unsigned", Type: TypeWebhook, Url: srv.URL})
+
+	Publish("org-unsigned", event("org-unsigned", "a"))
+	if r := receive(t, requests); r.header.Get(SignatureHeader) != "" {
+		t.Errorf("unexpected %s: %s", SignatureHeader, r.header.Get(SignatureHeader))
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	configure(t, Settings{DedupWindow: time.Hour, AllowPrivateUrls: true})
+	srv, requests := webhookServer(t)
+	createChannel(t, "org-dedup", &ChannelRequest{Name: "dedup", Type: TypeWebhook, Url: srv.URL})
+
+	Publish("org-dedup", event("org-dedup", "a"))
+	receive(t, requests)
+	// the same key within the window is dropped, another key is delivered
+	Publish("org-dedup", event("org-dedup", "a"), event("org-dedup", "b"))
+	if p := payload(t, receive(t, requests)); len(p.Events) != 1 || p.Events[0].Key != "b" {
+		t.Errorf("events = %+v", p.Events)
+	}
+	Publish("org-dedup", event("org-dedup", "a"))
+	noDelivery(t, requests)
+
+	// past the window, the keys are forgotten and delivered again
+	flushDigests(time.Now().Add(2 * time.Hour))
+	Publish("org-dedup", event("org-dedup", "a"))
+	if p := payload(t, receive(t, requests)); len(p.Events) != 1 || p.Events[0].Key != "a" {
+		t.Errorf("events = %+v", p.Events)
+	}
+}
+
+func TestRedeliveryAfterFailure(t *testing.T) {
+	configure(t, Settings{DedupWindow: time.Hour, AllowPrivateUrls: true})
+	srv, requests := webhookServer(t)
+	var failures int32 = 1
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(failing.Close)
+	ch := createChannel(t, "org-retry", &ChannelRequest{Name: "retry", Type: TypeWebhook, Url: failing.URL})
+
+	Publish("org-retry", event("org-retry", "a"))
+	// the failed delivery forgets the key, so that the event is delivered when published again
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if stored, _ := GetChannel("org-retry", ch.Id); stored != nil && stored.LastError != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no failed delivery")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	Publish("org-retry", event("org-retry", "a"))
+	if p := payload(t, receive(t, requests)); len(p.Events) != 1 || p.Events[0].Key != "a" {
+		t.Errorf("events = %+v", p.Events)
+	}
+}
+
+func TestPrivateUrl(t *testing.T) {
+	configure(t, Settings{DedupWindow: time.Hour})
+	srv, requests := webhookServer(t)
+	if _, err := CreateChannel("org-private", &ChannelRequest{Name: "loopback", Type: TypeWebhook, Url: srv.URL}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("err = %v, want %v", err, ErrInvalid)
+	}
+	// a host name is checked against the addresses it resolves to, when delivering
+	u, _ := url.Parse(srv.URL)
+	ch := createChannel(t, "org-private", &ChannelRequest{Name: "localhost", Type: TypeWebhook, Url: "http://localhost:" + u.Port()})
+	if err := Test("org-private", ch.Id); err == nil || !strings.Contains(err.Error(), "Private address not allowed") {
+		t.Errorf("err = %v", err)
+	}
+	noDelivery(t, requests)
+}
+
+func TestUpdateKeepsSecret(t *testing.T) {
+	configure(t, Settings{DedupWindow: time.Hour, AllowPrivateUrls: true})
+	ch := createChannel(t, "org-update", &ChannelRequest{Name: "signed", Type: TypeWebhook, Url: "https://hooks.example.com", Secret: "s3cret"})
+
+	updated, err := UpdateChannel("org-update", ch.Id, &ChannelRequest{Name: "renamed", Type: TypeWebhook, Url: "https://hooks.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := GetChannel("org-update", ch.Id); updated.Name != "renamed" || !updated.HasSecret || stored.Secret != "s3cret" {
+		t.Errorf("updated = %+v, stored = %+v", updated, stored)
+	}
+	if _, err := UpdateChannel("org-update", ch.Id, &ChannelRequest{Name: "renamed", Type: TypeWebhook, Url: "https://hooks.example.com", ClearSecret: true}); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := GetChannel("org-update", ch.Id); stored.HasSecret || stored.Secret != "" {
+		t.Errorf("stored = %+v", stored)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	configure(t, Settings{DedupWindow: time.Hour, AllowPrivateUrls: true})
+	srv, requests := webhookServer(t)
+	createChannel(t, "org-digest", &ChannelRequest{Name: "digest", Type: TypeWebhook, Url: srv.URL, Digest: "30m"})
+
+	start := time.Now()
+	Publish("org-digest", event("org-digest", "a"))
+	Publish("org-digest", event("org-digest", "b"), event("org-digest", "a"))
+	noDelivery(t, requests)
+
+	flushDigests(start.Add(10 * time.Minute))
+	noDelivery(t, requests)
+
+	// once the period is over, the pending events are delivered together, without duplicates
+	flushDigests(start.Add(31 * time.Minute))
+	r := receive(t, requests)
+	if got := r.header.Get("X-Collie-Event"); got != "digest" {
+		t.Errorf("X-Collie-Event = %q", got)
+	}
+	keys := []string{}
+	for _, e := range payload(t, r).Events {
+		keys = append(keys, e.Key)
+	}
+	if strings.Join(keys, ",") != "a,b" {
+		t.Errorf("keys = %v", keys)
+	}
+
+	flushDigests(start.Add(62 * time.Minute))
+	noDelivery(t, requests)
+}
+
+// smtpStub accepts one message and sends it on the returned channel.
+func smtpStub(t *testing.T) (string, int, chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+		reply("220 stub")
+		var data strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 stub")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				messages <- data.String()
+				reply("250 queued")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, messages
+}
+
+func TestEmail(t *testing.T) {
+	host, port, messages := smtpStub(t)
+	configure(t, Settings{DedupWindow: time.Hour, AllowPrivateUrls: true, SmtpHost: host, SmtpPort: port, SmtpFrom: "collie@example.com"})
+	createChannel(t, "org-email", &ChannelRequest{Name: "email", Type: TypeEmail, Recipients: []string{"sec@example.com"}})
+
+	e := event("org-email", "a")
+	e.Message = "kube-bench\nfailed"
+	Publish("org-email", e)
+
+	var msg string
+	select {
+	case msg = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email")
+	}
+	for _, want := range []string{
+		"From: collie@example.com\r\n",
+		"To: sec@example.com\r\n",
+		"Subject: [Collie] Scan a failed\r\n",
+		"\r\n\r\nScan a failed\r\nkube-bench\r\nfailed\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("email lacks %q:\n%s", want, msg)
+		}
+	}
+}
+
+func TestStoredChannelKeepsSecret(t *testing.T) {
+	ch := &Channel{Id: "c1", OrgId: "org", Name: "signed", Type: TypeWebhook, Secret: "s3cret", HasSecret: true, Digest: "1h"}
+	b, err := json.Marshal(&storedChannel{Channel: *ch, Secret: ch.Secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored storedChannel
+	if err := json.Unmarshal(b, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Secret != "s3cret" || stored.Name != "signed" || stored.Channel.digestPeriod() != time.Hour {
+		t.Errorf("stored = %+v", stored)
+	}
+	// the API never returns the secret
+	if b, _ := json.Marshal(ch); strings.Contains(string(b), "s3cret") {
+		t.Errorf("secret in %s", b)
+	}
+}
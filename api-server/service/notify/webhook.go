@@ -0,0 +1,143 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of the webhook payload keyed with the channel secret,
+// as "sha256=<hex>", so that receivers can verify the payload comes from Collie.
+const SignatureHeader = "X-Collie-Signature"
+
+// client posts to the webhook and slack channels. It dials the addresses the urls resolve to
+// only once they are checked, so that a channel cannot reach the private network of the server.
+var client = &http.Client{Transport: transport()}
+
+func transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would dial the channel urls itself
+	t.Proxy = nil
+	t.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: checkAddress}).DialContext
+	return t
+}
+
+func checkAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("Invalid address: %s", address)
+	}
+	if isPrivate(ip) && !getSettings().AllowPrivateUrls {
+		return fmt.Errorf("Private address not allowed: %s", host)
+	}
+	return nil
+}
+
+// isPrivate tells whether an address is a loopback, link-local, private or unspecified one.
+func isPrivate(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified()
+}
+
+type webhookPayload struct {
+	OrgId  string   `json:"orgId"`
+	Events []*Event `json:"events"`
+}
+
+// Sign computes the value of the signature header of a payload.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func post(ctx context.Context, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s", req.URL.Host, res.Status)
+	}
+	return nil
+}
+
+func sendWebhook(ctx context.Context, ch *Channel, events []*Event) error {
+	body, err := json.Marshal(webhookPayload{OrgId: ch.OrgId, Events: events})
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{"X-Collie-Event": events[0].Type}
+	if len(events) > 1 {
+		headers["X-Collie-Event"] = "digest"
+	}
+	if ch.Secret != "" {
+		headers[SignatureHeader] = Sign(ch.Secret, body)
+	}
+	return post(ctx, ch.Url, body, headers)
+}
+
+// sendSlack posts the events in the format of Slack incoming webhooks, also accepted by Mattermost and others.
+func sendSlack(ctx context.Context, ch *Channel, events []*Event) error {
+	body, err := json.Marshal(map[string]string{"text": summary(events, true)})
+	if err != nil {
+		return err
+	}
+	return post(ctx, ch.Url, body, nil)
+}
+
+// summary renders events as text, with Slack markup when markup is set.
+func summary(events []*Event, markup bool) string {
+	var sb strings.Builder
+	if len(events) > 1 {
+		fmt.Fprintf(&sb, "%d Collie notifications\n", len(events))
+	}
+	for _, e := range events {
+		title := e.Title
+		if markup {
+			title = "*" + title + "*"
+		}
+		if e.ClusterId != "" {
+			title += " (cluster " + e.ClusterId + ")"
+		}
+		fmt.Fprintf(&sb, "%s\n%s\n", title, e.Message)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
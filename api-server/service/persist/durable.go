@@ -0,0 +1,258 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package persist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Record is an item of a durable collection as the backend keeps it.
+type Record struct {
+	OrgId string
+	Id    string
+	Item  json.RawMessage
+}
+
+// Backend keeps the items of the durable collections, in an index per collection and org. It is
+// Elasticsearch, registered by the es package, which depends on services keeping durable collections.
+type Backend interface {
+	Put(collection string, orgId string, id string, item interface{}) error
+	Delete(collection string, orgId string, id string) error
+	// Load returns the items of a collection, of every org.
+	Load(collection string) ([]Record, error)
+}
+
+var (
+	backend   Backend
+	muBackend sync.RWMutex
+)
+
+// SetBackend registers the backend of the durable collections. Without a backend, their items only live
+// in memory.
+func SetBackend(b Backend) {
+	muBackend.Lock()
+	defer muBackend.Unlock()
+	backend = b
+}
+
+func getBackend() Backend {
+	muBackend.RLock()
+	defer muBackend.RUnlock()
+	return backend
+}
+
+// DurableStore is a collection whose items survive a restart. The items of an org are kept under their id.
+type DurableStore interface {
+	Put(orgId string, id string, data interface{}) error
+	Get(orgId string, id string) (interface{}, error)
+	Delete(orgId string, id string) error
+	// List returns the items of an org, or of every org when orgId is empty, in no particular order.
+	List(orgId string) ([]interface{}, error)
+}
+
+// ErrNotFound is returned for an item which is not in the collection
+var ErrNotFound = errors.New("Item not found")
+
+type durableItem struct {
+	orgId string
+	data  interface{}
+}
+
+type durableImpl struct {
+	name    string
+	newItem func() interface{}
+
+	mu     sync.RWMutex
+	loaded bool
+	data   map[string]durableItem
+}
+
+var (
+	durables  = map[string]*durableImpl{}
+	muDurable sync.Mutex
+)
+
+// Durable returns the durable collection of the given name. The items are kept in memory and written
+// through to the backend, from which they are loaded at the first access, decoded into newItem().
+// The API server runs a single replica, so the memory stays in line with the backend.
+func Durable(name string, newItem func() interface{}) DurableStore {
+	muDurable.Lock()
+	defer muDurable.Unlock()
+	s, ok := durables[name]
+	if !ok {
+		s = &durableImpl{name: name, newItem: newItem, data: map[string]durableItem{}}
+		durables[name] = s
+	}
+	return s
+}
+
+// Unload drops the items of the durable collections from memory, so that they are loaded again from the
+// backend at the next access, as after a restart of the server.
+func Unload() {
+	muDurable.Lock()
+	defer muDurable.Unlock()
+	for _, s := range durables {
+		s.mu.Lock()
+		s.loaded = false
+		s.data = map[string]durableItem{}
+		s.mu.Unlock()
+	}
+}
+
+func durableKey(orgId string, id string) string {
+	return orgId + "/" + id
+}
+
+// load reads the items from the backend unless done before. A failed load is retried at the next access.
+func (s *durableImpl) load() error {
+	s.mu.RLock()
+	loaded := s.loaded
+	s.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loaded {
+		return nil
+	}
+	b := getBackend()
+	if b == nil {
+		s.loaded = true
+		return nil
+	}
+	records, err := b.Load(s.name)
+	if err != nil {
+		return errors.New("Error loading " + s.name + ": " + err.Error())
+	}
+	for _, r := range records {
+		item := s.newItem()
+		if err := json.Unmarshal(r.Item, item); err != nil {
+			log.Printf("Skipping %s %s/%s: %s", s.name, r.OrgId, r.Id, err)
+			continue
+		}
+		s.data[durableKey(r.OrgId, r.Id)] = durableItem{orgId: r.OrgId, data: item}
+	}
+	s.loaded = true
+	log.Printf("Collection loaded: %s, items=%d", s.name, len(s.data))
+	return nil
+}
+
+func (s *durableImpl) Put(orgId string, id string, data interface{}) error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b := getBackend(); b != nil {
+		if err := b.Put(s.name, orgId, id, data); err != nil {
+			return err
+		}
+	}
+	s.data[durableKey(orgId, id)] = durableItem{orgId: orgId, data: data}
+	return nil
+}
+
+func (s *durableImpl) Get(orgId string, id string) (interface{}, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, exist := s.data[durableKey(orgId, id)]
+	if exist {
+		return v.data, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+}
+
+func (s *durableImpl) Delete(orgId string, id string) error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := durableKey(orgId, id)
+	if _, exist := s.data[k]; !exist {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if b := getBackend(); b != nil {
+		if err := b.Delete(s.name, orgId, id); err != nil {
+			return err
+		}
+	}
+	delete(s.data, k)
+	return nil
+}
+
+func (s *durableImpl) List(orgId string) ([]interface{}, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := make([]interface{}, 0, len(s.data))
+	for _, v := range s.data {
+		if orgId == "" || v.orgId == orgId {
+			items = append(items, v.data)
+		}
+	}
+	return items, nil
+}
+
+// Counter is a durable counter per org, which only increases.
+type Counter struct {
+	store DurableStore
+	mu    sync.Mutex
+}
+
+type counterValue struct {
+	Value int64 `json:"value"`
+}
+
+// NewCounter returns a counter kept in the durable collection of the given name.
+func NewCounter(name string) *Counter {
+	return &Counter{store: Durable(name, func() interface{} { return &counterValue{} })}
+}
+
+// Get returns the value of the counter of the org, 0 until it is incremented.
+func (c *Counter) Get(orgId string) (int64, error) {
+	v, err := c.store.List(orgId)
+	if err != nil || len(v) == 0 {
+		return 0, err
+	}
+	return v[0].(*counterValue).Value, nil
+}
+
+// Incr increments the counter of the org, and returns its new value.
+func (c *Counter) Incr(orgId string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, err := c.Get(orgId)
+	if err != nil {
+		return 0, err
+	}
+	v++
+	if err := c.store.Put(orgId, "value", &counterValue{Value: v}); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
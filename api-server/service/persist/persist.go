@@ -17,6 +17,7 @@ package persist
 
 import (
 	"errors"
+	"sync"
 
 	_ "k8s.io/utils/lru"
 )
@@ -24,6 +25,7 @@ import (
 var (
 	// TODO: change to persist store
 	collections map[string]Store
+	muColl      sync.Mutex
 )
 
 func init() {
@@ -33,13 +35,18 @@ func init() {
 type Store interface {
 	Put(id string, data interface{})
 	Get(id string) (interface{}, error)
+	Delete(id string) error
+	List() []interface{}
 }
 
 type storeImpl struct {
+	mu   sync.RWMutex
 	data map[string]interface{}
 }
 
 func Collection(name string) Store {
+	muColl.Lock()
+	defer muColl.Unlock()
 	s, ok := collections[name]
 	if !ok {
 		s = &storeImpl{data: map[string]interface{}{}}
@@ -49,13 +56,38 @@ func Collection(name string) Store {
 }
 
 func (s *storeImpl) Put(id string, data interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.data[id] = data
 }
 
 func (s *storeImpl) Get(id string) (interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	v, exist := s.data[id]
 	if exist {
 		return v, nil
 	}
 	return nil, errors.New("Item not found: " + id)
 }
+
+func (s *storeImpl) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exist := s.data[id]; !exist {
+		return errors.New("Item not found: " + id)
+	}
+	delete(s.data, id)
+	return nil
+}
+
+// List returns a snapshot of all items in the collection, in no particular order.
+func (s *storeImpl) List() []interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := make([]interface{}, 0, len(s.data))
+	for _, v := range s.data {
+		items = append(items, v)
+	}
+	return items
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package report
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"time"
+)
+
+// renderCSV writes one row per finding, so that the file can be filtered and pivoted by auditors.
+func renderCSV(d *data) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	rows := [][]string{{
+		"timestamp", "cluster", "plugin", "rule", "category", "subcategory", "severity", "status",
+		"namespace", "resource", "description", "remediation", "controls",
+	}}
+	for _, f := range d.Findings {
+		rows = append(rows, []string{
+			f.Timestamp.Format(time.RFC3339), f.ClusterId, f.Plugin, f.RuleId, f.Category, f.Subcategory,
+			f.Severity, f.Status, f.Namespace, f.Resource, f.Description, f.Remediation,
+			strings.Join(mappings(f.Controls), "; "),
+		})
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
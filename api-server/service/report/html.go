@@ -0,0 +1,41 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package report
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"strings"
+)
+
+var (
+	//go:embed template/report.html
+	templateReportHtml string
+
+	reportHtml = template.Must(template.New("report.html").
+			Funcs(template.FuncMap{"lower": strings.ToLower}).
+			Parse(templateReportHtml))
+)
+
+// renderHTML renders a self-contained page, with no external stylesheet, script or image.
+func renderHTML(d *data) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := reportHtml.Execute(&buf, d); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
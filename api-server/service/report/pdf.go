@@ -0,0 +1,129 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+
+	"collie-api-server/service/es"
+)
+
+// renderPDF lays out the same content as the HTML report, in process with the core PDF fonts.
+func renderPDF(d *data) ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	// the core fonts are single byte encoded
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetTitle(d.Title+" - "+d.Scope, true)
+	pdf.SetCreator("Collie", true)
+	pdf.SetMargins(15, 15, 15)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.CellFormat(0, 6, fmt.Sprintf("%s - page %d/{nb}", tr(d.Scope), pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	heading := func(text string) {
+		pdf.Ln(4)
+		pdf.SetFont("Helvetica", "B", 14)
+		pdf.CellFormat(0, 9, tr(text), "", 1, "L", false, 0, "")
+	}
+	table := func(header []string, rows [][]string) {
+		width, _ := pdf.GetPageSize()
+		left, _, right, _ := pdf.GetMargins()
+		w := (width - left - right) / float64(len(header))
+		pdf.SetFont("Helvetica", "B", 9)
+		for _, h := range header {
+			pdf.CellFormat(w, 7, tr(h), "B", 0, "L", false, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 9)
+		for _, row := range rows {
+			for _, c := range row {
+				pdf.CellFormat(w, 6, tr(c), "B", 0, "L", false, 0, "")
+			}
+			pdf.Ln(-1)
+		}
+	}
+	field := func(label string, text string) {
+		if text == "" {
+			return
+		}
+		pdf.SetFont("Helvetica", "B", 9)
+		pdf.CellFormat(30, 5, tr(label), "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 9)
+		pdf.MultiCell(0, 5, tr(text), "", "L", false)
+	}
+
+	pdf.SetFont("Helvetica", "B", 20)
+	pdf.CellFormat(0, 12, tr(d.Title), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, tr(fmt.Sprintf("%s, generated at %s", d.Scope, d.GeneratedAt.Format("2006-01-02 15:04:05 MST"))), "", 1, "L", false, 0, "")
+
+	s := d.Summary
+	heading("Executive summary")
+	pdf.SetFont("Helvetica", "B", 28)
+	pdf.CellFormat(0, 14, fmt.Sprintf("%.1f%%", s.Score), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, fmt.Sprintf("Weighted share of passing checks across %d cluster(s).", len(d.Clusters)), "", 1, "L", false, 0, "")
+	pdf.Ln(2)
+	table([]string{"Passed", "Failed", "Warnings", "Waived", "Other", "Failing controls"}, [][]string{{
+		fmt.Sprint(s.Pass), fmt.Sprint(s.Fail), fmt.Sprint(s.Warn), fmt.Sprint(s.Waived), fmt.Sprint(s.Other), fmt.Sprint(len(d.Controls)),
+	}})
+
+	breakdown := func(title string, key string, list []es.Breakdown) {
+		heading(title)
+		rows := [][]string{}
+		for _, b := range list {
+			rows = append(rows, []string{b.Key, fmt.Sprint(b.Pass), fmt.Sprint(b.Fail), fmt.Sprint(b.Warn), fmt.Sprint(b.Waived), fmt.Sprint(b.Other)})
+		}
+		table([]string{key, "Passed", "Failed", "Warnings", "Waived", "Other"}, rows)
+	}
+	breakdown("By plugin", "Plugin", s.ByPlugin)
+	breakdown("By severity", "Severity", s.BySeverity)
+
+	heading("Failing controls")
+	if len(d.Controls) == 0 {
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.CellFormat(0, 6, "No failing control.", "", 1, "L", false, 0, "")
+	}
+	for _, c := range d.Controls {
+		title := fmt.Sprintf("%s  %s %s", c.Status, c.Plugin, c.RuleId)
+		if c.Severity != "" {
+			title += " (" + c.Severity + ")"
+		}
+		pdf.Ln(2)
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.MultiCell(0, 6, tr(title), "B", "L", false)
+		field("Description", c.Description)
+		field("Category", c.Category)
+		field("Remediation", c.Remediation)
+		field("Controls", strings.Join(c.Mappings, ", "))
+		field("Affected", strings.Join(c.Resources, "\n"))
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
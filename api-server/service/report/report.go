@@ -0,0 +1,394 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"collie-api-server/config"
+	"collie-api-server/service/catalog"
+	"collie-api-server/service/es"
+	"collie-api-server/service/export"
+	"collie-api-server/util"
+)
+
+const (
+	FormatCSV   = "csv"
+	FormatHTML  = "html"
+	FormatPDF   = "pdf"
+	FormatSARIF = "sarif"
+	FormatOSCAL = "oscal"
+)
+
+var contentTypes = map[string]string{
+	FormatCSV:   "text/csv; charset=utf-8",
+	FormatHTML:  "text/html; charset=utf-8",
+	FormatPDF:   "application/pdf",
+	FormatSARIF: "application/sarif+json",
+	FormatOSCAL: "application/json",
+}
+
+var extensions = map[string]string{
+	FormatSARIF: "sarif",
+	FormatOSCAL: "oscal.json",
+}
+
+// Report is the metadata of a generated report. The content is kept apart and downloaded separately.
+type Report struct {
+	Id          string    `json:"id" example:"9c1f3e5a7b2d4c6e"`
+	OrgId       string    `json:"orgId"`
+	ClusterId   string    `json:"clusterId,omitempty"`
+	Format      string    `json:"format" example:"pdf"`
+	Title       string    `json:"title"`
+	CreatedAt   time.Time `json:"createdAt"`
+	FileName    string    `json:"fileName" example:"collie-report-20231003-101500.pdf"`
+	ContentType string    `json:"contentType"`
+	Size        int       `json:"size"`
+	Score       float64   `json:"score"`
+	Framework   string    `json:"framework,omitempty"`
+	Control     string    `json:"control,omitempty"`
+	// CatalogVersion is the version of the control catalog the report was generated with
+	CatalogVersion string `json:"catalogVersion"`
+}
+
+// Request asks for a report of one cluster, or of the whole org when ClusterId is empty.
+// Besides the documents for auditors, findings can be exported as SARIF 2.1.0 and OSCAL assessment results.
+// Given a framework and one of its controls, the report is restricted to the rules mapping to the control.
+type Request struct {
+	ClusterId string `json:"clusterId"`
+	Format    string `json:"format" binding:"required" enums:"csv,html,pdf,sarif,oscal"`
+	Framework string `json:"framework" example:"nist-800-53"`
+	Control   string `json:"control" example:"AC-6"`
+}
+
+// Control is a failing rule with the locations where it fails.
+type Control struct {
+	Plugin      string
+	RuleId      string
+	Category    string
+	Description string
+	Severity    string
+	Status      string
+	Remediation string
+	Resources   []string
+	// Mappings are the controls of the catalog the rule maps to, as "framework control"
+	Mappings []string
+}
+
+// data is what the renderers work on.
+type data struct {
+	Title       string
+	Scope       string
+	GeneratedAt time.Time
+	Clusters    []string
+	Summary     *es.Posture
+	Controls    []*Control
+	Findings    []*es.Finding
+}
+
+type renderer func(d *data) ([]byte, error)
+
+var renderers = map[string]renderer{
+	FormatCSV:  renderCSV,
+	FormatHTML: renderHTML,
+	FormatPDF:  renderPDF,
+	FormatSARIF: func(d *data) ([]byte, error) {
+		return export.SARIF(exportFindings(d.Findings))
+	},
+	FormatOSCAL: func(d *data) ([]byte, error) {
+		return export.OSCAL(d.Title+" - "+d.Scope, exportFindings(d.Findings), d.GeneratedAt)
+	},
+}
+
+func exportFindings(findings []*es.Finding) []*export.Finding {
+	ret := make([]*export.Finding, 0, len(findings))
+	for _, f := range findings {
+		ret = append(ret, &export.Finding{
+			Timestamp:   f.Timestamp,
+			ClusterId:   f.ClusterId,
+			Plugin:      f.Plugin,
+			RuleId:      f.RuleId,
+			Category:    f.Category,
+			Subcategory: f.Subcategory,
+			Description: f.Description,
+			Status:      f.Status,
+			WaiverId:    f.WaiverId,
+			Severity:    f.Severity,
+			Namespace:   f.Namespace,
+			Resource:    f.Resource,
+			Remediation: f.Remediation,
+		})
+	}
+	return ret
+}
+
+// ErrTooLarge is returned when a report exceeds the maximum size of the configuration
+var ErrTooLarge = errors.New("Report too large")
+
+// maxReports bounds the reports listed at once
+const maxReports = 1000
+
+// IndexName is the index holding the metadata of the reports of an org. Reports are kept for the report
+// retention of the configuration.
+func IndexName(orgId string) string {
+	return "collie-report-" + orgId
+}
+
+// ContentIndexName is the index holding the files of the reports of an org, under the ids of the reports.
+func ContentIndexName(orgId string) string {
+	return "collie-report-content-" + orgId
+}
+
+// location describes where a finding applies, for listing the affected resources of a control.
+func location(f *es.Finding) string {
+	loc := "cluster " + f.ClusterId
+	if f.Resource != "" {
+		loc += ", " + f.Resource
+	} else if f.Namespace != "" {
+		loc += ", namespace " + f.Namespace
+	}
+	return loc
+}
+
+func mappings(controls map[string][]string) []string {
+	ret := []string{}
+	for fw, ids := range controls {
+		for _, id := range ids {
+			ret = append(ret, fw+" "+id)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// failingControls groups the failing findings by rule, most severe first.
+func failingControls(findings []*es.Finding) []*Control {
+	controls := map[string]*Control{}
+	for _, f := range findings {
+		if !es.IsFailing(f.Status) {
+			continue
+		}
+		k := f.Plugin + "|" + f.RuleId
+		c, ok := controls[k]
+		if !ok {
+			c = &Control{
+				Plugin:      f.Plugin,
+				RuleId:      f.RuleId,
+				Category:    f.Category,
+				Description: f.Description,
+				Severity:    f.Severity,
+				Status:      f.Status,
+				Remediation: f.Remediation,
+				Mappings:    mappings(f.Controls),
+			}
+			controls[k] = c
+		}
+		c.Resources = append(c.Resources, location(f))
+	}
+
+	ret := make([]*Control, 0, len(controls))
+	for _, c := range controls {
+		sort.Strings(c.Resources)
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		wi, wj := es.SeverityWeight(ret[i].Severity), es.SeverityWeight(ret[j].Severity)
+		if wi != wj {
+			return wi > wj
+		}
+		if ret[i].Plugin != ret[j].Plugin {
+			return ret[i].Plugin < ret[j].Plugin
+		}
+		return ret[i].RuleId < ret[j].RuleId
+	})
+	return ret
+}
+
+// Generate builds a point-in-time report from the current snapshots and stores it.
+func Generate(orgId string, req Request) (*Report, error) {
+	render, ok := renderers[req.Format]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported format: %s", req.Format)
+	}
+
+	q := &es.FindingQuery{}
+	scope := "Organization " + orgId
+	if req.ClusterId != "" {
+		q.ClusterIds = []string{req.ClusterId}
+		scope = "Cluster " + req.ClusterId
+	}
+	if req.Framework != "" || req.Control != "" {
+		f, control, selectors, err := catalog.Resolve(req.Framework, req.Control)
+		if err != nil {
+			return nil, err
+		}
+		q.RuleSelectors = selectors
+		scope += fmt.Sprintf(", %s %s", f.Name, control.Id)
+		if control.Title != "" {
+			scope += " " + control.Title
+		}
+	}
+	findings, err := es.ListFindings(orgId, q)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	ext, ok := extensions[req.Format]
+	if !ok {
+		ext = req.Format
+	}
+	d := &data{
+		Title:       "Compliance report",
+		Scope:       scope,
+		GeneratedAt: now,
+		Summary:     es.SummarizeFindings(findings),
+		Controls:    failingControls(findings),
+		Findings:    findings,
+	}
+	clusters := map[string]bool{}
+	for _, f := range findings {
+		clusters[f.ClusterId] = true
+	}
+	for c := range clusters {
+		d.Clusters = append(d.Clusters, c)
+	}
+	sort.Strings(d.Clusters)
+
+	content, err := render(d)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize := config.Get().ReportMaxSize; len(content) > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes over %d, narrow it to a cluster or a control", ErrTooLarge, len(content), maxSize)
+	}
+
+	r := &Report{
+		Id:          util.RandomString(8),
+		OrgId:       orgId,
+		ClusterId:   req.ClusterId,
+		Format:      req.Format,
+		Title:       d.Title + " - " + scope,
+		CreatedAt:   now,
+		FileName:    fmt.Sprintf("collie-report-%s.%s", now.Format("20060102-150405"), ext),
+		ContentType: contentTypes[req.Format],
+		Size:        len(content),
+		Score:       d.Summary.Score,
+		Framework:   req.Framework,
+		Control:     req.Control,
+
+		CatalogVersion: catalog.Version(),
+	}
+
+	// the metadata goes last, so that a listed report can be downloaded
+	if err := es.PutContent(ContentIndexName(orgId), r.Id, content, now); err != nil {
+		return nil, err
+	}
+	if err := es.PutDoc(IndexName(orgId), r.Id, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func Get(orgId string, reportId string) (*Report, error) {
+	var r Report
+	found, err := es.GetDocSource(IndexName(orgId), reportId, &r)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("Item not found: " + reportId)
+	}
+	return &r, nil
+}
+
+// Content returns the metadata and the file of a report.
+func Content(orgId string, reportId string) (*Report, []byte, error) {
+	r, err := Get(orgId, reportId)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, found, err := es.GetContent(ContentIndexName(orgId), reportId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, errors.New("Report file not found: " + reportId)
+	}
+	return r, content, nil
+}
+
+// List returns the reports of the org, most recent first.
+func List(orgId string) ([]*Report, error) {
+	docs, err := es.SearchSources(IndexName(orgId), nil, "createdAt", true, maxReports)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Report, 0, len(docs))
+	for _, doc := range docs {
+		var r Report
+		if err := json.Unmarshal(doc, &r); err != nil {
+			return nil, err
+		}
+		ret = append(ret, &r)
+	}
+	return ret, nil
+}
+
+func Delete(orgId string, reportId string) error {
+	if strings.TrimSpace(reportId) == "" {
+		return errors.New("report id is required")
+	}
+	if _, err := Get(orgId, reportId); err != nil {
+		return err
+	}
+	if err := es.DeleteDoc(IndexName(orgId), reportId); err != nil {
+		return err
+	}
+	return es.DeleteDoc(ContentIndexName(orgId), reportId)
+}
+
+// Expire deletes the reports of every org older than the retention, now and then at each interval.
+func Expire(ctx context.Context, interval time.Duration, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		before := time.Now().Add(-retention)
+		// the files go first, so that no listed report is left without its file
+		if _, err := es.DeleteBefore([]string{ContentIndexName("*")}, "createdAt", before); err != nil {
+			log.Printf("Error expiring report files: %s", err)
+		} else if _, err := es.DeleteBefore([]string{IndexName("*")}, "createdAt", before); err != nil {
+			log.Printf("Error expiring reports: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func IsSupported(format string) bool {
+	_, ok := renderers[format]
+	return ok
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rulepack
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+
+	"collie-api-server/service/persist"
+	"collie-api-server/util"
+)
+
+// packages of the rule packs must be under this root, next to the policies bundled with the agent
+const policyRoot = "data.collie."
+
+// RulePack is a set of Rego policies of an org, evaluated by its agents next to the bundled
+// policies. Each policy is a package with a deny set of messages and its __rego_metadata__.
+type RulePack struct {
+	Id          string `json:"id" example:"7d3f9a1c"`
+	OrgId       string `json:"orgId"`
+	Name        string `json:"name" example:"platform-policies"`
+	Description string `json:"description"`
+	// Modules are the Rego sources, keyed by file name
+	Modules map[string]string `json:"modules"`
+	Enabled bool              `json:"enabled"`
+	// Version is incremented on every update
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	CreatedBy string    `json:"createdBy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Request creates or replaces a rule pack.
+type Request struct {
+	Name        string            `json:"name" binding:"required"`
+	Description string            `json:"description"`
+	Modules     map[string]string `json:"modules" binding:"required"`
+	Enabled     *bool             `json:"enabled"`
+}
+
+// ErrInvalid is returned when a request does not make a valid rule pack
+var ErrInvalid = errors.New("Invalid rule pack")
+
+var (
+	packColl persist.DurableStore
+	// revision counts the changes of the rule packs of each org, so that agents tell a server which lost them
+	revision *persist.Counter
+	mu       sync.Mutex
+)
+
+func init() {
+	packColl = persist.Durable("rulepack", func() interface{} { return &RulePack{} })
+	revision = persist.NewCounter("rulepack-revision")
+}
+
+// validate compiles the modules of the pack, so that errors are reported when the pack
+// is saved rather than skipped by the agents.
+func (r *Request) validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("name is required")
+	}
+	if len(r.Modules) == 0 {
+		return errors.New("at least one module is required")
+	}
+	modules := map[string]*ast.Module{}
+	for name, src := range r.Modules {
+		m, err := ast.ParseModule(name, src)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return fmt.Errorf("%s: empty module", name)
+		}
+		if !strings.HasPrefix(m.Package.Path.String(), policyRoot) {
+			return fmt.Errorf("%s: package %s is not under %s", name, m.Package.Path, strings.TrimSuffix(policyRoot, "."))
+		}
+		modules[name] = m
+	}
+	compiler := ast.NewCompiler()
+	compiler.Compile(modules)
+	if compiler.Failed() {
+		return compiler.Errors
+	}
+	return nil
+}
+
+func (p *RulePack) apply(r *Request) {
+	p.Name = r.Name
+	p.Description = r.Description
+	p.Modules = r.Modules
+	p.Enabled = r.Enabled == nil || *r.Enabled
+}
+
+func Create(orgId string, user string, r *Request) (*RulePack, error) {
+	if err := r.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+	now := time.Now().UTC()
+	p := &RulePack{
+		Id:        util.RandomString(8),
+		OrgId:     orgId,
+		Version:   1,
+		CreatedAt: now,
+		CreatedBy: user,
+		UpdatedAt: now,
+	}
+	p.apply(r)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err := packColl.Put(orgId, p.Id, p); err != nil {
+		return nil, err
+	}
+	if _, err := revision.Incr(orgId); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func Update(orgId string, packId string, r *Request) (*RulePack, error) {
+	if err := r.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	v, err := packColl.Get(orgId, packId)
+	if err != nil {
+		return nil, err
+	}
+	p := *v.(*RulePack)
+	p.apply(r)
+	p.Version++
+	p.UpdatedAt = time.Now().UTC()
+	if err := packColl.Put(orgId, packId, &p); err != nil {
+		return nil, err
+	}
+	if _, err := revision.Incr(orgId); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func Get(orgId string, packId string) (*RulePack, error) {
+	v, err := packColl.Get(orgId, packId)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*RulePack), nil
+}
+
+// List returns the rule packs of the org, by name.
+func List(orgId string) ([]*RulePack, error) {
+	items, err := packColl.List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*RulePack, 0, len(items))
+	for _, v := range items {
+		ret = append(ret, v.(*RulePack))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// Enabled returns the rule packs of the org to be evaluated by its agents.
+func Enabled(orgId string) ([]*RulePack, error) {
+	packs, err := List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*RulePack{}
+	for _, p := range packs {
+		if p.Enabled {
+			ret = append(ret, p)
+		}
+	}
+	return ret, nil
+}
+
+// Revision returns the number of changes of the rule packs of the org.
+func Revision(orgId string) (int64, error) {
+	return revision.Get(orgId)
+}
+
+func Delete(orgId string, packId string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := packColl.Delete(orgId, packId); err != nil {
+		return err
+	}
+	_, err := revision.Incr(orgId)
+	return err
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"collie-api-server/service/es"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusPartial   = "partial"
+	StatusFailed    = "failed"
+)
+
+// Scan is the record of one agent cycle. It is the evidence of when each cluster was last assessed.
+type Scan struct {
+	Id         string            `json:"id" example:"7f1c1f5e-5b7a-11ee-8c99-0242ac120002"`
+	OrgId      string            `json:"orgId"`
+	AgentId    string            `json:"agentId"`
+	ClusterId  string            `json:"clusterId"`
+	Status     string            `json:"status" example:"completed"`
+	StartedAt  time.Time         `json:"startedAt"`
+	EndedAt    *time.Time        `json:"endedAt,omitempty"`
+	DurationMs int64             `json:"durationMs"`
+	Phases     []Phase           `json:"phases"`
+	Documents  int64             `json:"documents"`
+	Errors     []string          `json:"errors"`
+	Plugins    map[string]string `json:"plugins"`
+	// RequestId is the scan request the cycle was run for, empty for a scheduled cycle
+	RequestId string `json:"requestId,omitempty"`
+}
+
+type Phase struct {
+	Name       string    `json:"name" example:"resources"`
+	StartedAt  time.Time `json:"startedAt"`
+	EndedAt    time.Time `json:"endedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Documents  int64     `json:"documents"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type Filter struct {
+	AgentId   string
+	ClusterId string
+	Limit     int
+}
+
+// ErrNoId rejects a scan reported without id
+var ErrNoId = errors.New("scan id is required")
+
+// maxScans bounds the scans listed at once
+const maxScans = 10000
+
+// IndexName is the index holding the scans of an org. Scans are kept for the scan retention of the
+// configuration, at least as long as the trends look back.
+func IndexName(orgId string) string {
+	return "collie-scan-" + orgId
+}
+
+// Start records a scan reported by sync-start.
+func Start(orgId string, s *Scan) (*Scan, error) {
+	if s.Id == "" {
+		return nil, ErrNoId
+	}
+	if s.StartedAt.IsZero() {
+		s.StartedAt = time.Now().UTC()
+	}
+	s.OrgId = orgId
+	s.Status = StatusRunning
+	s.EndedAt = nil
+
+	if err := es.PutDoc(IndexName(orgId), s.Id, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Complete records the final state of a scan reported by sync-complete.
+// A scan whose sync-start was missed is recorded as well.
+func Complete(orgId string, s *Scan) (*Scan, error) {
+	if s.Id == "" {
+		return nil, ErrNoId
+	}
+	if s.EndedAt == nil {
+		now := time.Now().UTC()
+		s.EndedAt = &now
+	}
+	s.OrgId = orgId
+	s.DurationMs = s.EndedAt.Sub(s.StartedAt).Milliseconds()
+	s.Status = completionStatus(s)
+
+	if err := es.PutDoc(IndexName(orgId), s.Id, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// completionStatus is failed when every phase failed, partial when only some did.
+func completionStatus(s *Scan) string {
+	failed := 0
+	for _, p := range s.Phases {
+		if p.Error != "" {
+			failed++
+		}
+	}
+	if len(s.Phases) > 0 && failed == len(s.Phases) {
+		return StatusFailed
+	}
+	if failed > 0 || len(s.Errors) > 0 {
+		return StatusPartial
+	}
+	return StatusCompleted
+}
+
+func Get(orgId string, scanId string) (*Scan, error) {
+	var s Scan
+	found, err := es.GetDocSource(IndexName(orgId), scanId, &s)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("Item not found: " + scanId)
+	}
+	return &s, nil
+}
+
+// Reassign moves the scans of a cluster to the id it is now known by, and returns how many it moved.
+func Reassign(orgId string, from string, to string) (int, error) {
+	n, err := es.ReassignDocs(IndexName(orgId), "clusterId", from, to)
+	return int(n), err
+}
+
+// List returns the scans of the org matching the filter, most recent first.
+func List(orgId string, filter Filter) ([]*Scan, error) {
+	terms := map[string]string{}
+	if filter.AgentId != "" {
+		terms["agentId.keyword"] = filter.AgentId
+	}
+	if filter.ClusterId != "" {
+		terms["clusterId.keyword"] = filter.ClusterId
+	}
+	size := maxScans
+	if filter.Limit > 0 && filter.Limit < size {
+		size = filter.Limit
+	}
+	docs, err := es.SearchSources(IndexName(orgId), terms, "startedAt", true, size)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Scan, 0, len(docs))
+	for _, doc := range docs {
+		var s Scan
+		if err := json.Unmarshal(doc, &s); err != nil {
+			return nil, err
+		}
+		ret = append(ret, &s)
+	}
+	return ret, nil
+}
+
+// Expire deletes the scans of every org older than the retention, now and then at each interval.
+func Expire(ctx context.Context, interval time.Duration, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := es.DeleteBefore([]string{IndexName("*")}, "startedAt", time.Now().Add(-retention)); err != nil {
+			log.Printf("Error expiring scans: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scanrequest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"collie-api-server/service/persist"
+	"collie-api-server/util"
+)
+
+const (
+	// StatusQueued is a request waiting for its agent
+	StatusQueued = "queued"
+	// StatusDispatched is a request handed to its agent, whose scan has not started yet
+	StatusDispatched = "dispatched"
+	StatusRunning    = "running"
+	StatusCompleted  = "completed"
+	StatusPartial    = "partial"
+	StatusFailed     = "failed"
+	StatusCancelled  = "cancelled"
+)
+
+// Phases are the phases of the agent cycle a request can be limited to. The cluster phase always runs.
+var Phases = []string{"resources", "rules", "kube-bench", "kube-hunter"}
+
+// ScanRequest asks an agent to run a cycle now, instead of waiting for its next scheduled one.
+// The findings of the phases left out are carried over from the current snapshot of the cluster.
+type ScanRequest struct {
+	Id      string `json:"id" example:"7d3f9a1c"`
+	OrgId   string `json:"orgId"`
+	AgentId string `json:"agentId"`
+	// Phases limits the cycle to some phases, all phases when empty
+	Phases      []string   `json:"phases" example:"kube-bench"`
+	Status      string     `json:"status" example:"queued"`
+	RequestedAt time.Time  `json:"requestedAt"`
+	RequestedBy string     `json:"requestedBy"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	EndedAt     *time.Time `json:"endedAt,omitempty"`
+	// ScanId is the scan run for the request, once started
+	ScanId string `json:"scanId,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Request queues a scan request.
+type Request struct {
+	AgentId string   `json:"agentId" binding:"required"`
+	Phases  []string `json:"phases"`
+}
+
+// Run is the scan run for a request, as reported by its agent.
+type Run struct {
+	ScanId string
+	// Status is the status of the scan, completed, partial or failed once it ended
+	Status    string
+	StartedAt time.Time
+	EndedAt   *time.Time
+	Errors    []string
+}
+
+var (
+	// ErrInvalid is returned when a request is not valid
+	ErrInvalid = errors.New("Invalid scan request")
+	// ErrNotQueued is returned when cancelling a request which is not queued anymore
+	ErrNotQueued = errors.New("Scan request not queued")
+)
+
+var (
+	requestColl persist.DurableStore
+	mu          sync.Mutex
+	// waiting holds a channel per agent long-polling for a request, closed when one is queued
+	waiting = map[string]chan struct{}{}
+)
+
+func init() {
+	requestColl = persist.Durable("scanrequest", func() interface{} { return &ScanRequest{} })
+}
+
+func (r *Request) validate() error {
+	known := map[string]bool{}
+	for _, p := range Phases {
+		known[p] = true
+	}
+	for _, p := range r.Phases {
+		if !known[p] {
+			return fmt.Errorf("%w: unknown phase %s, expected one of %s", ErrInvalid, p, strings.Join(Phases, ", "))
+		}
+	}
+	return nil
+}
+
+// Create queues a scan request for an agent. A request still queued for the agent is returned
+// instead, with the phases of both requests.
+func Create(orgId string, user string, r *Request) (*ScanRequest, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	requests, err := list(orgId, r.AgentId)
+	if err != nil {
+		return nil, err
+	}
+	for _, sr := range requests {
+		if sr.Status == StatusQueued {
+			merged := *sr
+			merged.Phases = mergePhases(sr.Phases, r.Phases)
+			if err := requestColl.Put(orgId, sr.Id, &merged); err != nil {
+				return nil, err
+			}
+			return &merged, nil
+		}
+	}
+
+	sr := &ScanRequest{
+		Id:          util.RandomString(8),
+		OrgId:       orgId,
+		AgentId:     r.AgentId,
+		Phases:      r.Phases,
+		Status:      StatusQueued,
+		RequestedAt: time.Now().UTC(),
+		RequestedBy: user,
+	}
+	if sr.Phases == nil {
+		sr.Phases = []string{}
+	}
+	if err := requestColl.Put(orgId, sr.Id, sr); err != nil {
+		return nil, err
+	}
+	if ch, ok := waiting[orgId+"/"+r.AgentId]; ok {
+		close(ch)
+		delete(waiting, orgId+"/"+r.AgentId)
+	}
+	return sr, nil
+}
+
+// mergePhases returns the union of the phases, all phases when either asks for all of them.
+func mergePhases(a []string, b []string) []string {
+	if len(a) == 0 || len(b) == 0 {
+		return []string{}
+	}
+	ret := append([]string{}, a...)
+	for _, p := range b {
+		if !contains(ret, p) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func Get(orgId string, id string) (*ScanRequest, error) {
+	v, err := requestColl.Get(orgId, id)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*ScanRequest), nil
+}
+
+// List returns the requests of the org, of one agent when agentId is not empty, most recent first.
+func List(orgId string, agentId string) ([]*ScanRequest, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	return list(orgId, agentId)
+}
+
+func list(orgId string, agentId string) ([]*ScanRequest, error) {
+	items, err := requestColl.List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*ScanRequest{}
+	for _, v := range items {
+		if sr := v.(*ScanRequest); agentId == "" || sr.AgentId == agentId {
+			ret = append(ret, sr)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].RequestedAt.After(ret[j].RequestedAt)
+	})
+	return ret, nil
+}
+
+// Cancel cancels a request which has not been handed to its agent yet.
+func Cancel(orgId string, id string) (*ScanRequest, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	v, err := requestColl.Get(orgId, id)
+	if err != nil {
+		return nil, err
+	}
+	sr := *v.(*ScanRequest)
+	if sr.Status != StatusQueued {
+		return nil, fmt.Errorf("%w: request is %s, only a queued request can be cancelled", ErrNotQueued, sr.Status)
+	}
+	now := time.Now().UTC()
+	sr.Status = StatusCancelled
+	sr.EndedAt = &now
+	if err := requestColl.Put(orgId, id, &sr); err != nil {
+		return nil, err
+	}
+	return &sr, nil
+}
+
+// Next hands the oldest queued request of the agent to it, waiting up to wait for one to be queued.
+// It returns nil when none was queued in time.
+func Next(ctx context.Context, orgId string, agentId string, wait time.Duration) (*ScanRequest, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		mu.Lock()
+		if sr, err := dispatch(orgId, agentId); sr != nil || err != nil {
+			mu.Unlock()
+			return sr, err
+		}
+		k := orgId + "/" + agentId
+		ch, ok := waiting[k]
+		if !ok {
+			ch = make(chan struct{})
+			waiting[k] = ch
+		}
+		mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// dispatch marks the oldest queued request of the agent as dispatched, and returns it.
+func dispatch(orgId string, agentId string) (*ScanRequest, error) {
+	requests, err := list(orgId, agentId)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(requests) - 1; i >= 0; i-- {
+		if requests[i].Status == StatusQueued {
+			sr := *requests[i]
+			sr.Status = StatusDispatched
+			if err := requestColl.Put(orgId, sr.Id, &sr); err != nil {
+				return nil, err
+			}
+			return &sr, nil
+		}
+	}
+	return nil, nil
+}
+
+// Started links the request to the scan run for it, reported by sync-start.
+func Started(orgId string, id string, run *Run) error {
+	return update(orgId, id, func(sr *ScanRequest) {
+		sr.Status = StatusRunning
+		sr.ScanId = run.ScanId
+		startedAt := run.StartedAt
+		sr.StartedAt = &startedAt
+	})
+}
+
+// Completed records the outcome of the scan run for the request, reported by sync-complete.
+func Completed(orgId string, id string, run *Run) error {
+	return update(orgId, id, func(sr *ScanRequest) {
+		sr.ScanId = run.ScanId
+		if sr.StartedAt == nil {
+			startedAt := run.StartedAt
+			sr.StartedAt = &startedAt
+		}
+		sr.EndedAt = run.EndedAt
+		sr.Error = strings.Join(run.Errors, "; ")
+		switch run.Status {
+		case StatusCompleted, StatusPartial:
+			sr.Status = run.Status
+		default:
+			sr.Status = StatusFailed
+		}
+	})
+}
+
+func update(orgId string, id string, fn func(*ScanRequest)) error {
+	if id == "" {
+		return errors.New("scan request id is required")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	v, err := requestColl.Get(orgId, id)
+	if err != nil {
+		return err
+	}
+	sr := *v.(*ScanRequest)
+	fn(&sr)
+	return requestColl.Put(orgId, id, &sr)
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scanrequest
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"collie-api-server/service/persist"
+)
+
+// memoryBackend keeps the records as Elasticsearch would, encoded.
+type memoryBackend struct {
+	mu      sync.Mutex
+	records map[string]map[string]persist.Record
+}
+
+func (b *memoryBackend) Put(collection string, orgId string, id string, item interface{}) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.records[collection] == nil {
+		b.records[collection] = map[string]persist.Record{}
+	}
+	b.records[collection][orgId+"/"+id] = persist.Record{OrgId: orgId, Id: id, Item: data}
+	return nil
+}
+
+func (b *memoryBackend) Delete(collection string, orgId string, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.records[collection], orgId+"/"+id)
+	return nil
+}
+
+func (b *memoryBackend) Load(collection string) ([]persist.Record, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret := []persist.Record{}
+	for _, r := range b.records[collection] {
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+func TestReload(t *testing.T) {
+	backend := &memoryBackend{records: map[string]map[string]persist.Record{}}
+	persist.SetBackend(backend)
+	persist.Unload()
+	t.Cleanup(func() {
+		persist.SetBackend(nil)
+		persist.Unload()
+	})
+
+	queued, err := Create("org", "alice", &Request{AgentId: "agent-1", Phases: []string{"kube-bench"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, err := Create("org", "alice", &Request{AgentId: "agent-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr, err := Next(context.Background(), "org", "agent-2", 0); err != nil || sr == nil || sr.Id != started.Id {
+		t.Fatalf("Next = %+v, %v", sr, err)
+	}
+	startedAt := time.Now().UTC().Truncate(time.Second)
+	if err := Started("org", started.Id, &Run{ScanId: "scan-1", Status: StatusRunning, StartedAt: startedAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	if records, _ := backend.Load("scanrequest"); len(records) != 2 {
+		t.Fatalf("records = %d, want 2", len(records))
+	}
+	// as after a restart of the server
+	persist.Unload()
+
+	sr, err := Get("org", queued.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Status != StatusQueued || sr.AgentId != "agent-1" || len(sr.Phases) != 1 || sr.Phases[0] != "kube-bench" {
+		t.Errorf("queued request = %+v", sr)
+	}
+	sr, err = Get("org", started.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Status != StatusRunning || sr.ScanId != "scan-1" || sr.StartedAt == nil || !sr.StartedAt.Equal(startedAt) {
+		t.Errorf("started request = %+v", sr)
+	}
+
+	// the queued request is still handed to its agent, and the agent can report on the other one
+	if sr, err := Next(context.Background(), "org", "agent-1", 0); err != nil || sr == nil || sr.Id != queued.Id {
+		t.Errorf("Next = %+v, %v", sr, err)
+	}
+	endedAt := startedAt.Add(time.Minute)
+	if err := Completed("org", started.Id, &Run{ScanId: "scan-1", Status: StatusPartial, StartedAt: startedAt, EndedAt: &endedAt, Errors: []string{"kube-hunter: timeout"}}); err != nil {
+		t.Fatal(err)
+	}
+	if sr, _ := Get("org", started.Id); sr.Status != StatusPartial || sr.Error != "kube-hunter: timeout" {
+		t.Errorf("completed request = %+v", sr)
+	}
+	if requests, err := List("other", ""); err != nil || len(requests) != 0 {
+		t.Errorf("requests of another org = %v, %v", requests, err)
+	}
+}
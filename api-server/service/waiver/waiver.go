@@ -0,0 +1,337 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package waiver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"collie-api-server/config"
+	"collie-api-server/service/persist"
+	"collie-api-server/util"
+)
+
+const (
+	StatusActive   = "active"
+	StatusExpiring = "expiring"
+	StatusExpired  = "expired"
+)
+
+// Waiver accepts the failures of a rule as a risk until it expires. The failing findings it covers
+// are reported with the status WAIVED, and do not count against the posture score.
+// An empty scope field matches anything; Resource is a resource key, or a prefix of keys ending with "*".
+type Waiver struct {
+	Id            string    `json:"id" example:"7d3f9a1c"`
+	OrgId         string    `json:"orgId"`
+	Plugin        string    `json:"plugin" example:"kube-bench"`
+	RuleId        string    `json:"ruleId" example:"4.2.6"`
+	ClusterId     string    `json:"clusterId,omitempty"`
+	Namespace     string    `json:"namespace,omitempty"`
+	Resource      string    `json:"resource,omitempty" example:"pods#kube-system/*"`
+	Justification string    `json:"justification" example:"Managed by AKS, not configurable"`
+	Owner         string    `json:"owner" example:"platform-team@example.com"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+	CreatedBy     string    `json:"createdBy"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+	UpdatedBy     string    `json:"updatedBy,omitempty"`
+	Status        string    `json:"status" example:"active"`
+}
+
+// Request creates or replaces a waiver.
+type Request struct {
+	Plugin        string    `json:"plugin" binding:"required"`
+	RuleId        string    `json:"ruleId" binding:"required"`
+	ClusterId     string    `json:"clusterId"`
+	Namespace     string    `json:"namespace"`
+	Resource      string    `json:"resource"`
+	Justification string    `json:"justification" binding:"required"`
+	Owner         string    `json:"owner" binding:"required"`
+	ExpiresAt     time.Time `json:"expiresAt" binding:"required"`
+}
+
+const (
+	ActionCreated    = "created"
+	ActionUpdated    = "updated"
+	ActionReassigned = "reassigned"
+	ActionDeleted    = "deleted"
+)
+
+// Event records a change of a waiver, who made it and the waiver as it was after the change. The events of
+// a waiver are its approval trail, kept after the waiver is deleted.
+type Event struct {
+	Id       string    `json:"id"`
+	WaiverId string    `json:"waiverId"`
+	Action   string    `json:"action" example:"updated"`
+	By       string    `json:"by,omitempty"`
+	At       time.Time `json:"at"`
+	Waiver   *Waiver   `json:"waiver"`
+}
+
+// ErrInvalid is returned when a request does not make a valid waiver
+var ErrInvalid = errors.New("Invalid waiver")
+
+var (
+	waiverColl persist.DurableStore
+	eventColl  persist.DurableStore
+	mu         sync.Mutex
+)
+
+func init() {
+	waiverColl = persist.Durable("waiver", func() interface{} { return &Waiver{} })
+	eventColl = persist.Durable("waiver-event", func() interface{} { return &Event{} })
+}
+
+func (r *Request) validate() error {
+	if strings.TrimSpace(r.Justification) == "" {
+		return fmt.Errorf("%w: justification is required", ErrInvalid)
+	}
+	if strings.TrimSpace(r.Owner) == "" {
+		return fmt.Errorf("%w: owner is required", ErrInvalid)
+	}
+	if !r.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("%w: expiresAt must be in the future", ErrInvalid)
+	}
+	if i := strings.Index(r.Resource, "*"); i >= 0 && i != len(r.Resource)-1 {
+		return fmt.Errorf("%w: resource only accepts a trailing *", ErrInvalid)
+	}
+	return nil
+}
+
+// record adds a change of a waiver to its trail.
+func record(action string, by string, w *Waiver) error {
+	e := &Event{
+		Id:       util.RandomString(8),
+		WaiverId: w.Id,
+		Action:   action,
+		By:       by,
+		At:       time.Now().UTC(),
+		Waiver:   w,
+	}
+	return eventColl.Put(w.OrgId, e.Id, e)
+}
+
+func (w *Waiver) apply(r *Request) {
+	w.Plugin = r.Plugin
+	w.RuleId = r.RuleId
+	w.ClusterId = r.ClusterId
+	w.Namespace = r.Namespace
+	w.Resource = r.Resource
+	w.Justification = r.Justification
+	w.Owner = r.Owner
+	w.ExpiresAt = r.ExpiresAt.UTC()
+}
+
+func Create(orgId string, user string, r *Request) (*Waiver, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	w := &Waiver{
+		Id:        util.RandomString(8),
+		OrgId:     orgId,
+		CreatedAt: now,
+		CreatedBy: user,
+		UpdatedAt: now,
+	}
+	w.apply(r)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err := waiverColl.Put(orgId, w.Id, w); err != nil {
+		return nil, err
+	}
+	if err := record(ActionCreated, user, w); err != nil {
+		return nil, err
+	}
+	return withStatus(w), nil
+}
+
+// Update replaces the scope, justification, owner and expiry of a waiver, for instance to renew it.
+func Update(orgId string, user string, waiverId string, r *Request) (*Waiver, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	v, err := waiverColl.Get(orgId, waiverId)
+	if err != nil {
+		return nil, err
+	}
+	w := *v.(*Waiver)
+	w.apply(r)
+	w.UpdatedAt = time.Now().UTC()
+	w.UpdatedBy = user
+	if err := waiverColl.Put(orgId, waiverId, &w); err != nil {
+		return nil, err
+	}
+	if err := record(ActionUpdated, user, &w); err != nil {
+		return nil, err
+	}
+	return withStatus(&w), nil
+}
+
+func Get(orgId string, waiverId string) (*Waiver, error) {
+	v, err := waiverColl.Get(orgId, waiverId)
+	if err != nil {
+		return nil, err
+	}
+	return withStatus(v.(*Waiver)), nil
+}
+
+// List returns the waivers of the org, soonest expiry first.
+func List(orgId string) ([]*Waiver, error) {
+	items, err := waiverColl.List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Waiver, 0, len(items))
+	for _, v := range items {
+		ret = append(ret, withStatus(v.(*Waiver)))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ExpiresAt.Before(ret[j].ExpiresAt)
+	})
+	return ret, nil
+}
+
+// Active returns the waivers of the org which have not expired yet.
+func Active(orgId string) ([]*Waiver, error) {
+	waivers, err := List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*Waiver{}
+	for _, w := range waivers {
+		if w.Status != StatusExpired {
+			ret = append(ret, w)
+		}
+	}
+	return ret, nil
+}
+
+// Expiring returns the active waivers of the org expiring within the given duration.
+func Expiring(orgId string, within time.Duration) ([]*Waiver, error) {
+	active, err := Active(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*Waiver{}
+	limit := time.Now().Add(within)
+	for _, w := range active {
+		if w.ExpiresAt.Before(limit) {
+			ret = append(ret, w)
+		}
+	}
+	return ret, nil
+}
+
+// Reassign moves the waivers scoped to a cluster to the id it is now known by, and returns how many it moved.
+func Reassign(orgId string, from string, to string) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	items, err := waiverColl.List(orgId)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, v := range items {
+		w := v.(*Waiver)
+		if w.ClusterId == from {
+			moved := *w
+			moved.ClusterId = to
+			moved.UpdatedAt = time.Now().UTC()
+			if err := waiverColl.Put(orgId, w.Id, &moved); err != nil {
+				return n, err
+			}
+			if err := record(ActionReassigned, "", &moved); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+func Delete(orgId string, user string, waiverId string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	v, err := waiverColl.Get(orgId, waiverId)
+	if err != nil {
+		return err
+	}
+	if err := waiverColl.Delete(orgId, waiverId); err != nil {
+		return err
+	}
+	return record(ActionDeleted, user, v.(*Waiver))
+}
+
+// History returns the trail of a waiver, oldest change first. The trail of a deleted waiver is kept.
+func History(orgId string, waiverId string) ([]*Event, error) {
+	items, err := eventColl.List(orgId)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*Event{}
+	for _, v := range items {
+		if e := v.(*Event); e.WaiverId == waiverId {
+			ret = append(ret, e)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("Item not found: " + waiverId)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].At.Before(ret[j].At)
+	})
+	return ret, nil
+}
+
+// Matches tells whether the waiver covers a finding. Only failing findings are waived.
+func (w *Waiver) Matches(plugin string, ruleId string, clusterId string, namespace string, resource string) bool {
+	if !strings.EqualFold(w.Plugin, plugin) || w.RuleId != ruleId {
+		return false
+	}
+	if w.ClusterId != "" && w.ClusterId != clusterId {
+		return false
+	}
+	if w.Namespace != "" && w.Namespace != namespace {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(w.Resource, "*"); ok {
+		return strings.HasPrefix(resource, prefix)
+	}
+	return w.Resource == "" || w.Resource == resource
+}
+
+// withStatus returns a copy of the waiver with the derived status filled in.
+func withStatus(w *Waiver) *Waiver {
+	ret := *w
+	remaining := time.Until(ret.ExpiresAt)
+	if remaining <= 0 {
+		ret.Status = StatusExpired
+	} else if remaining <= config.Get().WaiverExpiringWithin {
+		ret.Status = StatusExpiring
+	} else {
+		ret.Status = StatusActive
+	}
+	return &ret
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"net/url"
+	"strings"
+)
+
+// sensitiveParams are the query parameters carrying credentials, such as the OAuth callback code
+var sensitiveParams = map[string]bool{
+	"token":         true,
+	"access_token":  true,
+	"code":          true,
+	"state":         true,
+	"key":           true,
+	"api_key":       true,
+	"password":      true,
+	"client_secret": true,
+}
+
+// RedactToken keeps the scheme, the auth provider and the first characters of a token, so that
+// failures can be told apart in the logs without leaking credentials.
+func RedactToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	scheme := ""
+	for _, s := range []string{"Bearer ", "Token "} {
+		if strings.HasPrefix(token, s) {
+			scheme = s
+			token = strings.TrimPrefix(token, s)
+		}
+	}
+	provider := ""
+	if i := strings.Index(token, "/"); i >= 0 {
+		provider = token[:i+1]
+		token = token[i+1:]
+	}
+	if len(token) > 4 {
+		token = token[:4]
+	}
+	return scheme + provider + token + "****"
+}
+
+// RedactQuery returns the raw query with the values of the sensitive parameters masked.
+func RedactQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "REDACTED"
+	}
+	for name := range values {
+		if sensitiveParams[strings.ToLower(name)] {
+			values[name] = []string{"REDACTED"}
+		}
+	}
+	return values.Encode()
+}
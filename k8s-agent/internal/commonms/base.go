@@ -17,16 +17,21 @@ package commonms
 
 import (
 	"collie-agent/internal/config"
+	"collie-agent/internal/tracing"
 	"context"
 	"encoding/json"
 	"errors"
 	"runtime/debug"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 )
 
-func RunApp(fnRun func(config.Config, *logrus.Entry, context.Context, chan error) error) {
+// tracingShutdownTimeout bounds the export of the spans left on exit
+const tracingShutdownTimeout = 5 * time.Second
+
+func RunApp(fnRun func(config.Config, *logrus.Entry, context.Context, *HealthzProvider, chan error) error) {
 
 	cfg := config.Get()
 
@@ -49,10 +54,37 @@ func RunApp(fnRun func(config.Config, *logrus.Entry, context.Context, chan error
 
 	exitCh := make(chan error, 10)
 	go watchExitErrors(ctx, log, exitCh, ctxCancel)
-	closeHealthz := StartHealthz(cfg, log, exitCh)
+	healthz, closeHealthz := StartHealthz(cfg, log, exitCh)
 	defer closeHealthz()
 
-	if err := fnRun(cfg, log, ctx, exitCh); err != nil {
+	shutdownTracing, err := tracing.Start(ctx, cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Error starting tracing: %v", err)
+	}
+	defer func() {
+		// the signal context is done by now, the spans left get a while of their own to be exported
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Warnf("Error flushing traces: %v", err)
+		}
+	}()
+
+	run := func(ctx context.Context) error {
+		return fnRun(cfg, log, ctx, healthz, exitCh)
+	}
+	// an offline run is a one-off, only the scan loop of the replicas needs a leader
+	if cfg.LeaderElection.Enabled && cfg.Offline.Format == "" {
+		clientset, cerr := leaseClient(log, cfg)
+		if cerr != nil {
+			log.Fatalf("Error creating the client of the Lease: %v", cerr)
+		}
+		err = runElected(ctx, cfg, log, healthz, clientset, run)
+	} else {
+		healthz.Leading()
+		err = run(ctx)
+	}
+	if err != nil {
 		log.Fatalf("agent failed: %v", err)
 	}
 
@@ -16,8 +16,11 @@ limitations under the License.
 package commonms
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -25,23 +28,51 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 
 	"collie-agent/internal/config"
+	"collie-agent/internal/metrics"
 )
 
+// readyCheckInterval is the time the result of a readiness check is reused, so that the probes of
+// the kubelet do not hit the API server and ES at each call
+const readyCheckInterval = 30 * time.Second
+
 func newHealthzProvider(cfg config.Config, log logrus.FieldLogger) *HealthzProvider {
 	return &HealthzProvider{
 		cfg:             cfg,
 		log:             log,
 		initHardTimeout: cfg.Controller.PrepTimeout + cfg.Controller.InitialSleepDuration + cfg.Controller.InitializationTimeoutExtension,
+		readyChecks:     map[string]healthz.Checker{},
+		readyResults:    map[string]readyResult{},
 	}
 }
 
+// HealthzProvider reports the liveness of the scan loop, which drives it through the lifecycle of
+// the probe, and its readiness, from the connectivity checks registered once the clients exist.
 type HealthzProvider struct {
 	cfg             config.Config
 	log             logrus.FieldLogger
 	initHardTimeout time.Duration
 
+	mu                  sync.Mutex
 	initializeStartedAt *time.Time
 	lastHealthyActionAt *time.Time
+	// busy is set while a cycle runs, the loop is healthy while it sleeps between cycles
+	busy           bool
+	phase          string
+	phaseStartedAt *time.Time
+	// electing is set when the replicas elect a leader, a follower is healthy and ready to take over
+	electing bool
+	leading  bool
+	holder   string
+
+	// readyMu guards the readiness checks apart, since they may be slow
+	readyMu      sync.Mutex
+	readyChecks  map[string]healthz.Checker
+	readyResults map[string]readyResult
+}
+
+type readyResult struct {
+	at  time.Time
+	err error
 }
 
 func now() *time.Time {
@@ -54,12 +85,23 @@ func (h *HealthzProvider) healthyAction() {
 	h.lastHealthyActionAt = now()
 }
 
-func runHealthzEndpoints(cfg config.Config, log *logrus.Entry, controllerCheck healthz.Checker, exitCh chan error) func() {
+func runHealthzEndpoints(cfg config.Config, log *logrus.Entry, controllerCheck healthz.Checker, readyCheck healthz.Checker, leaderz http.HandlerFunc, exitCh chan error) func() {
 	log.Infof("starting healthz on port: %d", cfg.HealthzPort)
-	healthzSrv := &http.Server{Addr: portToServerAddr(cfg.HealthzPort), Handler: &healthz.Handler{Checks: map[string]healthz.Checker{
+	liveness := &healthz.Handler{Checks: map[string]healthz.Checker{
 		"server":     healthz.Ping,
 		"controller": controllerCheck,
-	}}}
+	}}
+	readiness := &healthz.Handler{Checks: map[string]healthz.Checker{
+		"server":       healthz.Ping,
+		"connectivity": readyCheck,
+	}}
+	mux := http.NewServeMux()
+	mux.Handle("/healthz/", http.StripPrefix("/healthz", liveness))
+	mux.Handle("/readyz/", http.StripPrefix("/readyz", readiness))
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/leaderz", leaderz)
+	mux.Handle("/", liveness)
+	healthzSrv := &http.Server{Addr: portToServerAddr(cfg.HealthzPort), Handler: mux}
 	closeFunc := func() {
 		if err := healthzSrv.Close(); err != nil {
 			log.Errorf("closing healthz server: %v", err)
@@ -83,8 +125,23 @@ func (h *HealthzProvider) Check(_ *http.Request) (err error) {
 		}
 	}()
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.electing && !h.leading {
+		return nil
+	}
+
+	if h.phase != "" {
+		deadline := h.cfg.Controller.PhaseDeadline.ByPhase()[h.phase]
+		if deadline > 0 && time.Since(*h.phaseStartedAt) > deadline {
+			return fmt.Errorf("phase %s is running for longer than its deadline of %s", h.phase, deadline)
+		}
+		return nil
+	}
+
 	if h.lastHealthyActionAt != nil {
-		if time.Since(*h.lastHealthyActionAt) > h.cfg.Controller.HealthySnapshotIntervalLimit {
+		if h.busy && time.Since(*h.lastHealthyActionAt) > h.cfg.Controller.HealthySnapshotIntervalLimit {
 			return fmt.Errorf("time since initialization or last snapshot sent is over the considered healthy limit of %s", h.cfg.Controller.HealthySnapshotIntervalLimit)
 		}
 		return nil
@@ -100,7 +157,54 @@ func (h *HealthzProvider) Check(_ *http.Request) (err error) {
 	return nil
 }
 
+// Ready fails until the connectivity checks are registered, then when one of them fails. A follower
+// is ready as is.
+func (h *HealthzProvider) Ready(req *http.Request) error {
+	h.mu.Lock()
+	following := h.electing && !h.leading
+	h.mu.Unlock()
+	if following {
+		return nil
+	}
+
+	h.readyMu.Lock()
+	defer h.readyMu.Unlock()
+
+	if len(h.readyChecks) == 0 {
+		return fmt.Errorf("controller is not initialized")
+	}
+	names := make([]string, 0, len(h.readyChecks))
+	for name := range h.readyChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res, ok := h.readyResults[name]
+		if !ok || time.Since(res.at) > readyCheckInterval {
+			res = readyResult{at: time.Now(), err: h.readyChecks[name](req)}
+			h.readyResults[name] = res
+			if res.err != nil {
+				h.log.Warnf("Readiness check %s failed due to: %v", name, res.err)
+			}
+		}
+		if res.err != nil {
+			return fmt.Errorf("%s: %w", name, res.err)
+		}
+	}
+	return nil
+}
+
+// AddReadyCheck registers a connectivity check of the readiness endpoint.
+func (h *HealthzProvider) AddReadyCheck(name string, check healthz.Checker) {
+	h.readyMu.Lock()
+	defer h.readyMu.Unlock()
+	h.readyChecks[name] = check
+	delete(h.readyResults, name)
+}
+
 func (h *HealthzProvider) Initializing() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	if h.initializeStartedAt == nil {
 		h.initializeStartedAt = now()
 		h.lastHealthyActionAt = nil
@@ -108,15 +212,108 @@ func (h *HealthzProvider) Initializing() {
 }
 
 func (h *HealthzProvider) Initialized() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.healthyAction()
+}
+
+// CycleStarted marks the start of a cycle, which must send its snapshot within the healthy limit,
+// its phases aside.
+func (h *HealthzProvider) CycleStarted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.busy = true
+	h.healthyAction()
+}
+
+// PhaseStarted marks the start of a phase, which must end within its deadline.
+func (h *HealthzProvider) PhaseStarted(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.phase = name
+	h.phaseStartedAt = now()
+}
+
+func (h *HealthzProvider) PhaseEnded() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.phase = ""
+	h.phaseStartedAt = nil
 	h.healthyAction()
 }
 
+// SnapshotSent marks the end of a cycle, the loop then sleeps until the next one.
 func (h *HealthzProvider) SnapshotSent() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.busy = false
 	h.healthyAction()
 }
 
-func StartHealthz(cfg config.Config, log *logrus.Entry, exitCh chan error) func() {
+// Electing tells that the replicas elect the leader running the scan loop, the replica follows until it leads.
+func (h *HealthzProvider) Electing() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.electing = true
+	metrics.Leader(false)
+}
+
+// Leading marks the start of the scan loop, the replica being the leader when the replicas elect one.
+func (h *HealthzProvider) Leading() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leading = true
+	metrics.Leader(true)
+}
+
+// Following marks the end of the scan loop of a leader which stepped down. The lifecycle of the loop and
+// its connectivity checks are dropped, the next one starts over when the replica leads again.
+func (h *HealthzProvider) Following() {
+	h.mu.Lock()
+	h.leading = false
+	h.busy = false
+	h.phase = ""
+	h.phaseStartedAt = nil
+	h.initializeStartedAt = nil
+	h.lastHealthyActionAt = nil
+	metrics.Leader(false)
+	h.mu.Unlock()
+
+	h.readyMu.Lock()
+	defer h.readyMu.Unlock()
+	h.readyChecks = map[string]healthz.Checker{}
+	h.readyResults = map[string]readyResult{}
+}
+
+// LeaderObserved records the identity of the replica holding the Lease.
+func (h *HealthzProvider) LeaderObserved(identity string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.holder = identity
+}
+
+// Leaderz reports whether the replica leads, and which replica does.
+func (h *HealthzProvider) Leaderz(w http.ResponseWriter, _ *http.Request) {
+	h.mu.Lock()
+	status := struct {
+		Electing bool   `json:"electing"`
+		Identity string `json:"identity,omitempty"`
+		Leader   bool   `json:"leader"`
+		Holder   string `json:"holder,omitempty"`
+	}{h.electing, "", h.leading, h.holder}
+	if h.electing {
+		status.Identity = h.cfg.LeaderElection.Identity
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.log.Warnf("Error writing leader status: %v", err)
+	}
+}
+
+func StartHealthz(cfg config.Config, log *logrus.Entry, exitCh chan error) (*HealthzProvider, func()) {
 	ctrlHealthz := newHealthzProvider(cfg, log)
-	closeHealthz := runHealthzEndpoints(cfg, log, ctrlHealthz.Check, exitCh)
-	return closeHealthz
+	closeHealthz := runHealthzEndpoints(cfg, log, ctrlHealthz.Check, ctrlHealthz.Ready, ctrlHealthz.Leaderz, exitCh)
+	return ctrlHealthz, closeHealthz
 }
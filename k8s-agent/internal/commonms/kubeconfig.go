@@ -0,0 +1,66 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commonms
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"collie-agent/internal/config"
+)
+
+func kubeConfigFromPath(kubepath string) (*rest.Config, error) {
+	if kubepath == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(kubepath)
+	if err != nil {
+		return nil, fmt.Errorf("reading kubeconfig at %s: %w", kubepath, err)
+	}
+
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("building rest config from kubeconfig at %s: %w", kubepath, err)
+	}
+
+	return restConfig, nil
+}
+
+// KubeConfig returns the configuration of the clients of the cluster, from the kubeconfig file of the
+// configuration when set, else from the service account of the pod.
+func KubeConfig(log logrus.FieldLogger, cfg config.Config) (*rest.Config, error) {
+	kubeconfig, err := kubeConfigFromPath(cfg.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if kubeconfig != nil {
+		log.Debug("using kubeconfig from env variables")
+		return kubeconfig, nil
+	}
+
+	inClusterConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("using in cluster kubeconfig")
+	return inClusterConfig, nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commonms
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"collie-agent/internal/config"
+)
+
+// runElected runs fn while the replica holds the Lease of the configuration. A leader which loses the
+// Lease waits for fn to return, then follows again, so that a single replica reports at any time. It
+// returns when ctx is done, or with the error of fn.
+func runElected(ctx context.Context, cfg config.Config, log *logrus.Entry, healthz *HealthzProvider, clientset kubernetes.Interface, fn func(context.Context) error) error {
+	le := cfg.LeaderElection
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: le.LeaseName, Namespace: le.Namespace},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: le.Identity},
+	}
+	log.Infof("Electing the leader with Lease %s/%s as %s", le.Namespace, le.LeaseName, le.Identity)
+	healthz.Electing()
+
+	for {
+		// the election outlives ctx, so that a leader holds the Lease until its loop is over
+		electionCtx, cancelElection := context.WithCancel(context.Background())
+		var mu sync.Mutex
+		running := false
+		done := make(chan struct{})
+		var fnErr error
+
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   le.LeaseDuration,
+			RenewDeadline:   le.RenewDeadline,
+			RetryPeriod:     le.RetryPeriod,
+			ReleaseOnCancel: true,
+			Name:            le.LeaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(leaderCtx context.Context) {
+					// the elector starts the callback asynchronously, the election or ctx may be over by then
+					mu.Lock()
+					if leaderCtx.Err() != nil || ctx.Err() != nil {
+						mu.Unlock()
+						cancelElection()
+						return
+					}
+					running = true
+					mu.Unlock()
+					defer close(done)
+					// the Lease is released once the loop is over
+					defer cancelElection()
+
+					runCtx, cancelRun := context.WithCancel(leaderCtx)
+					defer cancelRun()
+					go func() {
+						select {
+						case <-ctx.Done():
+							cancelRun()
+						case <-runCtx.Done():
+						}
+					}()
+
+					log.Info("Leading, starting the scan loop")
+					healthz.Leading()
+					// the errors of a loop cut short are those of its canceled calls
+					if err := fn(runCtx); err != nil && runCtx.Err() == nil {
+						fnErr = err
+					}
+				},
+				OnStoppedLeading: func() {
+					log.Info("Not leading")
+				},
+				OnNewLeader: func(identity string) {
+					log.Infof("Leader is %s", identity)
+					healthz.LeaderObserved(identity)
+				},
+			},
+		})
+		if err != nil {
+			cancelElection()
+			return fmt.Errorf("creating leader elector: %w", err)
+		}
+		// a follower leaves the election when ctx is done
+		go func() {
+			select {
+			case <-ctx.Done():
+				mu.Lock()
+				if !running {
+					cancelElection()
+				}
+				mu.Unlock()
+			case <-electionCtx.Done():
+			}
+		}()
+		elector.Run(electionCtx)
+
+		// the Lease may be lost while the loop runs, it stops within the lease duration left
+		cancelElection()
+		mu.Lock()
+		wasRunning := running
+		mu.Unlock()
+		if wasRunning {
+			<-done
+			healthz.Following()
+		}
+
+		if fnErr != nil {
+			return fnErr
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Warn("Lost the Lease, following")
+	}
+}
+
+// leaseClient returns the client of the Leases, apart from the clients of the scan loop.
+func leaseClient(log *logrus.Entry, cfg config.Config) (*kubernetes.Clientset, error) {
+	restconfig, err := KubeConfig(log, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restconfig)
+}
@@ -17,6 +17,7 @@ package config
 
 import (
 	"fmt"
+	"os"
 	"reflect"
 	"strings"
 	"sync"
@@ -32,12 +33,20 @@ type Config struct {
 	ES         API    `mapstructure:"es"`
 	Kubeconfig string `mapstructure:"kubeconfig"`
 	AgentId    string `mapstructure:"agentId"`
+	// Namespace of the agent, where it keeps its Lease and its ConfigMaps
+	Namespace string `mapstructure:"namespace"`
 
+	// Provider is the provider agent.yaml was generated for, which chose the benchmark of kube-bench.
+	// The agent reports the provider it detects.
 	Provider string `mapstructure:"provider"`
 	EKS      *EKS   `mapstructure:"eks"`
 	GKE      *GKE   `mapstructure:"gke"`
 	AKS      *AKS   `mapstructure:"aks"`
 
+	Offline        Offline        `mapstructure:"offline"`
+	Tracing        Tracing        `mapstructure:"tracing"`
+	LeaderElection LeaderElection `mapstructure:"leader_election"`
+
 	Static      *Static     `mapstructure:"static"`
 	Controller  *Controller `mapstructure:"controller"`
 	PprofPort   int         `mapstructure:"pprof.port"`
@@ -53,6 +62,49 @@ type API struct {
 	URL string `mapstructure:"url"`
 }
 
+// Tracing exports OpenTelemetry traces of the cycles. It is off unless an exporter is set.
+type Tracing struct {
+	// Exporter is otlp, to send the traces to a collector over OTLP/HTTP, or file
+	Exporter string `mapstructure:"exporter"`
+	// Endpoint is the host:port of the collector, such as otel-collector:4318. The OTEL_EXPORTER_OTLP_ENDPOINT
+	// variable applies when it is empty.
+	Endpoint string `mapstructure:"endpoint"`
+	// Insecure sends the traces over plain HTTP
+	Insecure bool `mapstructure:"insecure"`
+	// File is the path of the file the traces are appended to as JSON, "-" for stdout
+	File string `mapstructure:"file"`
+	// SampleRatio is the ratio of the traces kept, from 0 to 1
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// Offline runs the scanners once and writes the results to a file instead of reporting them.
+type Offline struct {
+	// Format is sarif or oscal. The agent runs in offline mode when it is set.
+	Format string `mapstructure:"format"`
+	// Output is the path of the file written, "-" for stdout
+	Output string `mapstructure:"output"`
+}
+
+// LeaderElection lets a single replica of the agent run the scan loop, the leader holding a Lease.
+// The other replicas wait to take the Lease over when the leader stops renewing it.
+type LeaderElection struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Namespace of the Lease, the namespace of the agent by default
+	Namespace string `mapstructure:"namespace"`
+	// LeaseName is the name of the Lease
+	LeaseName string `mapstructure:"lease_name"`
+	// Identity tells the replicas apart, the hostname, which is the pod name, by default
+	Identity string `mapstructure:"identity"`
+	// LeaseDuration is the time the followers wait before taking over a Lease that is not renewed
+	LeaseDuration time.Duration `mapstructure:"lease_duration"`
+	// RenewDeadline is the time the leader retries renewing the Lease before it steps down
+	RenewDeadline time.Duration `mapstructure:"renew_deadline"`
+	// RetryPeriod is the time between two attempts to acquire or renew the Lease
+	RetryPeriod time.Duration `mapstructure:"retry_period"`
+}
+
+// EKS, GKE and AKS override what the agent detects about a cluster of the provider, and tell the
+// provider when it is not detected.
 type EKS struct {
 	AccountID   string `mapstructure:"account_id"`
 	Region      string `mapstructure:"region"`
@@ -72,6 +124,9 @@ type AKS struct {
 	SubscriptionID    string `mapstructure:"subscription_id"`
 }
 
+// Static overrides what the agent discovers. ClusterID replaces the identity of the cluster, which is
+// the UID of the kube-system namespace otherwise. The identity is kept in the ConfigMap collie-agent-cluster,
+// it stays when ClusterID is unset afterwards.
 type Static struct {
 	SkipClusterRegistration bool   `mapstructure:"skip_cluster_registration"`
 	ClusterID               string `mapstructure:"cluster_id"`
@@ -84,11 +139,75 @@ type Controller struct {
 	InitialSleepDuration           time.Duration `mapstructure:"initial_sleep_duration"`
 	HealthySnapshotIntervalLimit   time.Duration `mapstructure:"healthy_snapshot_interval_limit"`
 	InitializationTimeoutExtension time.Duration `mapstructure:"initialization_timeout_extension"`
+	// SnapshotRetention is the number of completed snapshots kept per cluster, for diffing
+	SnapshotRetention int `mapstructure:"snapshot_retention"`
+	// ConfigPollInterval is the time between two polls of the remote configuration
+	ConfigPollInterval time.Duration `mapstructure:"config_poll_interval"`
+	// Schedule is the cron schedule of each phase, in Timezone. A phase without schedule runs at the scan interval.
+	Schedule Schedule `mapstructure:"schedule"`
+	// Timezone is the IANA name of the timezone of the schedules, the local time of the agent by default
+	Timezone string `mapstructure:"timezone"`
+	// Blackouts are the windows during which the active scanners, kube-bench and kube-hunter, do not run,
+	// separated by ";". A window is a cron schedule of its start followed by its duration, such as "0 9 * * 1-5 8h".
+	Blackouts string `mapstructure:"blackouts"`
+	// PhaseDeadline is the time a phase may run before the liveness check fails and the pod restarts
+	PhaseDeadline PhaseDeadline `mapstructure:"phase_deadline"`
+}
+
+// PhaseDeadline holds the liveness deadline of each phase of a cycle.
+type PhaseDeadline struct {
+	Cluster    time.Duration `mapstructure:"cluster"`
+	Resources  time.Duration `mapstructure:"resources"`
+	KubeBench  time.Duration `mapstructure:"kube_bench"`
+	KubeHunter time.Duration `mapstructure:"kube_hunter"`
+	Rules      time.Duration `mapstructure:"rules"`
+	CarryOver  time.Duration `mapstructure:"carry_over"`
+}
+
+// ByPhase returns the deadlines keyed by phase name.
+func (d PhaseDeadline) ByPhase() map[string]time.Duration {
+	return map[string]time.Duration{
+		"cluster":     d.Cluster,
+		"resources":   d.Resources,
+		"kube-bench":  d.KubeBench,
+		"kube-hunter": d.KubeHunter,
+		"rules":       d.Rules,
+		"carry-over":  d.CarryOver,
+	}
+}
+
+// Schedule holds cron expressions, such as "0 2 * * *" or "@every 1h", by phase.
+type Schedule struct {
+	Resources  string `mapstructure:"resources"`
+	Rules      string `mapstructure:"rules"`
+	KubeBench  string `mapstructure:"kube_bench"`
+	KubeHunter string `mapstructure:"kube_hunter"`
+}
+
+// ByPhase returns the cron expressions keyed by phase name, omitting the phases without schedule.
+func (s Schedule) ByPhase() map[string]string {
+	ret := map[string]string{}
+	for phase, spec := range map[string]string{
+		"resources":   s.Resources,
+		"rules":       s.Rules,
+		"kube-bench":  s.KubeBench,
+		"kube-hunter": s.KubeHunter,
+	} {
+		if spec != "" {
+			ret[phase] = spec
+		}
+	}
+	return ret
 }
 
 var cfg *Config
 var mu sync.Mutex
 
+// defaultNamespace is the namespace of the agent when it runs out of the cluster
+const defaultNamespace = "collie-agent"
+
+const serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
 // Get configuration bound to environment variables.
 func Get() Config {
 	if cfg != nil {
@@ -106,8 +225,24 @@ func Get() Config {
 	viper.SetDefault("controller.initial_sleep_duration", 30*time.Second)
 	viper.SetDefault("controller.healthy_snapshot_interval_limit", 12*time.Minute)
 	viper.SetDefault("controller.initialization_timeout_extension", 5*time.Minute)
+	viper.SetDefault("controller.snapshot_retention", 3)
+	viper.SetDefault("controller.config_poll_interval", time.Minute)
+	viper.SetDefault("controller.phase_deadline.cluster", 5*time.Minute)
+	viper.SetDefault("controller.phase_deadline.resources", 30*time.Minute)
+	viper.SetDefault("controller.phase_deadline.kube_bench", 15*time.Minute)
+	viper.SetDefault("controller.phase_deadline.kube_hunter", 15*time.Minute)
+	viper.SetDefault("controller.phase_deadline.rules", 10*time.Minute)
+	viper.SetDefault("controller.phase_deadline.carry_over", 10*time.Minute)
 
 	viper.SetDefault("healthz_port", 9876)
+	viper.SetDefault("tracing.file", "-")
+	viper.SetDefault("tracing.sample_ratio", 1.0)
+	viper.SetDefault("offline.output", "-")
+	viper.SetDefault("leader_election.enabled", true)
+	viper.SetDefault("leader_election.lease_name", "collie-agent")
+	viper.SetDefault("leader_election.lease_duration", 15*time.Second)
+	viper.SetDefault("leader_election.renew_deadline", 10*time.Second)
+	viper.SetDefault("leader_election.retry_period", 2*time.Second)
 
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
@@ -123,12 +258,40 @@ func Get() Config {
 		cfg.Log.Level = int(logrus.InfoLevel)
 	}
 
-	required(cfg.API.URL, "API_URL")
-	required(cfg.API.Key, "API_KEY")
-	required(cfg.ES.URL, "ES_URL")
-	required(cfg.ES.Key, "ES_KEY")
-	required(cfg.Provider, "PROVIDER")
-	required(cfg.AgentId, "AGENTID")
+	if cfg.Offline.Format == "" {
+		required(cfg.API.URL, "API_URL")
+		required(cfg.API.Key, "API_KEY")
+		required(cfg.ES.URL, "ES_URL")
+		required(cfg.ES.Key, "ES_KEY")
+		required(cfg.Provider, "PROVIDER")
+		required(cfg.AgentId, "AGENTID")
+	} else if cfg.Offline.Format != "sarif" && cfg.Offline.Format != "oscal" {
+		panic(fmt.Errorf("env variable OFFLINE_FORMAT must be sarif or oscal: %s", cfg.Offline.Format))
+	}
+
+	if cfg.Tracing.Exporter != "" && cfg.Tracing.Exporter != "otlp" && cfg.Tracing.Exporter != "file" {
+		panic(fmt.Errorf("env variable TRACING_EXPORTER must be otlp or file: %s", cfg.Tracing.Exporter))
+	}
+
+	if cfg.LeaderElection.Identity == "" {
+		cfg.LeaderElection.Identity, _ = os.Hostname()
+	}
+	if cfg.Namespace == "" {
+		cfg.Namespace = defaultNamespace
+		if ns, err := os.ReadFile(serviceAccountNamespace); err == nil {
+			cfg.Namespace = strings.TrimSpace(string(ns))
+		}
+	}
+	if cfg.LeaderElection.Namespace == "" {
+		cfg.LeaderElection.Namespace = cfg.Namespace
+	}
+	if cfg.LeaderElection.Enabled && cfg.LeaderElection.RenewDeadline >= cfg.LeaderElection.LeaseDuration {
+		panic(fmt.Errorf("env variable LEADER_ELECTION_RENEW_DEADLINE must be shorter than LEADER_ELECTION_LEASE_DURATION"))
+	}
+
+	if cfg.Controller.SnapshotRetention < 1 {
+		panic(fmt.Errorf("env variable CONTROLLER_SNAPSHOT_RETENTION must be at least 1"))
+	}
 
 	if !strings.HasPrefix(cfg.API.URL, "https://") && !strings.HasPrefix(cfg.API.URL, "http://") {
 		cfg.API.URL = fmt.Sprintf("https://%s", cfg.API.URL)
@@ -0,0 +1,159 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+
+	"collie-agent/internal/model"
+)
+
+// testdata holds the schemas and the golden exports, shared with the API server which exports its findings alike
+const testdata = "../../../testdata"
+
+var update = flag.Bool("update", false, "update the golden exports of testdata/export")
+
+// testResults are the results of the golden exports, the findings of the API server in
+// api-server/service/export.
+func testResults() []*model.Compliance {
+	return []*model.Compliance{
+		{
+			Plugin:      "kube-bench",
+			RuleId:      "1.1.1",
+			Category:    "Control Plane Components",
+			Subcategory: "Control Plane Node Configuration Files",
+			Description: "Ensure that the API server pod specification file permissions are set to 600 or more restrictive",
+			Status:      "FAIL",
+			Severity:    "high",
+			Remediation: "chmod 600 /etc/kubernetes/manifests/kube-apiserver.yaml",
+		},
+		{
+			Plugin:      "kube-bench",
+			RuleId:      "1.1.2",
+			Category:    "Control Plane Components",
+			Description: "Ensure that the API server pod specification file ownership is set to root:root",
+			Status:      "PASS",
+			Severity:    "high",
+		},
+		{
+			Plugin:      "collie",
+			RuleId:      "no-privileged-containers",
+			Category:    "Pod Security",
+			Description: "Containers must not run privileged",
+			Status:      "WAIVED",
+			Severity:    "critical",
+			Namespace:   "default",
+			Resource:    "Pod/web",
+			Remediation: "Remove securityContext.privileged from the containers",
+		},
+		{
+			Plugin:      "kube-hunter",
+			RuleId:      "KHV002",
+			Description: "Kubernetes version disclosure",
+			Status:      "WARN",
+			Severity:    "low",
+		},
+	}
+}
+
+func validate(t *testing.T, schema string, doc []byte) {
+	t.Helper()
+	s, err := jsonschema.Compile(filepath.Join(testdata, "schemas", schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(v); err != nil {
+		t.Fatalf("%#v", err)
+	}
+}
+
+func golden(t *testing.T, name string, doc []byte) {
+	t.Helper()
+	path := filepath.Join(testdata, "export", name)
+	if *update {
+		if err := os.WriteFile(path, append(doc, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(want), doc) {
+		t.Errorf("export differs from %s:\n%s", path, doc)
+	}
+}
+
+func TestSARIF(t *testing.T) {
+	doc, err := SARIF("c1", testResults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	validate(t, "sarif-schema-2.1.0.json", doc)
+	golden(t, "findings.sarif.json", doc)
+}
+
+func TestOSCAL(t *testing.T) {
+	doc, err := OSCAL("Cluster c1", "c1", testResults(), time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	validate(t, "oscal_complete_schema-1-1-1.json", doc)
+
+	var d oscalDocument
+	if err := json.Unmarshal(doc, &d); err != nil {
+		t.Fatal(err)
+	}
+	result := d.AssessmentResults.Results[0]
+	states := map[string]string{}
+	for _, f := range result.Findings {
+		states[f.Target.TargetId] = f.Target.Status.State
+	}
+	want := map[string]string{
+		"kube-bench_1.1.1":                "not-satisfied",
+		"kube-bench_1.1.2":                "satisfied",
+		"collie_no-privileged-containers": "not-satisfied",
+		"kube-hunter_KHV002":              "not-satisfied",
+	}
+	for id, state := range want {
+		if states[id] != state {
+			t.Errorf("state of %s = %q, want %q", id, states[id], state)
+		}
+	}
+	waivedBy := ""
+	for _, p := range result.Observations[2].Props {
+		if p.Name == "waived-by" {
+			waivedBy = p.Value
+		}
+	}
+	if waivedBy != "annotation collie.io/waive" {
+		t.Errorf("waived-by = %q", waivedBy)
+	}
+}
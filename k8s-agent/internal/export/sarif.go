@@ -0,0 +1,249 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package export
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"collie-agent/internal/model"
+)
+
+// SARIF 2.1.0, https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+// This is the offline counterpart of the export of the API server, working on the results of a single cluster.
+// Each plugin is a tool with its own run. Results are located logically, by cluster, namespace and resource.
+
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+)
+
+var toolUris = map[string]string{
+	"kube-bench":  "https://github.com/aquasecurity/kube-bench",
+	"kube-hunter": "https://github.com/aquasecurity/kube-hunter",
+	"collie":      "https://github.com/vmware-labs/compliance-dashboard-for-kubernetes",
+}
+
+// securitySeverities are the CVSS like scores, used by code scanning tools to rank the rules.
+var securitySeverities = map[string]string{
+	"critical": "9.5",
+	"high":     "8.0",
+	"medium":   "5.5",
+	"low":      "2.0",
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationUri string      `json:"informationUri,omitempty"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifRule struct {
+	Id                   string             `json:"id"`
+	ShortDescription     sarifMessage       `json:"shortDescription"`
+	Help                 *sarifMessage      `json:"help,omitempty"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+	Properties           map[string]string  `json:"properties,omitempty"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifResult struct {
+	RuleId     string            `json:"ruleId"`
+	RuleIndex  int               `json:"ruleIndex"`
+	Kind       string            `json:"kind"`
+	Level      string            `json:"level"`
+	Message    sarifMessage      `json:"message"`
+	Locations  []sarifLocation   `json:"locations"`
+	Properties map[string]string `json:"properties,omitempty"`
+	// Suppressions mark the failures accepted by a waiver or an annotation
+	Suppressions []sarifSuppression `json:"suppressions,omitempty"`
+}
+
+type sarifSuppression struct {
+	Kind          string `json:"kind"`
+	Status        string `json:"status"`
+	Justification string `json:"justification,omitempty"`
+}
+
+type sarifLocation struct {
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations"`
+}
+
+type sarifLogicalLocation struct {
+	Name               string `json:"name"`
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+// waiveAnnotation is the annotation of a resource waiving rules in the agent. Findings without a waiver id
+// were waived by it.
+const waiveAnnotation = "collie.io/waive"
+
+// waivedBy tells what accepted the risk of a waived failure: a waiver of the API server, or the annotation
+// of the resource. The API server and the agent export waived findings alike, as in testdata/export.
+func waivedBy(waiverId string) string {
+	if waiverId != "" {
+		return "waiver " + waiverId
+	}
+	return "annotation " + waiveAnnotation
+}
+
+// sarifSuppressions marks a waived failure as suppressed outside of the results, by its waiver.
+func sarifSuppressions(status string, waiverId string) []sarifSuppression {
+	if !strings.EqualFold(status, "WAIVED") {
+		return nil
+	}
+	return []sarifSuppression{{Kind: "external", Status: "accepted", Justification: waivedBy(waiverId)}}
+}
+
+// sarifKindLevel maps a result to the kind and level of a SARIF result.
+func sarifKindLevel(status string, severity string) (string, string) {
+	switch strings.ToUpper(status) {
+	case "PASS":
+		return "pass", "none"
+	case "FAIL":
+		switch strings.ToLower(severity) {
+		case "medium":
+			return "fail", "warning"
+		case "low":
+			return "fail", "note"
+		}
+		return "fail", "error"
+	case "WARN", "WAIVED":
+		return "fail", "warning"
+	}
+	// the level of a result which is not a failure must be none
+	return "informational", "none"
+}
+
+func sarifLocations(clusterId string, c *model.Compliance) []sarifLocation {
+	locations := []sarifLogicalLocation{{Name: clusterId, FullyQualifiedName: clusterId, Kind: "cluster"}}
+	fqn := clusterId
+	if c.Namespace != "" {
+		fqn += "/" + c.Namespace
+		locations = append(locations, sarifLogicalLocation{Name: c.Namespace, FullyQualifiedName: fqn, Kind: "namespace"})
+	}
+	if c.Resource != "" {
+		fqn += "/" + c.Resource
+		locations = append(locations, sarifLogicalLocation{Name: c.Resource, FullyQualifiedName: fqn, Kind: "resource"})
+	}
+	return []sarifLocation{{LogicalLocations: locations}}
+}
+
+// SARIF exports the results of a cluster as a SARIF 2.1.0 log, with one run per plugin.
+func SARIF(clusterId string, results []*model.Compliance) ([]byte, error) {
+	runs := map[string]*sarifRun{}
+	ruleIndexes := map[string]map[string]int{}
+	for _, c := range results {
+		run, ok := runs[c.Plugin]
+		if !ok {
+			run = &sarifRun{
+				Tool: sarifTool{Driver: sarifDriver{
+					Name:           c.Plugin,
+					InformationUri: toolUris[c.Plugin],
+					Rules:          []sarifRule{},
+				}},
+				Results: []sarifResult{},
+			}
+			runs[c.Plugin] = run
+			ruleIndexes[c.Plugin] = map[string]int{}
+		}
+
+		kind, level := sarifKindLevel(c.Status, c.Severity)
+		idx, ok := ruleIndexes[c.Plugin][c.RuleId]
+		if !ok {
+			rule := sarifRule{
+				Id:                   c.RuleId,
+				ShortDescription:     sarifMessage{Text: nonEmpty(c.Description, c.RuleId)},
+				DefaultConfiguration: sarifConfiguration{Level: "warning"},
+				Properties:           map[string]string{},
+			}
+			if c.Remediation != "" {
+				rule.Help = &sarifMessage{Text: c.Remediation}
+			}
+			if c.Category != "" {
+				rule.Properties["category"] = c.Category
+			}
+			if c.Subcategory != "" {
+				rule.Properties["subcategory"] = c.Subcategory
+			}
+			if s, ok := securitySeverities[strings.ToLower(c.Severity)]; ok {
+				rule.Properties["security-severity"] = s
+			}
+			idx = len(run.Tool.Driver.Rules)
+			ruleIndexes[c.Plugin][c.RuleId] = idx
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, rule)
+		}
+
+		props := map[string]string{"status": c.Status}
+		if c.Severity != "" {
+			props["severity"] = c.Severity
+		}
+		// the waivers of the API server are applied to the findings later, the agent only knows the annotations
+		result := sarifResult{
+			RuleId:       c.RuleId,
+			RuleIndex:    idx,
+			Kind:         kind,
+			Level:        level,
+			Message:      sarifMessage{Text: nonEmpty(c.Description, c.RuleId) + " [" + c.Status + "]"},
+			Locations:    sarifLocations(clusterId, c),
+			Properties:   props,
+			Suppressions: sarifSuppressions(c.Status, ""),
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	log := sarifLog{Schema: sarifSchema, Version: sarifVersion, Runs: []sarifRun{}}
+	plugins := make([]string, 0, len(runs))
+	for p := range runs {
+		plugins = append(plugins, p)
+	}
+	sort.Strings(plugins)
+	for _, p := range plugins {
+		log.Runs = append(log.Runs, *runs[p])
+	}
+	return json.MarshalIndent(log, "", "  ")
+}
+
+func nonEmpty(s string, fallback string) string {
+	if strings.TrimSpace(s) == "" {
+		return fallback
+	}
+	return s
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "collie_agent"
+
+var (
+	phaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "phase_duration_seconds",
+		Help:      "Duration of the phases of the scan cycles.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800},
+	}, []string{"phase"})
+	scannerRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scanner_runs_total",
+		Help:      "Runs of the scanners by outcome, ok or failed.",
+	}, []string{"scanner", "outcome"})
+	resources = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "resources_discovered",
+		Help:      "Resources discovered by kind in the last resources phase.",
+	}, []string{"kind"})
+	documentsIndexed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "documents_indexed_total",
+		Help:      "Documents indexed in ES.",
+	})
+	documentsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "documents_failed_total",
+		Help:      "Documents which failed to be indexed in ES.",
+	})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the requests to ES and to the API server.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"target", "method", "code"})
+	requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "request_errors_total",
+		Help:      "Requests to ES and to the API server which failed or got an error status.",
+	}, []string{"target"})
+	findings = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "findings",
+		Help:      "Findings, the compliance results which did not pass, by scanner and severity in the last cycle which ran the scanner.",
+	}, []string{"plugin", "severity"})
+	lastSuccessfulCycle = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_cycle_timestamp_seconds",
+		Help:      "Time of the end of the last cycle completed without error.",
+	})
+	leader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "Whether the replica is the leader running the scan loop, 1, or a follower, 0.",
+	})
+)
+
+var mu sync.Mutex
+
+// counts of the cycle in progress, published when it completes
+var cycleResources = map[string]int{}
+var cycleFindings = map[string]map[string]int{}
+
+// Handler serves the metrics in the Prometheus format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// PhaseCompleted records the duration of a phase, and the outcome of its scanner, if any.
+func PhaseCompleted(phase string, scanner string, d time.Duration, err error) {
+	phaseDuration.WithLabelValues(phase).Observe(d.Seconds())
+	if scanner == "" {
+		return
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = "failed"
+	}
+	scannerRuns.WithLabelValues(scanner, outcome).Inc()
+}
+
+// CycleStarted resets the counts of the cycle.
+func CycleStarted() {
+	mu.Lock()
+	defer mu.Unlock()
+	cycleResources = map[string]int{}
+	cycleFindings = map[string]map[string]int{}
+}
+
+// CycleCompleted publishes the counts of the cycle. The counts of the phases which did not run
+// in the cycle are left as is.
+func CycleCompleted(success bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(cycleResources) > 0 {
+		resources.Reset()
+		for kind, n := range cycleResources {
+			resources.WithLabelValues(kind).Set(float64(n))
+		}
+	}
+	for plugin, bySeverity := range cycleFindings {
+		findings.DeletePartialMatch(prometheus.Labels{"plugin": plugin})
+		for severity, n := range bySeverity {
+			findings.WithLabelValues(plugin, severity).Set(float64(n))
+		}
+	}
+	if success {
+		lastSuccessfulCycle.SetToCurrentTime()
+	}
+}
+
+// ResourceDiscovered counts a resource of the cycle.
+func ResourceDiscovered(kind string) {
+	mu.Lock()
+	defer mu.Unlock()
+	cycleResources[kind]++
+}
+
+// ComplianceReported counts a compliance result of the cycle, which is a finding unless it passed.
+func ComplianceReported(plugin string, severity string, status string) {
+	mu.Lock()
+	defer mu.Unlock()
+	bySeverity, ok := cycleFindings[plugin]
+	if !ok {
+		bySeverity = map[string]int{}
+		cycleFindings[plugin] = bySeverity
+	}
+	if status == "PASS" {
+		return
+	}
+	if severity == "" {
+		severity = "UNKNOWN"
+	}
+	bySeverity[severity]++
+}
+
+// DocumentsIndexed counts the documents indexed, and those which failed to be.
+func DocumentsIndexed(indexed uint64, failed uint64) {
+	documentsIndexed.Add(float64(indexed))
+	documentsFailed.Add(float64(failed))
+}
+
+// Leader records whether the replica leads. A follower drops the counts of its last cycles as a leader,
+// so that the cluster is counted once across the replicas.
+func Leader(on bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if on {
+		leader.Set(1)
+		return
+	}
+	leader.Set(0)
+	resources.Reset()
+	findings.Reset()
+}
+
+// InstrumentTransport records the latency and the errors of the requests to target.
+func InstrumentTransport(target string, next http.RoundTripper) http.RoundTripper {
+	return roundTripper{target: target, next: next}
+}
+
+type roundTripper struct {
+	target string
+	next   http.RoundTripper
+}
+
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := rt.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	requestDuration.WithLabelValues(rt.target, req.Method, code).Observe(time.Since(start).Seconds())
+	if err != nil || res.StatusCode >= 400 {
+		requestErrors.WithLabelValues(rt.target).Inc()
+	}
+	return res, err
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// DefaultScanInterval is the time between the start of two cycles, when not configured remotely.
+const DefaultScanInterval = 12 * time.Hour
+
+// AgentConfig is the remote configuration of the agent, polled from the API server.
+// The zero value is the behavior of an agent without remote configuration.
+type AgentConfig struct {
+	Version      string          `json:"version"`
+	ScanInterval string          `json:"scanInterval"`
+	Scanners     []string        `json:"scanners"`
+	Namespaces   NamespaceFilter `json:"namespaces"`
+	Redaction    Redaction       `json:"redaction"`
+	LogLevel     string          `json:"logLevel"`
+	RulePacks    []*RulePack     `json:"rulePacks"`
+	CustomRules  []*CustomRule   `json:"customRules"`
+	// RulesRevision increases on every change of the rule packs or custom rules
+	RulesRevision int64 `json:"rulesRevision"`
+}
+
+// NamespaceFilter selects the namespaces scanned. A pattern is a namespace name, or a prefix
+// of names ending with "*". An empty include list selects all namespaces.
+type NamespaceFilter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// Redaction tells what is stripped from the resources before reporting them.
+type Redaction struct {
+	EnvValues   bool     `json:"envValues"`
+	Annotations []string `json:"annotations"`
+}
+
+// Interval returns the scan interval, the default when not set or invalid.
+func (c *AgentConfig) Interval() time.Duration {
+	if d, err := time.ParseDuration(c.ScanInterval); err == nil && d > 0 {
+		return d
+	}
+	return DefaultScanInterval
+}
+
+// ScannerEnabled tells whether a phase of the cycle runs. All run when no scanner is listed.
+func (c *AgentConfig) ScannerEnabled(name string) bool {
+	if c.Scanners == nil {
+		return true
+	}
+	for _, s := range c.Scanners {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NamespaceIncluded tells whether the resources of a namespace are scanned.
+func (c *AgentConfig) NamespaceIncluded(namespace string) bool {
+	if MatchesAny(c.Namespaces.Exclude, namespace) {
+		return false
+	}
+	return len(c.Namespaces.Include) == 0 || MatchesAny(c.Namespaces.Include, namespace)
+}
+
+// MatchesAny tells whether the value matches any of the patterns, which end with "*" to match a prefix.
+func MatchesAny(patterns []string, value string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(value, prefix) {
+				return true
+			}
+		} else if p == value {
+			return true
+		}
+	}
+	return false
+}
@@ -15,6 +15,8 @@ limitations under the License.
 
 package model
 
+import "time"
+
 type ComplianceRecord struct {
 	Timestamp string            `json:"@timestamp"`
 	OrgId     string            `json:"orgId"`
@@ -25,8 +27,19 @@ type ComplianceRecord struct {
 	Data      map[string]string `json:"data"`
 }
 
+// ClusterInfo describes the cluster, as detected from its nodes and its server version.
 type ClusterInfo struct {
+	// Provider is EKS, GKE, AKS or Other
 	Provider string `json:"provider"`
+	// Distribution is k3s, openshift or tkg, empty for an upstream or managed Kubernetes
+	Distribution string `json:"distribution,omitempty"`
+	Region       string `json:"region,omitempty"`
+	ClusterName  string `json:"clusterName,omitempty"`
+	// Account is the AWS account, the GCP project or the Azure subscription of the cluster
+	Account   string   `json:"account,omitempty"`
+	NodePools []string `json:"nodePools,omitempty"`
+	// Benchmark is the kube-bench benchmark of the provider, empty when kube-bench picks it by version
+	Benchmark string `json:"benchmark,omitempty"`
 
 	Data interface{} `json:"data"`
 }
@@ -38,5 +51,90 @@ type Compliance struct {
 	Subcategory string `json:"subcategory"`
 	Description string `json:"description"`
 	Status      string `json:"status"` //FAIL, PASS, WARN
+	Severity    string `json:"severity,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Resource    string `json:"resource,omitempty"`
 	Remediation string `json:"remediation"`
 }
+
+type AgentHeartbeat struct {
+	AgentId      string `json:"agentId"`
+	ClusterId    string `json:"clusterId"`
+	Provider     string `json:"provider"`
+	AgentVersion string `json:"agentVersion"`
+	K8sVersion   string `json:"k8sVersion"`
+	// Distribution and Region are detected along with the provider
+	Distribution string `json:"distribution,omitempty"`
+	Region       string `json:"region,omitempty"`
+	// ConfigVersion is the version of the remote configuration the agent runs
+	ConfigVersion string `json:"configVersion"`
+	Error         string `json:"error"`
+	// PreviousClusterIds are the ids the cluster was known by before, which the API server merges into ClusterId
+	PreviousClusterIds []string `json:"previousClusterIds,omitempty"`
+}
+
+// Scan describes one agent cycle, from sync-start to sync-complete.
+type Scan struct {
+	Id        string            `json:"id"`
+	AgentId   string            `json:"agentId"`
+	ClusterId string            `json:"clusterId"`
+	StartedAt time.Time         `json:"startedAt"`
+	EndedAt   *time.Time        `json:"endedAt,omitempty"`
+	Phases    []*ScanPhase      `json:"phases"`
+	Documents int64             `json:"documents"`
+	Errors    []string          `json:"errors"`
+	Plugins   map[string]string `json:"plugins"`
+	// RequestId is the scan request the cycle runs for, empty for a scheduled cycle
+	RequestId string `json:"requestId,omitempty"`
+}
+
+// ScanRequest asks the agent to run a cycle now, optionally limited to some phases.
+type ScanRequest struct {
+	Id      string   `json:"id"`
+	AgentId string   `json:"agentId"`
+	Phases  []string `json:"phases"`
+	Status  string   `json:"status"`
+}
+
+// Includes tells whether the request asks for a phase, all phases when none is listed.
+func (r *ScanRequest) Includes(phase string) bool {
+	if len(r.Phases) == 0 {
+		return true
+	}
+	for _, p := range r.Phases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+type ScanPhase struct {
+	Name       string    `json:"name"`
+	StartedAt  time.Time `json:"startedAt"`
+	EndedAt    time.Time `json:"endedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Documents  int64     `json:"documents"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// RulePack is a set of Rego policies of an org, fetched from the API server and
+// evaluated by the agent next to the bundled policies.
+type RulePack struct {
+	Id      string            `json:"id"`
+	Name    string            `json:"name"`
+	Version int               `json:"version"`
+	Modules map[string]string `json:"modules"`
+}
+
+// CustomRule is a CEL expression of an org, which must hold for the resources of the given kinds.
+type CustomRule struct {
+	Id          string   `json:"id"`
+	RuleId      string   `json:"ruleId"`
+	Title       string   `json:"title"`
+	Kinds       []string `json:"kinds"`
+	Expression  string   `json:"expression"`
+	Severity    string   `json:"severity"`
+	Category    string   `json:"category"`
+	Remediation string   `json:"remediation"`
+}
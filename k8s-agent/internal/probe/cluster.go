@@ -0,0 +1,139 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	K8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"collie-agent/internal/config"
+)
+
+// identityConfigMap is the ConfigMap, in the namespace of the agent, which keeps the identity of the cluster
+const identityConfigMap = "collie-agent-cluster"
+
+const (
+	keyClusterId  = "clusterId"
+	keyPreviousId = "previousClusterIds"
+)
+
+// GetClusterId returns the identity of the cluster, and the ids it was known by before, to be merged
+// into it by the API server. The identity is the static cluster id of the configuration, else the UID
+// of the kube-system namespace, which lives as long as the cluster. Once known, it is kept in a ConfigMap,
+// so that it stays the same across restarts of the agent. The first time, the id reported by the agents
+// before the ConfigMap existed, the SystemUUID of the first node, becomes a previous id.
+func GetClusterId(ctx context.Context, log *logrus.Entry, clientset kubernetes.Interface, cfg config.Config) (string, []string, error) {
+	configMaps := clientset.CoreV1().ConfigMaps(cfg.Namespace)
+	cm, err := configMaps.Get(ctx, identityConfigMap, metav1.GetOptions{})
+	// without access to the ConfigMap the identity is not kept, it stays the same as long as the
+	// configuration and the cluster do
+	keep := true
+	if K8sErrors.IsNotFound(err) {
+		cm = nil
+	} else if err != nil {
+		log.Warnf("Error reading the cluster identity from ConfigMap %s/%s: %s", cfg.Namespace, identityConfigMap, err)
+		cm, keep = nil, false
+	}
+
+	persisted := ""
+	previous := []string{}
+	if cm != nil {
+		persisted = cm.Data[keyClusterId]
+		previous = splitIds(cm.Data[keyPreviousId])
+	}
+
+	clusterId := persisted
+	if cfg.Static != nil && cfg.Static.ClusterID != "" {
+		clusterId = cfg.Static.ClusterID
+	}
+	if clusterId == "" {
+		ns, err := clientset.CoreV1().Namespaces().Get(ctx, metav1.NamespaceSystem, metav1.GetOptions{})
+		if err != nil {
+			return "", nil, err
+		}
+		clusterId = string(ns.UID)
+	}
+
+	if persisted != "" && persisted != clusterId {
+		previous = appendId(previous, persisted, clusterId)
+	}
+	if cm == nil && keep {
+		nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{Limit: 1})
+		if err != nil {
+			log.Warnf("Error retrieving the former cluster id: %s", err)
+		} else if len(nodes.Items) > 0 {
+			previous = appendId(previous, nodes.Items[0].Status.NodeInfo.SystemUUID, clusterId)
+		}
+	}
+
+	log.Infof("clusterId: %s, previous ids: %v", clusterId, previous)
+	if keep && (cm == nil || persisted != clusterId || cm.Data[keyPreviousId] != strings.Join(previous, ",")) {
+		if err := saveClusterId(ctx, clientset, cfg.Namespace, cm, clusterId, previous); err != nil {
+			log.Warnf("Error keeping the cluster identity in ConfigMap %s/%s: %s", cfg.Namespace, identityConfigMap, err)
+		}
+	}
+	return clusterId, previous, nil
+}
+
+func saveClusterId(ctx context.Context, clientset kubernetes.Interface, namespace string, cm *corev1.ConfigMap, clusterId string, previous []string) error {
+	data := map[string]string{keyClusterId: clusterId}
+	if len(previous) > 0 {
+		data[keyPreviousId] = strings.Join(previous, ",")
+	}
+	configMaps := clientset.CoreV1().ConfigMaps(namespace)
+	if cm == nil {
+		_, err := configMaps.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   identityConfigMap,
+				Labels: map[string]string{"app.kubernetes.io/managed-by": "collie"},
+			},
+			Data: data,
+		}, metav1.CreateOptions{})
+		return err
+	}
+	cm.Data = data
+	_, err := configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+func splitIds(s string) []string {
+	ret := []string{}
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// appendId adds id to the previous ids, unless it is the current id or already there.
+func appendId(previous []string, id string, clusterId string) []string {
+	if id == "" || id == clusterId {
+		return previous
+	}
+	for _, p := range previous {
+		if p == id {
+			return previous
+		}
+	}
+	return append(previous, id)
+}
@@ -23,7 +23,6 @@ import (
 	"io"
 	"regexp"
 	"strings"
-	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -36,9 +35,7 @@ func (p *Probe) DiscoverCompliance() error {
 	log := p.log
 
 	log.Info("DiscoverCompliance start")
-	startTime := time.Now()
 	defer func() {
-		p.cc.DeleteOldDoc(startTime, "compliance")
 		log.Info("DiscoverCompliance exit")
 	}()
 
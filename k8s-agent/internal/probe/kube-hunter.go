@@ -47,9 +47,7 @@ func (p *Probe) DiscoverComplianceForHunter() error {
 	log := p.log
 
 	log.Info("DiscoverCompliance start for kube-hunter")
-	startTime := time.Now()
 	defer func() {
-		p.cc.DeleteOldDoc(startTime, "compliance")
 		log.Info("DiscoverCompliance exit for kube-hunter")
 	}()
 	namespace := "collie-agent"
@@ -99,6 +97,8 @@ func getPluginResult(logContent string) ([]*model.Compliance, error) {
 			Subcategory: categories[1],
 			Description: vulnerabilities[i].Description,
 			Status:      "WARN",
+			Severity:    vulnerabilities[i].Severity,
+			Resource:    vulnerabilities[i].Location,
 			Remediation: "",
 		}
 	}
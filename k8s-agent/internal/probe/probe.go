@@ -18,17 +18,23 @@ package probe
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/client-go/kubernetes"
 
 	K8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"collie-agent/internal/config"
+	"collie-agent/internal/metrics"
 	"collie-agent/internal/model"
 	"collie-agent/internal/reporter"
+	"collie-agent/internal/rules"
+	"collie-agent/internal/tracing"
 )
 
 type Probe struct {
@@ -36,27 +42,42 @@ type Probe struct {
 	log       *logrus.Entry
 	clientset *kubernetes.Clientset
 	cc        *reporter.CollieClient
+	// configuration of the agent, whose provider settings override the detected ones
+	agentConfig config.Config
+	// remote configuration of the current cycle
+	config *model.AgentConfig
+	// reportResources is off when the resources are only discovered to evaluate the rules
+	reportResources bool
+	// policies evaluated against each discovered resource, loaded when the discovery starts
+	rules *rules.Engine
+	// version of the configuration the rules were loaded from
+	rulesVersion string
+	// violations found by the policies, reported by the rules phase
+	violations []*model.ComplianceRecord
 }
 
 func New(ctx context.Context, log *logrus.Entry, clientset *kubernetes.Clientset, cc *reporter.CollieClient) *Probe {
-	return &Probe{ctx, log, clientset, cc}
+	return &Probe{ctx: ctx, log: log, clientset: clientset, cc: cc, config: &model.AgentConfig{}, reportResources: true}
 }
 
-func GetClusterId(ctx context.Context, log *logrus.Entry, clientset *kubernetes.Clientset) (string, error) {
+// SetConfig sets the remote configuration applied from the next phase on.
+func (p *Probe) SetConfig(cfg *model.AgentConfig) {
+	p.config = cfg
+}
 
-	// retrieve the cluster information
-	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return "", err
-	}
-	if len(nodes.Items) == 0 {
-		return "", fmt.Errorf("no nodes found in the cluster")
-	}
+// SetAgentConfig sets the configuration of the agent, which the cluster discovery reads the provider settings from.
+func (p *Probe) SetAgentConfig(cfg config.Config) {
+	p.agentConfig = cfg
+}
 
-	// extract the cluster ID from the node information
-	clusterID := nodes.Items[0].Status.NodeInfo.SystemUUID
-	log.Infoln("clusterId: ", clusterID)
-	return clusterID, nil
+// SetReportResources tells whether the discovered resources are reported, or only evaluated by the rules.
+func (p *Probe) SetReportResources(on bool) {
+	p.reportResources = on
+}
+
+// SetContext sets the context of the discoveries, which carries the span of the phase running.
+func (p *Probe) SetContext(ctx context.Context) {
+	p.ctx = ctx
 }
 
 func (p *Probe) DiscoverCluster() error {
@@ -65,29 +86,22 @@ func (p *Probe) DiscoverCluster() error {
 
 	log.Info("DiscoverCluster start")
 
-	startTime := time.Now()
 	defer func() {
-		p.cc.DeleteOldDoc(startTime, "cluster")
 		log.Info("DiscoverCluster exit")
 	}()
 
-	serverVersion, err := p.clientset.Discovery().ServerVersion()
+	info, err := DetectProvider(p.ctx, p.clientset, p.agentConfig)
 	if err != nil {
 		return err
 	}
 
-	serverVersionJson, err := json.Marshal(serverVersion)
+	infoJson, err := json.Marshal(info)
 	if err != nil {
 		return err
 	}
-	log.Printf("Cluster info: %s", string(serverVersionJson))
-
-	info := model.ClusterInfo{
-		Provider: "",
-		Data:     serverVersion,
-	}
+	log.Printf("Cluster info: %s", string(infoJson))
 
-	p.cc.ReportClusterInfo(info)
+	p.cc.ReportClusterInfo(*info)
 	return nil
 }
 
@@ -96,20 +110,19 @@ func (p *Probe) DiscoverResources() error {
 	log := p.log
 
 	log.Info("DiscoverResources start")
-	startTime := time.Now()
 	defer func() {
-		p.cc.DeleteOldDoc(startTime, "resource")
 		log.Info("DiscoverResources exit")
 	}()
 
+	p.loadRules()
+	defer p.traceRuleUsage(time.Now())
+
 	coreV1 := p.clientset.CoreV1()
 
 	namespaceList, err := coreV1.Namespaces().List(p.ctx, metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
-	//ignoredNamespaces := map[string]int{"kube-node-lease":1, "kube-public":1, "kube-system":1}
-	ignoredNamespaces := map[string]int{}
 
 	p.discoverNodes()
 	p.discoverPersistentVolumes()
@@ -120,7 +133,7 @@ func (p *Probe) DiscoverResources() error {
 	for _, ns := range namespaceList.Items {
 		namespace := ns.Name
 		log.Infoln("namespace", namespace)
-		if _, ok := ignoredNamespaces[namespace]; ok {
+		if !p.config.NamespaceIncluded(namespace) {
 			log.Info("Ignore namespace ", namespace)
 			continue
 		}
@@ -151,7 +164,27 @@ func (p *Probe) reportResource(name string, data interface{}, err error) {
 	} else if err != nil {
 		p.cc.ReportError("get-res", name, err)
 	} else {
-		p.cc.ReportResource(name, data)
+		if p.reportResources {
+			p.cc.ReportResource(name, redact(data, p.config.Redaction))
+		}
+		kind, _, _ := strings.Cut(name, "#")
+		metrics.ResourceDiscovered(kind)
+		p.evaluateRules(name, data)
+	}
+}
+
+// startSpan starts the span of the discovery of a kind, under the span of the phase. The resources are
+// reported to ES under it, until the returned function ends it.
+func (p *Probe) startSpan(kind string, namespace string) (context.Context, func()) {
+	attrs := []attribute.KeyValue{attribute.String("k8s.kind", kind)}
+	if namespace != "" {
+		attrs = append(attrs, attribute.String("k8s.namespace.name", namespace))
+	}
+	ctx, span := tracing.Tracer().Start(p.ctx, "discover "+kind, trace.WithAttributes(attrs...))
+	prev := p.cc.SetContext(ctx)
+	return ctx, func() {
+		p.cc.SetContext(prev)
+		span.End()
 	}
 }
 
@@ -162,10 +195,12 @@ func (p *Probe) discoverNodes() {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, "")
+	defer end()
 
 	coreV1 := p.clientset.CoreV1()
 	api := coreV1.Nodes()
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind, err)
 		return
@@ -174,7 +209,7 @@ func (p *Probe) discoverNodes() {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -186,10 +221,12 @@ func (p *Probe) discoverPersistentVolumes() {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, "")
+	defer end()
 
 	coreV1 := p.clientset.CoreV1()
 	api := coreV1.PersistentVolumes()
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind, err)
 		return
@@ -198,7 +235,7 @@ func (p *Probe) discoverPersistentVolumes() {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -210,10 +247,12 @@ func (p *Probe) discoverPods(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	coreV1 := p.clientset.CoreV1()
 	api := coreV1.Pods(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -222,7 +261,7 @@ func (p *Probe) discoverPods(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -234,10 +273,12 @@ func (p *Probe) discoverReplicationControllers(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	coreV1 := p.clientset.CoreV1()
 	api := coreV1.ReplicationControllers(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -246,7 +287,7 @@ func (p *Probe) discoverReplicationControllers(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -258,10 +299,12 @@ func (p *Probe) discoverPersistentVolumeClaims(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	coreV1 := p.clientset.CoreV1()
 	api := coreV1.PersistentVolumeClaims(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -270,7 +313,7 @@ func (p *Probe) discoverPersistentVolumeClaims(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -282,10 +325,12 @@ func (p *Probe) discoverServices(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	coreV1 := p.clientset.CoreV1()
 	api := coreV1.Services(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -294,7 +339,7 @@ func (p *Probe) discoverServices(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -306,10 +351,12 @@ func (p *Probe) discoverEvents(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	coreV1 := p.clientset.CoreV1()
 	api := coreV1.Events(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -318,7 +365,7 @@ func (p *Probe) discoverEvents(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -330,10 +377,12 @@ func (p *Probe) discoverDeployments(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	appsV1 := p.clientset.AppsV1()
 	api := appsV1.Deployments(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -342,7 +391,7 @@ func (p *Probe) discoverDeployments(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -354,10 +403,12 @@ func (p *Probe) discoverReplicaSets(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	appsV1 := p.clientset.AppsV1()
 	api := appsV1.ReplicaSets(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -366,7 +417,7 @@ func (p *Probe) discoverReplicaSets(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -378,10 +429,12 @@ func (p *Probe) discoverDaemonSets(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	appsV1 := p.clientset.AppsV1()
 	api := appsV1.DaemonSets(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -390,7 +443,7 @@ func (p *Probe) discoverDaemonSets(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -402,10 +455,12 @@ func (p *Probe) discoverStatefulSets(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	appsV1 := p.clientset.AppsV1()
 	api := appsV1.StatefulSets(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -414,7 +469,7 @@ func (p *Probe) discoverStatefulSets(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -426,10 +481,12 @@ func (p *Probe) discoverStorageClasses() {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, "")
+	defer end()
 
 	storageV1 := p.clientset.StorageV1()
 	api := storageV1.StorageClasses()
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind, err)
 		return
@@ -438,7 +495,7 @@ func (p *Probe) discoverStorageClasses() {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -450,10 +507,12 @@ func (p *Probe) discoverCSINodes() {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, "")
+	defer end()
 
 	storageV1 := p.clientset.StorageV1()
 	api := storageV1.CSINodes()
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind, err)
 		return
@@ -462,7 +521,7 @@ func (p *Probe) discoverCSINodes() {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -474,10 +533,12 @@ func (p *Probe) discoverCSIDrivers() {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, "")
+	defer end()
 
 	storageV1 := p.clientset.StorageV1()
 	api := storageV1.CSIDrivers()
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind, err)
 		return
@@ -486,7 +547,7 @@ func (p *Probe) discoverCSIDrivers() {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -498,10 +559,12 @@ func (p *Probe) discoverCSIStorageCapacities(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	storageV1 := p.clientset.StorageV1()
 	api := storageV1.CSIStorageCapacities(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -510,7 +573,7 @@ func (p *Probe) discoverCSIStorageCapacities(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -522,10 +585,12 @@ func (p *Probe) discoverJobs(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	batchV1 := p.clientset.BatchV1()
 	api := batchV1.Jobs(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -534,7 +599,7 @@ func (p *Probe) discoverJobs(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -546,10 +611,12 @@ func (p *Probe) discoverCronJobs(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	batchV1 := p.clientset.BatchV1()
 	api := batchV1.CronJobs(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -558,7 +625,7 @@ func (p *Probe) discoverCronJobs(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -570,10 +637,12 @@ func (p *Probe) discoverHorizontalPodAutoscalers(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	autoscalingV2 := p.clientset.AutoscalingV2()
 	api := autoscalingV2.HorizontalPodAutoscalers(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
@@ -582,7 +651,7 @@ func (p *Probe) discoverHorizontalPodAutoscalers(namespace string) {
 	for idx, item := range itemList.Items {
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
@@ -594,19 +663,26 @@ func (p *Probe) discoverLeases(namespace string) {
 	defer func() {
 		log.Info("discoverRes exit: ", kind)
 	}()
+	ctx, end := p.startSpan(kind, namespace)
+	defer end()
 
 	coordinationV1 := p.clientset.CoordinationV1()
 	api := coordinationV1.Leases(namespace)
-	itemList, err := api.List(p.ctx, metav1.ListOptions{})
+	itemList, err := api.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		p.cc.ReportError("list-res", kind+"#"+namespace, err)
 		return
 	}
+	// the Lease of the agent is renewed every few seconds, it would show as changed in every snapshot
+	le := p.agentConfig.LeaderElection
 	total := len(itemList.Items)
 	for idx, item := range itemList.Items {
+		if le.Enabled && namespace == le.Namespace && item.Name == le.LeaseName {
+			continue
+		}
 		resourceName := kind + "#" + namespace + "/" + item.Name
 		p.log.Printf("Resource %d/%d: %s", idx+1, total, resourceName)
-		itemInfo, err := api.Get(p.ctx, item.Name, metav1.GetOptions{})
+		itemInfo, err := api.Get(ctx, item.Name, metav1.GetOptions{})
 		p.reportResource(resourceName, itemInfo, err)
 	}
 }
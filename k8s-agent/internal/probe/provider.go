@@ -0,0 +1,254 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/kubernetes"
+
+	"collie-agent/internal/config"
+	"collie-agent/internal/model"
+)
+
+// Providers, as named by the provider parameter of agent.yaml
+const (
+	ProviderEKS   = "EKS"
+	ProviderGKE   = "GKE"
+	ProviderAKS   = "AKS"
+	ProviderOther = "Other"
+)
+
+// Distributions of Kubernetes
+const (
+	DistributionK3s       = "k3s"
+	DistributionOpenShift = "openshift"
+	DistributionTKG       = "tkg"
+)
+
+// benchmarks are the kube-bench benchmarks of the managed providers, whose control plane is not scanned
+var benchmarks = map[string]string{
+	ProviderEKS: "eks-1.2.0",
+	ProviderGKE: "gke-1.2.0",
+	ProviderAKS: "aks-1.0",
+}
+
+// providerLabels are node labels only the managed providers set
+var providerLabels = map[string]string{
+	"eks.amazonaws.com/nodegroup":    ProviderEKS,
+	"eks.amazonaws.com/compute-type": ProviderEKS,
+	"cloud.google.com/gke-nodepool":  ProviderGKE,
+	"kubernetes.azure.com/cluster":   ProviderAKS,
+	"kubernetes.azure.com/agentpool": ProviderAKS,
+}
+
+// nodePoolLabels name the node pool, or node group, of a node
+var nodePoolLabels = []string{
+	"eks.amazonaws.com/nodegroup",
+	"alpha.eksctl.io/nodegroup-name",
+	"cloud.google.com/gke-nodepool",
+	"kubernetes.azure.com/agentpool",
+	"agentpool",
+}
+
+var regionLabels = []string{
+	"topology.kubernetes.io/region",
+	"failure-domain.beta.kubernetes.io/region",
+}
+
+// Benchmark returns the kube-bench benchmark of the provider, empty when kube-bench picks it
+// by the version of the cluster.
+func Benchmark(provider string) string {
+	return benchmarks[provider]
+}
+
+// DetectProvider tells the provider and the distribution of the cluster from the labels and the
+// providerID of its nodes, and from the version of its API server, along with its region, its node
+// pools and, when the nodes tell, its name. The EKS, GKE and AKS settings of the configuration
+// override what is detected.
+func DetectProvider(ctx context.Context, clientset kubernetes.Interface, cfg config.Config) (*model.ClusterInfo, error) {
+	sv, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	info := detectProvider(sv, nodes.Items, cfg)
+	return &info, nil
+}
+
+func detectProvider(sv *version.Info, nodes []corev1.Node, cfg config.Config) model.ClusterInfo {
+	info := model.ClusterInfo{Provider: ProviderOther, Data: sv}
+
+	// managed providers and distributions tag the version of the API server, such as
+	// v1.27.4-eks-2d98532, v1.27.3-gke.100, v1.27.4+k3s1 or v1.26.5+vmware.2
+	gitVersion := sv.GitVersion
+	switch {
+	case strings.Contains(gitVersion, "-eks-"):
+		info.Provider = ProviderEKS
+	case strings.Contains(gitVersion, "-gke."):
+		info.Provider = ProviderGKE
+	}
+	switch {
+	case strings.Contains(gitVersion, "+k3s"):
+		info.Distribution = DistributionK3s
+	case strings.Contains(gitVersion, "+vmware"):
+		info.Distribution = DistributionTKG
+	}
+
+	cloud := ""
+	pools := map[string]bool{}
+	for _, node := range nodes {
+		labels := node.Labels
+		for label, provider := range providerLabels {
+			if _, ok := labels[label]; ok && info.Provider == ProviderOther {
+				info.Provider = provider
+			}
+		}
+		if info.Distribution == "" {
+			info.Distribution = nodeDistribution(node)
+		}
+		for _, label := range nodePoolLabels {
+			if pool := labels[label]; pool != "" {
+				pools[pool] = true
+				break
+			}
+		}
+		for _, label := range regionLabels {
+			if info.Region == "" && labels[label] != "" {
+				info.Region = labels[label]
+			}
+		}
+		if info.ClusterName == "" {
+			info.ClusterName = nodeClusterName(node)
+		}
+		if cloud == "" {
+			cloud, info.Account = parseProviderId(node.Spec.ProviderID)
+		}
+	}
+
+	// the cloud of the nodes tells the provider when nothing else does, unless the cluster is
+	// a distribution running on the cloud
+	if info.Provider == ProviderOther && info.Distribution == "" {
+		info.Provider = cloud
+	}
+	for pool := range pools {
+		info.NodePools = append(info.NodePools, pool)
+	}
+	sort.Strings(info.NodePools)
+
+	applyProviderConfig(&info, cfg)
+	if info.Provider == "" {
+		info.Provider = ProviderOther
+	}
+	info.Benchmark = Benchmark(info.Provider)
+	return info
+}
+
+// nodeDistribution tells the distribution a node belongs to from its labels and its providerID.
+func nodeDistribution(node corev1.Node) string {
+	if strings.HasPrefix(node.Spec.ProviderID, "k3s://") || node.Labels["node.kubernetes.io/instance-type"] == "k3s" {
+		return DistributionK3s
+	}
+	for label := range node.Labels {
+		if strings.HasPrefix(label, "node.openshift.io/") {
+			return DistributionOpenShift
+		}
+		if strings.HasPrefix(label, "run.tanzu.vmware.com/") {
+			return DistributionTKG
+		}
+	}
+	return ""
+}
+
+// nodeClusterName returns the name of the cluster when a node tells it: eksctl labels the nodes with it,
+// AKS puts it in the name of the node resource group, MC_<resource group>_<cluster>_<location>, and GKE
+// in the names of the nodes, gke-<cluster>-<node pool>-<suffix>.
+func nodeClusterName(node corev1.Node) string {
+	if name := node.Labels["alpha.eksctl.io/cluster-name"]; name != "" {
+		return name
+	}
+	if group := node.Labels["kubernetes.azure.com/cluster"]; strings.HasPrefix(group, "MC_") {
+		if parts := strings.Split(group, "_"); len(parts) >= 4 {
+			return parts[len(parts)-2]
+		}
+	}
+	if pool := node.Labels["cloud.google.com/gke-nodepool"]; pool != "" && strings.HasPrefix(node.Name, "gke-") {
+		// GKE truncates long names, the name is only known when the node pool is found whole
+		if i := strings.LastIndex(node.Name, "-"+pool+"-"); i > len("gke-") {
+			return node.Name[len("gke-"):i]
+		}
+	}
+	return ""
+}
+
+// parseProviderId returns the provider of the cloud of a node, and its account when the providerID
+// tells it: gce://<project>/<zone>/<instance> and azure:///subscriptions/<subscription>/resourceGroups/...
+// do, aws:///<zone>/<instance> does not.
+func parseProviderId(providerId string) (string, string) {
+	scheme, path, ok := strings.Cut(providerId, "://")
+	if !ok {
+		return "", ""
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	switch scheme {
+	case "aws":
+		return ProviderEKS, ""
+	case "gce":
+		return ProviderGKE, parts[0]
+	case "azure":
+		if len(parts) >= 2 && strings.EqualFold(parts[0], "subscriptions") {
+			return ProviderAKS, parts[1]
+		}
+		return ProviderAKS, ""
+	}
+	return "", ""
+}
+
+// applyProviderConfig overrides the detected metadata with the provider settings of the configuration,
+// which also tell the provider when it is not detected.
+func applyProviderConfig(info *model.ClusterInfo, cfg config.Config) {
+	override := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	if cfg.EKS != nil && (info.Provider == ProviderEKS || info.Provider == ProviderOther || info.Provider == "") {
+		info.Provider = ProviderEKS
+		override(&info.Account, cfg.EKS.AccountID)
+		override(&info.Region, cfg.EKS.Region)
+		override(&info.ClusterName, cfg.EKS.ClusterName)
+	}
+	if cfg.GKE != nil && (info.Provider == ProviderGKE || info.Provider == ProviderOther || info.Provider == "") {
+		info.Provider = ProviderGKE
+		override(&info.Account, cfg.GKE.ProjectID)
+		override(&info.Region, cfg.GKE.Location)
+		override(&info.Region, cfg.GKE.Region)
+		override(&info.ClusterName, cfg.GKE.ClusterName)
+	}
+	if cfg.AKS != nil && (info.Provider == ProviderAKS || info.Provider == ProviderOther || info.Provider == "") {
+		info.Provider = ProviderAKS
+		override(&info.Account, cfg.AKS.SubscriptionID)
+		override(&info.Region, cfg.AKS.Location)
+	}
+}
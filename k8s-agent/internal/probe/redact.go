@@ -0,0 +1,82 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"encoding/json"
+
+	"collie-agent/internal/model"
+)
+
+const redacted = "REDACTED"
+
+// redact returns the resource stripped of what the redaction policy covers: the values of the
+// environment variables of containers, and the values of the listed annotations, wherever they
+// appear in the resource, such as in the pod template of a workload.
+func redact(data interface{}, policy model.Redaction) interface{} {
+	if !policy.EnvValues && len(policy.Annotations) == 0 {
+		return data
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return data
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return data
+	}
+	redactValue(doc, policy)
+	return doc
+}
+
+func redactValue(v interface{}, policy model.Redaction) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			switch {
+			case k == "env" && policy.EnvValues:
+				redactEnv(child)
+			case k == "annotations":
+				if annotations, ok := child.(map[string]interface{}); ok {
+					for name := range annotations {
+						if model.MatchesAny(policy.Annotations, name) {
+							annotations[name] = redacted
+						}
+					}
+				}
+			default:
+				redactValue(child, policy)
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			redactValue(child, policy)
+		}
+	}
+}
+
+// redactEnv redacts the literal values of a list of environment variables.
+// References to config maps and secrets are kept, they carry no value.
+func redactEnv(v interface{}) {
+	vars, _ := v.([]interface{})
+	for _, item := range vars {
+		if env, ok := item.(map[string]interface{}); ok {
+			if _, ok := env["value"]; ok {
+				env["value"] = redacted
+			}
+		}
+	}
+}
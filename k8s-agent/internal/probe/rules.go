@@ -0,0 +1,110 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package probe
+
+import (
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"collie-agent/internal/model"
+	"collie-agent/internal/rules"
+	"collie-agent/internal/tracing"
+)
+
+// loadRules loads the bundled policies, and the rule packs and custom rules of the remote
+// configuration. The rules are loaded again only when the configuration changed.
+func (p *Probe) loadRules() {
+	p.violations = nil
+	if p.rules != nil && p.rulesVersion == p.config.Version {
+		return
+	}
+	engine, err := rules.Load(p.ctx, p.log, p.config.RulePacks, p.config.CustomRules)
+	if err != nil {
+		p.cc.ReportError("load-rules", "", err)
+		return
+	}
+	p.rules = engine
+	p.rulesVersion = p.config.Version
+}
+
+// evaluateRules runs the policies against a discovered resource, named like pods#default/nginx.
+func (p *Probe) evaluateRules(name string, data interface{}) {
+	if p.rules == nil {
+		return
+	}
+	kind, _, _ := strings.Cut(name, "#")
+	p.violations = append(p.violations, p.rules.Evaluate(p.ctx, kind, name, data)...)
+}
+
+// traceRuleUsage adds a span for each source of policies evaluated since start, a rule pack, the bundled
+// policies or the custom rules. The span starts at start and lasts the total evaluation time of the source.
+func (p *Probe) traceRuleUsage(start time.Time) {
+	if p.rules == nil {
+		return
+	}
+	for source, u := range p.rules.TakeUsage() {
+		_, span := tracing.Tracer().Start(p.ctx, "rules.evaluate", trace.WithTimestamp(start), trace.WithAttributes(
+			attribute.String("collie.rule_source", source),
+			attribute.Int("collie.evaluations", u.Evaluations),
+			attribute.Int("collie.violations", u.Violations),
+		))
+		span.End(trace.WithTimestamp(start.Add(u.Duration)))
+	}
+}
+
+// DiscoverRuleViolations reports the policy violations found while discovering the resources,
+// each as a compliance finding attached to the resource. Violations waived by an annotation
+// of the resource are reported as WAIVED.
+func (p *Probe) DiscoverRuleViolations() error {
+	log := p.log
+
+	log.Info("DiscoverRuleViolations start")
+	defer func() {
+		log.Info("DiscoverRuleViolations exit")
+	}()
+
+	for _, r := range p.violations {
+		status := r.Data["status"]
+		if r.Data["waived"] == "true" {
+			status = "WAIVED"
+		}
+		category := r.Data["category"]
+		if category == "" {
+			category = r.Data["kind"]
+		}
+		description := r.Data["title"]
+		if msg := r.Data["message"]; msg != "" {
+			description = msg
+		}
+		p.cc.ReportCompliance(&model.Compliance{
+			Plugin:      "collie",
+			RuleId:      r.RuleId,
+			Category:    category,
+			Description: description,
+			Status:      status,
+			Severity:    r.Severity,
+			Namespace:   r.Data["namespace"],
+			Resource:    r.Data["resource"],
+			Remediation: r.Data["remediation"],
+		})
+	}
+	log.Infof("Reported %d policy violations", len(p.violations))
+	p.violations = nil
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"collie-agent/internal/model"
+	"collie-agent/internal/reporter"
+)
+
+// Watcher polls the remote configuration of the agent. The log level is applied as soon as
+// the configuration changes, the other settings are read by the main loop through Current.
+type Watcher struct {
+	log      *logrus.Entry
+	cc       *reporter.CollieClient
+	interval time.Duration
+	// level of the logger when the configuration does not set one
+	defaultLevel logrus.Level
+
+	mu      sync.Mutex
+	current *model.AgentConfig
+	changed chan struct{}
+}
+
+func New(log *logrus.Entry, cc *reporter.CollieClient, interval time.Duration) *Watcher {
+	return &Watcher{
+		log:          log,
+		cc:           cc,
+		interval:     interval,
+		defaultLevel: log.Logger.GetLevel(),
+		current:      &model.AgentConfig{},
+		changed:      make(chan struct{}, 1),
+	}
+}
+
+// Current returns the configuration in effect, the zero configuration until the first successful poll.
+func (w *Watcher) Current() *model.AgentConfig {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// Changed is signaled when a new version of the configuration is in effect.
+func (w *Watcher) Changed() <-chan struct{} {
+	return w.changed
+}
+
+// Poll retrieves the configuration once, and applies it when its version changed.
+func (w *Watcher) Poll() error {
+	cfg, err := w.cc.GetConfig(w.Current().Version)
+	if err != nil || cfg == nil {
+		return err
+	}
+
+	level := w.defaultLevel
+	if cfg.LogLevel != "" {
+		if l, err := logrus.ParseLevel(cfg.LogLevel); err != nil {
+			w.log.Warnf("Ignoring log level %s: %s", cfg.LogLevel, err)
+		} else {
+			level = l
+		}
+	}
+	w.log.Logger.SetLevel(level)
+
+	w.mu.Lock()
+	if cfg.RulesRevision < w.current.RulesRevision {
+		// the server lost rules it delivered before, keep running them rather than dropping them
+		w.log.Warnf("Keeping rules of revision %d, the configuration %s has revision %d",
+			w.current.RulesRevision, cfg.Version, cfg.RulesRevision)
+		cfg.RulePacks = w.current.RulePacks
+		cfg.CustomRules = w.current.CustomRules
+		cfg.RulesRevision = w.current.RulesRevision
+	}
+	w.current = cfg
+	w.mu.Unlock()
+	w.log.Infof("Applied configuration %s: interval=%s, scanners=%v, namespaces=%+v, log=%s",
+		cfg.Version, cfg.Interval(), cfg.Scanners, cfg.Namespaces, level)
+
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run polls the configuration at every interval until the context is done.
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := w.Poll(); err != nil {
+			w.log.Warnf("Error polling configuration: %s", err)
+		}
+	}
+}
@@ -27,5 +27,7 @@ type ICollieClient interface {
 	ReportError(operation string, resource string, e error)
 	ReportCompliance(data *model.Compliance)
 	ReportBulk(docs []*any)
-	ReportCompletion()
+	ReportStart(scan *model.Scan)
+	ReportCompletion(scan *model.Scan)
+	ReportHeartbeat(hb model.AgentHeartbeat) error
 }
@@ -37,8 +37,11 @@ import (
 	"github.com/elastic/go-elasticsearch/v8/esutil"
 	"github.com/go-resty/resty/v2"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 
+	"collie-agent/internal/metrics"
 	"collie-agent/internal/model"
+	"collie-agent/internal/tracing"
 )
 
 var (
@@ -62,9 +65,20 @@ type CollieClient struct {
 	es          *elasticsearch.Client
 	typedClient *elasticsearch.TypedClient
 	rest        *resty.Client
+
+	// number of documents indexed successfully, shared by all copies of the client
+	docCount *int64
+	// id of the snapshot the documents are reported to, shared by all copies of the client
+	snapshotId *atomic.Value
+	// number of completed snapshots kept per cluster
+	retention int
+	// collects the results instead of reporting them, in offline mode
+	offline *offlineSink
+	// context of the requests, carrying the span they are traced under, shared by all copies of the client
+	traceCtx *atomic.Value
 }
 
-func New(log *logrus.Entry, agentId string, clusterId string, apiUrl string, apiToken string, esUrl string, esToken string) (*CollieClient, error) {
+func New(log *logrus.Entry, agentId string, clusterId string, apiUrl string, apiToken string, esUrl string, esToken string, retention int) (*CollieClient, error) {
 
 	transport := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
@@ -84,7 +98,7 @@ func New(log *logrus.Entry, agentId string, clusterId string, apiUrl string, api
 		},
 		Username:  esUsername,
 		Password:  esPassword,
-		Transport: transport,
+		Transport: metrics.InstrumentTransport("es", tracing.Transport(transport)),
 
 		// Retry on 429 TooManyRequests statuses
 		RetryOnStatus: []int{502, 503, 504, 429},
@@ -119,11 +133,11 @@ func New(log *logrus.Entry, agentId string, clusterId string, apiUrl string, api
 	log.Info("API URL: ", apiUrl)
 
 	restClient := resty.New()
-	restClient.SetTransport(transport)
+	restClient.SetTransport(metrics.InstrumentTransport("api", tracing.Transport(transport)))
 	restClient.SetBaseURL(apiUrl)
 	restClient.SetAuthToken(apiToken)
 	orgId := esUsername
-	client := CollieClient{log, orgId, agentId, clusterId, es, typedClient, restClient}
+	client := CollieClient{log, orgId, agentId, clusterId, es, typedClient, restClient, new(int64), &atomic.Value{}, retention, nil, &atomic.Value{}}
 	return &client, err
 }
 
@@ -186,13 +200,47 @@ func (cc CollieClient) esInfo() error {
 	return nil
 }
 
+// PingAPI checks quietly that the API server is reachable, for the readiness endpoint.
+func (cc CollieClient) PingAPI(ctx context.Context) error {
+	resp, err := cc.rest.R().
+		SetContext(ctx).
+		Get("/api/v1/onboarding/status")
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("Fail invoking Collie API: %s", resp.Status())
+	}
+	return nil
+}
+
+// PingES checks quietly that ES is reachable, for the readiness endpoint.
+func (cc CollieClient) PingES(ctx context.Context) error {
+	res, err := cc.es.Ping(cc.es.Ping.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Fail invoking Collie ES: %s", res.Status())
+	}
+	return nil
+}
+
 func (cc CollieClient) ReportClusterInfo(info model.ClusterInfo) {
 	docType := "cluster"
-	cc.reportImpl(indexPrefix, docType, "", info)
+	cc.reportImpl(indexPrefix, docType, "", info, nil)
 }
 
+// ReportResource reports a resource object. The name is the resource key, "<kind>#<name>" for cluster
+// scoped resources and "<kind>#<namespace>/<name>" for namespaced ones. The kind and the key are
+// indexed as top-level fields "k" and "r".
 func (cc CollieClient) ReportResource(name string, data interface{}) {
-	cc.reportImpl(indexPrefix, "resource", name, data)
+	fields := map[string]string{
+		"r": name,
+		"k": strings.SplitN(name, "#", 2)[0],
+	}
+	cc.reportImpl(indexPrefix, "resource", name, data, fields)
 }
 
 type Activity struct {
@@ -206,7 +254,7 @@ func (cc CollieClient) ReportActivity(operation string, resource string) {
 		Operation: operation,
 		Resource:  resource,
 	}
-	cc.reportImpl(indexPrefix, "activity", "", data)
+	cc.reportImpl(indexPrefix, "activity", "", data, nil)
 }
 
 func (cc CollieClient) ReportError(operation string, resource string, e error) {
@@ -216,11 +264,12 @@ func (cc CollieClient) ReportError(operation string, resource string, e error) {
 		Resource:  resource,
 		Error:     e.Error(),
 	}
-	cc.reportImpl(indexPrefix, "activity", "", data)
+	cc.reportImpl(indexPrefix, "activity", "", data, nil)
 }
 
 func (cc CollieClient) ReportCompliance(data *model.Compliance) {
-	cc.reportImpl(indexPrefix, "compliance", "", data)
+	metrics.ComplianceReported(data.Plugin, data.Severity, data.Status)
+	cc.reportImpl(indexPrefix, "compliance", "", data, nil)
 }
 
 func (cc CollieClient) ReportBulk(docs []*any) {
@@ -241,6 +290,14 @@ func (cc CollieClient) ReportBulk(docs []*any) {
 		NumWorkers:    numWorkers,       // The number of worker goroutines
 		FlushBytes:    int(flushBytes),  // The flush threshold in bytes
 		FlushInterval: 30 * time.Second, // The periodic flush interval
+		// Trace each flush under the span of the client
+		OnFlushStart: func(context.Context) context.Context {
+			ctx, _ := tracing.Tracer().Start(cc.context(), "es.bulk.flush")
+			return ctx
+		},
+		OnFlushEnd: func(ctx context.Context) {
+			trace.SpanFromContext(ctx).End()
+		},
 	})
 	if err != nil {
 		log.Warnf("Error creating the indexer: %s", err)
@@ -316,6 +373,8 @@ func (cc CollieClient) ReportBulk(docs []*any) {
 	// <<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<
 
 	biStats := bi.Stats()
+	atomic.AddInt64(cc.docCount, int64(countSuccessful))
+	metrics.DocumentsIndexed(countSuccessful, biStats.NumFailed)
 
 	// Report the results: number of indexed docs, number of errors, duration, indexing rate
 	//
@@ -347,45 +406,98 @@ type HookReportSuccess struct {
 type HookReportError struct {
 }
 
-func (cc CollieClient) ReportCompletion() {
+// ReportStart notifies the API server that a scan cycle has started.
+func (cc CollieClient) ReportStart(scan *model.Scan) {
+	cc.Log.Info("ReportStart: ", scan.Id)
+	resp, err := cc.request().
+		SetBody(scan).
+		Post("/api/v1/agent/sync-start")
+	if err != nil {
+		cc.Log.Warnf("Error reporting sync-start: %s", err)
+	} else if resp.IsError() {
+		cc.Log.Warnf("Error reporting sync-start: %s", resp.Status())
+	}
+}
+
+func (cc CollieClient) ReportCompletion(scan *model.Scan) {
 
-	cc.Log.Info("ReportCompletion")
+	cc.Log.Info("ReportCompletion: ", scan.Id)
 	// POST Struct, default is JSON content type. No need to set one
-	resp, err := cc.rest.R().
+	// The timing of the request is in its span, when tracing is on
+	resp, err := cc.request().
+		SetBody(scan).
 		SetResult(&HookReportSuccess{}). // or SetResult(AuthSuccess{}).
 		SetError(&HookReportError{}).    // or SetError(AuthError{}).
 		Post("/api/v1/agent/sync-complete")
-
-	// Explore response object
-	fmt.Println("Response Info:")
-	fmt.Println("  Error      :", err)
-	fmt.Println("  Status Code:", resp.StatusCode())
-	fmt.Println("  Status     :", resp.Status())
-	fmt.Println("  Proto      :", resp.Proto())
-	fmt.Println("  Time       :", resp.Time())
-	fmt.Println("  Received At:", resp.ReceivedAt())
-	fmt.Println("  Body       :\n", resp)
-	fmt.Println()
-
-	// Explore trace info
-	fmt.Println("Request Trace Info:")
-	ti := resp.Request.TraceInfo()
-	fmt.Println("  DNSLookup     :", ti.DNSLookup)
-	fmt.Println("  ConnTime      :", ti.ConnTime)
-	fmt.Println("  TCPConnTime   :", ti.TCPConnTime)
-	fmt.Println("  TLSHandshake  :", ti.TLSHandshake)
-	fmt.Println("  ServerTime    :", ti.ServerTime)
-	fmt.Println("  ResponseTime  :", ti.ResponseTime)
-	fmt.Println("  TotalTime     :", ti.TotalTime)
-	fmt.Println("  IsConnReused  :", ti.IsConnReused)
-	fmt.Println("  IsConnWasIdle :", ti.IsConnWasIdle)
-	fmt.Println("  ConnIdleTime  :", ti.ConnIdleTime)
-	fmt.Println("  RequestAttempt:", ti.RequestAttempt)
-	fmt.Println("  RemoteAddr    :", ti.RemoteAddr)
+	if err != nil {
+		cc.Log.Warnf("Error reporting sync-complete: %s", err)
+	} else if resp.IsError() {
+		cc.Log.Warnf("Error reporting sync-complete: %s, %s", resp.Status(), resp)
+	} else {
+		cc.Log.Infof("Reported sync-complete in %s", resp.Time())
+	}
 
 	cc.ReportActivity("cycle-complete", "")
 }
 
-func (cc CollieClient) DeleteOldDoc(before time.Time, docType string) {
-	cc.deleteDocumentsBeforeTimestamp(indexPrefix, before, docType)
+// ReportHeartbeat registers the agent with the API server on first contact and refreshes its status afterwards.
+func (cc CollieClient) ReportHeartbeat(hb model.AgentHeartbeat) error {
+	hb.AgentId = cc.agentId
+	hb.ClusterId = cc.clusterId
+	resp, err := cc.request().
+		SetBody(hb).
+		Post("/api/v1/agent/heartbeat")
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("Fail reporting heartbeat: %s", resp.Status())
+	}
+	return nil
+}
+
+// GetConfig polls the remote configuration of the agent. It returns nil when the configuration
+// still has the given version, and in offline mode.
+func (cc CollieClient) GetConfig(version string) (*model.AgentConfig, error) {
+	if cc.offline != nil {
+		return nil, nil
+	}
+	var cfg model.AgentConfig
+	req := cc.rest.R().SetResult(&cfg)
+	if version != "" {
+		req.SetHeader("If-None-Match", `"`+version+`"`)
+	}
+	resp, err := req.Get("/api/v1/agent/config")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("Fail retrieving config: %s", resp.Status())
+	}
+	return &cfg, nil
+}
+
+// NextScanRequest long-polls the API server for the next scan request of the agent, waiting up to wait.
+// It returns nil when no request was queued in time.
+func (cc CollieClient) NextScanRequest(ctx context.Context, wait time.Duration) (*model.ScanRequest, error) {
+	var sr model.ScanRequest
+	resp, err := cc.rest.R().
+		SetContext(ctx).
+		SetQueryParam("agentId", cc.agentId).
+		SetQueryParam("wait", wait.String()).
+		SetResult(&sr).
+		Get("/api/v1/agent/scan-requests/next")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("Fail retrieving scan request: %s", resp.Status())
+	}
+	return &sr, nil
 }
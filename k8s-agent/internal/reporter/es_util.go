@@ -17,14 +17,17 @@ package reporter
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
-	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"collie-agent/internal/metrics"
 )
 
-func toESJson(agentId string, clusterId string, docType string, v interface{}) ([]byte, error) {
+// toESJson wraps the value into a document of the given type. fields are extra top-level
+// keys, such as the kind of a resource, so that they can be queried without digging into the object.
+func toESJson(agentId string, clusterId string, docType string, v interface{}, fields map[string]string) ([]byte, error) {
 	// Marshal the value to JSON
 	jsonBytes, err := json.Marshal(v)
 	if err != nil {
@@ -45,6 +48,9 @@ func toESJson(agentId string, clusterId string, docType string, v interface{}) (
 		"c":          clusterId,
 		docType:      jsonObj,
 	}
+	for k, v := range fields {
+		ret[k] = v
+	}
 
 	// Marshal the modified JSON object to bytes
 	return json.MarshalIndent(ret, "", "  ")
@@ -94,13 +100,24 @@ func convertKeysReplaceDotsWithUnderscores(v interface{}) {
 // 	}
 // }
 
-func (cc CollieClient) reportImpl(indexPrefix string, docType string, resName string, data interface{}) {
+func (cc CollieClient) reportImpl(indexPrefix string, docType string, resName string, data interface{}, fields map[string]string) {
 
 	log := cc.Log
 
+	if cc.offline != nil {
+		cc.offline.add(docType, data)
+		return
+	}
+
 	indexName := indexPrefix + cc.orgId
 
-	buf, err := toESJson(cc.agentId, cc.clusterId, docType, data)
+	if snapshotId := cc.currentSnapshot(); snapshotId != "" {
+		if fields == nil {
+			fields = map[string]string{}
+		}
+		fields["s"] = snapshotId
+	}
+	buf, err := toESJson(cc.agentId, cc.clusterId, docType, data, fields)
 	if err != nil {
 		log.Infof("reportImpl: Error encoding JSON.  type=%s, res=%s, error=%s", docType, resName, err)
 	}
@@ -108,59 +125,16 @@ func (cc CollieClient) reportImpl(indexPrefix string, docType string, resName st
 
 	res, err := cc.typedClient.Index(indexName).
 		Raw(reader).
-		Do(context.Background())
+		Do(cc.context())
 
 	if err != nil {
 		//log.Infof("Doc: %s", string(buf))
 		log.Warnf("Error adding document: type=%s, res=%s, %s", docType, resName, err)
+		metrics.DocumentsIndexed(0, 1)
 	} else {
+		atomic.AddInt64(cc.docCount, 1)
+		metrics.DocumentsIndexed(1, 0)
 		//log.Infof("Doc: %s", string(buf))
 		log.Infof("reportImpl: OK.  type=%s, res=%s, result=%s", docType, resName, res.Result)
 	}
 }
-
-func (cc CollieClient) deleteDocumentsBeforeTimestamp(indexPrefix string, timestamp time.Time, docType string) {
-
-	log := cc.Log
-	indexName := indexPrefix + cc.orgId
-
-	// Define the query to match documents before the given timestamp
-	query := fmt.Sprintf(`{
-		"query": {
-			"bool": {
-				"must": [
-					{
-						"range": {
-							"@timestamp": {
-								"lt": "%s"
-							}
-						}
-					},
-					{
-						"term": {
-							"a": "%s"
-						}
-					}
-				],
-				"filter": [
-					{
-						"exists": {
-							"field": "%s"
-						}
-					}
-				]
-			}
-		}
-	}`, timestamp.Format(time.RFC3339), cc.agentId, docType)
-
-	log.Printf("deleteDocumentsBeforeTimestamp(%s) - start...", docType)
-	resp, err := cc.es.DeleteByQuery([]string{indexName}, strings.NewReader(query))
-
-	if err != nil {
-		log.Printf("deleteDocumentsBeforeTimestamp(%s) - Error: %s", docType, err.Error())
-	} else if resp.IsError() {
-		log.Printf("deleteDocumentsBeforeTimestamp(%s) - Error: %s", docType, resp.String())
-	} else {
-		log.Printf("deleteDocumentsBeforeTimestamp(%s) - success: %s", docType, resp.String())
-	}
-}
@@ -0,0 +1,62 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reporter
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+
+	"collie-agent/internal/model"
+)
+
+// offlineSink keeps the compliance results of an offline run. Other documents are dropped.
+type offlineSink struct {
+	mu      sync.Mutex
+	results []*model.Compliance
+}
+
+func (s *offlineSink) add(docType string, data interface{}) {
+	c, ok := data.(*model.Compliance)
+	if docType != "compliance" || !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = append(s.results, c)
+}
+
+// NewOffline creates a client which connects to neither the API server nor Elasticsearch.
+// The compliance results are collected, to be exported once the scanners have run.
+func NewOffline(log *logrus.Entry, agentId string, clusterId string) *CollieClient {
+	return &CollieClient{
+		Log:        log,
+		agentId:    agentId,
+		clusterId:  clusterId,
+		docCount:   new(int64),
+		snapshotId: &atomic.Value{},
+		offline:    &offlineSink{},
+		traceCtx:   &atomic.Value{},
+	}
+}
+
+// OfflineResults returns the compliance results collected by an offline client.
+func (cc CollieClient) OfflineResults() []*model.Compliance {
+	cc.offline.mu.Lock()
+	defer cc.offline.mu.Unlock()
+	return append([]*model.Compliance{}, cc.offline.results...)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reporter
+
+import (
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	"collie-agent/internal/metrics"
+	"collie-agent/internal/model"
+)
+
+// plugins maps the scan phases backed by an external scanner to the plugin name used in compliance docs
+var plugins = map[string]string{
+	"kube-bench":  "kube-bench",
+	"kube-hunter": "kube-hunter",
+}
+
+// StartScan creates the record of a new cycle and reports it to the API server.
+// requestId is the scan request the cycle runs for, empty for a scheduled cycle.
+func (cc CollieClient) StartScan(requestId string) *model.Scan {
+	scan := &model.Scan{
+		Id:        string(uuid.NewUUID()),
+		AgentId:   cc.agentId,
+		ClusterId: cc.clusterId,
+		StartedAt: time.Now().UTC(),
+		Phases:    []*model.ScanPhase{},
+		Errors:    []string{},
+		Plugins:   map[string]string{},
+		RequestId: requestId,
+	}
+	metrics.CycleStarted()
+	cc.setSnapshot(scan.Id)
+	cc.ReportStart(scan)
+	return scan
+}
+
+// RunPhase runs one phase of the cycle, recording its timing, document count and error in the scan.
+func (cc CollieClient) RunPhase(scan *model.Scan, name string, fn func() error) error {
+	docsBefore := atomic.LoadInt64(cc.docCount)
+	phase := &model.ScanPhase{
+		Name:      name,
+		StartedAt: time.Now().UTC(),
+	}
+
+	err := fn()
+
+	phase.EndedAt = time.Now().UTC()
+	phase.DurationMs = phase.EndedAt.Sub(phase.StartedAt).Milliseconds()
+	phase.Documents = atomic.LoadInt64(cc.docCount) - docsBefore
+	if err != nil {
+		phase.Error = err.Error()
+		scan.Errors = append(scan.Errors, name+": "+err.Error())
+		cc.ReportError(name, "", err)
+	}
+	scan.Phases = append(scan.Phases, phase)
+	metrics.PhaseCompleted(name, plugins[name], phase.EndedAt.Sub(phase.StartedAt), err)
+	scan.Documents += phase.Documents
+
+	if plugin, ok := plugins[name]; ok {
+		if err != nil {
+			scan.Plugins[plugin] = "failed"
+		} else {
+			scan.Plugins[plugin] = "ok"
+		}
+	}
+	return err
+}
+
+// CompleteScan closes the cycle and posts the scan record to the API server.
+// The snapshot of the cycle becomes the current one only if all phases succeeded.
+func (cc CollieClient) CompleteScan(scan *model.Scan) {
+	if len(scan.Errors) == 0 {
+		retained, err := cc.flipSnapshot(scan)
+		if err != nil {
+			scan.Errors = append(scan.Errors, "snapshot: "+err.Error())
+			cc.ReportError("snapshot", scan.Id, err)
+		} else {
+			cc.deleteStaleSnapshots(retained)
+		}
+	} else {
+		cc.Log.Warnf("Scan %s has errors, keeping the current snapshot", scan.Id)
+	}
+	endedAt := time.Now().UTC()
+	scan.EndedAt = &endedAt
+	metrics.CycleCompleted(len(scan.Errors) == 0)
+	cc.ReportCompletion(scan)
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+
+	"collie-agent/internal/metrics"
+	"collie-agent/internal/model"
+)
+
+// Every document reported during a cycle is tagged with the snapshot id "s", which is the id of the scan.
+// A snapshot becomes the current one of the cluster only when its cycle completes without errors, by
+// flipping the pointer document of the cluster in the snapshot index. Readers only look at the current
+// snapshots, so they never see a partial cycle, and a failed cycle leaves the previous snapshot in place.
+
+const (
+	snapshotIndexPrefix = "collie-snapshot-"
+	maxFlipAttempts     = 5
+)
+
+type snapshotRef struct {
+	Id          string    `json:"id"`
+	StartedAt   time.Time `json:"startedAt"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+// snapshotPointer is the document, with the cluster id as its id, pointing at the current snapshot of a cluster.
+type snapshotPointer struct {
+	ClusterId string    `json:"c"`
+	AgentId   string    `json:"a"`
+	Current   string    `json:"current"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// retained snapshots, newest first, starting with the current one
+	Snapshots []snapshotRef `json:"snapshots"`
+}
+
+func (cc CollieClient) currentSnapshot() string {
+	if v, ok := cc.snapshotId.Load().(string); ok {
+		return v
+	}
+	return ""
+}
+
+func (cc CollieClient) setSnapshot(snapshotId string) {
+	cc.snapshotId.Store(snapshotId)
+}
+
+// getSnapshotPointer returns the pointer of the cluster with its sequence number and primary term,
+// or nil if the cluster has no snapshot yet.
+func (cc CollieClient) getSnapshotPointer() (*snapshotPointer, int, int, error) {
+	res, err := cc.es.Get(snapshotIndexPrefix+cc.orgId, cc.clusterId, cc.es.Get.WithContext(cc.context()))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, 0, 0, nil
+	}
+	if res.IsError() {
+		return nil, 0, 0, fmt.Errorf("Error getting snapshot pointer: %s", res.String())
+	}
+	var doc struct {
+		SeqNo       int             `json:"_seq_no"`
+		PrimaryTerm int             `json:"_primary_term"`
+		Source      snapshotPointer `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, 0, 0, err
+	}
+	return &doc.Source, doc.SeqNo, doc.PrimaryTerm, nil
+}
+
+// flipSnapshot makes the snapshot of the scan the current one of the cluster, and returns the ids of
+// the snapshots to retain. The pointer is updated with optimistic concurrency control, so that concurrent
+// updates are retried instead of overwritten.
+func (cc CollieClient) flipSnapshot(scan *model.Scan) ([]string, error) {
+	index := snapshotIndexPrefix + cc.orgId
+	for attempt := 1; attempt <= maxFlipAttempts; attempt++ {
+		old, seqNo, primaryTerm, err := cc.getSnapshotPointer()
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now().UTC()
+		ptr := snapshotPointer{
+			ClusterId: cc.clusterId,
+			AgentId:   cc.agentId,
+			Current:   scan.Id,
+			UpdatedAt: now,
+			Snapshots: []snapshotRef{{Id: scan.Id, StartedAt: scan.StartedAt, CompletedAt: now}},
+		}
+		if old != nil {
+			ptr.Snapshots = append(ptr.Snapshots, old.Snapshots...)
+		}
+		if len(ptr.Snapshots) > cc.retention {
+			ptr.Snapshots = ptr.Snapshots[:cc.retention]
+		}
+
+		body, err := json.Marshal(ptr)
+		if err != nil {
+			return nil, err
+		}
+		opts := []func(*esapi.IndexRequest){
+			cc.es.Index.WithContext(cc.context()),
+			cc.es.Index.WithDocumentID(cc.clusterId),
+			cc.es.Index.WithRefresh("true"),
+		}
+		if old == nil {
+			opts = append(opts, cc.es.Index.WithOpType("create"))
+		} else {
+			opts = append(opts, cc.es.Index.WithIfSeqNo(seqNo), cc.es.Index.WithIfPrimaryTerm(primaryTerm))
+		}
+		res, err := cc.es.Index(index, bytes.NewReader(body), opts...)
+		if err != nil {
+			return nil, err
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusConflict {
+			cc.Log.Warnf("Snapshot pointer changed concurrently, retrying %d/%d", attempt, maxFlipAttempts)
+			continue
+		}
+		if res.IsError() {
+			return nil, fmt.Errorf("Error updating snapshot pointer: %s", res.String())
+		}
+
+		retained := make([]string, 0, len(ptr.Snapshots))
+		for _, s := range ptr.Snapshots {
+			retained = append(retained, s.Id)
+		}
+		return retained, nil
+	}
+	return nil, fmt.Errorf("Error updating snapshot pointer: too many concurrent updates")
+}
+
+// deleteStaleSnapshots deletes the documents of the cluster which belong to none of the retained snapshots,
+// including documents of failed cycles and documents reported before snapshots were introduced.
+func (cc CollieClient) deleteStaleSnapshots(retained []string) {
+	log := cc.Log
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{"c.keyword": cc.clusterId}},
+				},
+				"must_not": []interface{}{
+					map[string]interface{}{"terms": map[string]interface{}{"s.keyword": retained}},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(query)
+	if err != nil {
+		log.Warnf("deleteStaleSnapshots - Error: %s", err)
+		return
+	}
+
+	log.Printf("deleteStaleSnapshots - start, retained=%v", retained)
+	resp, err := cc.es.DeleteByQuery([]string{indexPrefix + cc.orgId}, bytes.NewReader(body),
+		cc.es.DeleteByQuery.WithContext(cc.context()), cc.es.DeleteByQuery.WithConflicts("proceed"))
+	if err != nil {
+		log.Printf("deleteStaleSnapshots - Error: %s", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		log.Printf("deleteStaleSnapshots - Error: %s", resp.String())
+	} else {
+		log.Printf("deleteStaleSnapshots - success: %s", resp.String())
+	}
+}
+
+// carriedDocs selects the documents reported by each phase, which a cycle limited to some
+// phases carries over from the current snapshot.
+var carriedDocs = map[string]map[string]interface{}{
+	"resources":   {"exists": map[string]interface{}{"field": "resource"}},
+	"rules":       {"term": map[string]interface{}{"compliance.plugin.keyword": "collie"}},
+	"kube-bench":  {"term": map[string]interface{}{"compliance.plugin.keyword": "kube-bench"}},
+	"kube-hunter": {"term": map[string]interface{}{"compliance.plugin.keyword": "kube-hunter"}},
+}
+
+// CarryOver copies the documents of the given phases from the current snapshot of the cluster to the
+// snapshot of the scan, so that a cycle limited to some phases still makes up a complete snapshot.
+func (cc CollieClient) CarryOver(scan *model.Scan, phases []string) error {
+	if cc.offline != nil || len(phases) == 0 {
+		return nil
+	}
+	ptr, _, _, err := cc.getSnapshotPointer()
+	if err != nil {
+		return err
+	}
+	if ptr == nil || ptr.Current == "" {
+		return nil
+	}
+
+	should := make([]interface{}, 0, len(phases))
+	for _, phase := range phases {
+		if q, ok := carriedDocs[phase]; ok {
+			should = append(should, q)
+		}
+	}
+	index := indexPrefix + cc.orgId
+	body, err := json.Marshal(map[string]interface{}{
+		"source": map[string]interface{}{
+			"index": index,
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{
+					"filter": []interface{}{
+						map[string]interface{}{"term": map[string]interface{}{"c.keyword": cc.clusterId}},
+						map[string]interface{}{"term": map[string]interface{}{"s.keyword": ptr.Current}},
+					},
+					"should":               should,
+					"minimum_should_match": 1,
+				},
+			},
+		},
+		"dest": map[string]interface{}{"index": index},
+		// the copies get ids of their own, the originals stay in the previous snapshot. The ids derive from
+		// the id of the first original, kept in o, so that they do not grow each time a document is carried
+		"script": map[string]interface{}{
+			"source": "if (ctx._source.o == null) { ctx._source.o = ctx._id } ctx._id = ctx._source.o + '-' + params.s; ctx._source.s = params.s",
+			"params": map[string]interface{}{"s": scan.Id},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := cc.es.Reindex(bytes.NewReader(body), cc.es.Reindex.WithContext(cc.context()), cc.es.Reindex.WithRefresh(true))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Error carrying over snapshot %s: %s", ptr.Current, res.String())
+	}
+	var ret struct {
+		Total    int64             `json:"total"`
+		Created  int64             `json:"created"`
+		Failures []json.RawMessage `json:"failures"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&ret); err != nil {
+		return err
+	}
+	atomic.AddInt64(cc.docCount, ret.Created)
+	metrics.DocumentsIndexed(uint64(ret.Created), 0)
+	// a snapshot missing documents which could not be carried would report their findings as fixed
+	if len(ret.Failures) > 0 {
+		return fmt.Errorf("Error carrying over snapshot %s, %d of %d documents failed: %s", ptr.Current, len(ret.Failures), ret.Total, ret.Failures[0])
+	}
+	if ret.Created < ret.Total {
+		return fmt.Errorf("Error carrying over snapshot %s, %d of %d documents created", ptr.Current, ret.Created, ret.Total)
+	}
+	cc.Log.Infof("Carried over %d documents of %v from snapshot %s", ret.Created, phases, ptr.Current)
+	return nil
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reporter
+
+import (
+	"context"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// traceContext wraps the context stored in the client, since an atomic.Value holds a single concrete type
+type traceContext struct {
+	ctx context.Context
+}
+
+// SetContext sets the context of the requests to the API server and ES made by the client, which carries
+// the span they are traced under, such as the one of the phase running. It returns the context it replaces.
+func (cc CollieClient) SetContext(ctx context.Context) context.Context {
+	prev := cc.context()
+	cc.traceCtx.Store(traceContext{ctx})
+	return prev
+}
+
+func (cc CollieClient) context() context.Context {
+	if cc.traceCtx != nil {
+		if v, ok := cc.traceCtx.Load().(traceContext); ok {
+			return v.ctx
+		}
+	}
+	return context.Background()
+}
+
+// request returns a request to the API server in the context of the client.
+func (cc CollieClient) request() *resty.Request {
+	return cc.rest.R().SetContext(cc.context())
+}
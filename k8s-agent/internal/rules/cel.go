@@ -0,0 +1,98 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/cel-go/cel"
+
+	"collie-agent/internal/model"
+)
+
+const (
+	// celCostLimit bounds the cost of an evaluation, as the server bounds the estimated cost of the rules
+	celCostLimit = 10000000
+	// celTimeout bounds the time of an evaluation, which checks for it every celInterruptCheck iterations
+	celTimeout        = time.Second
+	celInterruptCheck = 100
+)
+
+var celEnv *cel.Env
+
+func init() {
+	var err error
+	celEnv, err = cel.NewEnv(cel.Variable("object", cel.DynType))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// customRule is a CEL expression which must hold for the resources of its kinds. The expression
+// sees the resource as object, and the resources for which it is false are reported.
+type customRule struct {
+	meta  Metadata
+	kinds map[string]bool
+	prg   cel.Program
+}
+
+func compileCustomRule(r *model.CustomRule) (*customRule, error) {
+	ast, issues := celEnv.Compile(r.Expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	prg, err := celEnv.Program(ast, cel.CostLimit(celCostLimit), cel.InterruptCheckFrequency(celInterruptCheck))
+	if err != nil {
+		return nil, err
+	}
+	cr := &customRule{
+		meta: Metadata{
+			Id:          r.RuleId,
+			Title:       r.Title,
+			Description: r.Expression,
+			Severity:    r.Severity,
+			Category:    r.Category,
+			Remediation: r.Remediation,
+			Status:      "FAIL",
+		},
+		kinds: map[string]bool{},
+		prg:   prg,
+	}
+	if cr.meta.Title == "" {
+		cr.meta.Title = r.Expression
+	}
+	for _, k := range r.Kinds {
+		cr.kinds[k] = true
+	}
+	return cr, nil
+}
+
+// eval tells whether the expression holds for the object.
+func (cr *customRule) eval(ctx context.Context, object map[string]interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, celTimeout)
+	defer cancel()
+	out, _, err := cr.prg.ContextEval(ctx, map[string]interface{}{"object": object})
+	if err != nil {
+		return false, err
+	}
+	ok, isBool := out.Value().(bool)
+	if !isBool {
+		return false, fmt.Errorf("expression evaluated to %v, not a bool", out.Value())
+	}
+	return ok, nil
+}
@@ -0,0 +1,18 @@
+package collie.deprecate_host_ip
+
+__rego_metadata__ := {
+	"id": "deprecate-host-ip",
+	"title": "Containers should not bind a host IP",
+	"severity": "INFO",
+	"status": "WARN",
+	"category": "pod",
+	"remediation": "Expose the container through a Service instead of a hostIP.",
+}
+
+deny[msg] {
+	input.kind == "pods"
+	c := input.object.spec.containers[_]
+	p := c.ports[_]
+	p.hostIP != ""
+	msg := sprintf("container %s binds host IP %s", [c.name, p.hostIP])
+}
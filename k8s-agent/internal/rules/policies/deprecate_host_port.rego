@@ -0,0 +1,18 @@
+package collie.deprecate_host_port
+
+__rego_metadata__ := {
+	"id": "deprecate-host-port",
+	"title": "Containers should not bind host ports",
+	"severity": "INFO",
+	"status": "WARN",
+	"category": "pod",
+	"remediation": "Expose the container through a Service instead of a hostPort.",
+}
+
+deny[msg] {
+	input.kind == "pods"
+	c := input.object.spec.containers[_]
+	p := c.ports[_]
+	p.hostPort > 0
+	msg := sprintf("container %s binds host port %d", [c.name, p.hostPort])
+}
@@ -0,0 +1,16 @@
+package collie.host_namespaces
+
+__rego_metadata__ := {
+	"id": "host-namespaces",
+	"title": "Pods should not share the host namespaces",
+	"severity": "HIGH",
+	"category": "pod",
+	"remediation": "Remove hostNetwork, hostPID and hostIPC from the pod spec.",
+}
+
+deny[msg] {
+	input.kind == "pods"
+	field := ["hostNetwork", "hostPID", "hostIPC"][_]
+	input.object.spec[field] == true
+	msg := sprintf("pod shares the host namespace: %s", [field])
+}
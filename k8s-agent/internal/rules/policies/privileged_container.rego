@@ -0,0 +1,24 @@
+package collie.privileged_container
+
+__rego_metadata__ := {
+	"id": "privileged-container",
+	"title": "Containers should not run privileged",
+	"severity": "HIGH",
+	"category": "pod",
+	"remediation": "Remove securityContext.privileged, and grant only the capabilities the container needs.",
+}
+
+containers[c] {
+	c := input.object.spec.containers[_]
+}
+
+containers[c] {
+	c := input.object.spec.initContainers[_]
+}
+
+deny[msg] {
+	input.kind == "pods"
+	c := containers[_]
+	c.securityContext.privileged == true
+	msg := sprintf("container %s runs privileged", [c.name])
+}
@@ -16,118 +16,402 @@ limitations under the License.
 package rules
 
 import (
-	"collie-agent/internal/model"
 	"context"
-	"log"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
 	"github.com/sirupsen/logrus"
-	v1 "k8s.io/api/core/v1"
-	"k8s.io/client-go/kubernetes"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"collie-agent/internal/model"
+	"collie-agent/internal/tracing"
+)
+
+// WaiveAnnotation lists the rules waived for an object, comma separated. Each rule is named, so
+// that a resource cannot opt out of the rules added later. Violations of waived rules are still
+// reported, flagged as waived.
+const WaiveAnnotation = "collie.io/waive"
+
+// A policy is a Rego package under data.collie with a deny set of messages, and its
+// metadata in __rego_metadata__:
+//
+//	package collie.deprecate_host_port
+//
+//	__rego_metadata__ := {"id": "deprecate-host-port", "severity": "INFO", "category": "pod"}
+//
+//	deny[msg] { input.kind == "pods"; ... }
+//
+// The input is {"kind": "pods", "namespace": "...", "name": "...", "object": <k8s object>}.
+const policyRoot = "collie"
 
-	K8sErrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+// prefix of the modules of the rule packs, followed by the id of the pack
+const packPrefix = "packs/"
+
+// sources of the policies which are not from a rule pack
+const (
+	bundledSource = "bundled"
+	customSource  = "custom"
 )
 
-type fnReport func(*model.ComplianceRecord) error
+//go:embed policies/*.rego
+var bundled embed.FS
+
+// objects of these namespaces are not evaluated
+var ignoredNamespaces = map[string]bool{"kube-node-lease": true, "kube-public": true, "kube-system": true}
+
+// Metadata describes a policy, as declared by its __rego_metadata__.
+type Metadata struct {
+	Id          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Severity    string `json:"severity"`
+	Category    string `json:"category"`
+	Remediation string `json:"remediation"`
+	Url         string `json:"url"`
+	// Status of the violations, FAIL by default
+	Status string `json:"status"`
+}
 
-func RunAll(log *logrus.Entry, clientset *kubernetes.Clientset, report fnReport) error {
+type policy struct {
+	pkg string
+	// source is the id of the rule pack of the policy, or bundled
+	source string
+	meta   Metadata
+	query  rego.PreparedEvalQuery
+}
 
-	coreV1 := clientset.CoreV1()
+// Usage sums up the evaluations of the policies of a source, a rule pack, the bundled policies or the custom rules.
+type Usage struct {
+	Evaluations int
+	Violations  int
+	Duration    time.Duration
+}
 
-	namespaceList, err := coreV1.Namespaces().List(context.Background(), metav1.ListOptions{})
+type Engine struct {
+	log         *logrus.Entry
+	policies    []*policy
+	customRules []*customRule
+	// usage by source since the last TakeUsage
+	usage map[string]*Usage
+}
+
+// Load compiles the bundled policies, and the rule packs and custom rules of the org. A rule pack
+// which does not compile, or which conflicts with the policies already loaded, is skipped, and so
+// is a custom rule which does not compile.
+func Load(ctx context.Context, log *logrus.Entry, packs []*model.RulePack, customRules []*model.CustomRule) (*Engine, error) {
+	modules, err := bundledModules()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if _, err := compile(modules); err != nil {
+		return nil, fmt.Errorf("Error compiling bundled policies: %w", err)
 	}
-	ignoredNamespaces := map[string]int{"kube-node-lease": 1, "kube-public": 1, "kube-system": 1}
-	for _, namespace := range namespaceList.Items {
-		log.Infoln("namespace", namespace.Name)
-		podApi := coreV1.Pods(namespace.Name)
-		podList, err := podApi.List(context.Background(), metav1.ListOptions{})
+
+	ctx, span := tracing.Tracer().Start(ctx, "rules.load")
+	defer span.End()
+	for _, pack := range packs {
+		_, packSpan := tracing.Tracer().Start(ctx, "rules.pack", trace.WithAttributes(
+			attribute.String("collie.rule_pack.id", pack.Id),
+			attribute.String("collie.rule_pack.name", pack.Name),
+			attribute.Int("collie.rule_pack.version", pack.Version),
+		))
+		merged, err := mergePack(modules, pack)
 		if err != nil {
-			return err
+			log.Warnf("Skipping rule pack %s: %s", pack.Name, err)
+			tracing.End(packSpan, err)
+			continue
 		}
-		log.Printf("There are %d pods in %s", len(podList.Items), namespace.Name)
+		modules = merged
+		packSpan.End()
+	}
 
-		if _, ok := ignoredNamespaces[namespace.Name]; ok {
-			log.Info("Ignore namespace ", namespace.Name)
+	compiler, err := compile(modules)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Engine{log: log, usage: map[string]*Usage{}}
+	sources := packageSources(modules)
+	for _, pkg := range policyPackages(modules) {
+		p, err := preparePolicy(ctx, compiler, pkg)
+		if err != nil {
+			log.Warnf("Skipping policy %s: %s", pkg, err)
 			continue
 		}
+		p.source = sources[pkg]
+		e.policies = append(e.policies, p)
+	}
+	for _, r := range customRules {
+		cr, err := compileCustomRule(r)
+		if err != nil {
+			log.Warnf("Skipping custom rule %s: %s", r.RuleId, err)
+			continue
+		}
+		e.customRules = append(e.customRules, cr)
+	}
+	log.Infof("Loaded %d policies, from %d rule packs, and %d custom rules", len(e.policies), len(packs), len(e.customRules))
+	return e, nil
+}
 
-		for idx, pod := range podList.Items {
-			log.Printf("pod %d %s", idx, pod.Name)
+// mergePack returns the modules with those of the rule pack, if they compile together.
+func mergePack(modules map[string]*ast.Module, pack *model.RulePack) (map[string]*ast.Module, error) {
+	merged := map[string]*ast.Module{}
+	for name, m := range modules {
+		merged[name] = m
+	}
+	if err := parseInto(merged, packPrefix+pack.Id+"/", pack.Modules); err != nil {
+		return nil, err
+	}
+	if _, err := compile(merged); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
 
-			podInfo, err := podApi.Get(context.Background(), pod.Name, metav1.GetOptions{})
-			if K8sErrors.IsNotFound(err) {
-				log.Printf("Pod not found: %s/%s", namespace.Name, pod.Name)
-			} else if statusError, isStatus := err.(*K8sErrors.StatusError); isStatus {
-				log.Printf("Error getting pod %v", statusError.ErrStatus.Message)
-			} else if err != nil {
-				return err
-			} else {
-				//log.Info(podInfo)
+func bundledModules() (map[string]*ast.Module, error) {
+	entries, err := bundled.ReadDir("policies")
+	if err != nil {
+		return nil, err
+	}
+	sources := map[string]string{}
+	for _, entry := range entries {
+		b, err := bundled.ReadFile(path.Join("policies", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sources[entry.Name()] = string(b)
+	}
+	modules := map[string]*ast.Module{}
+	if err := parseInto(modules, "bundled/", sources); err != nil {
+		return nil, err
+	}
+	return modules, nil
+}
 
-				runSinglePodRules(podInfo, report)
-			}
+func parseInto(modules map[string]*ast.Module, prefix string, sources map[string]string) error {
+	for name, src := range sources {
+		m, err := ast.ParseModule(prefix+name, src)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(m.Package.Path.String(), "data."+policyRoot+".") {
+			return fmt.Errorf("%s: package %s is not under %s", name, m.Package.Path, policyRoot)
 		}
+		modules[prefix+name] = m
 	}
 	return nil
 }
 
-type fnPodRule func(*v1.Pod) *model.ComplianceRecord
+func compile(modules map[string]*ast.Module) (*ast.Compiler, error) {
+	compiler := ast.NewCompiler()
+	compiler.Compile(modules)
+	if compiler.Failed() {
+		return nil, compiler.Errors
+	}
+	return compiler, nil
+}
 
-func runSinglePodRules(pod *v1.Pod, fn fnReport) {
+// policyPackages returns the packages declaring a deny rule, in a stable order.
+func policyPackages(modules map[string]*ast.Module) []string {
+	seen := map[string]bool{}
+	for _, m := range modules {
+		for _, r := range m.Rules {
+			if r.Head.Name.String() == "deny" {
+				seen[m.Package.Path.String()] = true
+			}
+		}
+	}
+	ret := make([]string, 0, len(seen))
+	for pkg := range seen {
+		ret = append(ret, pkg)
+	}
+	sort.Strings(ret)
+	return ret
+}
 
-	podRules := []fnPodRule{
-		ruleDeprecateHostPort,
-		ruleDeprecateHostIp,
+// packageSources maps the packages to the rule pack declaring them, or to bundled.
+func packageSources(modules map[string]*ast.Module) map[string]string {
+	ret := map[string]string{}
+	for name, m := range modules {
+		source := bundledSource
+		if rest, ok := strings.CutPrefix(name, packPrefix); ok {
+			source, _, _ = strings.Cut(rest, "/")
+		}
+		ret[m.Package.Path.String()] = source
 	}
+	return ret
+}
 
-	for _, rule := range podRules {
-		ret := rule(pod)
-		if ret == nil {
-			continue
+func preparePolicy(ctx context.Context, compiler *ast.Compiler, pkg string) (*policy, error) {
+	rs, err := rego.New(rego.Query(pkg+".__rego_metadata__"), rego.Compiler(compiler)).Eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+		return nil, fmt.Errorf("missing __rego_metadata__")
+	}
+	b, err := json.Marshal(rs[0].Expressions[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	var meta Metadata
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	if meta.Id == "" {
+		return nil, fmt.Errorf("missing id in __rego_metadata__")
+	}
+	if meta.Status == "" {
+		meta.Status = "FAIL"
+	}
+
+	query, err := rego.New(rego.Query(pkg+".deny"), rego.Compiler(compiler)).PrepareForEval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &policy{pkg: pkg, meta: meta, query: query}, nil
+}
+
+// Evaluate runs the policies against a discovered object, and returns a record for each denial.
+// name is the resource name of the object, such as pods#default/nginx.
+func (e *Engine) Evaluate(ctx context.Context, kind string, name string, obj interface{}) []*model.ComplianceRecord {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		e.log.Warnf("Error encoding %s: %s", name, err)
+		return nil
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(b, &object); err != nil {
+		e.log.Warnf("Error decoding %s: %s", name, err)
+		return nil
+	}
+	metadata, _ := object["metadata"].(map[string]interface{})
+	namespace, _ := metadata["namespace"].(string)
+	if ignoredNamespaces[namespace] {
+		return nil
+	}
+	objName, _ := metadata["name"].(string)
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	waive, _ := annotations[WaiveAnnotation].(string)
+
+	input := rego.EvalInput(map[string]interface{}{
+		"kind":      kind,
+		"namespace": namespace,
+		"name":      objName,
+		"object":    object,
+	})
+
+	record := func(meta *Metadata, msg string) *model.ComplianceRecord {
+		r := &model.ComplianceRecord{
+			RuleId:   meta.Id,
+			Severity: meta.Severity,
+			Url:      meta.Url,
+			Data: map[string]string{
+				"kind":        kind,
+				"namespace":   namespace,
+				"name":        objName,
+				"resource":    name,
+				"message":     msg,
+				"title":       meta.Title,
+				"category":    meta.Category,
+				"remediation": meta.Remediation,
+				"status":      meta.Status,
+			},
+		}
+		if isWaived(waive, meta.Id) {
+			r.Data["waived"] = "true"
 		}
+		return r
+	}
 
-		decoratePodRecord(pod, ret)
-		err := fn(ret)
+	var ret []*model.ComplianceRecord
+	for _, p := range e.policies {
+		start := time.Now()
+		rs, err := p.query.Eval(ctx, input)
+		if err != nil {
+			e.log.Warnf("Error evaluating policy %s on %s: %s", p.meta.Id, name, err)
+			continue
+		}
+		msgs := denials(rs)
+		for _, msg := range msgs {
+			ret = append(ret, record(&p.meta, msg))
+		}
+		e.use(p.source, len(msgs), time.Since(start))
+	}
+	for _, cr := range e.customRules {
+		if !cr.kinds[kind] {
+			continue
+		}
+		start := time.Now()
+		ok, err := cr.eval(ctx, object)
 		if err != nil {
-			log.Printf("Fail reporting %s", err)
+			e.log.Warnf("Error evaluating custom rule %s on %s: %s", cr.meta.Id, name, err)
+			continue
 		}
+		violations := 0
+		if !ok {
+			ret = append(ret, record(&cr.meta, cr.meta.Title))
+			violations = 1
+		}
+		e.use(customSource, violations, time.Since(start))
 	}
+	return ret
 }
 
-func decoratePodRecord(pod *v1.Pod, r *model.ComplianceRecord) {
-	if r.Data == nil {
-		r.Data = make(map[string]string)
-		r.Data["pod"] = pod.Name
-		r.Data["namespace"] = pod.Namespace
+func (e *Engine) use(source string, violations int, d time.Duration) {
+	u, ok := e.usage[source]
+	if !ok {
+		u = &Usage{}
+		e.usage[source] = u
 	}
+	u.Evaluations++
+	u.Violations += violations
+	u.Duration += d
 }
 
-func ruleDeprecateHostPort(pod *v1.Pod) *model.ComplianceRecord {
-	for _, c := range pod.Spec.Containers {
-		for _, p := range c.Ports {
-			if p.HostPort > 0 {
-				return &model.ComplianceRecord{
-					RuleId:   "deprecate-host-port",
-					Severity: "INFO",
+// TakeUsage returns the usage of each source since the previous call, keyed by rule pack id,
+// bundled or custom.
+func (e *Engine) TakeUsage() map[string]Usage {
+	ret := map[string]Usage{}
+	for source, u := range e.usage {
+		ret[source] = *u
+	}
+	e.usage = map[string]*Usage{}
+	return ret
+}
+
+// denials returns the messages of the deny set of a policy.
+func denials(rs rego.ResultSet) []string {
+	var ret []string
+	for _, r := range rs {
+		for _, expr := range r.Expressions {
+			values, _ := expr.Value.([]interface{})
+			for _, v := range values {
+				if s, ok := v.(string); ok {
+					ret = append(ret, s)
+				} else {
+					ret = append(ret, fmt.Sprint(v))
 				}
 			}
 		}
 	}
-	return nil
+	sort.Strings(ret)
+	return ret
 }
 
-func ruleDeprecateHostIp(pod *v1.Pod) *model.ComplianceRecord {
-	for _, c := range pod.Spec.Containers {
-		for _, p := range c.Ports {
-			if len(p.HostIP) > 0 {
-				return &model.ComplianceRecord{
-					RuleId:   "deprecate-host-ip",
-					Severity: "INFO",
-				}
-			}
+func isWaived(annotation string, ruleId string) bool {
+	for _, r := range strings.Split(annotation, ",") {
+		if r = strings.TrimSpace(r); r == ruleId {
+			return true
 		}
 	}
-	return nil
+	return false
 }
@@ -0,0 +1,191 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"collie-agent/internal/config"
+)
+
+// Phases are the phases of the cycle which are scheduled. The cluster phase runs in every cycle.
+var Phases = []string{"resources", "kube-bench", "kube-hunter", "rules"}
+
+// active scanners run jobs in the cluster, they do not run during blackout windows
+var active = map[string]bool{"kube-bench": true, "kube-hunter": true}
+
+// maxWindowSteps bounds the walk through back-to-back blackout windows
+const maxWindowSteps = 100
+
+type window struct {
+	start    cron.Schedule
+	duration time.Duration
+}
+
+// Scheduler tells which phases are due. A phase with a cron schedule runs at its schedule, the others
+// run at the scan interval. Active scanners due during a blackout window are deferred to its end.
+type Scheduler struct {
+	loc       *time.Location
+	crons     map[string]cron.Schedule
+	blackouts []window
+	// last run of each phase, a phase which never ran is due immediately
+	last map[string]time.Time
+}
+
+func New(cfg *config.Controller) (*Scheduler, error) {
+	s := &Scheduler{
+		loc:   time.Local,
+		crons: map[string]cron.Schedule{},
+		last:  map[string]time.Time{},
+	}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CONTROLLER_TIMEZONE: %w", err)
+		}
+		s.loc = loc
+	}
+	for phase, spec := range cfg.Schedule.ByPhase() {
+		sched, err := cron.ParseStandard(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule of %s %q: %w", phase, spec, err)
+		}
+		s.crons[phase] = sched
+	}
+	for _, w := range strings.Split(cfg.Blackouts, ";") {
+		if w = strings.TrimSpace(w); w == "" {
+			continue
+		}
+		i := strings.LastIndex(w, " ")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid blackout window %q, expecting a cron schedule and a duration", w)
+		}
+		start, err := cron.ParseStandard(strings.TrimSpace(w[:i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid blackout window %q: %w", w, err)
+		}
+		d, err := time.ParseDuration(w[i+1:])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration of blackout window %q", w)
+		}
+		s.blackouts = append(s.blackouts, window{start: start, duration: d})
+	}
+	return s, nil
+}
+
+// next returns when a phase is next scheduled, the zero time when it is due now.
+func (s *Scheduler) next(phase string, interval time.Duration) time.Time {
+	last, ok := s.last[phase]
+	if !ok {
+		return time.Time{}
+	}
+	if sched, ok := s.crons[phase]; ok {
+		return sched.Next(last.In(s.loc))
+	}
+	return last.Add(interval)
+}
+
+// Blackout returns the end of the blackout window covering t, or the zero time when t is outside of all windows.
+func (s *Scheduler) Blackout(t time.Time) time.Time {
+	var end time.Time
+	for step := 0; step < maxWindowSteps; step++ {
+		extended := false
+		at := t
+		if !end.IsZero() {
+			at = end
+		}
+		for _, w := range s.blackouts {
+			// the earliest start after at - duration opens a window covering at, if it starts by at
+			start := w.start.Next(at.In(s.loc).Add(-w.duration))
+			if !start.After(at) {
+				if e := start.Add(w.duration); e.After(end) {
+					end = e
+					extended = true
+				}
+			}
+		}
+		if !extended {
+			break
+		}
+	}
+	return end
+}
+
+// Allowed tells whether a phase may run at t.
+func (s *Scheduler) Allowed(phase string, t time.Time) bool {
+	return !active[phase] || s.Blackout(t).IsZero()
+}
+
+// Due returns the phases among the given ones due at now.
+func (s *Scheduler) Due(phases []string, now time.Time, interval time.Duration) []string {
+	ret := []string{}
+	for _, phase := range phases {
+		if !s.next(phase, interval).After(now) && s.Allowed(phase, now) {
+			ret = append(ret, phase)
+		}
+	}
+	return ret
+}
+
+// Ran records that the phases ran at t.
+func (s *Scheduler) Ran(phases []string, t time.Time) {
+	for _, phase := range phases {
+		s.last[phase] = t
+	}
+}
+
+// Restore sets the last runs of the phases, as kept before a restart of the agent.
+func (s *Scheduler) Restore(last map[string]time.Time) {
+	for phase, t := range last {
+		s.last[phase] = t
+	}
+}
+
+// LastRuns returns the last run of each phase which ran.
+func (s *Scheduler) LastRuns() map[string]time.Time {
+	ret := make(map[string]time.Time, len(s.last))
+	for phase, t := range s.last {
+		ret[phase] = t
+	}
+	return ret
+}
+
+// NextWake returns when the next of the given phases is due, after now, accounting for blackout windows.
+func (s *Scheduler) NextWake(phases []string, now time.Time, interval time.Duration) time.Time {
+	var ret time.Time
+	for _, phase := range phases {
+		t := s.next(phase, interval)
+		if t.Before(now) {
+			t = now
+		}
+		if active[phase] {
+			if end := s.Blackout(t); !end.IsZero() {
+				t = end
+			}
+		}
+		if ret.IsZero() || t.Before(ret) {
+			ret = t
+		}
+	}
+	if ret.IsZero() {
+		ret = now.Add(interval)
+	}
+	return ret
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2023-2024 VMware Inc.
+SPDX-License-Identifier: Apache-2.0
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedule
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	K8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// stateConfigMap is the ConfigMap, in the namespace of the agent, which keeps the last run of each phase,
+// so that a restarted agent does not run again the phases which are not due
+const stateConfigMap = "collie-agent-schedule"
+
+// State keeps the last runs of the phases in a ConfigMap.
+type State struct {
+	clientset kubernetes.Interface
+	namespace string
+}
+
+func NewState(clientset kubernetes.Interface, namespace string) *State {
+	return &State{clientset: clientset, namespace: namespace}
+}
+
+// Load returns the last runs of the phases, none when they were never kept.
+func (st *State) Load(ctx context.Context) (map[string]time.Time, error) {
+	cm, err := st.clientset.CoreV1().ConfigMaps(st.namespace).Get(ctx, stateConfigMap, metav1.GetOptions{})
+	if K8sErrors.IsNotFound(err) {
+		return map[string]time.Time{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ret := map[string]time.Time{}
+	for phase, v := range cm.Data {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			ret[phase] = t
+		}
+	}
+	return ret, nil
+}
+
+// Save keeps the last runs of the phases.
+func (st *State) Save(ctx context.Context, last map[string]time.Time) error {
+	data := map[string]string{}
+	for phase, t := range last {
+		data[phase] = t.UTC().Format(time.RFC3339)
+	}
+	configMaps := st.clientset.CoreV1().ConfigMaps(st.namespace)
+	cm, err := configMaps.Get(ctx, stateConfigMap, metav1.GetOptions{})
+	if K8sErrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   stateConfigMap,
+				Labels: map[string]string{"app.kubernetes.io/managed-by": "collie"},
+			},
+			Data: data,
+		}, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+	cm.Data = data
+	_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
@@ -19,25 +19,34 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 
 	//"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
 
 	//"k8s.io/metrics/pkg/client/clientset/versioned"
 
 	"collie-agent/internal/commonms"
 	"collie-agent/internal/config"
+	"collie-agent/internal/export"
+	"collie-agent/internal/model"
 	"collie-agent/internal/probe"
+	"collie-agent/internal/remote"
 	"collie-agent/internal/reporter"
+	"collie-agent/internal/schedule"
+	"collie-agent/internal/services/version"
+	"collie-agent/internal/tracing"
 )
 
 // type Greeter struct{}
@@ -47,6 +56,12 @@ import (
 // 	return nil
 // }
 
+// scanRequestWait is how long a poll for scan requests waits on the API server
+const scanRequestWait = 30 * time.Second
+
+// readyCheckTimeout bounds the connectivity checks of the readiness endpoint
+const readyCheckTimeout = 10 * time.Second
+
 // Set by `go build` during a release
 var (
 	GitCommit = "undefined"
@@ -57,8 +72,8 @@ func main() {
 	commonms.RunApp(run)
 }
 
-func run(cfg config.Config, log *logrus.Entry, ctx context.Context, exitCh chan error) error {
-	restconfig, err := retrieveKubeConfig(log, cfg)
+func run(cfg config.Config, log *logrus.Entry, ctx context.Context, healthz *commonms.HealthzProvider, exitCh chan error) error {
+	restconfig, err := commonms.KubeConfig(log, cfg)
 	if err != nil {
 		return err
 	}
@@ -68,6 +83,7 @@ func run(cfg config.Config, log *logrus.Entry, ctx context.Context, exitCh chan
 	}
 
 	restconfig.NegotiatedSerializer = serializer.NewCodecFactory(scheme.Scheme)
+	restconfig.Wrap(tracing.Transport)
 
 	clientset, err := kubernetes.NewForConfig(restconfig)
 	if err != nil {
@@ -86,7 +102,7 @@ func run(cfg config.Config, log *logrus.Entry, ctx context.Context, exitCh chan
 
 	//discoveryService := discovery.New(clientset, dynamicClient)
 
-	return loop(ctx, log, cfg, clientset)
+	return loop(ctx, log, cfg, clientset, healthz)
 
 }
 
@@ -104,85 +120,315 @@ func run(cfg config.Config, log *logrus.Entry, ctx context.Context, exitCh chan
 // 	cc.ReportCompliance(&complianceRecord)
 // }
 
-func loop(ctx context.Context, log *logrus.Entry, cfg config.Config, clientset *kubernetes.Clientset) error {
+func loop(ctx context.Context, log *logrus.Entry, cfg config.Config, clientset *kubernetes.Clientset, healthz *commonms.HealthzProvider) error {
+	healthz.Initializing()
 
-	clusterId, err := probe.GetClusterId(ctx, log, clientset)
+	clusterId, previousIds, err := probe.GetClusterId(ctx, log, clientset, cfg)
 	if err != nil {
 		return fmt.Errorf("Error retrieving cluster ID: %w", err)
 	}
 
-	cc, err := reporter.New(log, cfg.AgentId, clusterId, cfg.API.URL, cfg.API.Key, cfg.ES.URL, cfg.ES.Key)
+	if cfg.Offline.Format != "" {
+		return runOffline(ctx, log, cfg, clientset, clusterId)
+	}
+
+	sched, err := schedule.New(cfg.Controller)
+	if err != nil {
+		return err
+	}
+	// the last runs are kept across restarts, so that a restart does not run again the weekly and nightly scanners
+	schedState := schedule.NewState(clientset, cfg.Namespace)
+	if last, err := schedState.Load(ctx); err != nil {
+		log.Warnf("Error reading the last runs of the phases, running them all: %s", err)
+	} else {
+		sched.Restore(last)
+	}
+
+	cc, err := reporter.New(log, cfg.AgentId, clusterId, cfg.API.URL, cfg.API.Key, cfg.ES.URL, cfg.ES.Key, cfg.Controller.SnapshotRetention)
 	if err != nil && !errors.Is(err, context.Canceled) {
 		return fmt.Errorf("Error creating collie client: %w", err)
 	}
 
+	healthz.AddReadyCheck("api", func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), readyCheckTimeout)
+		defer cancel()
+		return cc.PingAPI(ctx)
+	})
+	healthz.AddReadyCheck("es", func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), readyCheckTimeout)
+		defer cancel()
+		return cc.PingES(ctx)
+	})
+
 	p := probe.New(ctx, log, clientset, cc)
+	p.SetAgentConfig(cfg)
 	// Test connectivity
 	err = cc.Info()
 	if err != nil {
 		return err
 	}
 
+	heartbeat := model.AgentHeartbeat{
+		Provider:           cfg.Provider,
+		AgentVersion:       agentVersion().Version,
+		PreviousClusterIds: previousIds,
+	}
+	if v, err := version.Get(log, clientset); err != nil {
+		log.Warnf("Error retrieving kubernetes version: %s", err)
+	} else {
+		heartbeat.K8sVersion = v.Full()
+	}
+	if info, err := probe.DetectProvider(ctx, clientset, cfg); err != nil {
+		log.Warnf("Error detecting the provider, reporting %s: %s", cfg.Provider, err)
+	} else {
+		heartbeat.Provider = info.Provider
+		heartbeat.Distribution = info.Distribution
+		heartbeat.Region = info.Region
+		// the kube-bench job of agent.yaml runs the benchmark of the provider it was generated for
+		if probe.Benchmark(info.Provider) != probe.Benchmark(strings.ToUpper(cfg.Provider)) {
+			log.Warnf("The cluster runs on %s but agent.yaml was generated for provider %s, kube-bench may run the wrong benchmark", info.Provider, cfg.Provider)
+		}
+	}
+	if err := cc.ReportHeartbeat(heartbeat); err != nil {
+		log.Warnf("Error registering agent: %s", err)
+	}
+
 	// test(cc)
 
-	for {
+	watcher := remote.New(log, cc, cfg.Controller.ConfigPollInterval)
+	if err := watcher.Poll(); err != nil {
+		log.Warnf("Error retrieving configuration, running with defaults: %s", err)
+	}
+	go watcher.Run(ctx)
+	healthz.Initialized()
 
-		err := p.DiscoverCluster()
-		if err != nil {
-			cc.ReportError("DiscoverCluster", "", err)
-		}
-		err = p.DiscoverResources()
-		if err != nil {
-			cc.ReportError("DiscoverResources", "", err)
-		}
-		err = p.DiscoverCompliance()
-		if err != nil {
-			cc.ReportError("DiscoverCompliance", "", err)
+	requests := make(chan *model.ScanRequest)
+	go pollScanRequests(ctx, log, cc, requests)
+
+	// phases of scheduled cycles run at their cron schedule or at the scan interval, cycles run
+	// for scan requests leave the schedule as is
+	var req *model.ScanRequest
+	for {
+		settings := watcher.Current()
+		now := time.Now()
+		due := []string{}
+		if req == nil {
+			due = sched.Due(enabledPhases(settings), now, settings.Interval())
 		}
-		err = p.DiscoverComplianceForHunter()
-		if err != nil {
-			cc.ReportError("DiscoverComplianceForHunter", "", err)
+		if req != nil || len(due) > 0 {
+			p.SetConfig(settings)
+			requestId := ""
+			if req != nil {
+				requestId = req.Id
+				log.Infof("Running scan request %s, phases=%v", req.Id, req.Phases)
+			} else {
+				log.Infof("Running scheduled phases %v", due)
+			}
+			healthz.CycleStarted()
+			cycleCtx, span := tracing.Tracer().Start(ctx, "cycle", trace.WithAttributes(attribute.String("collie.request_id", requestId)))
+			cc.SetContext(cycleCtx)
+			scan := cc.StartScan(requestId)
+			span.SetAttributes(attribute.String("collie.scan_id", scan.Id))
+
+			wanted, carried := cyclePhases(settings, sched, now, req, due)
+			p.SetReportResources(wanted["resources"])
+			phases := []struct {
+				name string
+				fn   func() error
+			}{
+				{"cluster", p.DiscoverCluster},
+				{"resources", p.DiscoverResources},
+				{"kube-bench", p.DiscoverCompliance},
+				{"kube-hunter", p.DiscoverComplianceForHunter},
+				{"rules", p.DiscoverRuleViolations},
+			}
+			for _, phase := range phases {
+				// the resources are discovered whenever the rules are evaluated, since the rules are evaluated on them
+				if phase.name == "cluster" || wanted[phase.name] || (phase.name == "resources" && wanted["rules"]) {
+					runPhase(cycleCtx, healthz, p, cc, scan, phase.name, phase.fn)
+				}
+			}
+			if len(carried) > 0 {
+				runPhase(cycleCtx, healthz, p, cc, scan, "carry-over", func() error {
+					return cc.CarryOver(scan, carried)
+				})
+			}
+			if req == nil {
+				sched.Ran(due, now)
+				if err := schedState.Save(ctx, sched.LastRuns()); err != nil {
+					log.Warnf("Error keeping the last runs of the phases: %s", err)
+				}
+			}
+
+			cc.CompleteScan(scan)
+			healthz.SnapshotSent()
+			heartbeat.Error = strings.Join(scan.Errors, "; ")
+			heartbeat.ConfigVersion = settings.Version
+			if err := cc.ReportHeartbeat(heartbeat); err != nil {
+				log.Warnf("Error reporting heartbeat: %s", err)
+			}
+			if len(scan.Errors) > 0 {
+				span.SetStatus(codes.Error, heartbeat.Error)
+			}
+			span.End()
+			cc.SetContext(ctx)
 		}
 
-		cc.ReportCompletion()
-		log.Infoln("Sleeping")
-		time.Sleep(12 * time.Hour)
+		// sleep until the next phase is due, which moves when the configuration changes the interval
+		// or the enabled scanners, or until a scan request comes in
+		req = nil
+		next := sched.NextWake(enabledPhases(settings), time.Now(), settings.Interval())
+		log.Infof("Sleeping, next cycle at %s", next.Format(time.RFC3339))
+	sleep:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Until(next)):
+				break sleep
+			case req = <-requests:
+				break sleep
+			case <-watcher.Changed():
+				settings = watcher.Current()
+				next = sched.NextWake(enabledPhases(settings), time.Now(), settings.Interval())
+				heartbeat.ConfigVersion = settings.Version
+				if err := cc.ReportHeartbeat(heartbeat); err != nil {
+					log.Warnf("Error reporting heartbeat: %s", err)
+				}
+				log.Infof("Next cycle at %s", next.Format(time.RFC3339))
+			}
+		}
 	}
 }
 
-func kubeConfigFromPath(kubepath string) (*rest.Config, error) {
-	if kubepath == "" {
-		return nil, nil
+// runPhase runs one phase of the cycle under its liveness deadline, and traces it under the span of the cycle.
+func runPhase(ctx context.Context, healthz *commonms.HealthzProvider, p *probe.Probe, cc *reporter.CollieClient, scan *model.Scan, name string, fn func() error) {
+	healthz.PhaseStarted(name)
+	defer healthz.PhaseEnded()
+
+	attrs := []attribute.KeyValue{attribute.String("collie.phase", name)}
+	if name == "kube-bench" || name == "kube-hunter" {
+		attrs = append(attrs, attribute.String("collie.scanner", name))
 	}
+	phaseCtx, span := tracing.Tracer().Start(ctx, "phase "+name, trace.WithAttributes(attrs...))
+	p.SetContext(phaseCtx)
+	cc.SetContext(phaseCtx)
+	defer func() {
+		p.SetContext(ctx)
+		cc.SetContext(ctx)
+	}()
+	tracing.End(span, cc.RunPhase(scan, name, fn))
+}
 
-	data, err := os.ReadFile(kubepath)
-	if err != nil {
-		return nil, fmt.Errorf("reading kubeconfig at %s: %w", kubepath, err)
+// enabledPhases returns the scheduled phases enabled by the configuration.
+func enabledPhases(settings *model.AgentConfig) []string {
+	ret := []string{}
+	for _, name := range schedule.Phases {
+		if settings.ScannerEnabled(name) {
+			ret = append(ret, name)
+		}
 	}
+	return ret
+}
 
-	restConfig, err := clientcmd.RESTConfigFromKubeConfig(data)
-	if err != nil {
-		return nil, fmt.Errorf("building rest config from kubeconfig at %s: %w", kubepath, err)
+// cyclePhases returns the phases of the cycle to run, among the phases enabled by the configuration:
+// the phases due for a scheduled cycle, or the phases asked for by the scan request, if any, which
+// are allowed at now. The phases enabled but left out are carried over from the current snapshot.
+func cyclePhases(settings *model.AgentConfig, sched *schedule.Scheduler, now time.Time, req *model.ScanRequest, due []string) (map[string]bool, []string) {
+	wanted := map[string]bool{}
+	carried := []string{}
+	for _, name := range enabledPhases(settings) {
+		run := false
+		if req == nil {
+			for _, d := range due {
+				run = run || d == name
+			}
+		} else if req.Includes(name) {
+			run = sched.Allowed(name, now)
+		}
+		if run {
+			wanted[name] = true
+		} else {
+			carried = append(carried, name)
+		}
 	}
+	return wanted, carried
+}
 
-	return restConfig, nil
+// pollScanRequests long-polls the scan requests of the agent until the context is done, and hands
+// them to the main loop. A request is only claimed once the previous one has been taken.
+func pollScanRequests(ctx context.Context, log *logrus.Entry, cc *reporter.CollieClient, requests chan<- *model.ScanRequest) {
+	for ctx.Err() == nil {
+		req, err := cc.NextScanRequest(ctx, scanRequestWait)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warnf("Error polling scan requests: %s", err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(scanRequestWait):
+			}
+			continue
+		}
+		if req == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case requests <- req:
+		}
+	}
 }
 
-func retrieveKubeConfig(log logrus.FieldLogger, cfg config.Config) (*rest.Config, error) {
-	kubeconfig, err := kubeConfigFromPath(cfg.Kubeconfig)
+// runOffline runs the scanners once, and writes their results as SARIF or OSCAL,
+// for clusters which cannot reach the API server.
+func runOffline(ctx context.Context, log *logrus.Entry, cfg config.Config, clientset *kubernetes.Clientset, clusterId string) error {
+	cc := reporter.NewOffline(log, cfg.AgentId, clusterId)
+	p := probe.New(ctx, log, clientset, cc)
+	p.SetAgentConfig(cfg)
+	start := time.Now().UTC()
+
+	phases := []struct {
+		name string
+		fn   func() error
+	}{
+		// resources are not reported offline, but evaluated by the policies of the rules phase
+		{"resources", p.DiscoverResources},
+		{"kube-bench", p.DiscoverCompliance},
+		{"kube-hunter", p.DiscoverComplianceForHunter},
+		{"rules", p.DiscoverRuleViolations},
+	}
+	for _, phase := range phases {
+		if err := phase.fn(); err != nil {
+			log.Warnf("Offline phase %s failed: %s", phase.name, err)
+		}
+	}
+
+	var data []byte
+	var err error
+	results := cc.OfflineResults()
+	switch cfg.Offline.Format {
+	case "sarif":
+		data, err = export.SARIF(clusterId, results)
+	case "oscal":
+		data, err = export.OSCAL("Compliance assessment of cluster "+clusterId, clusterId, results, start)
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if kubeconfig != nil {
-		log.Debug("using kubeconfig from env variables")
-		return kubeconfig, nil
+	if cfg.Offline.Output == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
 	}
+	log.Infof("Writing %d results to %s", len(results), cfg.Offline.Output)
+	return os.WriteFile(cfg.Offline.Output, data, 0644)
+}
 
-	inClusterConfig, err := rest.InClusterConfig()
-	if err != nil {
-		return nil, err
+func agentVersion() *config.AgentVersion {
+	return &config.AgentVersion{
+		GitCommit: GitCommit,
+		GitRef:    GitRef,
+		Version:   GitRef + "-" + GitCommit,
 	}
-	log.Debug("using in cluster kubeconfig")
-	return inClusterConfig, nil
 }